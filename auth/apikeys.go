@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrKeyNotFound = errors.New("API key not found")
+
+// APIKey is a stored API key; only a hash of the secret part of the key is kept
+type APIKey struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Grants  []Grant   `json:"grants"`
+	Created time.Time `json:"created"`
+}
+
+// KeyStore holds API keys, persisting them as JSON to a file
+type KeyStore struct {
+	filePath string
+	mu       sync.RWMutex
+	keys     map[string]APIKey
+}
+
+// NewKeyStore returns a KeyStore backed by the specified file, loading any keys already saved there
+func NewKeyStore(filePath string) (*KeyStore, error) {
+	store := &KeyStore{
+		filePath: filePath,
+		keys:     map[string]APIKey{},
+	}
+	data, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		store.keys[key.ID] = key
+	}
+	return store, nil
+}
+
+// Create generates and saves a new API key, returning the bearer token which is not stored anywhere
+func (store *KeyStore) Create(name string, grants []Grant) (string, APIKey, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	key := APIKey{
+		ID:      id,
+		Name:    name,
+		Hash:    hashSecret(secret),
+		Grants:  grants,
+		Created: time.Now().UTC(),
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.keys[id] = key
+	if err := store.save(); err != nil {
+		delete(store.keys, id)
+		return "", APIKey{}, err
+	}
+	return id + "." + secret, key, nil
+}
+
+// List returns every stored key, ordered by creation time
+func (store *KeyStore) List() []APIKey {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	keys := make([]APIKey, 0, len(store.keys))
+	for _, key := range store.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	return keys
+}
+
+// Delete revokes the key with the specified ID
+func (store *KeyStore) Delete(id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	key, exists := store.keys[id]
+	if !exists {
+		return ErrKeyNotFound
+	}
+	delete(store.keys, id)
+	if err := store.save(); err != nil {
+		store.keys[id] = key
+		return err
+	}
+	return nil
+}
+
+// Authenticate returns the identity of the API key given as the request's bearer token
+func (store *KeyStore) Authenticate(r *http.Request) (Identity, error) {
+	token, err := BearerToken(r)
+	if err != nil {
+		return Identity{}, err
+	}
+	id, secret, found := strings.Cut(token, ".")
+	if !found {
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	store.mu.RLock()
+	key, exists := store.keys[id]
+	store.mu.RUnlock()
+	if !exists {
+		return Identity{}, ErrInvalidCredentials
+	}
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashSecret(secret))) != 1 {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{
+		Name:   "apikey:" + key.Name,
+		Grants: key.Grants,
+	}, nil
+}
+
+// save overwrites the key file with the current keys; the caller must hold the write lock
+func (store *KeyStore) save() error {
+	keys := make([]APIKey, 0, len(store.keys))
+	for _, key := range store.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ID < keys[j].ID
+	})
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(store.filePath, data, 0600)
+}
+
+// hashSecret returns the hex encoded SHA-256 hash of the specified secret
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// randomHex returns n random bytes encoded as hex
+func randomHex(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
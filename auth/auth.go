@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Permission is an action which a caller may be granted on a set of keys
+type Permission string
+
+const (
+	PermissionRead    Permission = "read"
+	PermissionWrite   Permission = "write"
+	PermissionDelete  Permission = "delete"
+	PermissionHistory Permission = "history"
+	PermissionAdmin   Permission = "admin"
+
+	// NamespaceSeparator separates a key's namespace from the rest of the key, e.g. "team-a:key1"
+	NamespaceSeparator = ":"
+)
+
+var (
+	ErrNoCredentials      = errors.New("no credentials provided")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Grant allows a permission on every key beginning with Prefix, or on every key in Namespace
+type Grant struct {
+	Permission Permission `json:"permission"`
+	Prefix     string     `json:"prefix,omitempty"`
+	Namespace  string     `json:"namespace,omitempty"`
+}
+
+// Matches reports whether the grant covers the specified permission and key
+func (grant Grant) Matches(permission Permission, key string) bool {
+	if grant.Permission != permission {
+		return false
+	}
+	if grant.Namespace != "" {
+		return Namespace(key) == grant.Namespace
+	}
+	return strings.HasPrefix(key, grant.Prefix)
+}
+
+// Valid reports whether the grant refers to a known permission
+func (grant Grant) Valid() bool {
+	switch grant.Permission {
+	case PermissionRead, PermissionWrite, PermissionDelete, PermissionHistory, PermissionAdmin:
+		return true
+	}
+	return false
+}
+
+// Identity is an authenticated caller and the grants it holds
+type Identity struct {
+	Name   string
+	Grants []Grant
+}
+
+// Allowed reports whether any of the identity's grants cover the specified permission and key
+func (id Identity) Allowed(permission Permission, key string) bool {
+	for _, grant := range id.Grants {
+		if grant.Matches(permission, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator establishes the identity of the caller making a request
+type Authenticator interface {
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// Namespace returns the namespace of the specified key, or an empty string if it has none
+func Namespace(key string) string {
+	namespace, _, found := strings.Cut(key, NamespaceSeparator)
+	if !found {
+		return ""
+	}
+	return namespace
+}
+
+// BearerToken returns the bearer token from the Authorization header of the specified request
+func BearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", ErrNoCredentials
+	}
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", ErrInvalidCredentials
+	}
+	return strings.TrimSpace(token), nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the specified identity
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity carried by ctx, if any
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(Identity)
+	return id, ok
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentityAllowed(t *testing.T) {
+	id := Identity{
+		Name: "test",
+		Grants: []Grant{
+			{Permission: PermissionRead, Prefix: "key"},
+			{Permission: PermissionWrite, Namespace: "team-a"},
+		},
+	}
+
+	for _, tc := range []struct {
+		name       string
+		permission Permission
+		key        string
+		expAllowed bool
+	}{
+		{name: "read matching prefix", permission: PermissionRead, key: "key1", expAllowed: true},
+		{name: "read other prefix", permission: PermissionRead, key: "other", expAllowed: false},
+		{name: "write in namespace", permission: PermissionWrite, key: "team-a:key1", expAllowed: true},
+		{name: "write in other namespace", permission: PermissionWrite, key: "team-b:key1", expAllowed: false},
+		{name: "write namespace without separator", permission: PermissionWrite, key: "team-a", expAllowed: false},
+		{name: "delete never granted", permission: PermissionDelete, key: "key1", expAllowed: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expAllowed, id.Allowed(tc.permission, tc.key))
+		})
+	}
+}
+
+func TestKeyStore(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "keys.json")
+	store, err := NewKeyStore(filePath)
+	assert.NoError(t, err)
+
+	grants := []Grant{{Permission: PermissionRead}}
+	token, key, err := store.Create("reader", grants)
+	assert.NoError(t, err)
+	assert.NotContains(t, key.Hash, token)
+
+	// Authenticate with the new key
+	id, err := store.Authenticate(requestWithToken(token))
+	assert.NoError(t, err)
+	assert.Equal(t, "apikey:reader", id.Name)
+	assert.Equal(t, grants, id.Grants)
+
+	// Reject a tampered key
+	_, err = store.Authenticate(requestWithToken(token + "0"))
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	// Reject a missing key
+	_, err = store.Authenticate(requestWithToken(""))
+	assert.ErrorIs(t, err, ErrNoCredentials)
+
+	// Reload from file
+	reloaded, err := NewKeyStore(filePath)
+	assert.NoError(t, err)
+	_, err = reloaded.Authenticate(requestWithToken(token))
+	assert.NoError(t, err)
+
+	// Revoke the key
+	assert.NoError(t, reloaded.Delete(key.ID))
+	assert.ErrorIs(t, reloaded.Delete(key.ID), ErrKeyNotFound)
+	_, err = reloaded.Authenticate(requestWithToken(token))
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestChain(t *testing.T) {
+	store, err := NewKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	assert.NoError(t, err)
+	token, _, err := store.Create("writer", []Grant{{Permission: PermissionWrite}})
+	assert.NoError(t, err)
+	certGrants := []Grant{{Permission: PermissionRead}}
+	chain := Chain{ClientCertAuthenticator{Identities: map[string][]Grant{"svc-a": certGrants}}, store}
+
+	for _, tc := range []struct {
+		name    string
+		cert    string
+		token   string
+		expName string
+		expErr  error
+	}{
+		{name: "mapped certificate", cert: "svc-a", token: token, expName: "cert:svc-a"},
+		{name: "unmapped certificate falls through to token", cert: "svc-b", token: token, expName: "apikey:writer"},
+		{name: "unmapped certificate without token", cert: "svc-b", expErr: ErrNoCredentials},
+		{name: "unmapped certificate with invalid token", cert: "svc-b", token: token + "0", expErr: ErrInvalidCredentials},
+		{name: "token without certificate", token: token, expName: "apikey:writer"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := requestWithToken(tc.token)
+			if tc.cert != "" {
+				cert := &x509.Certificate{Subject: pkix.Name{CommonName: tc.cert}}
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+			}
+			id, err := chain.Authenticate(r)
+			if tc.expErr != nil {
+				assert.ErrorIs(t, err, tc.expErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expName, id.Name)
+		})
+	}
+}
+
+// requestWithToken returns a new request with the specified bearer token, if any
+func requestWithToken(token string) *http.Request {
+	r, _ := http.NewRequest(http.MethodGet, "/api/key1", nil)
+	if token != "" {
+		r.Header.Add("Authorization", "Bearer "+token)
+	}
+	return r
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net/http"
+)
+
+// ClientCertAuthenticator identifies callers by the verified TLS client certificate they presented
+type ClientCertAuthenticator struct {
+	// Identities maps a certificate subject common name, DNS name, email address or URI SAN to the grants it holds
+	Identities map[string][]Grant
+}
+
+// Authenticate returns the identity of the request's verified client certificate. A certificate whose names are not
+// mapped is treated as no credentials, so that a Chain tries the request's other credentials, such as a token
+func (authenticator ClientCertAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Identity{}, ErrNoCredentials
+	}
+	names := certNames(r.TLS.VerifiedChains[0][0])
+	for _, name := range names {
+		if grants, ok := authenticator.Identities[name]; ok {
+			return Identity{Name: "cert:" + name, Grants: grants}, nil
+		}
+	}
+	if len(names) == 0 {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{}, ErrNoCredentials
+}
+
+// certNames returns the names a certificate identifies, subject common name first
+func certNames(cert *x509.Certificate) []string {
+	names := []string{}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
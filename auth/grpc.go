@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"its-dave/simple-crud-rest-server/crudpb"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// RequestFromIncomingContext returns an HTTP request presenting the credentials of the gRPC call in ctx as an
+// Authenticator expects: its metadata as headers, such as the Authorization header of a bearer token, and its peer's
+// address and TLS state, such as a verified client certificate
+func RequestFromIncomingContext(ctx context.Context) *http.Request {
+	r := (&http.Request{Method: http.MethodPost, Header: http.Header{}}).WithContext(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		if strings.HasPrefix(key, ":") || strings.HasSuffix(key, "-bin") {
+			continue
+		}
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if p.Addr != nil {
+			r.RemoteAddr = p.Addr.String()
+		}
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			r.TLS = &info.State
+		}
+	}
+	return r
+}
+
+// UnaryServerInterceptor requires every call to be authenticated, as Middleware does every request, failing those
+// which are not with UNAUTHENTICATED and passing the caller's identity on in the context
+func UnaryServerInterceptor(authenticator Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticateCall(ctx, authenticator)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor requires every streaming call to be authenticated, as UnaryServerInterceptor does
+func StreamServerInterceptor(authenticator Authenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticateCall(ss.Context(), authenticator)
+		if err != nil {
+			return err
+		}
+		return handler(srv, serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authenticateCall returns a copy of ctx carrying the identity of the call's caller
+func authenticateCall(ctx context.Context, authenticator Authenticator) (context.Context, error) {
+	id, err := authenticator.Authenticate(RequestFromIncomingContext(ctx))
+	if err != nil {
+		return nil, crudpb.Error(codes.Unauthenticated, crudpb.ReasonUnauthenticated, errorUnauthenticated)
+	}
+	return NewContext(ctx, id), nil
+}
+
+// serverStream is a stream whose context carries the caller's identity
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss serverStream) Context() context.Context {
+	return ss.ctx
+}
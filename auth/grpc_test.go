@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"context"
+	"its-dave/simple-crud-rest-server/crudpb"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// tokenAuthenticator authenticates bearer tokens which it maps to identities
+type tokenAuthenticator map[string]Identity
+
+func (authenticator tokenAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	token, err := BearerToken(r)
+	if err != nil {
+		return Identity{}, err
+	}
+	id, ok := authenticator[token]
+	if !ok {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return id, nil
+}
+
+func TestRequestFromIncomingContext(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer token1", "x-request-id", "abc", "trace-bin", "\x00"))
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}})
+
+	r := RequestFromIncomingContext(ctx)
+	assert.Equal(t, "Bearer token1", r.Header.Get("Authorization"))
+	assert.Equal(t, "abc", r.Header.Get("X-Request-ID"))
+	// Binary metadata is not a header
+	assert.Empty(t, r.Header.Get("Trace-Bin"))
+	assert.Equal(t, "192.0.2.1:1234", r.RemoteAddr)
+	assert.Nil(t, r.TLS)
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	interceptor := UnaryServerInterceptor(tokenAuthenticator{"token1": {Name: "apikey:ci"}})
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		id, _ := FromContext(ctx)
+		return id.Name, nil
+	}
+	call := func(md metadata.MD) (interface{}, error) {
+		return interceptor(metadata.NewIncomingContext(context.Background(), md), nil, &grpc.UnaryServerInfo{}, handler)
+	}
+
+	// Unauthenticated calls
+	_, err := call(metadata.MD{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Equal(t, crudpb.ReasonUnauthenticated, crudpb.Reason(err))
+	_, err = call(metadata.Pairs("authorization", "Bearer invalid"))
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// Authenticated call
+	name, err := call(metadata.Pairs("authorization", "Bearer token1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "apikey:ci", name)
+}
@@ -0,0 +1,420 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksRefreshInterval is the minimum time between fetches of a remote key set
+	jwksRefreshInterval = time.Minute
+	// clockSkew is the leeway allowed when checking token expiry and not-before times
+	clockSkew = 30 * time.Second
+)
+
+var (
+	ErrUnknownKey       = errors.New("token signed with an unknown key")
+	ErrUnsupportedAlg   = errors.New("unsupported token signing algorithm")
+	ErrInvalidSignature = errors.New("invalid token signature")
+	ErrInvalidClaims    = errors.New("invalid token claims")
+)
+
+// JWTConfig describes how tokens are validated and how their claims map to grants
+type JWTConfig struct {
+	// JWKS is the path or http(s) URL of the JSON Web Key Set used to verify signatures
+	JWKS     string `json:"jwks"`
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// RolesClaim is the claim holding the caller's roles, "roles" if unset
+	RolesClaim string `json:"rolesClaim,omitempty"`
+	// NamespacesClaim is the claim holding the namespaces the caller may access, "namespaces" if unset
+	NamespacesClaim string `json:"namespacesClaim,omitempty"`
+	// RoleGrants maps each role to the grants it confers
+	RoleGrants map[string][]Grant `json:"roleGrants,omitempty"`
+	// NamespacePermissions are granted within each namespace listed in the namespaces claim
+	NamespacePermissions []Permission `json:"namespacePermissions,omitempty"`
+}
+
+// JWTValidator authenticates requests bearing a JWT signed with RS256 or ES256
+type JWTValidator struct {
+	config JWTConfig
+	keys   *KeySet
+	now    func() time.Time
+}
+
+// NewJWTValidator loads the configured key set and returns a validator using it
+func NewJWTValidator(config JWTConfig) (*JWTValidator, error) {
+	if config.Issuer == "" || config.Audience == "" {
+		return nil, errors.New("JWT issuer and audience must be configured")
+	}
+	if config.RolesClaim == "" {
+		config.RolesClaim = "roles"
+	}
+	if config.NamespacesClaim == "" {
+		config.NamespacesClaim = "namespaces"
+	}
+	keys, err := LoadKeySet(config.JWKS)
+	if err != nil {
+		return nil, err
+	}
+	return &JWTValidator{
+		config: config,
+		keys:   keys,
+		now:    time.Now,
+	}, nil
+}
+
+// Authenticate validates the request's bearer token and returns the identity described by its claims
+func (validator *JWTValidator) Authenticate(r *http.Request) (Identity, error) {
+	token, err := BearerToken(r)
+	if err != nil {
+		return Identity{}, err
+	}
+	claims, err := validator.Validate(token)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	return validator.identity(claims), nil
+}
+
+// Validate checks the signature, issuer, audience and lifetime of the specified token and returns its claims
+func (validator *JWTValidator) Validate(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	key, err := validator.keys.Key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := validator.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkClaims verifies the registered claims of a token with a valid signature
+func (validator *JWTValidator) checkClaims(claims map[string]interface{}) error {
+	if iss, _ := claims["iss"].(string); iss != validator.config.Issuer {
+		return fmt.Errorf("%w: unexpected issuer %q", ErrInvalidClaims, iss)
+	}
+	audienceMatched := false
+	for _, aud := range stringsFromClaim(claims["aud"]) {
+		if aud == validator.config.Audience {
+			audienceMatched = true
+		}
+	}
+	if !audienceMatched {
+		return fmt.Errorf("%w: audience does not include %q", ErrInvalidClaims, validator.config.Audience)
+	}
+
+	now := validator.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: missing expiry", ErrInvalidClaims)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return fmt.Errorf("%w: token has expired", ErrInvalidClaims)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: token is not yet valid", ErrInvalidClaims)
+	}
+	return nil
+}
+
+// identity maps the claims of a valid token to an identity using the configured roles and namespaces
+func (validator *JWTValidator) identity(claims map[string]interface{}) Identity {
+	subject, _ := claims["sub"].(string)
+	id := Identity{Name: "jwt:" + subject}
+	for _, role := range stringsFromClaim(claims[validator.config.RolesClaim]) {
+		id.Grants = append(id.Grants, validator.config.RoleGrants[role]...)
+	}
+	for _, namespace := range stringsFromClaim(claims[validator.config.NamespacesClaim]) {
+		if namespace == "" {
+			continue
+		}
+		for _, permission := range validator.config.NamespacePermissions {
+			id.Grants = append(id.Grants, Grant{Permission: permission, Namespace: namespace})
+		}
+	}
+	return id
+}
+
+// KeySet is a set of public keys loaded from a JWKS file or URL, indexed by key ID
+type KeySet struct {
+	source     string
+	mu         sync.Mutex
+	keys       map[string]crypto.PublicKey
+	fetched    time.Time
+	refreshing *keyRefresh
+}
+
+// keyRefresh is a fetch of a remote key set in progress, which callers needing a key it may hold wait for together
+type keyRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+// LoadKeySet loads the JSON Web Key Set from the specified path or http(s) URL
+func LoadKeySet(source string) (*KeySet, error) {
+	keySet := &KeySet{source: source}
+	keys, err := keySet.read()
+	if err != nil {
+		return nil, err
+	}
+	keySet.keys = keys
+	keySet.fetched = time.Now()
+	return keySet, nil
+}
+
+// Key returns the key with the specified ID, refetching a remote key set if the key is not known,
+// or the only key if the ID is empty and the set holds a single key. The lock is not held while fetching, so keys
+// already known are served meanwhile, and callers needing an unknown key share a single fetch
+func (keySet *KeySet) Key(kid string) (crypto.PublicKey, error) {
+	keySet.mu.Lock()
+	if key, ok := keySet.lookup(kid); ok {
+		keySet.mu.Unlock()
+		return key, nil
+	}
+	refresh := keySet.refreshing
+	if refresh == nil {
+		if !keySet.remote() || time.Since(keySet.fetched) < jwksRefreshInterval {
+			keySet.mu.Unlock()
+			return nil, ErrUnknownKey
+		}
+		// Keys may have been rotated
+		refresh = &keyRefresh{done: make(chan struct{})}
+		keySet.refreshing = refresh
+		keySet.fetched = time.Now()
+		keySet.mu.Unlock()
+
+		keys, err := keySet.read()
+		keySet.mu.Lock()
+		if err == nil {
+			keySet.keys = keys
+		}
+		refresh.err = err
+		keySet.refreshing = nil
+		close(refresh.done)
+	} else {
+		keySet.mu.Unlock()
+		<-refresh.done
+		keySet.mu.Lock()
+	}
+	defer keySet.mu.Unlock()
+
+	if refresh.err != nil {
+		return nil, refresh.err
+	}
+	if key, ok := keySet.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// lookup finds the specified key; the caller must hold the lock
+func (keySet *KeySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(keySet.keys) == 1 {
+		for _, key := range keySet.keys {
+			return key, true
+		}
+	}
+	key, ok := keySet.keys[kid]
+	return key, ok
+}
+
+func (keySet *KeySet) remote() bool {
+	return strings.HasPrefix(keySet.source, "http://") || strings.HasPrefix(keySet.source, "https://")
+}
+
+// read reads and parses the key set source
+func (keySet *KeySet) read() (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+	if keySet.remote() {
+		data, err = fetch(keySet.source)
+	} else {
+		data, err = os.ReadFile(keySet.source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("key set contains no signing keys")
+	}
+	return keys, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes the RSA or P-256 EC public key described by the JWK
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// verifySignature checks the signature over the signing input using the specified algorithm and key
+func verifySignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signingInput))
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrInvalidSignature
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature); err != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	default:
+		return ErrUnsupportedAlg
+	}
+}
+
+// stringsFromClaim returns a claim which may be a single string or an array of strings as a slice
+func stringsFromClaim(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := []string{}
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url encoded JSON token segment into v
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// fetch gets the body of the specified URL
+func fetch(url string) ([]byte, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: unexpected status %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testIssuer   = "https://sso.example.com"
+	testAudience = "crud-server"
+)
+
+func TestJWTValidator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	jwksPath := writeJWKS(t, map[string]crypto.PublicKey{"rsa1": &rsaKey.PublicKey, "ec1": &ecKey.PublicKey})
+
+	validator, err := NewJWTValidator(JWTConfig{
+		JWKS:     jwksPath,
+		Issuer:   testIssuer,
+		Audience: testAudience,
+		RoleGrants: map[string][]Grant{
+			"auditor": {{Permission: PermissionHistory}},
+		},
+		NamespacePermissions: []Permission{PermissionRead, PermissionWrite},
+	})
+	assert.NoError(t, err)
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":        testIssuer,
+			"aud":        []string{"other", testAudience},
+			"sub":        "alice",
+			"exp":        time.Now().Add(time.Hour).Unix(),
+			"roles":      []string{"auditor"},
+			"namespaces": []string{"team-a"},
+		}
+	}
+
+	// Valid RS256 token
+	id, err := validator.Authenticate(requestWithToken(signToken(t, "RS256", "rsa1", rsaKey, validClaims())))
+	assert.NoError(t, err)
+	assert.Equal(t, "jwt:alice", id.Name)
+	assert.True(t, id.Allowed(PermissionHistory, "anything"))
+	assert.True(t, id.Allowed(PermissionWrite, "team-a:key1"))
+	assert.False(t, id.Allowed(PermissionWrite, "team-b:key1"))
+	assert.False(t, id.Allowed(PermissionDelete, "team-a:key1"))
+
+	// Valid ES256 token
+	_, err = validator.Authenticate(requestWithToken(signToken(t, "ES256", "ec1", ecKey, validClaims())))
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		name   string
+		token  func() string
+		expErr error
+	}{
+		{
+			name:   "no token",
+			token:  func() string { return "" },
+			expErr: ErrNoCredentials,
+		},
+		{
+			name: "expired",
+			token: func() string {
+				claims := validClaims()
+				claims["exp"] = time.Now().Add(-time.Hour).Unix()
+				return signToken(t, "RS256", "rsa1", rsaKey, claims)
+			},
+			expErr: ErrInvalidCredentials,
+		},
+		{
+			name: "wrong issuer",
+			token: func() string {
+				claims := validClaims()
+				claims["iss"] = "https://evil.example.com"
+				return signToken(t, "RS256", "rsa1", rsaKey, claims)
+			},
+			expErr: ErrInvalidCredentials,
+		},
+		{
+			name: "wrong audience",
+			token: func() string {
+				claims := validClaims()
+				claims["aud"] = "other"
+				return signToken(t, "RS256", "rsa1", rsaKey, claims)
+			},
+			expErr: ErrInvalidCredentials,
+		},
+		{
+			name: "unknown key",
+			token: func() string {
+				return signToken(t, "RS256", "rsa2", rsaKey, validClaims())
+			},
+			expErr: ErrInvalidCredentials,
+		},
+		{
+			name: "key and algorithm mismatch",
+			token: func() string {
+				return signToken(t, "RS256", "ec1", rsaKey, validClaims())
+			},
+			expErr: ErrInvalidCredentials,
+		},
+		{
+			name: "tampered claims",
+			token: func() string {
+				parts := strings.Split(signToken(t, "ES256", "ec1", ecKey, validClaims()), ".")
+				claims := validClaims()
+				claims["roles"] = []string{"admin"}
+				parts[1] = encodeSegment(t, claims)
+				return strings.Join(parts, ".")
+			},
+			expErr: ErrInvalidCredentials,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := validator.Authenticate(requestWithToken(tc.token()))
+			assert.ErrorIs(t, err, tc.expErr)
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	validator, err := NewJWTValidator(JWTConfig{
+		JWKS:     writeJWKS(t, map[string]crypto.PublicKey{"ec1": &ecKey.PublicKey}),
+		Issuer:   testIssuer,
+		Audience: testAudience,
+	})
+	assert.NoError(t, err)
+
+	handler := Middleware(validator, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := FromContext(r.Context())
+		w.Write([]byte(id.Name))
+	}))
+
+	// Unauthenticated request
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, requestWithToken(""))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Authenticated request
+	token := signToken(t, "ES256", "", ecKey, map[string]interface{}{
+		"iss": testIssuer,
+		"aud": testAudience,
+		"sub": "bob",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, requestWithToken(token))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "jwt:bob", resp.Body.String())
+}
+
+func TestKeySetRefresh(t *testing.T) {
+	ecKey1, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ecKey2, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	before, err := os.ReadFile(writeJWKS(t, map[string]crypto.PublicKey{"ec1": &ecKey1.PublicKey}))
+	assert.NoError(t, err)
+	after, err := os.ReadFile(writeJWKS(t, map[string]crypto.PublicKey{"ec1": &ecKey1.PublicKey, "ec2": &ecKey2.PublicKey}))
+	assert.NoError(t, err)
+
+	var fetches atomic.Int32
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) == 1 {
+			w.Write(before)
+			return
+		}
+		close(entered)
+		<-release
+		w.Write(after)
+	}))
+	defer srv.Close()
+
+	keySet, err := LoadKeySet(srv.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Allow the rotated key to be fetched at once
+	keySet.fetched = time.Time{}
+
+	// Callers needing the rotated key share a single fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := keySet.Key("ec2")
+			assert.NoError(t, err)
+			assert.Equal(t, &ecKey2.PublicKey, key)
+		}()
+	}
+	<-entered
+
+	// Known keys are served while the key set is fetched
+	key, err := keySet.Key("ec1")
+	assert.NoError(t, err)
+	assert.Equal(t, &ecKey1.PublicKey, key)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(2), fetches.Load())
+
+	// Unknown keys are not fetched again until the refresh interval has passed
+	_, err = keySet.Key("ec3")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	assert.Equal(t, int32(2), fetches.Load())
+}
+
+// writeJWKS writes the specified public keys as a JWKS file and returns its path
+func writeJWKS(t *testing.T, keys map[string]crypto.PublicKey) string {
+	jwks := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	for kid, key := range keys {
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, jwk{
+				Kty: "RSA",
+				Kid: kid,
+				N:   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			jwks.Keys = append(jwks.Keys, jwk{
+				Kty: "EC",
+				Kid: kid,
+				Crv: "P-256",
+				X:   base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, 32))),
+				Y:   base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+	}
+	data, err := json.Marshal(jwks)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, data, 0600))
+	return path
+}
+
+// signToken returns a JWT with the specified claims signed by the specified private key
+func signToken(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	signingInput := encodeSegment(t, map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		assert.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		assert.NoError(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	assert.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
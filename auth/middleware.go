@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const errorUnauthenticated = "Error: the request could not be authenticated"
+
+// Chain tries each authenticator in turn, returning the first identity established
+type Chain []Authenticator
+
+// Authenticate returns the identity from the first authenticator which accepts the request
+func (chain Chain) Authenticate(r *http.Request) (Identity, error) {
+	err := ErrNoCredentials
+	for _, authenticator := range chain {
+		id, authErr := authenticator.Authenticate(r)
+		if authErr == nil {
+			return id, nil
+		}
+		if !errors.Is(authErr, ErrNoCredentials) {
+			err = authErr
+		}
+	}
+	return Identity{}, err
+}
+
+// Middleware wraps the specified handler so that every request must be authenticated,
+// responding 401 to requests which are not and passing the caller's identity on in the request context
+func Middleware(authenticator Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := authenticator.Authenticate(r)
+		if err != nil {
+			w.Header().Add("WWW-Authenticate", "Bearer")
+			w.Header().Add("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, errorUnauthenticated)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
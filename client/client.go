@@ -0,0 +1,332 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	contentType     = "Content-Type"
+	contentTypeText = "text/plain"
+	contentTypeJson = "application/json"
+
+	// Messages returned by the server which distinguish responses sharing a status code
+	messageKeyDeleted = "Error: the specified key has been deleted"
+	messageKeyExists  = "Error: the specified key already exists"
+)
+
+var (
+	ErrNotFound      = errors.New("key not found")
+	ErrDeleted       = errors.New("key has been deleted")
+	ErrExists        = errors.New("key already exists")
+	ErrChanged       = errors.New("key has changed")
+	ErrBadRequest    = errors.New("bad request")
+	ErrUnauthorised  = errors.New("unauthorised")
+	ErrForbidden     = errors.New("forbidden")
+	ErrRateLimited   = errors.New("rate limited")
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+	ErrNotReady      = errors.New("server not ready")
+)
+
+// Error is an unsuccessful response from the server. It matches the sentinel error for its status code with errors.Is
+type Error struct {
+	StatusCode int
+	Message    string
+	sentinel   error
+}
+
+func (err *Error) Error() string {
+	if err.Message == "" {
+		return fmt.Sprintf("unexpected status %d %s", err.StatusCode, http.StatusText(err.StatusCode))
+	}
+	return fmt.Sprintf("unexpected status %d: %s", err.StatusCode, err.Message)
+}
+
+func (err *Error) Unwrap() error {
+	return err.sentinel
+}
+
+// errorFromResponse maps an unsuccessful response to an *Error
+func errorFromResponse(resp *http.Response, body []byte) error {
+	err := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		err.sentinel = ErrNotFound
+	case http.StatusPreconditionFailed:
+		err.sentinel = ErrChanged
+	case http.StatusBadRequest:
+		switch err.Message {
+		case messageKeyDeleted:
+			err.sentinel = ErrDeleted
+		case messageKeyExists:
+			err.sentinel = ErrExists
+		default:
+			err.sentinel = ErrBadRequest
+		}
+	case http.StatusUnsupportedMediaType:
+		err.sentinel = ErrBadRequest
+	case http.StatusUnauthorized:
+		err.sentinel = ErrUnauthorised
+	case http.StatusForbidden:
+		err.sentinel = ErrForbidden
+	case http.StatusTooManyRequests:
+		err.sentinel = ErrRateLimited
+	case http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage:
+		err.sentinel = ErrQuotaExceeded
+	case http.StatusServiceUnavailable:
+		err.sentinel = ErrNotReady
+	}
+	return err
+}
+
+// Event is an event in the history of a key. Time is when it was recorded, in RFC 3339 format, if the server records
+// event times
+type Event struct {
+	Event    string `json:"event"`
+	Value    string `json:"value"`
+	Identity string `json:"identity,omitempty"`
+	Time     string `json:"time,omitempty"`
+}
+
+// Entry is a key with its current value
+type Entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Client makes requests to a server
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	authorise  func(*http.Request) error
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// Option configures optional behaviour of the client returned by New
+type Option func(*Client)
+
+// WithHTTPClient makes requests using the specified HTTP client, e.g. to configure TLS client certificates,
+// instead of http.DefaultClient
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithToken authenticates each request with the specified API key or JWT as a bearer token
+func WithToken(token string) Option {
+	return WithAuthorisation(func(r *http.Request) error {
+		r.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	})
+}
+
+// WithAuthorisation calls the specified function to authenticate each request, e.g. to set a JWT which is refreshed
+func WithAuthorisation(authorise func(*http.Request) error) Option {
+	return func(c *Client) {
+		c.authorise = authorise
+	}
+}
+
+// WithRetries retries a request up to the specified number of times when the server is rate limiting or not ready,
+// and retries reads after network errors, waiting for an exponentially increasing backoff starting at the specified
+// duration, or as long as the server asks
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// New returns a client of the server at the specified base URL, e.g. http://localhost:9080
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		backoff:    100 * time.Millisecond,
+		maxBackoff: 10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Get returns the current value of the key, ErrDeleted if it has been deleted or ErrNotFound if it has never existed
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	value, _, err := c.GetVersion(ctx, key)
+	return value, err
+}
+
+// GetVersion returns the current value of the key as Get does, and its version, which UpdateVersion requires to be
+// unchanged. The version is returned with ErrDeleted too
+func (c *Client) GetVersion(ctx context.Context, key string) (string, string, error) {
+	resp, body, err := c.do(ctx, http.MethodGet, keyPath(key), "", nil, nil)
+	if err != nil {
+		return "", "", err
+	}
+	version := resp.Header.Get("ETag")
+	if resp.StatusCode == http.StatusNoContent {
+		return "", version, ErrDeleted
+	}
+	return string(body), version, nil
+}
+
+// Create creates the key with the specified value, returning ErrExists if it already has a value
+func (c *Client) Create(ctx context.Context, key, value string) error {
+	reqBody, err := json.Marshal(map[string]string{key: value})
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do(ctx, http.MethodPost, "/api", contentTypeJson, reqBody, nil)
+	return err
+}
+
+// Update sets the value of the key, returning ErrDeleted if it has been deleted or ErrNotFound if it has never existed
+func (c *Client) Update(ctx context.Context, key, value string) error {
+	_, _, err := c.do(ctx, http.MethodPut, keyPath(key), contentTypeText, []byte(value), nil)
+	return err
+}
+
+// UpdateVersion sets the value of the key as Update does, but only if its version is still that returned by
+// GetVersion, returning ErrChanged if it has since been written, so that a value computed from the one read does not
+// overwrite a concurrent write
+func (c *Client) UpdateVersion(ctx context.Context, key, value, version string) error {
+	header := http.Header{"If-Match": {version}}
+	_, _, err := c.do(ctx, http.MethodPut, keyPath(key), contentTypeText, []byte(value), header)
+	return err
+}
+
+// Delete deletes the value of the key, returning ErrDeleted if it has already been deleted
+// or ErrNotFound if it has never existed
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, _, err := c.do(ctx, http.MethodDelete, keyPath(key), "", nil, nil)
+	return err
+}
+
+// History returns every event of the key, oldest first
+func (c *Client) History(ctx context.Context, key string) ([]Event, error) {
+	_, body, err := c.do(ctx, http.MethodGet, keyPath(key)+"/history", "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	if err := json.Unmarshal(body, &events); err != nil {
+		return nil, fmt.Errorf("decoding history: %w", err)
+	}
+	return events, nil
+}
+
+// List returns the keys with the specified prefix which have a current value, sorted by key
+func (c *Client) List(ctx context.Context, prefix string) ([]Entry, error) {
+	_, body, err := c.do(ctx, http.MethodGet, "/api?prefix="+url.QueryEscape(prefix), "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("decoding keys: %w", err)
+	}
+	return entries, nil
+}
+
+// keyPath is the path of the specified key
+func keyPath(key string) string {
+	return "/api/" + url.PathEscape(key)
+}
+
+// newRequest creates an authorised request with the specified headers
+func (c *Client) newRequest(ctx context.Context, method, path, reqContentType string, reqBody []byte, header http.Header) (*http.Request, error) {
+	var body io.Reader
+	if reqBody != nil {
+		body = bytes.NewReader(reqBody)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if reqContentType != "" {
+		req.Header.Set(contentType, reqContentType)
+	}
+	if c.authorise != nil {
+		if err := c.authorise(req); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// do makes a request, retrying as configured, and returns the response and its body if it was successful
+func (c *Client) do(ctx context.Context, method, path, reqContentType string, reqBody []byte, header http.Header) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := c.newRequest(ctx, method, path, reqContentType, reqBody, header)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			// The server may have applied a mutation before the connection failed, so only reads are retried
+			if method != http.MethodGet || attempt >= c.retries || ctx.Err() != nil {
+				return nil, nil, err
+			}
+			if err := c.wait(ctx, attempt, 0); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode/100 == 2 {
+			return resp, body, nil
+		}
+
+		// The request was rejected before it was applied, so can be retried whatever its method
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+		if !retryable || attempt >= c.retries {
+			return nil, nil, errorFromResponse(resp, body)
+		}
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err := c.wait(ctx, attempt, time.Duration(retryAfter)*time.Second); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// wait sleeps before the specified retry, for the longer of the exponential backoff and the server's Retry-After
+func (c *Client) wait(ctx context.Context, attempt int, retryAfter time.Duration) error {
+	backoff := c.backoff << attempt
+	if backoff <= 0 || backoff > c.maxBackoff {
+		backoff = c.maxBackoff
+	}
+	// Jitter spreads out the retries of clients which failed together
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	if retryAfter > backoff {
+		backoff = retryAfter
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
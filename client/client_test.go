@@ -0,0 +1,288 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/repository"
+	"its-dave/simple-crud-rest-server/server"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newServer starts a server storing its data in a temporary file
+func newServer(t *testing.T, opts ...server.Option) *httptest.Server {
+	dataFilePath := filepath.Join(t.TempDir(), "data.json")
+	assert.NoError(t, os.WriteFile(dataFilePath, []byte("{}"), 0644))
+	repo := repository.Repo{}
+	repo.SetDataFilePath(dataFilePath)
+	srv := httptest.NewServer(server.Create(&repo, opts...))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	srv := newServer(t)
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	_, err := c.Get(ctx, "key1")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, c.Update(ctx, "key1", "value1"), ErrNotFound)
+
+	assert.NoError(t, c.Create(ctx, "key1", "value1"))
+	assert.ErrorIs(t, c.Create(ctx, "key1", "value1"), ErrExists)
+	value, err := c.Get(ctx, "key1")
+	assert.NoError(t, err)
+	assert.Equal(t, "value1", value)
+
+	assert.NoError(t, c.Update(ctx, "key1", "value 2/with spaces"))
+	value, err = c.Get(ctx, "key1")
+	assert.NoError(t, err)
+	assert.Equal(t, "value 2/with spaces", value)
+
+	assert.NoError(t, c.Create(ctx, "key2", "value1"))
+	assert.NoError(t, c.Create(ctx, "other", "value1"))
+	entries, err := c.List(ctx, "key")
+	assert.NoError(t, err)
+	assert.Equal(t, []Entry{{Key: "key1", Value: "value 2/with spaces"}, {Key: "key2", Value: "value1"}}, entries)
+
+	assert.NoError(t, c.Delete(ctx, "key1"))
+	assert.ErrorIs(t, c.Delete(ctx, "key1"), ErrDeleted)
+	assert.ErrorIs(t, c.Update(ctx, "key1", "value3"), ErrDeleted)
+	_, err = c.Get(ctx, "key1")
+	assert.ErrorIs(t, err, ErrDeleted)
+
+	history, err := c.History(ctx, "key1")
+	assert.NoError(t, err)
+	assert.Equal(t, []Event{
+		{Event: "create", Value: "value1"},
+		{Event: "update", Value: "value 2/with spaces"},
+		{Event: "delete"},
+	}, history)
+	_, err = c.History(ctx, "key3")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	var statusErr *Error
+	if assert.ErrorAs(t, c.Create(ctx, "key2", "value1"), &statusErr) {
+		assert.Equal(t, http.StatusBadRequest, statusErr.StatusCode)
+		assert.Equal(t, "Error: the specified key already exists", statusErr.Message)
+	}
+}
+
+func TestUpdateVersion(t *testing.T) {
+	srv := newServer(t)
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	assert.NoError(t, c.Create(ctx, "key1", "value1"))
+	value, version, err := c.GetVersion(ctx, "key1")
+	assert.NoError(t, err)
+	assert.Equal(t, "value1", value)
+	assert.NotEmpty(t, version)
+
+	// A write since the read makes the version stale
+	assert.NoError(t, c.Update(ctx, "key1", "value2"))
+	assert.ErrorIs(t, c.UpdateVersion(ctx, "key1", "value3", version), ErrChanged)
+	_, version, err = c.GetVersion(ctx, "key1")
+	assert.NoError(t, err)
+	assert.NoError(t, c.UpdateVersion(ctx, "key1", "value3", version))
+	value, err = c.Get(ctx, "key1")
+	assert.NoError(t, err)
+	assert.Equal(t, "value3", value)
+
+	assert.NoError(t, c.Delete(ctx, "key1"))
+	_, version, err = c.GetVersion(ctx, "key1")
+	assert.ErrorIs(t, err, ErrDeleted)
+	assert.NotEmpty(t, version)
+	assert.ErrorIs(t, c.UpdateVersion(ctx, "key2", "value1", `"0"`), ErrChanged)
+}
+
+func TestExportImport(t *testing.T) {
+	source, target := New(newServer(t).URL), New(newServer(t).URL)
+	ctx := context.Background()
+	assert.NoError(t, source.Create(ctx, "key1", "value1"))
+	assert.NoError(t, source.Update(ctx, "key1", "value2"))
+	assert.NoError(t, source.Create(ctx, "key2", "value1"))
+	assert.NoError(t, source.Delete(ctx, "key2"))
+	assert.NoError(t, target.Create(ctx, "key1", "other"))
+
+	var export bytes.Buffer
+	assert.NoError(t, source.Export(ctx, "", &export))
+	assert.Equal(t, `{"key":"key1","events":[{"event":"create","value":"value1"},{"event":"update","value":"value2"}]}`+"\n"+
+		`{"key":"key2","events":[{"event":"create","value":"value1"},{"event":"delete","value":""}]}`+"\n", export.String())
+
+	summary, err := target.Import(ctx, bytes.NewReader(export.Bytes()), ImportSkip, true)
+	assert.NoError(t, err)
+	assert.Equal(t, ImportSummary{DryRun: true, Created: 1, Skipped: 1}, summary)
+	_, err = target.Get(ctx, "key2")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	summary, err = target.Import(ctx, bytes.NewReader(export.Bytes()), ImportReplace, false)
+	assert.NoError(t, err)
+	assert.Equal(t, ImportSummary{Created: 1, Replaced: 1}, summary)
+	history, err := target.History(ctx, "key1")
+	assert.NoError(t, err)
+	assert.Equal(t, []Event{{Event: "create", Value: "value1"}, {Event: "update", Value: "value2"}}, history)
+	_, err = target.Get(ctx, "key2")
+	assert.ErrorIs(t, err, ErrDeleted)
+
+	_, err = target.Import(ctx, strings.NewReader("not json"), ImportMerge, false)
+	assert.ErrorIs(t, err, ErrBadRequest)
+}
+
+func TestVerify(t *testing.T) {
+	srv := newServer(t)
+	c := New(srv.URL)
+	ctx := context.Background()
+	assert.NoError(t, c.Create(ctx, "key1", "value1"))
+	assert.NoError(t, c.Delete(ctx, "key1"))
+
+	report, err := c.Verify(ctx, false)
+	assert.NoError(t, err)
+	assert.Equal(t, VerifyReport{Keys: 1, Events: 2, Problems: []Problem{}}, report)
+	report, err = c.Verify(ctx, true)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Problems)
+}
+
+func TestClientAuth(t *testing.T) {
+	keyStore, err := auth.NewKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	assert.NoError(t, err)
+	token, _, err := keyStore.Create("team-a", []auth.Grant{
+		{Permission: auth.PermissionRead, Namespace: "team-a"},
+		{Permission: auth.PermissionWrite, Namespace: "team-a"},
+	})
+	assert.NoError(t, err)
+	srv := newServer(t, server.WithAPIKeys(keyStore))
+	ctx := context.Background()
+
+	_, err = New(srv.URL).Get(ctx, "team-a:key1")
+	assert.ErrorIs(t, err, ErrUnauthorised)
+
+	c := New(srv.URL, WithToken(token))
+	assert.NoError(t, c.Create(ctx, "team-a:key1", "value1"))
+	assert.ErrorIs(t, c.Create(ctx, "team-b:key1", "value1"), ErrForbidden)
+	history, err := New(srv.URL, WithAuthorisation(func(r *http.Request) error {
+		r.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	})).History(ctx, "team-a:key1")
+	assert.ErrorIs(t, err, ErrForbidden)
+	assert.Nil(t, history)
+
+	authErr := errors.New("no token")
+	_, err = New(srv.URL, WithAuthorisation(func(r *http.Request) error { return authErr })).Get(ctx, "team-a:key1")
+	assert.ErrorIs(t, err, authErr)
+}
+
+func TestClientRetries(t *testing.T) {
+	srv := newServer(t)
+	var requests atomic.Int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reject the first two requests as though the server were starting
+		if requests.Add(1) <= 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		srv.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+	ctx := context.Background()
+
+	assert.ErrorIs(t, New(flaky.URL).Create(ctx, "key1", "value1"), ErrNotReady)
+	assert.NoError(t, New(flaky.URL, WithRetries(2, time.Millisecond)).Create(ctx, "key1", "value1"))
+	assert.Equal(t, int32(3), requests.Load())
+
+	// Retries stop when the context is cancelled
+	requests.Store(0)
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err := New(flaky.URL, WithRetries(5, time.Hour)).Get(ctx, "key1")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+// connectedWriter signals when the response headers are written, by which time a watch has been registered
+type connectedWriter struct {
+	http.ResponseWriter
+	connected chan<- struct{}
+}
+
+func (w *connectedWriter) WriteHeader(status int) {
+	w.ResponseWriter.WriteHeader(status)
+	w.connected <- struct{}{}
+}
+
+func (w *connectedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestWatch(t *testing.T) {
+	shutdown := make(chan struct{})
+	srv := newServer(t, server.WithShutdown(shutdown))
+	connected := make(chan struct{}, 1)
+	mux := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/watch" {
+			w = &connectedWriter{ResponseWriter: w, connected: connected}
+		}
+		mux.ServeHTTP(w, r)
+	})
+	c := New(srv.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var received []WatchEvent
+	watched := make(chan error, 1)
+	go func() {
+		watched <- c.Watch(ctx, "key", func(event WatchEvent) error {
+			received = append(received, event)
+			if len(received) == 3 {
+				cancel()
+			}
+			return nil
+		})
+	}()
+	<-connected
+	assert.NoError(t, c.Create(context.Background(), "key1", "value1"))
+	assert.NoError(t, c.Create(context.Background(), "other", "value1"))
+	assert.NoError(t, c.Update(context.Background(), "key1", "value2"))
+	assert.NoError(t, c.Delete(context.Background(), "key1"))
+	assert.ErrorIs(t, <-watched, context.Canceled)
+	assert.Equal(t, []WatchEvent{
+		{Key: "key1", Event: Event{Event: "create", Value: "value1"}},
+		{Key: "key1", Event: Event{Event: "update", Value: "value2"}},
+		{Key: "key1", Event: Event{Event: "delete"}},
+	}, received)
+
+	// An error from the callback stops watching
+	stop := errors.New("stop")
+	go func() {
+		watched <- c.Watch(context.Background(), "", func(event WatchEvent) error {
+			return stop
+		})
+	}()
+	<-connected
+	assert.NoError(t, c.Create(context.Background(), "key2", "value1"))
+	assert.ErrorIs(t, <-watched, stop)
+
+	// The stream ends when the server shuts down
+	go func() {
+		watched <- c.Watch(context.Background(), "", func(event WatchEvent) error {
+			return nil
+		})
+	}()
+	<-connected
+	close(shutdown)
+	assert.ErrorIs(t, <-watched, ErrStreamEnded)
+}
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Problem is an inconsistency found in the stored data. Event is the index of the event in the key's history,
+// if the problem is with a single event, and Key is empty if the problem is with the whole data file
+type Problem struct {
+	Key      string `json:"key,omitempty"`
+	Event    *int   `json:"event,omitempty"`
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired"`
+}
+
+// VerifyReport is the result of checking every key in the store
+type VerifyReport struct {
+	Keys     int       `json:"keys"`
+	Events   int       `json:"events"`
+	Problems []Problem `json:"problems"`
+}
+
+// Verify checks the stored data for malformed histories, unknown events, impossible transitions and a checksum
+// mismatch. With repair, the problems are also repaired if each can be without losing information. It requires admin
+// permission
+func (c *Client) Verify(ctx context.Context, repair bool) (VerifyReport, error) {
+	method := http.MethodGet
+	if repair {
+		method = http.MethodPost
+	}
+	_, body, err := c.do(ctx, method, "/admin/verify", "", nil, nil)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	var report VerifyReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return VerifyReport{}, fmt.Errorf("decoding verify report: %w", err)
+	}
+	return report, nil
+}
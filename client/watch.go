@@ -0,0 +1,74 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrStreamEnded is returned by Watch when the server ends the stream, e.g. as it shuts down, so that the caller can
+// reconnect
+var ErrStreamEnded = errors.New("watch stream ended")
+
+// WatchEvent is an event of a key, received as it happens
+type WatchEvent struct {
+	Key string `json:"key"`
+	Event
+}
+
+// Watch calls fn with each event of the keys with the specified prefix, in order, until ctx is cancelled, the stream
+// ends or fn returns an error, which is returned. Events which happen while the caller is not watching are not sent
+func (c *Client) Watch(ctx context.Context, prefix string, fn func(WatchEvent) error) error {
+	req, err := c.newRequest(ctx, http.MethodGet, "/watch?prefix="+url.QueryEscape(prefix), "", nil, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return errorFromResponse(resp, body)
+	}
+
+	// Parse the server-sent events, dispatching each at the blank line which ends it
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) == 0 {
+				continue
+			}
+			var event WatchEvent
+			if err := json.Unmarshal([]byte(strings.Join(data, "\n")), &event); err != nil {
+				return fmt.Errorf("decoding event: %w", err)
+			}
+			data = data[:0]
+			if err := fn(event); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// Event names repeat the type in the data, and comments keep the connection alive
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return ErrStreamEnded
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"its-dave/simple-crud-rest-server/client"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputRaw   = "raw"
+)
+
+var commands = map[string]func(c *cli, ctx context.Context, args []string) error{
+	"get":     (*cli).get,
+	"set":     (*cli).set,
+	"create":  (*cli).create,
+	"delete":  (*cli).delete,
+	"history": (*cli).history,
+	"ls":      (*cli).ls,
+	"watch":   (*cli).watch,
+	"export":  (*cli).export,
+	"import":  (*cli).importKeys,
+	"verify":  (*cli).verify,
+}
+
+// format returns the output format, or the specified default if none was chosen
+func (c *cli) format(def string) string {
+	if c.output == "" {
+		return def
+	}
+	return c.output
+}
+
+// writeJSON writes v as indented JSON
+func (c *cli) writeJSON(v interface{}) error {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeTable writes the rows with aligned columns under the specified header
+func (c *cli) writeTable(header []string, rows [][]string) error {
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		// Keep each row on one line whatever the value holds
+		for i := range row {
+			row[i] = strings.NewReplacer("\n", `\n`, "\t", `\t`).Replace(row[i])
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// parseArgs parses the arguments of a command, checking that the number of positional arguments is within range
+func parseArgs(fs *flag.FlagSet, args []string, min, max int) error {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+	if fs.NArg() < min || fs.NArg() > max {
+		return usageError(fmt.Sprintf("expected %d to %d arguments, got %d", min, max, fs.NArg()))
+	}
+	return nil
+}
+
+// readValue returns the value given as the argument after the key, read from the file given by -f, or read from stdin
+func (c *cli) readValue(fs *flag.FlagSet, valueFile string) (string, error) {
+	if fs.NArg() == 2 && fs.Arg(1) != "-" {
+		if valueFile != "" {
+			return "", usageError("a value cannot be given with -f")
+		}
+		return fs.Arg(1), nil
+	}
+	var data []byte
+	var err error
+	if valueFile != "" && valueFile != "-" {
+		data, err = os.ReadFile(valueFile)
+	} else {
+		data, err = io.ReadAll(c.stdin)
+	}
+	if err != nil {
+		return "", err
+	}
+	// A single trailing newline is from the shell rather than part of the value
+	value := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+	if value == "" {
+		return "", usageError("the value must not be empty")
+	}
+	return value, nil
+}
+
+func (c *cli) get(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 1, 1); err != nil {
+		return err
+	}
+	key := fs.Arg(0)
+	value, err := c.client.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	switch c.format(outputRaw) {
+	case outputJSON:
+		return c.writeJSON(client.Entry{Key: key, Value: value})
+	case outputTable:
+		return c.writeTable([]string{"KEY", "VALUE"}, [][]string{{key, value}})
+	}
+	_, err = fmt.Fprintln(c.stdout, value)
+	return err
+}
+
+func (c *cli) set(ctx context.Context, args []string) error {
+	return c.write(ctx, "set", args)
+}
+
+func (c *cli) create(ctx context.Context, args []string) error {
+	return c.write(ctx, "create", args)
+}
+
+// write creates a key, or for set updates it if it already has a value
+func (c *cli) write(ctx context.Context, command string, args []string) error {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	valueFile := fs.String("f", "", "file to read the value from")
+	if err := parseArgs(fs, args, 1, 2); err != nil {
+		return err
+	}
+	key := fs.Arg(0)
+	value, err := c.readValue(fs, *valueFile)
+	if err != nil {
+		return err
+	}
+	err = c.client.Create(ctx, key, value)
+	if command == "set" && errors.Is(err, client.ErrExists) {
+		err = c.client.Update(ctx, key, value)
+	}
+	return err
+}
+
+func (c *cli) delete(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 1, 1); err != nil {
+		return err
+	}
+	return c.client.Delete(ctx, fs.Arg(0))
+}
+
+func (c *cli) history(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 1, 1); err != nil {
+		return err
+	}
+	events, err := c.client.History(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	switch c.format(outputTable) {
+	case outputJSON:
+		return c.writeJSON(events)
+	case outputRaw:
+		for _, event := range events {
+			fmt.Fprintln(c.stdout, event.Value)
+		}
+		return nil
+	}
+	rows := make([][]string, 0, len(events))
+	for _, event := range events {
+		rows = append(rows, []string{event.Event, event.Value, event.Identity, event.Time})
+	}
+	return c.writeTable([]string{"EVENT", "VALUE", "IDENTITY", "TIME"}, rows)
+}
+
+func (c *cli) ls(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 0, 1); err != nil {
+		return err
+	}
+	entries, err := c.client.List(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	switch c.format(outputTable) {
+	case outputJSON:
+		return c.writeJSON(entries)
+	case outputRaw:
+		for _, entry := range entries {
+			fmt.Fprintln(c.stdout, entry.Key)
+		}
+		return nil
+	}
+	rows := make([][]string, 0, len(entries))
+	for _, entry := range entries {
+		rows = append(rows, []string{entry.Key, entry.Value})
+	}
+	return c.writeTable([]string{"KEY", "VALUE"}, rows)
+}
+
+func (c *cli) watch(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 0, 1); err != nil {
+		return err
+	}
+	format := c.format(outputTable)
+	encoder := json.NewEncoder(c.stdout)
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	if format == outputTable {
+		fmt.Fprintln(tw, "KEY\tEVENT\tVALUE\tIDENTITY")
+		tw.Flush()
+	}
+	err := c.client.Watch(ctx, fs.Arg(0), func(event client.WatchEvent) error {
+		switch format {
+		case outputJSON:
+			// One event per line so that the output can be processed as it arrives
+			return encoder.Encode(event)
+		case outputRaw:
+			_, err := fmt.Fprintf(c.stdout, "%s %s %s\n", event.Event, event.Key, event.Value)
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", event.Key, event.Event, event.Value, event.Identity)
+		return tw.Flush()
+	})
+	if errors.Is(err, context.Canceled) {
+		// Interrupted by the user
+		return nil
+	}
+	return err
+}
+
+// export writes every key, including deleted keys, with its history
+func (c *cli) export(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	if err := parseArgs(fs, args, 0, 1); err != nil {
+		return err
+	}
+	return c.client.Export(ctx, fs.Arg(0), c.stdout)
+}
+
+// importKeys loads exported keys, doing as -mode specifies with keys which already exist
+func (c *cli) importKeys(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	mode := fs.String("mode", string(client.ImportMerge), "what to do with keys which already exist: merge, replace or skip")
+	dryRun := fs.Bool("dry-run", false, "print what would be imported without changing anything")
+	if err := parseArgs(fs, args, 0, 1); err != nil {
+		return err
+	}
+	switch client.ImportMode(*mode) {
+	case client.ImportMerge, client.ImportReplace, client.ImportSkip:
+	default:
+		return usageError(fmt.Sprintf("unknown import mode %q", *mode))
+	}
+	in := c.stdin
+	if fs.NArg() == 1 && fs.Arg(0) != "-" {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	summary, err := c.client.Import(ctx, in, client.ImportMode(*mode), *dryRun)
+	if err != nil {
+		return err
+	}
+	switch c.format(outputTable) {
+	case outputJSON:
+		return c.writeJSON(summary)
+	case outputRaw:
+		_, err := fmt.Fprintf(c.stdout, "%d %d %d %d\n", summary.Created, summary.Merged, summary.Replaced, summary.Skipped)
+		return err
+	}
+	return c.writeTable([]string{"CREATED", "MERGED", "REPLACED", "SKIPPED"}, [][]string{{
+		strconv.Itoa(summary.Created), strconv.Itoa(summary.Merged), strconv.Itoa(summary.Replaced), strconv.Itoa(summary.Skipped),
+	}})
+}
+
+// verify checks the stored data, and with -repair repairs it if it can, failing if any problem remains
+func (c *cli) verify(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	repair := fs.Bool("repair", false, "repair the problems if each can be repaired without losing information")
+	if err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	report, err := c.client.Verify(ctx, *repair)
+	if err != nil {
+		return err
+	}
+	remaining := 0
+	for _, problem := range report.Problems {
+		if !problem.Repaired {
+			remaining++
+		}
+	}
+
+	switch c.format(outputTable) {
+	case outputJSON:
+		err = c.writeJSON(report)
+	case outputRaw:
+		for _, problem := range report.Problems {
+			fmt.Fprintln(c.stdout, problem.Problem)
+		}
+	default:
+		fmt.Fprintf(c.stdout, "checked %d keys with %d events\n", report.Keys, report.Events)
+		if len(report.Problems) > 0 {
+			rows := make([][]string, 0, len(report.Problems))
+			for _, problem := range report.Problems {
+				event := ""
+				if problem.Event != nil {
+					event = strconv.Itoa(*problem.Event)
+				}
+				rows = append(rows, []string{problem.Key, event, problem.Problem, strconv.FormatBool(problem.Repaired)})
+			}
+			err = c.writeTable([]string{"KEY", "EVENT", "PROBLEM", "REPAIRED"}, rows)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%d problems found", remaining)
+	}
+	return nil
+}
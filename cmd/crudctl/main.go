@@ -0,0 +1,151 @@
+// Command crudctl reads and writes the keys of a simple-crud-rest-server
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"its-dave/simple-crud-rest-server/client"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Exit codes distinguish the outcomes a script is likely to branch on
+const (
+	exitOK        = 0
+	exitError     = 1
+	exitUsage     = 2
+	exitNotFound  = 3
+	exitDeleted   = 4
+	exitExists    = 5
+	exitForbidden = 6
+)
+
+const usage = `Usage: crudctl [flags] <command> [args]
+
+Commands:
+  get <key>                    print the current value of a key
+  set <key> [value]            create or update a key
+  create <key> [value]         create a key, failing if it has a value
+  delete <key>                 delete the value of a key
+  history <key>                print every event of a key
+  ls [prefix]                  list the keys with a current value
+  watch [prefix]               print events of keys as they happen
+  export [prefix]              write every key with its history as NDJSON (requires admin)
+  import [-mode merge|replace|skip] [-dry-run] [file]
+                               load keys exported as NDJSON (requires admin)
+  verify [-repair]             check the stored data for problems (requires admin)
+
+Values are read from -f <file>, or from stdin if omitted or "-".
+
+Exit codes: 0 ok, 1 error, 2 usage, 3 not found, 4 deleted, 5 exists, 6 unauthorised or forbidden
+
+Flags:
+`
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr, os.Getenv))
+}
+
+// cli runs a command with the global flags applied
+type cli struct {
+	client *client.Client
+	output string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// run runs crudctl with the specified arguments and returns its exit code
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer, getenv func(string) string) int {
+	fs := flag.NewFlagSet("crudctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	serverURL := fs.String("server", "", "base URL of the server; also set by CRUDCTL_SERVER (default from the profile, or http://localhost:9080)")
+	token := fs.String("token", "", "API key or JWT to authenticate with; also set by CRUDCTL_TOKEN")
+	profileName := fs.String("profile", "", "name of the profile to use; also set by CRUDCTL_PROFILE (default the current profile)")
+	profilesPath := fs.String("profiles", defaultProfilesPath(getenv), "path to the YAML file of server profiles")
+	output := fs.String("o", "", "output format: table, json or raw (default raw for get, otherwise table)")
+	timeout := fs.Duration("timeout", 30*time.Second, "maximum duration of each command, except watch")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	switch *output {
+	case "", outputTable, outputJSON, outputRaw:
+	default:
+		fmt.Fprintf(stderr, "crudctl: unknown output format %q\n", *output)
+		return exitUsage
+	}
+
+	profile, err := resolveProfile(*profilesPath, *profileName, *serverURL, *token, getenv)
+	if err != nil {
+		fmt.Fprintln(stderr, "crudctl:", err)
+		return exitUsage
+	}
+	c, err := profile.client()
+	if err != nil {
+		fmt.Fprintln(stderr, "crudctl:", err)
+		return exitUsage
+	}
+
+	command, commandArgs := fs.Arg(0), fs.Args()[1:]
+	runCommand, ok := commands[command]
+	if !ok {
+		fmt.Fprintf(stderr, "crudctl: unknown command %q\n", command)
+		fs.Usage()
+		return exitUsage
+	}
+	if command != "watch" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	err = runCommand(&cli{client: c, output: *output, stdin: stdin, stdout: stdout, stderr: stderr}, ctx, commandArgs)
+	if err != nil {
+		fmt.Fprintf(stderr, "crudctl %s: %v\n", command, err)
+	}
+	return exitCode(err)
+}
+
+// usageError is an error in the arguments to a command
+type usageError string
+
+func (err usageError) Error() string {
+	return string(err)
+}
+
+// exitCode returns the exit code for the outcome of a command
+func exitCode(err error) int {
+	var usageErr usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case errors.Is(err, client.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, client.ErrDeleted):
+		return exitDeleted
+	case errors.Is(err, client.ErrExists):
+		return exitExists
+	case errors.Is(err, client.ErrUnauthorised), errors.Is(err, client.ErrForbidden):
+		return exitForbidden
+	}
+	return exitError
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/repository"
+	"its-dave/simple-crud-rest-server/server"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newServer starts a server storing its data in a temporary file
+func newServer(t *testing.T, opts ...server.Option) *httptest.Server {
+	dataFilePath := filepath.Join(t.TempDir(), "data.json")
+	assert.NoError(t, os.WriteFile(dataFilePath, []byte("{}"), 0644))
+	repo := repository.Repo{}
+	repo.SetDataFilePath(dataFilePath)
+	srv := httptest.NewServer(server.Create(&repo, opts...))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// crudctl runs crudctl against the specified server with the specified stdin, returning its exit code and output
+func crudctl(t *testing.T, serverURL, stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"-profiles", filepath.Join(t.TempDir(), "none.yaml"), "-server", serverURL}, args...)
+	code := run(context.Background(), args, strings.NewReader(stdin), &stdout, &stderr, func(string) string { return "" })
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCommands(t *testing.T) {
+	srv := newServer(t)
+	for _, tc := range []struct {
+		args      []string
+		stdin     string
+		expCode   int
+		expStdout string
+	}{
+		{args: []string{"get", "key1"}, expCode: exitNotFound},
+		{args: []string{"create", "key1", "value1"}, expCode: exitOK},
+		{args: []string{"create", "key1", "value1"}, expCode: exitExists},
+		{args: []string{"get", "key1"}, expCode: exitOK, expStdout: "value1\n"},
+		{args: []string{"set", "key1"}, stdin: "value2\n", expCode: exitOK},
+		{args: []string{"set", "key2", "-"}, stdin: "multi\nline\n", expCode: exitOK},
+		{args: []string{"-o", "json", "get", "key2"}, expCode: exitOK, expStdout: "{\n  \"key\": \"key2\",\n  \"value\": \"multi\\nline\"\n}\n"},
+		{args: []string{"ls"}, expCode: exitOK, expStdout: "KEY   VALUE\nkey1  value2\nkey2  multi\\nline\n"},
+		{args: []string{"-o", "raw", "ls", "key1"}, expCode: exitOK, expStdout: "key1\n"},
+		{args: []string{"delete", "key1"}, expCode: exitOK},
+		{args: []string{"delete", "key1"}, expCode: exitDeleted},
+		{args: []string{"get", "key1"}, expCode: exitDeleted},
+		{args: []string{"history", "key1"}, expCode: exitOK, expStdout: "EVENT   VALUE   IDENTITY  TIME\ncreate  value1            \nupdate  value2            \ndelete                    \n"},
+		{args: []string{"-o", "raw", "history", "key1"}, expCode: exitOK, expStdout: "value1\nvalue2\n\n"},
+		{args: []string{"set", "key1", "value3"}, expCode: exitOK},
+		{args: []string{"verify"}, expCode: exitOK, expStdout: "checked 2 keys with 5 events\n"},
+		{args: []string{"verify", "extra"}, expCode: exitUsage},
+		{args: []string{"create", "key3"}, stdin: "\n", expCode: exitUsage},
+		{args: []string{"get"}, expCode: exitUsage},
+		{args: []string{"frobnicate"}, expCode: exitUsage},
+		{args: []string{"-o", "yaml", "ls"}, expCode: exitUsage},
+	} {
+		code, stdout, stderr := crudctl(t, srv.URL, tc.stdin, tc.args...)
+		assert.Equal(t, tc.expCode, code, "%v: %s", tc.args, stderr)
+		assert.Equal(t, tc.expStdout, stdout, tc.args)
+	}
+
+	// Values can be read from a file
+	valueFilePath := filepath.Join(t.TempDir(), "value.txt")
+	assert.NoError(t, os.WriteFile(valueFilePath, []byte("from file"), 0644))
+	code, _, _ := crudctl(t, srv.URL, "", "set", "-f", valueFilePath, "key4")
+	assert.Equal(t, exitOK, code)
+	_, stdout, _ := crudctl(t, srv.URL, "", "get", "key4")
+	assert.Equal(t, "from file\n", stdout)
+
+	// Unreachable servers are errors
+	code, _, _ = crudctl(t, "http://127.0.0.1:1", "", "-timeout", "1s", "get", "key1")
+	assert.Equal(t, exitError, code)
+}
+
+func TestExportImport(t *testing.T) {
+	source := newServer(t)
+	for _, args := range [][]string{{"create", "a:key1", "value1"}, {"set", "a:key1", "value2"}, {"create", "a:key2", "value1"}, {"delete", "a:key2"}, {"create", "b:key1", "value1"}} {
+		code, _, stderr := crudctl(t, source.URL, "", args...)
+		assert.Equal(t, exitOK, code, stderr)
+	}
+	code, exported, _ := crudctl(t, source.URL, "", "export", "a:")
+	assert.Equal(t, exitOK, code)
+	assert.Equal(t, `{"key":"a:key1","events":[{"event":"create","value":"value1"},{"event":"update","value":"value2"}]}`+"\n"+
+		`{"key":"a:key2","events":[{"event":"create","value":"value1"},{"event":"delete","value":""}]}`+"\n", exported)
+
+	target := newServer(t)
+	code, _, _ = crudctl(t, target.URL, "", "create", "a:key1", "other")
+	assert.Equal(t, exitOK, code)
+	code, stdout, stderr := crudctl(t, target.URL, exported, "import", "-dry-run", "-mode", "skip")
+	assert.Equal(t, exitOK, code, stderr)
+	assert.Equal(t, "CREATED  MERGED  REPLACED  SKIPPED\n1        0       0         1\n", stdout)
+	code, _, _ = crudctl(t, target.URL, "", "get", "a:key2")
+	assert.Equal(t, exitNotFound, code)
+
+	code, stdout, stderr = crudctl(t, target.URL, exported, "-o", "raw", "import", "-mode", "replace")
+	assert.Equal(t, exitOK, code, stderr)
+	assert.Equal(t, "1 0 1 0\n", stdout)
+	_, stdout, _ = crudctl(t, target.URL, "", "get", "a:key1")
+	assert.Equal(t, "value2\n", stdout)
+	code, _, _ = crudctl(t, target.URL, "", "get", "a:key2")
+	assert.Equal(t, exitDeleted, code)
+
+	code, _, stderr = crudctl(t, target.URL, "not json\n", "import")
+	assert.Equal(t, exitError, code)
+	assert.Contains(t, stderr, "(line 1)")
+	code, _, _ = crudctl(t, target.URL, exported, "import", "-mode", "overwrite")
+	assert.Equal(t, exitUsage, code)
+}
+
+func TestProfiles(t *testing.T) {
+	keyStore, err := auth.NewKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	assert.NoError(t, err)
+	token, _, err := keyStore.Create("reader", []auth.Grant{{Permission: auth.PermissionRead}})
+	assert.NoError(t, err)
+	srv := newServer(t, server.WithAPIKeys(keyStore))
+
+	tokenFilePath := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenFilePath, []byte(token+"\n"), 0600))
+	profilesPath := filepath.Join(t.TempDir(), "profiles.yaml")
+	assert.NoError(t, os.WriteFile(profilesPath, []byte(`
+current: test
+profiles:
+  test:
+    server: `+srv.URL+`
+    tokenFile: `+tokenFilePath+`
+  other:
+    server: http://127.0.0.1:1
+`), 0600))
+
+	env := map[string]string{}
+	getenv := func(name string) string { return env[name] }
+	crudctlWithProfiles := func(args ...string) int {
+		var stdout, stderr bytes.Buffer
+		return run(context.Background(), append([]string{"-profiles", profilesPath, "-timeout", time.Second.String()}, args...), strings.NewReader(""), &stdout, &stderr, getenv)
+	}
+
+	// The current profile's token is used
+	assert.Equal(t, exitNotFound, crudctlWithProfiles("get", "key1"))
+	assert.Equal(t, exitForbidden, crudctlWithProfiles("create", "key1", "value1"))
+	// The environment overrides the profile, and flags override the environment
+	env["CRUDCTL_TOKEN"] = "invalid"
+	assert.Equal(t, exitForbidden, crudctlWithProfiles("get", "key1"))
+	assert.Equal(t, exitNotFound, crudctlWithProfiles("-token", token, "get", "key1"))
+	delete(env, "CRUDCTL_TOKEN")
+	// Other profiles can be chosen
+	assert.Equal(t, exitError, crudctlWithProfiles("-profile", "other", "get", "key1"))
+	env["CRUDCTL_PROFILE"] = "other"
+	assert.Equal(t, exitError, crudctlWithProfiles("get", "key1"))
+	assert.Equal(t, exitUsage, crudctlWithProfiles("-profile", "missing", "get", "key1"))
+}
+
+// lockedBuffer is a buffer which can be read while a command writes to it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWatch(t *testing.T) {
+	srv := newServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var stdout lockedBuffer
+	watched := make(chan int)
+	go func() {
+		args := []string{"-profiles", filepath.Join(t.TempDir(), "none.yaml"), "-server", srv.URL, "-o", "json", "watch", "key"}
+		watched <- run(ctx, args, strings.NewReader(""), &stdout, &bytes.Buffer{}, func(string) string { return "" })
+	}()
+	// Keep writing until the watch has started and received an event
+	for i := 0; i < 100 && !strings.Contains(stdout.String(), "key1"); i++ {
+		crudctl(t, srv.URL, "", "set", "key1", "value1")
+		time.Sleep(20 * time.Millisecond)
+	}
+	cancel()
+	assert.Equal(t, exitOK, <-watched)
+	// The watch may start after the key is created
+	assert.Regexp(t, `\{"key":"key1","event":"(create|update)","value":"value1"\}`, stdout.String())
+}
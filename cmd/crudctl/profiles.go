@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"its-dave/simple-crud-rest-server/client"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultServer = "http://localhost:9080"
+
+// profile is how to reach and authenticate with a server
+type profile struct {
+	Server    string `yaml:"server"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"tokenFile"`
+	CAFile    string `yaml:"caFile"`
+	CertFile  string `yaml:"certFile"`
+	KeyFile   string `yaml:"keyFile"`
+}
+
+// profiles is the file of named profiles, e.g.
+//
+//	current: prod
+//	profiles:
+//	  prod:
+//	    server: https://crud.example.com
+//	    tokenFile: ~/.crud-token
+type profiles struct {
+	Current  string             `yaml:"current"`
+	Profiles map[string]profile `yaml:"profiles"`
+}
+
+// defaultProfilesPath is crudctl/profiles.yaml in the user's config directory
+func defaultProfilesPath(getenv func(string) string) string {
+	if dir := getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "crudctl", "profiles.yaml")
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "crudctl", "profiles.yaml")
+	}
+	return ""
+}
+
+// resolveProfile chooses the profile named by the flag, CRUDCTL_PROFILE or the file, then overrides it with the
+// CRUDCTL_SERVER and CRUDCTL_TOKEN environment variables and then the -server and -token flags
+func resolveProfile(profilesPath, name, serverURL, token string, getenv func(string) string) (profile, error) {
+	var p profile
+	if name == "" {
+		name = getenv("CRUDCTL_PROFILE")
+	}
+	data, err := os.ReadFile(profilesPath)
+	switch {
+	case err == nil:
+		var ps profiles
+		if err := yaml.Unmarshal(data, &ps); err != nil {
+			return profile{}, fmt.Errorf("reading profiles %s: %w", profilesPath, err)
+		}
+		if name == "" {
+			name = ps.Current
+		}
+		if name != "" {
+			var ok bool
+			if p, ok = ps.Profiles[name]; !ok {
+				return profile{}, fmt.Errorf("no profile named %q in %s", name, profilesPath)
+			}
+		}
+	case errors.Is(err, os.ErrNotExist) && name == "":
+		// Profiles are optional
+	default:
+		return profile{}, fmt.Errorf("reading profiles: %w", err)
+	}
+
+	for _, override := range []struct {
+		field *string
+		value string
+	}{
+		{&p.Server, getenv("CRUDCTL_SERVER")},
+		{&p.Token, getenv("CRUDCTL_TOKEN")},
+		{&p.Server, serverURL},
+		{&p.Token, token},
+	} {
+		if override.value != "" {
+			*override.field = override.value
+		}
+	}
+	if p.Server == "" {
+		p.Server = defaultServer
+	}
+	return p, nil
+}
+
+// client returns a client configured by the profile
+func (p profile) client() (*client.Client, error) {
+	opts := []client.Option{client.WithRetries(3, 200*time.Millisecond)}
+
+	token := p.Token
+	if token == "" && p.TokenFile != "" {
+		data, err := os.ReadFile(expandHome(p.TokenFile))
+		if err != nil {
+			return nil, fmt.Errorf("reading token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		opts = append(opts, client.WithToken(token))
+	}
+
+	if p.CAFile != "" || p.CertFile != "" {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if p.CAFile != "" {
+			pem, err := os.ReadFile(expandHome(p.CAFile))
+			if err != nil {
+				return nil, fmt.Errorf("reading CA: %w", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", p.CAFile)
+			}
+		}
+		if p.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(expandHome(p.CertFile), expandHome(p.KeyFile))
+			if err != nil {
+				return nil, fmt.Errorf("loading client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		opts = append(opts, client.WithHTTPClient(&http.Client{Transport: transport}))
+	}
+	return client.New(p.Server, opts...), nil
+}
+
+// expandHome replaces a leading ~ with the user's home directory
+func expandHome(path string) string {
+	if home, err := os.UserHomeDir(); err == nil && strings.HasPrefix(path, "~/") {
+		return filepath.Join(home, path[2:])
+	}
+	return path
+}
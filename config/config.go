@@ -0,0 +1,574 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the environment variables setting each option, e.g. CRUD_LISTEN
+const EnvPrefix = "CRUD_"
+
+// Config is the configuration of the server. Each option is loaded, in increasing order of precedence, from its default,
+// the config file, its environment variable and its command-line flag
+type Config struct {
+	Listen      string            `json:"listen" yaml:"listen"`
+	Storage     StorageConfig     `json:"storage" yaml:"storage"`
+	TLS         TLSConfig         `json:"tls" yaml:"tls"`
+	Auth        AuthConfig        `json:"auth" yaml:"auth"`
+	Limits      LimitsConfig      `json:"limits" yaml:"limits"`
+	Metrics     MetricsConfig     `json:"metrics" yaml:"metrics"`
+	Docs        DocsConfig        `json:"docs" yaml:"docs"`
+	Tracing     TracingConfig     `json:"tracing" yaml:"tracing"`
+	Log         LogConfig         `json:"log" yaml:"log"`
+	Timeouts    TimeoutsConfig    `json:"timeouts" yaml:"timeouts"`
+	Snapshots   SnapshotsConfig   `json:"snapshots" yaml:"snapshots"`
+	Retention   RetentionConfig   `json:"retention" yaml:"retention"`
+	Replication ReplicationConfig `json:"replication" yaml:"replication"`
+	Cluster     ClusterConfig     `json:"cluster" yaml:"cluster"`
+	RESP        RESPConfig        `json:"resp" yaml:"resp"`
+	GRPC        GRPCConfig        `json:"grpc" yaml:"grpc"`
+}
+
+type StorageConfig struct {
+	Backend string `json:"backend" yaml:"backend"`
+	Path    string `json:"path" yaml:"path"`
+	Shards  int    `json:"shards" yaml:"shards"`
+}
+
+type TLSConfig struct {
+	Cert              string `json:"cert" yaml:"cert"`
+	Key               string `json:"key" yaml:"key"`
+	ClientCA          string `json:"clientCA" yaml:"clientCA"`
+	ClientIdentities  string `json:"clientIdentities" yaml:"clientIdentities"`
+	RequireClientCert bool   `json:"requireClientCert" yaml:"requireClientCert"`
+}
+
+type AuthConfig struct {
+	APIKeys   string `json:"apiKeys" yaml:"apiKeys"`
+	JWTConfig string `json:"jwtConfig" yaml:"jwtConfig"`
+}
+
+type LimitsConfig struct {
+	ReadRate   float64 `json:"readRate" yaml:"readRate"`
+	ReadBurst  int     `json:"readBurst" yaml:"readBurst"`
+	WriteRate  float64 `json:"writeRate" yaml:"writeRate"`
+	WriteBurst int     `json:"writeBurst" yaml:"writeBurst"`
+	// AddressRate and AddressBurst limit each IP address before authentication, including requests which fail it
+	AddressRate  float64 `json:"addressRate" yaml:"addressRate"`
+	AddressBurst int     `json:"addressBurst" yaml:"addressBurst"`
+	Quotas       string  `json:"quotas" yaml:"quotas"`
+}
+
+type MetricsConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+}
+
+type DocsConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+}
+
+type TracingConfig struct {
+	Exporter     string `json:"exporter" yaml:"exporter"`
+	OTLPEndpoint string `json:"otlpEndpoint" yaml:"otlpEndpoint"`
+	File         string `json:"file" yaml:"file"`
+}
+
+type LogConfig struct {
+	Level  string `json:"level" yaml:"level"`
+	Format string `json:"format" yaml:"format"`
+}
+
+type TimeoutsConfig struct {
+	Read     Duration `json:"read" yaml:"read"`
+	Write    Duration `json:"write" yaml:"write"`
+	Idle     Duration `json:"idle" yaml:"idle"`
+	Shutdown Duration `json:"shutdown" yaml:"shutdown"`
+}
+
+type SnapshotsConfig struct {
+	Dir        string   `json:"dir" yaml:"dir"`
+	Interval   Duration `json:"interval" yaml:"interval"`
+	KeepHourly int      `json:"keepHourly" yaml:"keepHourly"`
+	KeepDaily  int      `json:"keepDaily" yaml:"keepDaily"`
+}
+
+type RetentionConfig struct {
+	Policies string   `json:"policies" yaml:"policies"`
+	Interval Duration `json:"interval" yaml:"interval"`
+}
+
+type ReplicationConfig struct {
+	LogSize       int    `json:"logSize" yaml:"logSize"`
+	Leader        string `json:"leader" yaml:"leader"`
+	LeaderToken   string `json:"leaderToken" yaml:"leaderToken"`
+	ForwardWrites bool   `json:"forwardWrites" yaml:"forwardWrites"`
+}
+
+type ClusterConfig struct {
+	ID                string `json:"id" yaml:"id"`
+	Members           string `json:"members" yaml:"members"`
+	Dir               string `json:"dir" yaml:"dir"`
+	Token             string `json:"token" yaml:"token"`
+	LinearizableReads bool   `json:"linearizableReads" yaml:"linearizableReads"`
+}
+
+type RESPConfig struct {
+	Listen string `json:"listen" yaml:"listen"`
+}
+
+type GRPCConfig struct {
+	Listen string `json:"listen" yaml:"listen"`
+}
+
+// ClusterMember is a member of the cluster listed in cluster.members
+type ClusterMember struct {
+	ID      string
+	Address string
+}
+
+// ParseMembers parses cluster.members, a comma-separated list of id=url
+func (c ClusterConfig) ParseMembers() ([]ClusterMember, error) {
+	var members []ClusterMember
+	for _, member := range strings.Split(c.Members, ",") {
+		if member = strings.TrimSpace(member); member == "" {
+			continue
+		}
+		id, address, ok := strings.Cut(member, "=")
+		if parsed, err := url.Parse(address); !ok || id == "" || err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid member %q: must be id=url with an http or https URL", member)
+		}
+		members = append(members, ClusterMember{ID: id, Address: address})
+	}
+	return members, nil
+}
+
+// Duration is a time.Duration written as a string such as "30s" in config files
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// Default returns the configuration used when no option is set
+func Default() Config {
+	return Config{
+		Listen:  ":9080",
+		Storage: StorageConfig{Backend: "file", Path: "data.json", Shards: 1},
+		Metrics: MetricsConfig{Enabled: true},
+		Tracing: TracingConfig{OTLPEndpoint: "http://localhost:4318", File: "traces.jsonl"},
+		Log:     LogConfig{Level: "info", Format: "json"},
+		Timeouts: TimeoutsConfig{
+			Read:     Duration(10 * time.Second),
+			Write:    Duration(30 * time.Second),
+			Idle:     Duration(2 * time.Minute),
+			Shutdown: Duration(30 * time.Second),
+		},
+		Snapshots:   SnapshotsConfig{Dir: "snapshots", KeepHourly: 24, KeepDaily: 7},
+		Retention:   RetentionConfig{Interval: Duration(time.Hour)},
+		Replication: ReplicationConfig{LogSize: 10000},
+		Cluster:     ClusterConfig{Dir: "raft"},
+	}
+}
+
+// setting is an option which can be set by a command-line flag and an environment variable
+type setting struct {
+	flag  string
+	usage string
+	field func(config *Config) interface{}
+}
+
+// env is the name of the environment variable setting the option
+func (s setting) env() string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(s.flag, "-", "_"))
+}
+
+var settings = []setting{
+	{"listen", "address to listen on", func(c *Config) interface{} { return &c.Listen }},
+	{"storage-backend", "storage backend: file, sqlite or lsm", func(c *Config) interface{} { return &c.Storage.Backend }},
+	{"data-file", "path to the data file, the database for -storage-backend=sqlite, or the directory for -storage-backend=lsm", func(c *Config) interface{} { return &c.Storage.Path }},
+	{"shards", "number of shards to partition the keys across, each stored at -data-file with its number before the extension; changed with -rebalance", func(c *Config) interface{} { return &c.Storage.Shards }},
+	{"tls-cert", "path to the PEM certificate to serve TLS with; reloaded when changed", func(c *Config) interface{} { return &c.TLS.Cert }},
+	{"tls-key", "path to the PEM private key for -tls-cert; reloaded when changed", func(c *Config) interface{} { return &c.TLS.Key }},
+	{"tls-client-ca", "path to a PEM bundle of CAs whose client certificates are verified", func(c *Config) interface{} { return &c.TLS.ClientCA }},
+	{"tls-client-identities", "path to a JSON file mapping client certificate names to grants; authentication is required when set", func(c *Config) interface{} { return &c.TLS.ClientIdentities }},
+	{"tls-require-client-cert", "reject connections without a verified client certificate", func(c *Config) interface{} { return &c.TLS.RequireClientCert }},
+	{"api-keys", "path to the API key file; authentication is required when set", func(c *Config) interface{} { return &c.Auth.APIKeys }},
+	{"jwt-config", "path to a JSON file configuring JWT validation; authentication is required when set", func(c *Config) interface{} { return &c.Auth.JWTConfig }},
+	{"read-rate", "reads per second allowed for each client; unlimited if 0", func(c *Config) interface{} { return &c.Limits.ReadRate }},
+	{"read-burst", "reads each client may burst above -read-rate", func(c *Config) interface{} { return &c.Limits.ReadBurst }},
+	{"write-rate", "writes per second allowed for each client; unlimited if 0", func(c *Config) interface{} { return &c.Limits.WriteRate }},
+	{"write-burst", "writes each client may burst above -write-rate", func(c *Config) interface{} { return &c.Limits.WriteBurst }},
+	{"address-rate", "reads and writes per second each allowed from each IP address, before authentication; unlimited if 0", func(c *Config) interface{} { return &c.Limits.AddressRate }},
+	{"address-burst", "reads and writes each IP address may burst above -address-rate", func(c *Config) interface{} { return &c.Limits.AddressBurst }},
+	{"quotas", "path to a JSON file listing storage quotas for namespaces", func(c *Config) interface{} { return &c.Limits.Quotas }},
+	{"metrics", "serve Prometheus metrics at /metrics", func(c *Config) interface{} { return &c.Metrics.Enabled }},
+	{"docs", "serve a page for browsing the OpenAPI document at /docs", func(c *Config) interface{} { return &c.Docs.Enabled }},
+	{"trace-exporter", "where to export trace spans: otlp, stdout or file; tracing is disabled if unset", func(c *Config) interface{} { return &c.Tracing.Exporter }},
+	{"otlp-endpoint", "OTLP/HTTP collector endpoint for -trace-exporter=otlp", func(c *Config) interface{} { return &c.Tracing.OTLPEndpoint }},
+	{"trace-file", "file to append spans to for -trace-exporter=file", func(c *Config) interface{} { return &c.Tracing.File }},
+	{"log-level", "minimum level of log messages: debug, info, warn or error", func(c *Config) interface{} { return &c.Log.Level }},
+	{"log-format", "format of log messages: json or text", func(c *Config) interface{} { return &c.Log.Format }},
+	{"read-timeout", "maximum duration for reading a request, including its body", func(c *Config) interface{} { return &c.Timeouts.Read }},
+	{"write-timeout", "maximum duration before timing out writes of a response", func(c *Config) interface{} { return &c.Timeouts.Write }},
+	{"idle-timeout", "maximum time to wait for the next request on a keep-alive connection", func(c *Config) interface{} { return &c.Timeouts.Idle }},
+	{"shutdown-timeout", "maximum time to wait for in-flight requests when shutting down", func(c *Config) interface{} { return &c.Timeouts.Shutdown }},
+	{"snapshot-dir", "directory to save snapshots to; /admin/snapshot is disabled if unset", func(c *Config) interface{} { return &c.Snapshots.Dir }},
+	{"snapshot-interval", "interval between scheduled snapshots; disabled if 0", func(c *Config) interface{} { return &c.Snapshots.Interval }},
+	{"snapshot-keep-hourly", "number of recent hours to keep the newest snapshot of", func(c *Config) interface{} { return &c.Snapshots.KeepHourly }},
+	{"snapshot-keep-daily", "number of recent days to keep the newest snapshot of; every snapshot is kept if this and -snapshot-keep-hourly are 0", func(c *Config) interface{} { return &c.Snapshots.KeepDaily }},
+	{"retention", "path to a JSON file listing retention policies for key prefixes and namespaces; /admin/compact is disabled if unset", func(c *Config) interface{} { return &c.Retention.Policies }},
+	{"compaction-interval", "interval between applying the retention policies; only on request if 0", func(c *Config) interface{} { return &c.Retention.Interval }},
+	{"replication-log-size", "number of recent changes held for followers to replicate; /replication is disabled if 0", func(c *Config) interface{} { return &c.Replication.LogSize }},
+	{"leader", "URL of the leader to replicate as a read-only follower", func(c *Config) interface{} { return &c.Replication.Leader }},
+	{"leader-token", "bearer token with the admin permission to replicate from -leader with", func(c *Config) interface{} { return &c.Replication.LeaderToken }},
+	{"forward-writes", "forward writes to -leader instead of rejecting them", func(c *Config) interface{} { return &c.Replication.ForwardWrites }},
+	{"cluster-id", "ID of this member of a Raft cluster; clustering is disabled if unset", func(c *Config) interface{} { return &c.Cluster.ID }},
+	{"cluster-members", "comma-separated id=url list of the members of a new cluster, including this one; empty to join an existing cluster", func(c *Config) interface{} { return &c.Cluster.Members }},
+	{"cluster-dir", "directory to persist this member's Raft log in", func(c *Config) interface{} { return &c.Cluster.Dir }},
+	{"cluster-token", "bearer token with the admin permission for calls to the other members", func(c *Config) interface{} { return &c.Cluster.Token }},
+	{"linearizable-reads", "serve reads from the leader once it has confirmed its leadership, rather than from this member", func(c *Config) interface{} { return &c.Cluster.LinearizableReads }},
+	{"resp-listen", "address to serve the Redis protocol (RESP) on; disabled if unset", func(c *Config) interface{} { return &c.RESP.Listen }},
+	{"grpc-listen", "address to serve the gRPC API on; disabled if unset", func(c *Config) interface{} { return &c.GRPC.Listen }},
+}
+
+// setField parses the specified value into the field, which is a pointer returned by setting.field
+func setField(field interface{}, value string) error {
+	switch f := field.(type) {
+	case *string:
+		*f = value
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		*f = b
+	case *int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*f = i
+	case *float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		*f = n
+	case *Duration:
+		if err := f.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+	default:
+		panic(fmt.Sprintf("unsupported setting type %T", field))
+	}
+	return nil
+}
+
+// formatField formats the field, which is a pointer returned by setting.field, as it would be set
+func formatField(field interface{}) string {
+	switch f := field.(type) {
+	case *string:
+		return *f
+	case *bool:
+		return strconv.FormatBool(*f)
+	case *int:
+		return strconv.Itoa(*f)
+	case *float64:
+		return strconv.FormatFloat(*f, 'g', -1, 64)
+	case *Duration:
+		return time.Duration(*f).String()
+	}
+	panic(fmt.Sprintf("unsupported setting type %T", field))
+}
+
+// flagValue records the value of a flag, which is only applied once the config file and environment have been loaded
+type flagValue struct {
+	setting  setting
+	defValue string
+	value    *string
+}
+
+func (v *flagValue) String() string {
+	return v.defValue
+}
+
+func (v *flagValue) Set(value string) error {
+	// Check the value now so that the error names the flag
+	if err := setField(v.setting.field(&Config{}), value); err != nil {
+		return err
+	}
+	v.value = &value
+	return nil
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	if v.setting.field == nil {
+		return false
+	}
+	_, ok := v.setting.field(&Config{}).(*bool)
+	return ok
+}
+
+// Load parses the command-line arguments using the specified flag set, to which the flags for each option are added,
+// then loads the configuration from the config file named by -config or CRUD_CONFIG, the environment and the flags
+// and validates it
+func Load(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	config := Default()
+	configFilePath := fs.String("config", "", "path to a YAML or JSON config file; also set by "+EnvPrefix+"CONFIG")
+	flagValues := make([]*flagValue, len(settings))
+	for i, s := range settings {
+		flagValues[i] = &flagValue{setting: s, defValue: formatField(s.field(&config))}
+		fs.Var(flagValues[i], s.flag, s.usage+"; also set by "+s.env())
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if *configFilePath == "" {
+		*configFilePath, _ = lookupEnv(EnvPrefix + "CONFIG")
+	}
+	if *configFilePath != "" {
+		if err := loadFile(*configFilePath, &config); err != nil {
+			return Config{}, fmt.Errorf("loading config file %s: %w", *configFilePath, err)
+		}
+	}
+
+	for _, v := range flagValues {
+		if value, ok := lookupEnv(v.setting.env()); ok {
+			if err := setField(v.setting.field(&config), value); err != nil {
+				return Config{}, fmt.Errorf("%s: %w", v.setting.env(), err)
+			}
+		}
+	}
+	for _, v := range flagValues {
+		if v.value != nil {
+			// Already checked by Set
+			setField(v.setting.field(&config), *v.value)
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// loadFile reads the config file at the specified path into config, as YAML unless its extension is .json
+func loadFile(filePath string, config *Config) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(filePath), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(config)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// Validate checks that every option is valid, returning an error describing each which is not
+func (config Config) Validate() error {
+	var errs []error
+	invalid := func(option, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", option, fmt.Sprintf(format, args...)))
+	}
+
+	validateAddress := func(field, address string) {
+		if _, port, err := net.SplitHostPort(address); err != nil {
+			invalid(field, "invalid address %q: %v", address, err)
+		} else if n, err := strconv.Atoi(port); port != "" && (err != nil || n < 0 || n > 65535) {
+			invalid(field, "invalid port %q", port)
+		}
+	}
+	validateAddress("listen", config.Listen)
+
+	if config.Storage.Backend != "file" && config.Storage.Backend != "sqlite" && config.Storage.Backend != "lsm" {
+		invalid("storage.backend", "unknown backend %q: must be file, sqlite or lsm", config.Storage.Backend)
+	}
+	if config.Storage.Path == "" {
+		invalid("storage.path", "required")
+	}
+	if config.Storage.Shards < 1 {
+		invalid("storage.shards", "must be at least 1")
+	}
+
+	if config.TLS.Cert != "" && config.TLS.Key == "" {
+		invalid("tls.key", "required when tls.cert is set")
+	}
+	if config.TLS.Key != "" && config.TLS.Cert == "" {
+		invalid("tls.cert", "required when tls.key is set")
+	}
+	if config.TLS.ClientCA != "" && config.TLS.Cert == "" {
+		invalid("tls.clientCA", "requires tls.cert to be set")
+	}
+	if config.TLS.ClientIdentities != "" && config.TLS.ClientCA == "" {
+		invalid("tls.clientIdentities", "requires tls.clientCA to be set")
+	}
+	if config.TLS.RequireClientCert && config.TLS.ClientCA == "" {
+		invalid("tls.requireClientCert", "requires tls.clientCA to be set")
+	}
+
+	for _, limit := range []struct {
+		name  string
+		rate  float64
+		burst int
+	}{
+		{"read", config.Limits.ReadRate, config.Limits.ReadBurst},
+		{"write", config.Limits.WriteRate, config.Limits.WriteBurst},
+		{"address", config.Limits.AddressRate, config.Limits.AddressBurst},
+	} {
+		if limit.rate < 0 {
+			invalid("limits."+limit.name+"Rate", "must not be negative")
+		}
+		if limit.burst < 0 {
+			invalid("limits."+limit.name+"Burst", "must not be negative")
+		}
+		if limit.rate > 0 && limit.burst == 0 {
+			invalid("limits."+limit.name+"Burst", "must be at least 1 when limits.%sRate is set", limit.name)
+		}
+	}
+
+	switch config.Tracing.Exporter {
+	case "", "stdout":
+	case "otlp":
+		if config.Tracing.OTLPEndpoint == "" {
+			invalid("tracing.otlpEndpoint", "required when tracing.exporter is otlp")
+		}
+	case "file":
+		if config.Tracing.File == "" {
+			invalid("tracing.file", "required when tracing.exporter is file")
+		}
+	default:
+		invalid("tracing.exporter", "unknown exporter %q: must be otlp, stdout or file", config.Tracing.Exporter)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Log.Level)); err != nil {
+		invalid("log.level", "unknown level %q: must be debug, info, warn or error", config.Log.Level)
+	}
+	if config.Log.Format != "json" && config.Log.Format != "text" {
+		invalid("log.format", "unknown format %q: must be json or text", config.Log.Format)
+	}
+
+	for _, timeout := range []struct {
+		name     string
+		duration Duration
+	}{
+		{"read", config.Timeouts.Read},
+		{"write", config.Timeouts.Write},
+		{"idle", config.Timeouts.Idle},
+	} {
+		if timeout.duration < 0 {
+			invalid("timeouts."+timeout.name, "must not be negative")
+		}
+	}
+	if config.Timeouts.Shutdown <= 0 {
+		invalid("timeouts.shutdown", "must be positive")
+	}
+
+	if config.Snapshots.Interval < 0 {
+		invalid("snapshots.interval", "must not be negative")
+	}
+	if config.Snapshots.Interval > 0 && config.Snapshots.Dir == "" {
+		invalid("snapshots.dir", "required when snapshots.interval is set")
+	}
+	if config.Snapshots.KeepHourly < 0 {
+		invalid("snapshots.keepHourly", "must not be negative")
+	}
+	if config.Snapshots.KeepDaily < 0 {
+		invalid("snapshots.keepDaily", "must not be negative")
+	}
+
+	if config.Retention.Interval < 0 {
+		invalid("retention.interval", "must not be negative")
+	}
+
+	if config.Replication.LogSize < 0 {
+		invalid("replication.logSize", "must not be negative")
+	}
+	if config.Replication.Leader != "" {
+		if leader, err := url.Parse(config.Replication.Leader); err != nil || (leader.Scheme != "http" && leader.Scheme != "https") || leader.Host == "" {
+			invalid("replication.leader", "invalid URL %q: must be an http or https URL", config.Replication.Leader)
+		}
+	}
+	if config.Replication.ForwardWrites && config.Replication.Leader == "" {
+		invalid("replication.forwardWrites", "requires replication.leader to be set")
+	}
+
+	if config.Cluster.ID != "" {
+		members, err := config.Cluster.ParseMembers()
+		if err != nil {
+			invalid("cluster.members", "%v", err)
+		} else if len(members) > 0 && !slices.ContainsFunc(members, func(member ClusterMember) bool { return member.ID == config.Cluster.ID }) {
+			invalid("cluster.members", "must include cluster.id %q", config.Cluster.ID)
+		}
+		if config.Cluster.Dir == "" {
+			invalid("cluster.dir", "required when cluster.id is set")
+		}
+		if config.Replication.Leader != "" {
+			invalid("cluster.id", "cannot be set with replication.leader")
+		}
+	} else if config.Cluster.Members != "" || config.Cluster.LinearizableReads {
+		invalid("cluster.id", "required when cluster.members or cluster.linearizableReads is set")
+	}
+
+	if config.RESP.Listen != "" {
+		validateAddress("resp.listen", config.RESP.Listen)
+	}
+	if config.GRPC.Listen != "" {
+		validateAddress("grpc.listen", config.GRPC.Listen)
+	}
+
+	return errors.Join(errs...)
+}
+
+// redacted replaces the value of a secret in the configuration written by Write
+const redacted = "REDACTED"
+
+// Write writes the configuration to w as YAML, in the format read from a config file, with secrets such as tokens
+// replaced by REDACTED
+func (config Config) Write(w io.Writer) error {
+	// config is a copy, so redacting it leaves the caller's configuration intact
+	if config.Replication.LeaderToken != "" {
+		config.Replication.LeaderToken = redacted
+	}
+	if config.Cluster.Token != "" {
+		config.Cluster.Token = redacted
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(config); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
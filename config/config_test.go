@@ -0,0 +1,184 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// load loads the configuration from the specified arguments and environment
+func load(args []string, env map[string]string) (Config, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return Load(fs, args, func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	})
+}
+
+func writeFile(t *testing.T, name, data string) string {
+	filePath := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(filePath, []byte(data), 0644))
+	return filePath
+}
+
+func TestDefault(t *testing.T) {
+	config, err := load(nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), config)
+	assert.Equal(t, ":9080", config.Listen)
+	assert.Equal(t, "data.json", config.Storage.Path)
+}
+
+func TestPrecedence(t *testing.T) {
+	configFilePath := writeFile(t, "config.yaml", `
+listen: ":8000"
+storage:
+  path: file.json
+limits:
+  readRate: 10
+  readBurst: 5
+log:
+  level: debug
+timeouts:
+  shutdown: 1m
+`)
+	env := map[string]string{
+		"CRUD_CONFIG":    configFilePath,
+		"CRUD_LISTEN":    ":8001",
+		"CRUD_DATA_FILE": "env.json",
+		"CRUD_METRICS":   "false",
+	}
+	config, err := load([]string{"-data-file", "flag.json", "-read-timeout=5s"}, env)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Flags override the environment, which overrides the file, which overrides the defaults
+	assert.Equal(t, "flag.json", config.Storage.Path)
+	assert.Equal(t, ":8001", config.Listen)
+	assert.False(t, config.Metrics.Enabled)
+	assert.Equal(t, 10.0, config.Limits.ReadRate)
+	assert.Equal(t, 5, config.Limits.ReadBurst)
+	assert.Equal(t, "debug", config.Log.Level)
+	assert.Equal(t, Duration(time.Minute), config.Timeouts.Shutdown)
+	assert.Equal(t, Duration(5*time.Second), config.Timeouts.Read)
+	assert.Equal(t, "json", config.Log.Format)
+
+	// The -config flag overrides CRUD_CONFIG
+	jsonFilePath := writeFile(t, "config.json", `{"listen": ":8002", "timeouts": {"idle": "90s"}}`)
+	config, err = load([]string{"-config", jsonFilePath}, map[string]string{"CRUD_CONFIG": configFilePath})
+	if assert.NoError(t, err) {
+		assert.Equal(t, ":8002", config.Listen)
+		assert.Equal(t, Duration(90*time.Second), config.Timeouts.Idle)
+		assert.Equal(t, "data.json", config.Storage.Path)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	_, err := load([]string{"-read-rate", "fast"}, nil)
+	assert.ErrorContains(t, err, `invalid value "fast" for flag -read-rate: invalid number "fast"`)
+
+	_, err = load(nil, map[string]string{"CRUD_SHUTDOWN_TIMEOUT": "soon"})
+	assert.EqualError(t, err, `CRUD_SHUTDOWN_TIMEOUT: invalid duration "soon"`)
+
+	_, err = load([]string{"-config", writeFile(t, "config.yaml", "listen: :80\nport: 80\n")}, nil)
+	assert.ErrorContains(t, err, "field port not found")
+
+	_, err = load([]string{"-config", writeFile(t, "config.json", `{"listn": ":80"}`)}, nil)
+	assert.ErrorContains(t, err, `unknown field "listn"`)
+
+	_, err = load([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, nil)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestValidate(t *testing.T) {
+	_, err := load([]string{
+		"-listen", "9080",
+		"-storage-backend", "memory",
+		"-shards", "0",
+		"-tls-key", "key.pem",
+		"-tls-require-client-cert",
+		"-write-rate", "5",
+		"-address-rate", "5",
+		"-trace-exporter", "jaeger",
+		"-log-level", "verbose",
+		"-shutdown-timeout", "0s",
+		"-snapshot-dir", "",
+		"-snapshot-interval", "1h",
+		"-snapshot-keep-daily", "-1",
+		"-compaction-interval", "-1h",
+		"-replication-log-size", "-1",
+		"-leader", "leader:9080",
+		"-cluster-id", "b",
+		"-cluster-members", "a=http://a:9080,b",
+		"-resp-listen", ":redis",
+		"-grpc-listen", "grpc",
+	}, nil)
+	assert.EqualError(t, err, `listen: invalid address "9080": address 9080: missing port in address
+storage.backend: unknown backend "memory": must be file, sqlite or lsm
+storage.shards: must be at least 1
+tls.cert: required when tls.key is set
+tls.requireClientCert: requires tls.clientCA to be set
+limits.writeBurst: must be at least 1 when limits.writeRate is set
+limits.addressBurst: must be at least 1 when limits.addressRate is set
+tracing.exporter: unknown exporter "jaeger": must be otlp, stdout or file
+log.level: unknown level "verbose": must be debug, info, warn or error
+timeouts.shutdown: must be positive
+snapshots.dir: required when snapshots.interval is set
+snapshots.keepDaily: must not be negative
+retention.interval: must not be negative
+replication.logSize: must not be negative
+replication.leader: invalid URL "leader:9080": must be an http or https URL
+cluster.members: invalid member "b": must be id=url with an http or https URL
+cluster.id: cannot be set with replication.leader
+resp.listen: invalid port "redis"
+grpc.listen: invalid address "grpc": address grpc: missing port in address`)
+}
+
+func TestWrite(t *testing.T) {
+	config, err := load([]string{"-listen", "127.0.0.1:8080", "-trace-exporter", "stdout", "-idle-timeout", "1m30s"}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, config.Write(&buf))
+	assert.Contains(t, buf.String(), "idle: 1m30s\n")
+
+	// The printed configuration can be loaded as a config file
+	reloaded, err := load([]string{"-config", writeFile(t, "config.yaml", buf.String())}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, config, reloaded)
+
+	// Secrets are redacted
+	config, err = load([]string{"-leader", "http://leader:9080", "-leader-token", "s3cret", "-cluster-token", "tok"}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf.Reset()
+	assert.NoError(t, config.Write(&buf))
+	assert.NotContains(t, buf.String(), "s3cret")
+	assert.NotContains(t, buf.String(), "tok\n")
+	assert.Contains(t, buf.String(), "leaderToken: REDACTED\n")
+	assert.Contains(t, buf.String(), "token: REDACTED\n")
+	assert.Equal(t, "s3cret", config.Replication.LeaderToken)
+	assert.Equal(t, "tok", config.Cluster.Token)
+}
+
+func TestParseMembers(t *testing.T) {
+	members, err := ClusterConfig{Members: "a=http://a:9080, b=https://b:9443,"}.ParseMembers()
+	assert.NoError(t, err)
+	assert.Equal(t, []ClusterMember{{ID: "a", Address: "http://a:9080"}, {ID: "b", Address: "https://b:9443"}}, members)
+
+	_, err = ClusterConfig{Members: "=http://a:9080"}.ParseMembers()
+	assert.EqualError(t, err, `invalid member "=http://a:9080": must be id=url with an http or https URL`)
+	_, err = load([]string{"-cluster-id", "c", "-cluster-members", "a=http://a:9080"}, nil)
+	assert.EqualError(t, err, `cluster.members: must include cluster.id "c"`)
+	_, err = load([]string{"-linearizable-reads"}, nil)
+	assert.EqualError(t, err, "cluster.id: required when cluster.members or cluster.linearizableReads is set")
+}
@@ -0,0 +1,61 @@
+// Package crudpb holds the messages and service of the gRPC API, generated from crud.proto, and the error reasons and
+// helpers shared by its server and clients
+package crudpb
+
+import (
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative crud.proto
+
+// ErrorDomain is the domain of the google.rpc.ErrorInfo carried by the API's errors
+const ErrorDomain = "simple-crud-rest-server"
+
+// Reasons of the google.rpc.ErrorInfo carried by the API's errors, as described in crud.proto
+const (
+	ReasonKeyNotFound     = "KEY_NOT_FOUND"
+	ReasonKeyDeleted      = "KEY_DELETED"
+	ReasonKeyExists       = "KEY_EXISTS"
+	ReasonQuotaExceeded   = "QUOTA_EXCEEDED"
+	ReasonValueTooLarge   = "VALUE_TOO_LARGE"
+	ReasonRateLimited     = "RATE_LIMITED"
+	ReasonInvalidKey      = "INVALID_KEY"
+	ReasonInvalidValue    = "INVALID_VALUE"
+	ReasonUnauthenticated = "UNAUTHENTICATED"
+	ReasonForbidden       = "FORBIDDEN"
+	ReasonReadOnly        = "READ_ONLY"
+	ReasonNotReady        = "NOT_READY"
+	ReasonNoLeader        = "NO_LEADER"
+	ReasonWatchDropped    = "WATCH_DROPPED"
+)
+
+// Error returns an error with the specified status code and message, carrying an ErrorInfo with the specified reason
+func Error(code codes.Code, reason, message string) error {
+	st, err := status.New(code, message).WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: ErrorDomain})
+	if err != nil {
+		return status.Error(code, message)
+	}
+	return st.Err()
+}
+
+// Reason returns the reason of the ErrorInfo carried by an error of the API, or an empty string if it has none
+func Reason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Domain == ErrorDomain {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+// Writes reports whether the method of the Crud service with the specified full name, such as "/crud.v1.Crud/Get",
+// modifies the data
+func Writes(fullMethod string) bool {
+	switch fullMethod {
+	case Crud_Create_FullMethodName, Crud_Update_FullMethodName, Crud_Delete_FullMethodName:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,409 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.27.1
+// source: crud.proto
+
+package crudpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Crud_Get_FullMethodName     = "/crud.v1.Crud/Get"
+	Crud_Create_FullMethodName  = "/crud.v1.Crud/Create"
+	Crud_Update_FullMethodName  = "/crud.v1.Crud/Update"
+	Crud_Delete_FullMethodName  = "/crud.v1.Crud/Delete"
+	Crud_History_FullMethodName = "/crud.v1.Crud/History"
+	Crud_List_FullMethodName    = "/crud.v1.Crud/List"
+	Crud_Watch_FullMethodName   = "/crud.v1.Crud/Watch"
+)
+
+// CrudClient is the client API for Crud service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// The key-value API served over gRPC alongside the HTTP API, with the same semantics: every change is an event in the
+// key's history, and a key which has been deleted keeps its history and can be created again.
+//
+// Errors are reported with the status codes below. Each also carries a google.rpc.ErrorInfo in the domain
+// "simple-crud-rest-server" whose reason distinguishes errors which share a code:
+//
+//	NOT_FOUND           KEY_NOT_FOUND    the key has never existed
+//	FAILED_PRECONDITION KEY_DELETED      the key has been deleted
+//	ALREADY_EXISTS      KEY_EXISTS       the key already has a value
+//	RESOURCE_EXHAUSTED  QUOTA_EXCEEDED   the storage quota of the key's namespace has been exceeded
+//	RESOURCE_EXHAUSTED  VALUE_TOO_LARGE  the value is larger than the storage quota of the key's namespace
+//	RESOURCE_EXHAUSTED  RATE_LIMITED     the caller has used its request budget
+//	INVALID_ARGUMENT    INVALID_KEY      the key is empty or contains '/'
+//	INVALID_ARGUMENT    INVALID_VALUE    the value is empty
+//	UNAUTHENTICATED     UNAUTHENTICATED  the call could not be authenticated
+//	PERMISSION_DENIED   FORBIDDEN        the caller does not have permission for the key
+//	FAILED_PRECONDITION READ_ONLY        the server is a read-only follower, and writes must be sent to the leader
+//	UNAVAILABLE         NOT_READY        the server has not yet initialised its data store
+//	UNAVAILABLE         NO_LEADER        the server is a member of a cluster which has no leader, or is not the leader
+type CrudClient interface {
+	// Get returns the current value of a key
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// Create sets the value of a key which does not exist or has been deleted
+	Create(ctx context.Context, in *CreateRequest, opts ...grpc.CallOption) (*CreateResponse, error)
+	// Update sets the value of a key which has a current value
+	Update(ctx context.Context, in *UpdateRequest, opts ...grpc.CallOption) (*UpdateResponse, error)
+	// Delete removes the current value of a key, leaving its history
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// History returns every event of a key, oldest first
+	History(ctx context.Context, in *HistoryRequest, opts ...grpc.CallOption) (*HistoryResponse, error)
+	// List returns the keys with a current value and a prefix which the caller may read, in order
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	// Watch streams the events of keys with a prefix which the caller may read, as they are written, until the call is
+	// cancelled. A watcher which cannot keep up has its stream ended, and should call Watch again
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[WatchResponse], error)
+}
+
+type crudClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCrudClient(cc grpc.ClientConnInterface) CrudClient {
+	return &crudClient{cc}
+}
+
+func (c *crudClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, Crud_Get_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *crudClient) Create(ctx context.Context, in *CreateRequest, opts ...grpc.CallOption) (*CreateResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CreateResponse)
+	err := c.cc.Invoke(ctx, Crud_Create_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *crudClient) Update(ctx context.Context, in *UpdateRequest, opts ...grpc.CallOption) (*UpdateResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(UpdateResponse)
+	err := c.cc.Invoke(ctx, Crud_Update_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *crudClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, Crud_Delete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *crudClient) History(ctx context.Context, in *HistoryRequest, opts ...grpc.CallOption) (*HistoryResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HistoryResponse)
+	err := c.cc.Invoke(ctx, Crud_History_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *crudClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, Crud_List_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *crudClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[WatchResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Crud_ServiceDesc.Streams[0], Crud_Watch_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchRequest, WatchResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Crud_WatchClient = grpc.ServerStreamingClient[WatchResponse]
+
+// CrudServer is the server API for Crud service.
+// All implementations must embed UnimplementedCrudServer
+// for forward compatibility.
+//
+// The key-value API served over gRPC alongside the HTTP API, with the same semantics: every change is an event in the
+// key's history, and a key which has been deleted keeps its history and can be created again.
+//
+// Errors are reported with the status codes below. Each also carries a google.rpc.ErrorInfo in the domain
+// "simple-crud-rest-server" whose reason distinguishes errors which share a code:
+//
+//	NOT_FOUND           KEY_NOT_FOUND    the key has never existed
+//	FAILED_PRECONDITION KEY_DELETED      the key has been deleted
+//	ALREADY_EXISTS      KEY_EXISTS       the key already has a value
+//	RESOURCE_EXHAUSTED  QUOTA_EXCEEDED   the storage quota of the key's namespace has been exceeded
+//	RESOURCE_EXHAUSTED  VALUE_TOO_LARGE  the value is larger than the storage quota of the key's namespace
+//	RESOURCE_EXHAUSTED  RATE_LIMITED     the caller has used its request budget
+//	INVALID_ARGUMENT    INVALID_KEY      the key is empty or contains '/'
+//	INVALID_ARGUMENT    INVALID_VALUE    the value is empty
+//	UNAUTHENTICATED     UNAUTHENTICATED  the call could not be authenticated
+//	PERMISSION_DENIED   FORBIDDEN        the caller does not have permission for the key
+//	FAILED_PRECONDITION READ_ONLY        the server is a read-only follower, and writes must be sent to the leader
+//	UNAVAILABLE         NOT_READY        the server has not yet initialised its data store
+//	UNAVAILABLE         NO_LEADER        the server is a member of a cluster which has no leader, or is not the leader
+type CrudServer interface {
+	// Get returns the current value of a key
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// Create sets the value of a key which does not exist or has been deleted
+	Create(context.Context, *CreateRequest) (*CreateResponse, error)
+	// Update sets the value of a key which has a current value
+	Update(context.Context, *UpdateRequest) (*UpdateResponse, error)
+	// Delete removes the current value of a key, leaving its history
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// History returns every event of a key, oldest first
+	History(context.Context, *HistoryRequest) (*HistoryResponse, error)
+	// List returns the keys with a current value and a prefix which the caller may read, in order
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	// Watch streams the events of keys with a prefix which the caller may read, as they are written, until the call is
+	// cancelled. A watcher which cannot keep up has its stream ended, and should call Watch again
+	Watch(*WatchRequest, grpc.ServerStreamingServer[WatchResponse]) error
+	mustEmbedUnimplementedCrudServer()
+}
+
+// UnimplementedCrudServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedCrudServer struct{}
+
+func (UnimplementedCrudServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedCrudServer) Create(context.Context, *CreateRequest) (*CreateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Create not implemented")
+}
+func (UnimplementedCrudServer) Update(context.Context, *UpdateRequest) (*UpdateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Update not implemented")
+}
+func (UnimplementedCrudServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedCrudServer) History(context.Context, *HistoryRequest) (*HistoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method History not implemented")
+}
+func (UnimplementedCrudServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedCrudServer) Watch(*WatchRequest, grpc.ServerStreamingServer[WatchResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedCrudServer) mustEmbedUnimplementedCrudServer() {}
+func (UnimplementedCrudServer) testEmbeddedByValue()              {}
+
+// UnsafeCrudServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CrudServer will
+// result in compilation errors.
+type UnsafeCrudServer interface {
+	mustEmbedUnimplementedCrudServer()
+}
+
+func RegisterCrudServer(s grpc.ServiceRegistrar, srv CrudServer) {
+	// If the following call pancis, it indicates UnimplementedCrudServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Crud_ServiceDesc, srv)
+}
+
+func _Crud_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CrudServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Crud_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CrudServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Crud_Create_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CrudServer).Create(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Crud_Create_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CrudServer).Create(ctx, req.(*CreateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Crud_Update_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CrudServer).Update(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Crud_Update_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CrudServer).Update(ctx, req.(*UpdateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Crud_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CrudServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Crud_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CrudServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Crud_History_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CrudServer).History(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Crud_History_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CrudServer).History(ctx, req.(*HistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Crud_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CrudServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Crud_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CrudServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Crud_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CrudServer).Watch(m, &grpc.GenericServerStream[WatchRequest, WatchResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Crud_WatchServer = grpc.ServerStreamingServer[WatchResponse]
+
+// Crud_ServiceDesc is the grpc.ServiceDesc for Crud service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Crud_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "crud.v1.Crud",
+	HandlerType: (*CrudServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _Crud_Get_Handler,
+		},
+		{
+			MethodName: "Create",
+			Handler:    _Crud_Create_Handler,
+		},
+		{
+			MethodName: "Update",
+			Handler:    _Crud_Update_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _Crud_Delete_Handler,
+		},
+		{
+			MethodName: "History",
+			Handler:    _Crud_History_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _Crud_List_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _Crud_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "crud.proto",
+}
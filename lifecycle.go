@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serve runs srv on the listener until ctx is cancelled, then stops accepting connections and waits up to
+// shutdownTimeout for in-flight requests to complete before running each cleanup function in order
+func serve(ctx context.Context, srv *http.Server, listener net.Listener, shutdownTimeout time.Duration, cleanups ...func(context.Context) error) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// The certificate is served by TLSConfig.GetCertificate so that it can be reloaded
+			serveErr <- srv.ServeTLS(listener, "", "")
+		} else {
+			serveErr <- srv.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		// The server failed rather than being asked to stop
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down", "timeout", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var errs []error
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		errs = append(errs, err)
+	}
+	for _, cleanup := range cleanups {
+		if err := cleanup(shutdownCtx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io"
+	"its-dave/simple-crud-rest-server/repository"
+	"its-dave/simple-crud-rest-server/server"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	dataFilePath := filepath.Join(t.TempDir(), "data.json")
+	assert.NoError(t, os.WriteFile(dataFilePath, []byte(`{}`), 0644))
+	repo := repository.Repo{}
+	repo.SetDataFilePath(dataFilePath)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	srv := &http.Server{Handler: server.Create(&repo)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cleanedUp := false
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, srv, listener, 5*time.Second, func(context.Context) error {
+			cleanedUp = true
+			return nil
+		})
+	}()
+
+	// Start a request whose body is still being sent when shutdown begins
+	body, bodyWriter := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, "http://"+listener.Addr().String()+"/api", body)
+	req.Header.Set("Content-Type", "application/json")
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		responses <- resp
+	}()
+	bodyWriter.Write([]byte(`{"key1":`))
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	bodyWriter.Write([]byte(`"value1"}`))
+	bodyWriter.Close()
+
+	resp := <-responses
+	if assert.NotNil(t, resp) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+	assert.NoError(t, <-served)
+	assert.True(t, cleanedUp)
+
+	data, err := os.ReadFile(dataFilePath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "value1")
+
+	// New connections are refused once the server has stopped
+	_, err = net.DialTimeout("tcp", listener.Addr().String(), time.Second)
+	assert.Error(t, err)
+}
@@ -0,0 +1,80 @@
+package lsm
+
+import "bytes"
+
+// iterator yields records in order of key
+type iterator interface {
+	// next returns the next key and its write, or false when there are none left
+	next() ([]byte, entry, bool, error)
+}
+
+// mergeIterator yields the records of several iterators in order of key. Where more than one holds a key, the write
+// from the first of them is yielded, so iterators must be ordered newest first
+type mergeIterator struct {
+	iterators []iterator
+	heads     []head
+	started   bool
+}
+
+// head is the next record of an iterator
+type head struct {
+	key   []byte
+	entry entry
+	ok    bool
+}
+
+func (m *mergeIterator) next() ([]byte, entry, bool, error) {
+	if !m.started {
+		m.started = true
+		m.heads = make([]head, len(m.iterators))
+		for i := range m.iterators {
+			if err := m.advance(i); err != nil {
+				return nil, entry{}, false, err
+			}
+		}
+	}
+
+	smallest := -1
+	for i, h := range m.heads {
+		if h.ok && (smallest < 0 || bytes.Compare(h.key, m.heads[smallest].key) < 0) {
+			smallest = i
+		}
+	}
+	if smallest < 0 {
+		return nil, entry{}, false, nil
+	}
+	key, e := m.heads[smallest].key, m.heads[smallest].entry
+	// Older writes of the same key are skipped
+	for i, h := range m.heads {
+		if h.ok && bytes.Equal(h.key, key) {
+			if err := m.advance(i); err != nil {
+				return nil, entry{}, false, err
+			}
+		}
+	}
+	return key, e, true, nil
+}
+
+// advance reads the next record of the iterator with the specified index
+func (m *mergeIterator) advance(i int) error {
+	key, e, ok, err := m.iterators[i].next()
+	if err != nil {
+		return err
+	}
+	m.heads[i] = head{key: key, entry: e, ok: ok}
+	return nil
+}
+
+// merge calls fn with each record of the merged iterators until there are none left or fn returns false
+func merge(iterators []iterator, fn func(key []byte, e entry) (bool, error)) error {
+	it := &mergeIterator{iterators: iterators}
+	for {
+		key, e, ok, err := it.next()
+		if err != nil || !ok {
+			return err
+		}
+		if more, err := fn(key, e); err != nil || !more {
+			return err
+		}
+	}
+}
@@ -0,0 +1,334 @@
+// Package lsm is an embedded ordered key-value store: a log-structured merge tree in which writes are appended to a
+// write-ahead log and held in memory, then flushed to immutable sorted table files which are merged by compaction as
+// they accumulate
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	walFileName     = "wal.log"
+	tableFileSuffix = ".sst"
+)
+
+var (
+	// ErrClosed is returned by operations on a closed DB
+	ErrClosed = errors.New("lsm: database is closed")
+	// ErrCorrupt is returned when a table file fails verification
+	ErrCorrupt = errors.New("lsm: table is corrupt")
+)
+
+// Options configures a DB
+type Options struct {
+	// MemtableSize is the size in bytes of the writes held in memory before they are flushed to a table file
+	MemtableSize int
+	// MaxTables is the number of table files above which they are compacted into one
+	MaxTables int
+}
+
+// DefaultOptions are the options used by Open when none are set
+var DefaultOptions = Options{MemtableSize: 4 << 20, MaxTables: 4}
+
+// DB is an embedded key-value store in a directory. It is safe for concurrent use
+type DB struct {
+	dir  string
+	opts Options
+
+	mu sync.RWMutex
+	// wal holds the writes in mem, so that they survive a restart before they are flushed
+	wal *wal
+	mem *memtable
+	// tables are the table files, newest first, so that a key's newest record is found first
+	tables []*table
+	// nextTable is the number of the next table file to write
+	nextTable int
+	// flushErr is the error from the last failed flush, which is retried on the next write
+	flushErr error
+	closed   bool
+}
+
+// Open opens the DB in the specified directory, creating it if it does not exist, and replays the writes which had
+// not been flushed when it was last closed. Zero options are taken from DefaultOptions
+func Open(dir string, opts Options) (*DB, error) {
+	if opts.MemtableSize <= 0 {
+		opts.MemtableSize = DefaultOptions.MemtableSize
+	}
+	if opts.MaxTables <= 0 {
+		opts.MaxTables = DefaultOptions.MaxTables
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	db := &DB{dir: dir, opts: opts, mem: newMemtable(), nextTable: 1}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var numbers []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// Left by a flush or compaction which did not finish
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, tableFileSuffix) {
+			continue
+		}
+		number, err := strconv.Atoi(strings.TrimSuffix(name, tableFileSuffix))
+		if err != nil {
+			continue
+		}
+		numbers = append(numbers, number)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(numbers)))
+	for _, number := range numbers {
+		t, err := openTable(db.tablePath(number))
+		if err != nil {
+			db.closeTables()
+			return nil, fmt.Errorf("opening table %d: %w", number, err)
+		}
+		db.tables = append(db.tables, t)
+		db.nextTable = max(db.nextTable, number+1)
+	}
+
+	db.wal, err = openWAL(filepath.Join(dir, walFileName), func(batch *Batch) {
+		db.mem.apply(batch)
+	})
+	if err != nil {
+		db.closeTables()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Close closes the DB. Writes which have not been flushed are replayed from the write-ahead log when it is reopened
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	return errors.Join(db.wal.close(), db.closeTables())
+}
+
+// Get returns the value of the specified key, and whether it exists
+func (db *DB) Get(key []byte) ([]byte, bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, false, ErrClosed
+	}
+	if e, ok := db.mem.get(key); ok {
+		return e.value, !e.deleted, nil
+	}
+	for _, t := range db.tables {
+		e, ok, err := t.get(key)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return e.value, !e.deleted, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// Scan calls fn with each key with the specified prefix, and its value, in order of key. Writes wait until the scan
+// has finished, so fn must not write to the DB
+func (db *DB) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	iterators := []iterator{db.mem.iterator(prefix)}
+	for _, t := range db.tables {
+		iterators = append(iterators, t.iterator(prefix))
+	}
+	return merge(iterators, func(key []byte, e entry) (bool, error) {
+		if !bytes.HasPrefix(key, prefix) {
+			return false, nil
+		}
+		if e.deleted {
+			return true, nil
+		}
+		return true, fn(key, e.value)
+	})
+}
+
+// Apply writes every operation of the batch atomically: after a restart either all or none of them have been made.
+// The batch is durable once Apply returns
+func (db *DB) Apply(batch *Batch) error {
+	if len(batch.ops) == 0 {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if err := db.wal.append(batch); err != nil {
+		return err
+	}
+	db.mem.apply(batch)
+	if db.mem.size >= db.opts.MemtableSize {
+		// The batch is already durable in the log, so a failed flush is only reported by Check and retried later
+		db.flushErr = db.flush()
+	}
+	return nil
+}
+
+// Check reports whether the DB is usable: that it is open, and that the last flush of writes held in memory to a
+// table file did not fail
+func (db *DB) Check() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if db.flushErr != nil {
+		return fmt.Errorf("flushing to a table file: %w", db.flushErr)
+	}
+	return db.wal.check()
+}
+
+// Size returns the total size in bytes of the write-ahead log and table files
+func (db *DB) Size() (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return 0, ErrClosed
+	}
+	size, err := db.wal.size()
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range db.tables {
+		size += t.size
+	}
+	return size, nil
+}
+
+// Verify checks every table file against its checksum, returning ErrCorrupt if any does not match
+func (db *DB) Verify() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	var errs []error
+	for _, t := range db.tables {
+		if err := t.verify(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", filepath.Base(t.path), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Flush writes the writes held in memory to a table file and compacts the table files if there are too many
+func (db *DB) Flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.flushErr = db.flush()
+	return db.flushErr
+}
+
+// flush writes mem to a new table file, then empties it and the write-ahead log. Deletions are written too, as older
+// tables may hold values for the keys
+func (db *DB) flush() error {
+	if len(db.mem.keys) > 0 {
+		t, err := writeTable(db.tablePath(db.nextTable), db.mem.iterator(nil), false)
+		if err != nil {
+			return err
+		}
+		db.nextTable++
+		db.tables = append([]*table{t}, db.tables...)
+		db.mem = newMemtable()
+		if err := db.wal.reset(); err != nil {
+			return err
+		}
+	}
+	if len(db.tables) > db.opts.MaxTables {
+		return db.compact()
+	}
+	return nil
+}
+
+// compact merges every table file into one, leaving out deleted keys as there are no older tables left to hold
+// their values
+func (db *DB) compact() error {
+	var iterators []iterator
+	for _, t := range db.tables {
+		iterators = append(iterators, t.iterator(nil))
+	}
+	merged, err := writeTable(db.tablePath(db.nextTable), &mergeIterator{iterators: iterators}, true)
+	if err != nil {
+		return err
+	}
+	db.nextTable++
+
+	// Remove the oldest tables first, so that if this is interrupted a deletion in a remaining table still hides the
+	// values in the tables it was newer than
+	old := db.tables
+	db.tables = []*table{merged}
+	var errs []error
+	for i := len(old) - 1; i >= 0; i-- {
+		errs = append(errs, old[i].close(), os.Remove(old[i].path))
+	}
+	return errors.Join(errs...)
+}
+
+// tablePath returns the path of the table file with the specified number
+func (db *DB) tablePath(number int) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%06d%s", number, tableFileSuffix))
+}
+
+// closeTables closes every table file
+func (db *DB) closeTables() error {
+	var errs []error
+	for _, t := range db.tables {
+		errs = append(errs, t.close())
+	}
+	return errors.Join(errs...)
+}
+
+// Batch is a list of writes which Apply makes atomically
+type Batch struct {
+	ops []op
+}
+
+type op struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// Put sets the key to the value
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, op{key: bytes.Clone(key), value: bytes.Clone(value)})
+}
+
+// Delete removes the key
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, op{key: bytes.Clone(key), delete: true})
+}
+
+// Len returns the number of writes in the batch
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
@@ -0,0 +1,190 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestDB(t *testing.T, dir string, opts Options) *DB {
+	db, err := Open(dir, opts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func put(t *testing.T, db *DB, keyValues ...string) {
+	batch := &Batch{}
+	for i := 0; i < len(keyValues); i += 2 {
+		batch.Put([]byte(keyValues[i]), []byte(keyValues[i+1]))
+	}
+	assert.NoError(t, db.Apply(batch))
+}
+
+func del(t *testing.T, db *DB, keys ...string) {
+	batch := &Batch{}
+	for _, key := range keys {
+		batch.Delete([]byte(key))
+	}
+	assert.NoError(t, db.Apply(batch))
+}
+
+func assertGet(t *testing.T, db *DB, key string, expected string, expectedOk bool) {
+	t.Helper()
+	value, ok, err := db.Get([]byte(key))
+	assert.NoError(t, err)
+	assert.Equal(t, expectedOk, ok, key)
+	if expectedOk {
+		assert.Equal(t, expected, string(value), key)
+	}
+}
+
+func scan(t *testing.T, db *DB, prefix string) []string {
+	t.Helper()
+	var keyValues []string
+	assert.NoError(t, db.Scan([]byte(prefix), func(key, value []byte) error {
+		keyValues = append(keyValues, string(key)+"="+string(value))
+		return nil
+	}))
+	return keyValues
+}
+
+func tableFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+tableFileSuffix))
+	assert.NoError(t, err)
+	return files
+}
+
+func TestDB(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir, Options{MemtableSize: 1 << 20})
+
+	put(t, db, "b", "1", "a", "2", "c", "3", "ab", "4")
+	del(t, db, "c")
+	assertGet(t, db, "a", "2", true)
+	assertGet(t, db, "c", "", false)
+	assertGet(t, db, "d", "", false)
+	assert.Equal(t, []string{"a=2", "ab=4", "b=1"}, scan(t, db, ""))
+	assert.Equal(t, []string{"a=2", "ab=4"}, scan(t, db, "a"))
+
+	// Writes made after a flush hide those in the table file
+	assert.NoError(t, db.Flush())
+	assert.Len(t, tableFiles(t, dir), 1)
+	put(t, db, "a", "5", "c", "6")
+	del(t, db, "b")
+	assertGet(t, db, "a", "5", true)
+	assertGet(t, db, "b", "", false)
+	assert.Equal(t, []string{"a=5", "ab=4", "c=6"}, scan(t, db, ""))
+
+	// Writes which were not flushed are replayed from the log when reopened
+	assert.NoError(t, db.Close())
+	db = openTestDB(t, dir, Options{MemtableSize: 1 << 20})
+	assert.Equal(t, []string{"a=5", "ab=4", "c=6"}, scan(t, db, ""))
+	assert.NoError(t, db.Check())
+	assert.NoError(t, db.Verify())
+	size, err := db.Size()
+	assert.NoError(t, err)
+	assert.Positive(t, size)
+
+	assert.NoError(t, db.Close())
+	_, _, err = db.Get([]byte("a"))
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestDBFlushAndCompaction(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir, Options{MemtableSize: 256, MaxTables: 3})
+
+	expected := map[string]string{}
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%03d", i%100)
+		if i%7 == 0 {
+			del(t, db, key)
+			delete(expected, key)
+		} else {
+			value := fmt.Sprintf("value%d", i)
+			put(t, db, key, value)
+			expected[key] = value
+		}
+	}
+	// Flushes are made as writes are held in memory, and the table files are compacted as they accumulate
+	assert.LessOrEqual(t, len(tableFiles(t, dir)), 3)
+	assert.NoError(t, db.Check())
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		value, ok := expected[key]
+		assertGet(t, db, key, value, ok)
+	}
+	assert.Len(t, scan(t, db, "key"), len(expected))
+	var prefixed []string
+	for i := 50; i < 60; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if value, ok := expected[key]; ok {
+			prefixed = append(prefixed, key+"="+value)
+		}
+	}
+	assert.Equal(t, prefixed, scan(t, db, "key05"))
+
+	// Compaction of every table leaves out the deleted keys
+	for len(tableFiles(t, dir)) > 1 {
+		put(t, db, "filler", fmt.Sprintf("%0256d", 0))
+	}
+	assert.NoError(t, db.Close())
+	db = openTestDB(t, dir, Options{MemtableSize: 256, MaxTables: 3})
+	assert.Len(t, scan(t, db, "key"), len(expected))
+	assert.NoError(t, db.Verify())
+}
+
+func TestDBRecovery(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir, Options{})
+	put(t, db, "a", "1")
+	put(t, db, "b", "2")
+	assert.NoError(t, db.Close())
+
+	// A batch which was only partly appended to the log is discarded, along with the torn record
+	walPath := filepath.Join(dir, walFileName)
+	info, err := os.Stat(walPath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(walPath, info.Size()-1))
+	db = openTestDB(t, dir, Options{})
+	assert.Equal(t, []string{"a=1"}, scan(t, db, ""))
+	put(t, db, "c", "3")
+	assert.NoError(t, db.Close())
+	db = openTestDB(t, dir, Options{})
+	assert.Equal(t, []string{"a=1", "c=3"}, scan(t, db, ""))
+}
+
+func TestDBVerify(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir, Options{})
+	put(t, db, "a", "1", "b", "2")
+	assert.NoError(t, db.Flush())
+	assert.NoError(t, db.Verify())
+	assert.NoError(t, db.Close())
+
+	files := tableFiles(t, dir)
+	if !assert.Len(t, files, 1) {
+		return
+	}
+	data, err := os.ReadFile(files[0])
+	assert.NoError(t, err)
+	data[len(data)-footerSize-4] ^= 0xff
+	assert.NoError(t, os.WriteFile(files[0], data, 0644))
+
+	db = openTestDB(t, dir, Options{})
+	assert.ErrorIs(t, db.Verify(), ErrCorrupt)
+
+	// A table file which was not completely written is rejected
+	assert.NoError(t, db.Close())
+	assert.NoError(t, os.WriteFile(files[0], data[:len(data)-1], 0644))
+	_, err = Open(dir, Options{})
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
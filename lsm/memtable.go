@@ -0,0 +1,73 @@
+package lsm
+
+import (
+	"bytes"
+	"sort"
+)
+
+// entry is the latest write of a key: its value, or its deletion
+type entry struct {
+	value   []byte
+	deleted bool
+}
+
+// memtable holds the writes which have not yet been flushed to a table file
+type memtable struct {
+	// keys are the written keys in order
+	keys    [][]byte
+	entries map[string]entry
+	// size is the approximate number of bytes held
+	size int
+}
+
+func newMemtable() *memtable {
+	return &memtable{entries: map[string]entry{}}
+}
+
+// apply makes every write of the batch
+func (m *memtable) apply(batch *Batch) {
+	for _, o := range batch.ops {
+		m.set(o.key, entry{value: o.value, deleted: o.delete})
+	}
+}
+
+// set records the latest write of a key
+func (m *memtable) set(key []byte, e entry) {
+	if old, ok := m.entries[string(key)]; ok {
+		m.size -= len(old.value)
+	} else {
+		i := sort.Search(len(m.keys), func(i int) bool { return bytes.Compare(m.keys[i], key) >= 0 })
+		m.keys = append(m.keys, nil)
+		copy(m.keys[i+1:], m.keys[i:])
+		m.keys[i] = key
+		m.size += len(key) + recordOverhead
+	}
+	m.entries[string(key)] = e
+	m.size += len(e.value)
+}
+
+// get returns the latest write of a key, if it has been written since the last flush
+func (m *memtable) get(key []byte) (entry, bool) {
+	e, ok := m.entries[string(key)]
+	return e, ok
+}
+
+// iterator returns an iterator over the writes of the keys with the specified prefix, starting at the prefix
+func (m *memtable) iterator(prefix []byte) iterator {
+	i := sort.Search(len(m.keys), func(i int) bool { return bytes.Compare(m.keys[i], prefix) >= 0 })
+	return &memtableIterator{m: m, i: i}
+}
+
+type memtableIterator struct {
+	m *memtable
+	i int
+}
+
+func (it *memtableIterator) next() ([]byte, entry, bool, error) {
+	if it.i >= len(it.m.keys) {
+		return nil, entry{}, false, nil
+	}
+	key := it.m.keys[it.i]
+	it.i++
+	return key, it.m.entries[string(key)], true, nil
+}
@@ -0,0 +1,319 @@
+package lsm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// tableMagic ends every table file, identifying it as one which was completely written
+	tableMagic = 0x4c534d31
+	// footerSize is the size of the footer: the offset of the index, the checksum of everything before the footer
+	// and the magic number
+	footerSize = 16
+	// indexInterval is the number of records between the keys held in the index
+	indexInterval = 16
+	// recordOverhead approximates the bytes taken by a record in addition to its key and value
+	recordOverhead = 8
+)
+
+const (
+	kindValue   byte = 1
+	kindDeleted byte = 2
+)
+
+// table is an immutable file of records in order of key. Records are the length and bytes of their key, their kind
+// and the length and bytes of their value. They are followed by a sparse index of every indexInterval'th key and its
+// offset, which is held in memory so that a lookup reads only the records between two indexed keys
+type table struct {
+	path string
+	file *os.File
+	size int64
+	// indexOffset is the offset of the index, which is the end of the records
+	indexOffset int64
+	index       []indexEntry
+}
+
+type indexEntry struct {
+	key    []byte
+	offset int64
+}
+
+// byteReader is the reader records are read from
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// appendRecord appends a record of the key and its write to buf
+func appendRecord(buf []byte, key []byte, e entry) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	if e.deleted {
+		return append(buf, kindDeleted, 0)
+	}
+	buf = append(buf, kindValue)
+	buf = binary.AppendUvarint(buf, uint64(len(e.value)))
+	return append(buf, e.value...)
+}
+
+// readRecord reads the next record
+func readRecord(r byteReader) ([]byte, entry, error) {
+	key, err := readBytes(r)
+	if err != nil {
+		return nil, entry{}, err
+	}
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, entry{}, err
+	}
+	if kind != kindValue && kind != kindDeleted {
+		return nil, entry{}, fmt.Errorf("%w: unknown record kind %d", ErrCorrupt, kind)
+	}
+	value, err := readBytes(r)
+	if err != nil {
+		return nil, entry{}, err
+	}
+	return key, entry{value: value, deleted: kind == kindDeleted}, nil
+}
+
+// readBytes reads a length, then that many bytes
+func readBytes(r byteReader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writeTable writes the records of the iterator to a new table file at the specified path, leaving out deletions if
+// dropDeleted is set. The file is written under a temporary name and renamed once it is complete, so a table file
+// is never seen partly written
+func writeTable(path string, it iterator, dropDeleted bool) (*table, error) {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpPath)
+
+	err = func() error {
+		defer file.Close()
+		checksum := crc32.NewIEEE()
+		w := bufio.NewWriter(io.MultiWriter(file, checksum))
+
+		var offset int64
+		var index []byte
+		var buf []byte
+		for count := 0; ; {
+			key, e, ok, err := it.next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			if e.deleted && dropDeleted {
+				continue
+			}
+			if count%indexInterval == 0 {
+				index = binary.AppendUvarint(index, uint64(len(key)))
+				index = append(index, key...)
+				index = binary.AppendUvarint(index, uint64(offset))
+			}
+			buf = appendRecord(buf[:0], key, e)
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+			offset += int64(len(buf))
+			count++
+		}
+		if _, err := w.Write(index); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		footer := make([]byte, footerSize)
+		binary.LittleEndian.PutUint64(footer, uint64(offset))
+		binary.LittleEndian.PutUint32(footer[8:], checksum.Sum32())
+		binary.LittleEndian.PutUint32(footer[12:], tableMagic)
+		if _, err := file.Write(footer); err != nil {
+			return err
+		}
+		return file.Sync()
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	return openTable(path)
+}
+
+// syncDir syncs a directory, so that files renamed into it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// openTable opens the table file at the specified path and reads its index
+func openTable(path string) (*table, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readIndex(path, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func readIndex(path string, file *os.File) (*table, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < footerSize {
+		return nil, fmt.Errorf("%w: too short", ErrCorrupt)
+	}
+	footer := make([]byte, footerSize)
+	if _, err := file.ReadAt(footer, size-footerSize); err != nil {
+		return nil, err
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer))
+	if binary.LittleEndian.Uint32(footer[12:]) != tableMagic || indexOffset < 0 || indexOffset > size-footerSize {
+		return nil, fmt.Errorf("%w: invalid footer", ErrCorrupt)
+	}
+
+	t := &table{path: path, file: file, size: size, indexOffset: indexOffset}
+	r := bufio.NewReader(io.NewSectionReader(file, indexOffset, size-footerSize-indexOffset))
+	for {
+		key, err := readBytes(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid index: %v", ErrCorrupt, err)
+		}
+		offset, err := binary.ReadUvarint(r)
+		if err != nil || int64(offset) > indexOffset {
+			return nil, fmt.Errorf("%w: invalid index", ErrCorrupt)
+		}
+		t.index = append(t.index, indexEntry{key: key, offset: int64(offset)})
+	}
+	return t, nil
+}
+
+// seek returns the position in the index of the last indexed key no greater than the specified key, or -1 if the
+// key is before every record
+func (t *table) seek(key []byte) int {
+	return sort.Search(len(t.index), func(i int) bool { return bytes.Compare(t.index[i].key, key) > 0 }) - 1
+}
+
+// get returns the record of a key, if the table holds one
+func (t *table) get(key []byte) (entry, bool, error) {
+	i := t.seek(key)
+	if i < 0 {
+		return entry{}, false, nil
+	}
+	end := t.indexOffset
+	if i+1 < len(t.index) {
+		end = t.index[i+1].offset
+	}
+	block := make([]byte, end-t.index[i].offset)
+	if _, err := t.file.ReadAt(block, t.index[i].offset); err != nil {
+		return entry{}, false, err
+	}
+	r := bytes.NewReader(block)
+	for r.Len() > 0 {
+		recordKey, e, err := readRecord(r)
+		if err != nil {
+			return entry{}, false, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		switch bytes.Compare(recordKey, key) {
+		case 0:
+			return e, true, nil
+		case 1:
+			return entry{}, false, nil
+		}
+	}
+	return entry{}, false, nil
+}
+
+// iterator returns an iterator over the records of the table from the first key no less than the specified prefix
+func (t *table) iterator(prefix []byte) iterator {
+	var start int64
+	if i := t.seek(prefix); i >= 0 {
+		start = t.index[i].offset
+	}
+	return &tableIterator{
+		r:      bufio.NewReader(io.NewSectionReader(t.file, start, t.indexOffset-start)),
+		prefix: prefix,
+	}
+}
+
+type tableIterator struct {
+	r      *bufio.Reader
+	prefix []byte
+}
+
+func (it *tableIterator) next() ([]byte, entry, bool, error) {
+	for {
+		key, e, err := readRecord(it.r)
+		if errors.Is(err, io.EOF) {
+			return nil, entry{}, false, nil
+		}
+		if err != nil {
+			return nil, entry{}, false, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		// Records before the prefix are read from the indexed key preceding it
+		if bytes.Compare(key, it.prefix) >= 0 {
+			return key, e, true, nil
+		}
+	}
+}
+
+// verify compares the checksum of the table's records and index with that written when it was created
+func (t *table) verify() error {
+	footer := make([]byte, footerSize)
+	if _, err := t.file.ReadAt(footer, t.size-footerSize); err != nil {
+		return err
+	}
+	checksum := crc32.NewIEEE()
+	if _, err := io.Copy(checksum, io.NewSectionReader(t.file, 0, t.size-footerSize)); err != nil {
+		return err
+	}
+	if checksum.Sum32() != binary.LittleEndian.Uint32(footer[8:]) {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+func (t *table) close() error {
+	return t.file.Close()
+}
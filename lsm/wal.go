@@ -0,0 +1,153 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// walHeaderSize is the size of the header of each log record: the length of the batch, then its checksum
+const walHeaderSize = 8
+
+// wal is the write-ahead log, to which each batch is appended before it is applied
+type wal struct {
+	file *os.File
+	// offset is the end of the last complete record
+	offset int64
+	// err is set if a failed append could not be undone, after which nothing more is appended
+	err error
+}
+
+// openWAL opens the log at the specified path, calling replay with each batch it holds. A record which was not
+// completely written, because the process stopped while appending it, ends the log and is truncated
+func openWAL(path string, replay func(*Batch)) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var offset int64
+	for len(data) >= walHeaderSize {
+		length := binary.LittleEndian.Uint32(data)
+		checksum := binary.LittleEndian.Uint32(data[4:])
+		if uint64(len(data)-walHeaderSize) < uint64(length) {
+			break
+		}
+		payload := data[walHeaderSize : walHeaderSize+length]
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+		batch, err := decodeBatch(payload)
+		if err != nil {
+			break
+		}
+		replay(batch)
+		offset += walHeaderSize + int64(length)
+		data = data[walHeaderSize+length:]
+	}
+
+	w := &wal{file: file, offset: offset}
+	if err := w.truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// append writes the batch to the end of the log and syncs it to disk
+func (w *wal) append(batch *Batch) error {
+	if w.err != nil {
+		return w.err
+	}
+	payload := encodeBatch(batch)
+	record := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+
+	_, err := w.file.Write(record)
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		// Remove any part of the record which was written, so that later records are not lost behind it on replay
+		if truncErr := w.truncate(w.offset); truncErr != nil {
+			w.err = errors.Join(err, truncErr)
+		}
+		return err
+	}
+	w.offset += int64(len(record))
+	return nil
+}
+
+// reset empties the log, once the batches it held have been flushed to a table file
+func (w *wal) reset() error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.truncate(0); err != nil {
+		w.err = err
+		return err
+	}
+	w.offset = 0
+	return nil
+}
+
+// truncate cuts the log to the specified length, and positions it there for the next append
+func (w *wal) truncate(length int64) error {
+	if err := w.file.Truncate(length); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(length, io.SeekStart); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// check returns the error which stopped appends to the log, if any
+func (w *wal) check() error {
+	return w.err
+}
+
+// size returns the size of the log in bytes
+func (w *wal) size() (int64, error) {
+	info, err := w.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
+
+// encodeBatch writes each operation of the batch as its kind, then the length and bytes of its key and value
+func encodeBatch(batch *Batch) []byte {
+	var buf []byte
+	for _, o := range batch.ops {
+		buf = appendRecord(buf, o.key, entry{value: o.value, deleted: o.delete})
+	}
+	return buf
+}
+
+func decodeBatch(payload []byte) (*Batch, error) {
+	batch := &Batch{}
+	r := bytes.NewReader(payload)
+	for r.Len() > 0 {
+		key, e, err := readRecord(r)
+		if err != nil {
+			return nil, err
+		}
+		batch.ops = append(batch.ops, op{key: key, value: e.value, delete: e.deleted})
+	}
+	return batch, nil
+}
@@ -1,13 +1,618 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/config"
+	"its-dave/simple-crud-rest-server/crudpb"
+	"its-dave/simple-crud-rest-server/metrics"
+	"its-dave/simple-crud-rest-server/raft"
+	"its-dave/simple-crud-rest-server/ratelimit"
 	"its-dave/simple-crud-rest-server/repository"
+	"its-dave/simple-crud-rest-server/resp"
 	"its-dave/simple-crud-rest-server/server"
+	"its-dave/simple-crud-rest-server/snapshot"
+	"its-dave/simple-crud-rest-server/tlsconfig"
+	"its-dave/simple-crud-rest-server/tracing"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
+const serviceName = "simple-crud-rest-server"
+
 func main() {
-	repo := repository.Repo{}
-	repo.SetDataFilePath("data.json")
-	http.ListenAndServe(":9080", server.Create(repo))
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+// run serves until stopped by a signal, returning an error if the server could not be started or failed; returning
+// rather than exiting lets deferred cleanups run
+func run() error {
+	printConfig := flag.Bool("print-config", false, "print the effective configuration as YAML and exit")
+	restorePath := flag.String("restore", "", "verify the specified snapshot and replace the data file with it, then exit; the server must be stopped")
+	rebalanceShards := flag.Int("rebalance", 0, "move the keys into the specified number of shards, then exit; the server must be stopped")
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if *printConfig {
+		return cfg.Write(os.Stdout)
+	}
+
+	logger, err := newLogger(cfg.Log.Level, cfg.Log.Format)
+	if err != nil {
+		return fmt.Errorf("invalid log configuration: %w", err)
+	}
+	slog.SetDefault(logger)
+
+	shards, err := recordedShards(cfg.Storage.Path)
+	if err != nil {
+		return fmt.Errorf("reading the shard count: %w", err)
+	}
+	if *rebalanceShards != 0 {
+		if err := rebalance(cfg.Storage.Backend, cfg.Storage.Path, shards, *rebalanceShards); err != nil {
+			return fmt.Errorf("rebalancing from %d to %d shards: %w", shards, *rebalanceShards, err)
+		}
+		return nil
+	}
+	if shards == 0 && cfg.Storage.Shards > 1 {
+		if err := writeShards(cfg.Storage.Path, cfg.Storage.Shards); err != nil {
+			return fmt.Errorf("writing the shard count: %w", err)
+		}
+	} else if shards != 0 && shards != cfg.Storage.Shards {
+		return fmt.Errorf("the data is in %d shards rather than the %d configured: run with -rebalance to change it", shards, cfg.Storage.Shards)
+	}
+
+	repo, closeRepo, err := openStorage(cfg.Storage.Backend, cfg.Storage.Path, cfg.Storage.Shards)
+	if err != nil {
+		return fmt.Errorf("opening %s storage %s: %w", cfg.Storage.Backend, cfg.Storage.Path, err)
+	}
+	defer closeRepo()
+
+	if *restorePath != "" {
+		if err := restore(repo, *restorePath); err != nil {
+			return fmt.Errorf("restoring snapshot %s: %w", *restorePath, err)
+		}
+		return nil
+	}
+
+	opts := []server.Option{server.WithLogger(logger)}
+	var authenticators auth.Chain
+	if cfg.TLS.ClientIdentities != "" {
+		var identities map[string][]auth.Grant
+		if err := readJSONFile(cfg.TLS.ClientIdentities, &identities); err != nil {
+			return fmt.Errorf("reading client identities: %w", err)
+		}
+		authenticators = append(authenticators, auth.ClientCertAuthenticator{Identities: identities})
+	}
+	if cfg.Auth.JWTConfig != "" {
+		var config auth.JWTConfig
+		if err := readJSONFile(cfg.Auth.JWTConfig, &config); err != nil {
+			return fmt.Errorf("reading JWT configuration: %w", err)
+		}
+		validator, err := auth.NewJWTValidator(config)
+		if err != nil {
+			return fmt.Errorf("invalid JWT configuration: %w", err)
+		}
+		authenticators = append(authenticators, validator)
+	}
+	if cfg.Auth.APIKeys != "" {
+		keyStore, err := auth.NewKeyStore(cfg.Auth.APIKeys)
+		if err != nil {
+			return fmt.Errorf("opening API key store: %w", err)
+		}
+		if len(keyStore.List()) == 0 {
+			// Bootstrap an admin key so that further keys can be created
+			token, _, err := keyStore.Create("admin", []auth.Grant{{Permission: auth.PermissionAdmin}})
+			if err != nil {
+				return fmt.Errorf("creating admin API key: %w", err)
+			}
+			fmt.Println("Created admin API key:", token)
+		}
+		authenticators = append(authenticators, keyStore)
+		opts = append(opts, server.WithAPIKeys(keyStore))
+	}
+
+	if cfg.Limits.Quotas != "" {
+		var quotas []server.Quota
+		if err := readJSONFile(cfg.Limits.Quotas, &quotas); err != nil {
+			return fmt.Errorf("reading quotas: %w", err)
+		}
+		opts = append(opts, server.WithQuotas(quotas...))
+	}
+
+	if cfg.Retention.Policies != "" {
+		var policies []server.RetentionPolicy
+		if err := readJSONFile(cfg.Retention.Policies, &policies); err != nil {
+			return fmt.Errorf("reading retention policies: %w", err)
+		}
+		opts = append(opts, server.WithRetention(time.Duration(cfg.Retention.Interval), policies...))
+	}
+	// Events are timed so that retention policies can remove them by age
+	opts = append(opts, server.WithClock(time.Now))
+
+	if cfg.Replication.LogSize > 0 {
+		opts = append(opts, server.WithReplicationLog(cfg.Replication.LogSize))
+	}
+	if cfg.Replication.Leader != "" {
+		leader, err := url.Parse(cfg.Replication.Leader)
+		if err != nil {
+			return fmt.Errorf("invalid leader URL: %w", err)
+		}
+		opts = append(opts, server.WithFollower(leader, cfg.Replication.LeaderToken, cfg.Replication.ForwardWrites))
+	}
+
+	if cfg.Metrics.Enabled {
+		opts = append(opts, server.WithMetrics(metrics.NewRegistry()))
+	}
+	if cfg.Docs.Enabled {
+		opts = append(opts, server.WithDocs())
+	}
+
+	var cleanups []func(context.Context) error
+	if cfg.Tracing.Exporter != "" {
+		exporter, err := spanExporter(cfg.Tracing.Exporter, cfg.Tracing.OTLPEndpoint, cfg.Tracing.File)
+		if err != nil {
+			return fmt.Errorf("invalid tracing configuration: %w", err)
+		}
+		tracer := tracing.NewTracer(serviceName, exporter, 5*time.Second)
+		opts = append(opts, server.WithTracer(tracer))
+		// Export the spans of requests completed while draining
+		cleanups = append(cleanups, tracer.Shutdown)
+	}
+
+	if cfg.Cluster.ID != "" {
+		members, err := cfg.Cluster.ParseMembers()
+		if err != nil {
+			return fmt.Errorf("invalid cluster members: %w", err)
+		}
+		var raftMembers []raft.Member
+		for _, member := range members {
+			raftMembers = append(raftMembers, raft.Member{ID: member.ID, Address: member.Address})
+		}
+		storage, err := raft.OpenFileStorage(cfg.Cluster.Dir)
+		if err != nil {
+			return fmt.Errorf("opening raft log %s: %w", cfg.Cluster.Dir, err)
+		}
+		cluster, err := server.NewCluster(repo, server.ClusterConfig{
+			ID:                cfg.Cluster.ID,
+			Members:           raftMembers,
+			Transport:         raft.HTTPTransport{Token: cfg.Cluster.Token},
+			Storage:           storage,
+			LinearizableReads: cfg.Cluster.LinearizableReads,
+			Logger:            logger,
+		})
+		if err != nil {
+			return fmt.Errorf("loading raft log %s: %w", cfg.Cluster.Dir, err)
+		}
+		opts = append(opts, server.WithCluster(cluster))
+		// Leave the cluster to elect another leader once requests have drained
+		cleanups = append(cleanups, func(context.Context) error {
+			cluster.Stop()
+			return storage.Close()
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.Snapshots.Dir != "" {
+		snapshots := snapshot.NewStore(cfg.Snapshots.Dir, snapshot.Retention{Hourly: cfg.Snapshots.KeepHourly, Daily: cfg.Snapshots.KeepDaily})
+		opts = append(opts, server.WithSnapshots(time.Duration(cfg.Snapshots.Interval), snapshots))
+	}
+
+	// Closed when shutdown begins so that watch streams end rather than holding up the drain
+	shutdown := make(chan struct{})
+	opts = append(opts, server.WithShutdown(shutdown))
+
+	var tlsConfig *tls.Config
+	if cfg.TLS.Cert != "" {
+		tlsConfig, err = tlsconfig.New(tlsconfig.Config{
+			CertFile:          cfg.TLS.Cert,
+			KeyFile:           cfg.TLS.Key,
+			ClientCAFile:      cfg.TLS.ClientCA,
+			RequireClientCert: cfg.TLS.RequireClientCert,
+		})
+		if err != nil {
+			return fmt.Errorf("loading TLS certificate: %w", err)
+		}
+	}
+	// The HTTP and gRPC APIs share each client's budget
+	var limiter *ratelimit.Limiter
+	readBudget := ratelimit.Budget{Rate: cfg.Limits.ReadRate, Burst: cfg.Limits.ReadBurst}
+	writeBudget := ratelimit.Budget{Rate: cfg.Limits.WriteRate, Burst: cfg.Limits.WriteBurst}
+	if readBudget.Enabled() || writeBudget.Enabled() {
+		limiter = ratelimit.NewLimiter(readBudget, writeBudget)
+	}
+	var addressLimiter *ratelimit.Limiter
+	if addressBudget := (ratelimit.Budget{Rate: cfg.Limits.AddressRate, Burst: cfg.Limits.AddressBurst}); addressBudget.Enabled() {
+		addressLimiter = ratelimit.NewLimiter(addressBudget, addressBudget)
+	}
+	var grpcServer *grpc.Server
+	if cfg.GRPC.Listen != "" {
+		grpcServer = newGRPCServer(authenticators, addressLimiter, limiter, tlsConfig)
+		opts = append(opts, server.WithGRPC(grpcServer))
+	}
+
+	mux := server.Create(repo, opts...)
+	var handler http.Handler = mux
+	if limiter != nil {
+		handler = ratelimit.Middleware(limiter, handler)
+	}
+	// Authenticate before rate limiting so that clients are limited by identity
+	if len(authenticators) > 0 {
+		handler = auth.Middleware(authenticators, handler)
+	}
+	// Limit each address before authenticating, so that requests which fail it are limited too
+	if addressLimiter != nil {
+		handler = ratelimit.AddressMiddleware(addressLimiter, handler)
+	}
+	// Probes and the API description bypass authentication and rate limiting
+	root := http.NewServeMux()
+	for _, pattern := range []string{"/healthz", "/readyz", "/openapi.json", "/docs", "/docs/swagger-ui/"} {
+		root.Handle(pattern, mux)
+	}
+	root.Handle("/", handler)
+	handler = root
+
+	srv := &http.Server{
+		Addr:         cfg.Listen,
+		Handler:      handler,
+		ReadTimeout:  time.Duration(cfg.Timeouts.Read),
+		WriteTimeout: time.Duration(cfg.Timeouts.Write),
+		IdleTimeout:  time.Duration(cfg.Timeouts.Idle),
+		TLSConfig:    tlsConfig,
+	}
+	srv.RegisterOnShutdown(func() {
+		close(shutdown)
+	})
+
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	if cfg.RESP.Listen != "" {
+		respListener, err := net.Listen("tcp", cfg.RESP.Listen)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		respServer := resp.NewServer(handler, logger)
+		go func() {
+			if err := respServer.Serve(respListener); err != nil && !errors.Is(err, resp.ErrServerClosed) {
+				slog.Error("serving RESP", "error", err)
+			}
+		}()
+		slog.Info("serving RESP", "addr", respListener.Addr().String())
+		// Commands in progress are made through the HTTP handler, so finish before the cleanups which follow it
+		cleanups = append([]func(context.Context) error{respServer.Shutdown}, cleanups...)
+	}
+	if grpcServer != nil {
+		grpcListener, err := net.Listen("tcp", cfg.GRPC.Listen)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		go func() {
+			if err := grpcServer.Serve(grpcListener); err != nil {
+				slog.Error("serving gRPC", "error", err)
+			}
+		}()
+		slog.Info("serving gRPC", "addr", grpcListener.Addr().String(), "tls", tlsConfig != nil)
+		// Watch streams end once the HTTP server begins shutting down, so calls drain before the cleanups which follow
+		cleanups = append([]func(context.Context) error{stopGRPC(grpcServer)}, cleanups...)
+	}
+	slog.Info("serving", "addr", listener.Addr().String(), "tls", srv.TLSConfig != nil)
+	if err := serve(ctx, srv, listener, time.Duration(cfg.Timeouts.Shutdown), cleanups...); err != nil {
+		return fmt.Errorf("server stopped: %w", err)
+	}
+	slog.Info("server stopped")
+	return nil
+}
+
+// newGRPCServer returns a server for the gRPC API which authenticates and rate limits calls as the HTTP API does
+// requests, and serves TLS if configured
+func newGRPCServer(authenticators auth.Chain, addressLimiter, limiter *ratelimit.Limiter, tlsConfig *tls.Config) *grpc.Server {
+	var unary []grpc.UnaryServerInterceptor
+	var stream []grpc.StreamServerInterceptor
+	// Limit each address before authenticating, so that calls which fail it are limited too
+	if addressLimiter != nil {
+		unary = append(unary, ratelimit.AddressUnaryServerInterceptor(addressLimiter, crudpb.Writes))
+		stream = append(stream, ratelimit.AddressStreamServerInterceptor(addressLimiter, crudpb.Writes))
+	}
+	// Authenticate before rate limiting so that clients are limited by identity
+	if len(authenticators) > 0 {
+		unary = append(unary, auth.UnaryServerInterceptor(authenticators))
+		stream = append(stream, auth.StreamServerInterceptor(authenticators))
+	}
+	if limiter != nil {
+		unary = append(unary, ratelimit.UnaryServerInterceptor(limiter, crudpb.Writes))
+		stream = append(stream, ratelimit.StreamServerInterceptor(limiter, crudpb.Writes))
+	}
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(unary...), grpc.ChainStreamInterceptor(stream...)}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	return grpc.NewServer(opts...)
+}
+
+// stopGRPC returns a cleanup which stops the gRPC server once its calls have finished, or at once if the context ends
+// first
+func stopGRPC(grpcServer *grpc.Server) func(context.Context) error {
+	return func(ctx context.Context) error {
+		done := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			grpcServer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// openStore opens the named storage backend at the specified path, returning a function to close it
+func openStore(backend, path string) (repository.Store, func() error, error) {
+	switch backend {
+	case "file":
+		repo := &repository.Repo{}
+		repo.SetDataFilePath(path)
+		return repo, func() error { return nil }, nil
+	case "sqlite":
+		store, err := repository.OpenSQLite(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, store.Close, nil
+	case "lsm":
+		store, err := repository.OpenLSM(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, store.Close, nil
+	}
+	return nil, nil, fmt.Errorf("unknown storage backend %q", backend)
+}
+
+// openStorage opens the named storage backend at the specified path, or if there is more than one shard the shards
+// at the paths given by shardPath, returning a function to close it
+func openStorage(backend, path string, shards int) (repository.Store, func() error, error) {
+	if shards == 1 {
+		return openStore(backend, path)
+	}
+	set := newStoreSet(backend)
+	stores, err := set.shards(path, shards)
+	if err != nil {
+		set.close()
+		return nil, nil, err
+	}
+	return repository.NewSharded(stores...), set.close, nil
+}
+
+// shardPath returns the path of the specified one of the number of shards: the path itself if there is one, and
+// otherwise the path with the shard's number before its extension, so data.json has shards data-0.json and so on
+func shardPath(path string, shard, shards int) string {
+	if shards == 1 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), shard, ext)
+}
+
+// storeSet opens the store at each path once, however often it is asked for, so that old and new shards at the same
+// path share a store while rebalancing
+type storeSet struct {
+	backend string
+	stores  map[string]repository.Store
+	closers []func() error
+}
+
+func newStoreSet(backend string) *storeSet {
+	return &storeSet{backend: backend, stores: map[string]repository.Store{}}
+}
+
+// shards returns the stores of the specified number of shards of the path
+func (set *storeSet) shards(path string, shards int) ([]repository.Store, error) {
+	stores := make([]repository.Store, 0, shards)
+	for shard := 0; shard < shards; shard++ {
+		shardPath := shardPath(path, shard, shards)
+		store, ok := set.stores[shardPath]
+		if !ok {
+			var closeStore func() error
+			var err error
+			if store, closeStore, err = openStore(set.backend, shardPath); err != nil {
+				return nil, err
+			}
+			set.stores[shardPath] = store
+			set.closers = append(set.closers, closeStore)
+		}
+		stores = append(stores, store)
+	}
+	return stores, nil
+}
+
+// close closes every store opened
+func (set *storeSet) close() error {
+	var errs []error
+	for _, closeStore := range set.closers {
+		errs = append(errs, closeStore())
+	}
+	set.closers = nil
+	return errors.Join(errs...)
+}
+
+// shardsPath returns the path of the file recording the number of shards of the data at the path
+func shardsPath(path string) string {
+	return path + ".shards"
+}
+
+// recordedShards returns the number of shards the data at the path is in: that recorded when it was sharded, 1 if it
+// never was, or 0 if there is no data yet
+func recordedShards(path string) (int, error) {
+	data, err := os.ReadFile(shardsPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	shards, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || shards < 1 {
+		return 0, fmt.Errorf("invalid shard count %q in %s", strings.TrimSpace(string(data)), shardsPath(path))
+	}
+	return shards, nil
+}
+
+// writeShards records the number of shards of the data at the path
+func writeShards(path string, shards int) error {
+	return os.WriteFile(shardsPath(path), []byte(strconv.Itoa(shards)+"\n"), 0644)
+}
+
+// rebalance moves the keys of the data at the path from the old number of shards to the new one, then records the new
+// number and removes the old shards which are not new ones
+func rebalance(backend, path string, from, to int) error {
+	if to < 1 {
+		return fmt.Errorf("invalid shard count %d: must be at least 1", to)
+	}
+	set := newStoreSet(backend)
+	defer set.close()
+	fromStores, err := set.shards(path, from)
+	if err != nil {
+		return err
+	}
+	toStores, err := set.shards(path, to)
+	if err != nil {
+		return err
+	}
+	report, err := repository.Rebalance(context.Background(), fromStores, toStores)
+	if err != nil {
+		return err
+	}
+	if err := writeShards(path, to); err != nil {
+		return err
+	}
+	if err := set.close(); err != nil {
+		return err
+	}
+	for shard := 0; shard < from; shard++ {
+		oldPath := shardPath(path, shard, from)
+		if !containsStore(toStores, set.stores[oldPath]) {
+			if err := removeStore(oldPath); err != nil {
+				return err
+			}
+		}
+	}
+	slog.Info("rebalanced shards", "from", from, "to", to, "keys", report.Keys, "moved", report.Moved)
+	return nil
+}
+
+func containsStore(stores []repository.Store, store repository.Store) bool {
+	for _, s := range stores {
+		if s == store {
+			return true
+		}
+	}
+	return false
+}
+
+// removeStore removes the data file, database or directory at the path, along with a database's journal files
+func removeStore(path string) error {
+	for _, p := range []string{path, path + "-wal", path + "-shm"} {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore verifies the snapshot at the specified path and replaces the data with it
+func restore(repo repository.Store, snapshotPath string) error {
+	dataMap, metadata, err := snapshot.Read(snapshotPath)
+	if err != nil {
+		return err
+	}
+	// A database must be created before it is written, whereas a data file is simply replaced
+	if _, ok := repo.(*repository.Repo); !ok {
+		if err := repo.InitialiseData(); err != nil {
+			return err
+		}
+	}
+	if err := repo.WriteData(context.Background(), dataMap); err != nil {
+		return err
+	}
+	slog.Info("restored snapshot", "path", snapshotPath, "createdAt", metadata.CreatedAt, "keys", metadata.Keys, "events", metadata.Events)
+	return nil
+}
+
+// readJSONFile parses the JSON file at the specified path into v
+func readJSONFile(filePath string, v interface{}) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", filePath, err)
+	}
+	return nil
+}
+
+// spanExporter creates the named trace exporter
+func spanExporter(name, otlpEndpoint, traceFilePath string) (tracing.Exporter, error) {
+	switch name {
+	case "otlp":
+		return tracing.NewOTLPExporter(otlpEndpoint, serviceName), nil
+	case "stdout":
+		return tracing.NewWriterExporter(os.Stdout, serviceName), nil
+	case "file":
+		file, err := os.OpenFile(traceFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			return nil, err
+		}
+		return tracing.NewWriterExporter(file, serviceName), nil
+	}
+	return nil, fmt.Errorf("unknown trace exporter %q", name)
+}
+
+// newLogger creates a logger writing to stderr at the specified level and in the specified format
+func newLogger(level, format string) (*slog.Logger, error) {
+	var handlerOpts slog.HandlerOptions
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	handlerOpts.Level = logLevel
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, &handlerOpts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, &handlerOpts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"its-dave/simple-crud-rest-server/repository"
+	"its-dave/simple-crud-rest-server/snapshot"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestore(t *testing.T) {
+	dataFilePath := filepath.Join(t.TempDir(), "data.json")
+	assert.NoError(t, os.WriteFile(dataFilePath, []byte(`{"key1":[{"event":"create","value":"value1"}]}`), 0644))
+	repo := repository.Repo{}
+	repo.SetDataFilePath(dataFilePath)
+	assert.NoError(t, repo.InitialiseData())
+	dataMap, err := repo.ReadData(context.Background())
+	assert.NoError(t, err)
+	created, err := snapshot.NewStore(t.TempDir(), snapshot.Retention{}).Create(context.Background(), dataMap)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	snapshotFile, err := os.ReadFile(created.Path)
+	assert.NoError(t, err)
+
+	assert.NoError(t, repo.WriteData(context.Background(), map[string]interface{}{}))
+	assert.NoError(t, restore(&repo, created.Path))
+	restored, err := repo.ReadData(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, restored)
+
+	// A corrupt snapshot leaves the data unchanged
+	assert.NoError(t, os.WriteFile(created.Path, []byte(`{"format":1,"checksum":"sha256:00","data":{}}`), 0644))
+	assert.ErrorIs(t, restore(&repo, created.Path), snapshot.ErrCorrupt)
+	restored, err = repo.ReadData(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, restored)
+
+	// A snapshot can be restored into a new database
+	assert.NoError(t, os.WriteFile(created.Path, snapshotFile, 0644))
+	store, closeStore, err := openStore("sqlite", filepath.Join(t.TempDir(), "data.db"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer closeStore()
+	assert.NoError(t, restore(store, created.Path))
+	restored, err = store.ReadData(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, restored)
+
+	store, closeStore, err = openStore("lsm", filepath.Join(t.TempDir(), "data"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer closeStore()
+	assert.NoError(t, restore(store, created.Path))
+	restored, err = store.ReadData(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, restored)
+}
+
+func TestRebalance(t *testing.T) {
+	dataFilePath := filepath.Join(t.TempDir(), "data.json")
+	assert.NoError(t, os.WriteFile(dataFilePath, []byte(`{"key1":[{"event":"create","value":"value1"}],"key2":[{"event":"create","value":"value2"}]}`), 0644))
+	shards, err := recordedShards(dataFilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, shards)
+	repo, closeRepo, err := openStorage("file", dataFilePath, 1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, repo.InitialiseData())
+	dataMap, err := repo.ReadData(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, closeRepo())
+
+	// Sharding moves the keys into new data files and removes the old one
+	assert.NoError(t, rebalance("file", dataFilePath, 1, 3))
+	shards, err = recordedShards(dataFilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, shards)
+	assert.NoFileExists(t, dataFilePath)
+	assert.FileExists(t, filepath.Join(filepath.Dir(dataFilePath), "data-2.json"))
+	repo, closeRepo, err = openStorage("file", dataFilePath, 3)
+	if !assert.NoError(t, err) {
+		return
+	}
+	read, err := repo.ReadData(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, read)
+	assert.NoError(t, closeRepo())
+
+	// Reducing the shards keeps those which remain
+	assert.NoError(t, rebalance("file", dataFilePath, 3, 2))
+	assert.FileExists(t, filepath.Join(filepath.Dir(dataFilePath), "data-1.json"))
+	assert.NoFileExists(t, filepath.Join(filepath.Dir(dataFilePath), "data-2.json"))
+	repo, closeRepo, err = openStorage("file", dataFilePath, 2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer closeRepo()
+	read, err = repo.ReadData(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, read)
+
+	// There is no shard count without data
+	shards, err = recordedShards(filepath.Join(t.TempDir(), "data.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, shards)
+}
@@ -0,0 +1,302 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const contentTypeExposition = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are histogram buckets suited to request and storage latencies in seconds
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metrics and writes them in the Prometheus text exposition format
+type Registry struct {
+	mu         sync.Mutex
+	metrics    []metric
+	onCollects []func()
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// OnCollect registers a function to be called before each collection, e.g. to update gauges
+func (reg *Registry) OnCollect(fn func()) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.onCollects = append(reg.onCollects, fn)
+}
+
+// Write writes every registered metric to w
+func (reg *Registry) Write(w io.Writer) error {
+	reg.mu.Lock()
+	onCollects := append([]func(){}, reg.onCollects...)
+	metrics := append([]metric{}, reg.metrics...)
+	reg.mu.Unlock()
+
+	for _, fn := range onCollects {
+		fn()
+	}
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	return buf.Flush()
+}
+
+// Handler returns a handler serving the registry's metrics
+func (reg *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeExposition)
+		reg.Write(w)
+	})
+}
+
+func (reg *Registry) register(m metric) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.metrics = append(reg.metrics, m)
+}
+
+// desc is the name, help text and label names shared by all series of a metric
+type desc struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+}
+
+func (d desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.metricType)
+}
+
+// labels formats the label names with the specified values, plus any extra label pair
+func (d desc) labels(labelValues []string, extra ...string) string {
+	if len(d.labelNames) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := []string{}
+	for i, name := range d.labelNames {
+		pairs = append(pairs, name+`="`+escapeLabelValue(labelValues[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabelValue(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (d desc) checkLabels(labelValues []string) {
+	if len(labelValues) != len(d.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", d.name, len(d.labelNames), len(labelValues)))
+	}
+}
+
+// seriesKey joins label values into a map key
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// Counter is a monotonically increasing value per set of label values
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+	labels map[string][]string
+}
+
+// NewCounter registers a counter with the specified label names
+func (reg *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	counter := &Counter{
+		desc:   desc{name: name, help: help, metricType: "counter", labelNames: labelNames},
+		values: map[string]float64{},
+		labels: map[string][]string{},
+	}
+	reg.register(counter)
+	return counter
+}
+
+// Inc adds one to the series with the specified label values
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the series with the specified label values
+func (counter *Counter) Add(v float64, labelValues ...string) {
+	counter.checkLabels(labelValues)
+	key := seriesKey(labelValues)
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	if _, exists := counter.labels[key]; !exists {
+		counter.labels[key] = append([]string{}, labelValues...)
+	}
+	counter.values[key] += v
+}
+
+func (counter *Counter) write(w *bufio.Writer) {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	counter.writeHeader(w)
+	for _, key := range sortedKeys(counter.labels) {
+		fmt.Fprintf(w, "%s%s %s\n", counter.name, counter.desc.labels(counter.labels[key]), formatFloat(counter.values[key]))
+	}
+}
+
+// Gauge is a value which may go up and down per set of label values
+type Gauge struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+	labels map[string][]string
+}
+
+// NewGauge registers a gauge with the specified label names
+func (reg *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	gauge := &Gauge{
+		desc:   desc{name: name, help: help, metricType: "gauge", labelNames: labelNames},
+		values: map[string]float64{},
+		labels: map[string][]string{},
+	}
+	reg.register(gauge)
+	return gauge
+}
+
+// Set sets the series with the specified label values to v
+func (gauge *Gauge) Set(v float64, labelValues ...string) {
+	gauge.checkLabels(labelValues)
+	key := seriesKey(labelValues)
+	gauge.mu.Lock()
+	defer gauge.mu.Unlock()
+	if _, exists := gauge.labels[key]; !exists {
+		gauge.labels[key] = append([]string{}, labelValues...)
+	}
+	gauge.values[key] = v
+}
+
+func (gauge *Gauge) write(w *bufio.Writer) {
+	gauge.mu.Lock()
+	defer gauge.mu.Unlock()
+	gauge.writeHeader(w)
+	for _, key := range sortedKeys(gauge.labels) {
+		fmt.Fprintf(w, "%s%s %s\n", gauge.name, gauge.desc.labels(gauge.labels[key]), formatFloat(gauge.values[key]))
+	}
+}
+
+// Histogram counts observations into cumulative buckets per set of label values
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+// NewHistogram registers a histogram with the specified upper bucket bounds, in increasing order, and label names
+func (reg *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	histogram := &Histogram{
+		desc:    desc{name: name, help: help, metricType: "histogram", labelNames: labelNames},
+		buckets: buckets,
+		series:  map[string]*histogramSeries{},
+	}
+	reg.register(histogram)
+	return histogram
+}
+
+// Observe adds an observation of v to the series with the specified label values
+func (histogram *Histogram) Observe(v float64, labelValues ...string) {
+	histogram.checkLabels(labelValues)
+	key := seriesKey(labelValues)
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	series, exists := histogram.series[key]
+	if !exists {
+		series = &histogramSeries{
+			labelValues: append([]string{}, labelValues...),
+			counts:      make([]uint64, len(histogram.buckets)),
+		}
+		histogram.series[key] = series
+	}
+	for i, upperBound := range histogram.buckets {
+		if v <= upperBound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += v
+}
+
+func (histogram *Histogram) write(w *bufio.Writer) {
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+	histogram.writeHeader(w)
+	keys := make([]string, 0, len(histogram.series))
+	for key := range histogram.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := histogram.series[key]
+		for i, upperBound := range histogram.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, histogram.desc.labels(series.labelValues, "le", formatFloat(upperBound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, histogram.desc.labels(series.labelValues, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", histogram.name, histogram.desc.labels(series.labelValues), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", histogram.name, histogram.desc.labels(series.labelValues), series.count)
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
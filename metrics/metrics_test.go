@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExposition(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("test_requests_total", "Total requests.", "method", "path")
+	gauge := registry.NewGauge("test_size_bytes", "Size\nin bytes.")
+	histogram := registry.NewHistogram("test_duration_seconds", "Durations.", []float64{0.1, 1})
+
+	counter.Inc("GET", "/a")
+	counter.Add(2, "POST", `/"b"`)
+	counter.Inc("GET", "/a")
+	registry.OnCollect(func() {
+		gauge.Set(42)
+	})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(5)
+
+	expected := `# HELP test_requests_total Total requests.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",path="/a"} 2
+test_requests_total{method="POST",path="/\"b\""} 2
+# HELP test_size_bytes Size\nin bytes.
+# TYPE test_size_bytes gauge
+test_size_bytes 42
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 5.55
+test_duration_seconds_count 3
+`
+	resp := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.True(t, strings.HasPrefix(resp.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	assert.Equal(t, expected, resp.Body.String())
+}
+
+func TestWrongLabelCount(t *testing.T) {
+	counter := NewRegistry().NewCounter("test_total", "Test.", "method")
+	assert.Panics(t, func() {
+		counter.Inc()
+	})
+}
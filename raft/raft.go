@@ -0,0 +1,1206 @@
+// Package raft replicates a log of commands across a cluster with the Raft consensus algorithm, so that every member
+// applies the same commands in the same order and a command is committed once a majority of the members have stored
+// it. Besides leader election and log replication it supports pre-votes, leadership transfer, adding and removing
+// one member at a time, linearizable reads and compaction of the log
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotLeader is returned by operations which only the leader can perform, when the member is not the leader
+	ErrNotLeader = errors.New("raft: not the leader")
+	// ErrLeadershipLost is returned for a proposal which was replaced in the log by a new leader's entries
+	ErrLeadershipLost = errors.New("raft: leadership lost before the proposal was committed")
+	// ErrMembershipChangePending is returned for a change of members while another has not yet been committed
+	ErrMembershipChangePending = errors.New("raft: another membership change has not yet been committed")
+	// ErrUnknownMember is returned for an operation on a member which is not in the cluster
+	ErrUnknownMember = errors.New("raft: unknown member")
+	// ErrMemberExists is returned for adding a member with the ID of an existing one
+	ErrMemberExists = errors.New("raft: member already exists")
+	// ErrLastMember is returned for removing the only member of the cluster
+	ErrLastMember = errors.New("raft: cannot remove the last member")
+	// ErrTransferFailed is returned when leadership was not transferred before the election timeout
+	ErrTransferFailed = errors.New("raft: leadership was not transferred")
+	// ErrStopped is returned by operations on a stopped node
+	ErrStopped = errors.New("raft: node is stopped")
+)
+
+// maxAppendEntries is the most entries sent in an AppendRequest
+const maxAppendEntries = 64
+
+// Defaults for the zero fields of Config
+const (
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+	DefaultElectionTimeout   = time.Second
+	DefaultCompactAfter      = 4096
+)
+
+type Role string
+
+const (
+	Follower  Role = "follower"
+	Candidate Role = "candidate"
+	Leader    Role = "leader"
+)
+
+// Member is a member of the cluster, with the address at which the transport reaches it
+type Member struct {
+	ID      string `json:"id"`
+	Address string `json:"address,omitempty"`
+}
+
+type EntryType string
+
+const (
+	// EntryCommand holds a command for the state machine
+	EntryCommand EntryType = "command"
+	// EntryNoop is appended by each new leader, so that it commits the entries of earlier terms
+	EntryNoop EntryType = "noop"
+	// EntryMembers changes the members of the cluster, taking effect as soon as it is appended
+	EntryMembers EntryType = "members"
+)
+
+// Entry is an entry in the log
+type Entry struct {
+	Index   uint64          `json:"index"`
+	Term    uint64          `json:"term"`
+	Type    EntryType       `json:"type"`
+	Command json.RawMessage `json:"command,omitempty"`
+	Members []Member        `json:"members,omitempty"`
+}
+
+// StateMachine applies the committed commands. It must persist the effect of each command before Apply returns, as
+// applied entries are discarded when the log is compacted, and applying a command must be idempotent, as the entries
+// since the last compaction are applied again after a restart
+type StateMachine interface {
+	Apply(command json.RawMessage) error
+	// Snapshot returns the state as of the latest command applied, to send to a member too far behind to be sent the
+	// entries it is missing
+	Snapshot() (json.RawMessage, error)
+	// Restore replaces the state with a snapshot
+	Restore(snapshot json.RawMessage) error
+}
+
+// Config configures a Node
+type Config struct {
+	ID string
+	// Members are the members of a new cluster, including this one, used if the storage is empty. A member joining an
+	// existing cluster starts with none, and waits to be added by the leader
+	Members      []Member
+	Transport    Transport
+	Storage      Storage
+	StateMachine StateMachine
+	// HeartbeatInterval is the interval between the leader's heartbeats
+	HeartbeatInterval time.Duration
+	// ElectionTimeout is the minimum time without hearing from a leader before a member starts an election
+	ElectionTimeout time.Duration
+	// CompactAfter is the number of applied entries after which the log is compacted
+	CompactAfter int
+	Logger       *slog.Logger
+}
+
+// Status describes a member's view of the cluster
+type Status struct {
+	ID           string   `json:"id"`
+	Role         Role     `json:"role"`
+	Term         uint64   `json:"term"`
+	Leader       string   `json:"leader,omitempty"`
+	Members      []Member `json:"members"`
+	LastIndex    uint64   `json:"lastIndex"`
+	CommitIndex  uint64   `json:"commitIndex"`
+	AppliedIndex uint64   `json:"appliedIndex"`
+	// Error is the error from the last failed application of a committed entry, if it has not since succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// Node is a member of a cluster. It is safe for concurrent use
+type Node struct {
+	id                string
+	transport         Transport
+	storage           Storage
+	sm                StateMachine
+	heartbeat         time.Duration
+	electionTimeout   time.Duration
+	compactAfter      uint64
+	logger            *slog.Logger
+	ctx               context.Context
+	stop              context.CancelFunc
+	wg                sync.WaitGroup
+	startOnce, finish sync.Once
+
+	// applyMu is held while the state machine applies an entry, takes a snapshot or restores one, and is acquired
+	// before mu
+	applyMu sync.Mutex
+
+	mu   sync.Mutex
+	role Role
+	term uint64
+	vote string
+	// leader is the ID of the leader of the current term, if known, and lastContact when it was last heard from
+	leader      string
+	lastContact time.Time
+	// electionDue is when a member which has not heard from a leader starts an election
+	electionDue time.Time
+	// snapshot is the latest compaction, and entries the log after it
+	snapshot SnapshotMeta
+	entries  []Entry
+	// members are those of the latest members entry in the log, or else of the compaction
+	members     []Member
+	commitIndex uint64
+	applied     uint64
+	applyErr    error
+	// waiters are the proposals waiting to be applied, by index
+	waiters map[uint64]waiter
+	// changed is closed, and replaced, whenever the state changes, to wake those waiting for it
+	changed chan struct{}
+
+	// Leader state
+	peers map[string]*peer
+	// leaderStart is the index of the noop appended on becoming leader
+	leaderStart uint64
+	// round numbers each round of heartbeats confirming leadership for a linearizable read
+	round uint64
+	// transferee is the member to which leadership is being transferred, during which proposals are refused
+	transferee string
+}
+
+// waiter is a proposal waiting to be applied
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// peer is the leader's record of replication to another member
+type peer struct {
+	member Member
+	// next is the index of the next entry to send, and match the index of the last entry known to be stored
+	next, match uint64
+	// round is the latest heartbeat round acknowledged, and lastAck when the member last responded
+	round   uint64
+	lastAck time.Time
+	wake    chan struct{}
+	stop    chan struct{}
+}
+
+// NewNode returns a node with the state loaded from the configured storage. It does nothing until started
+func NewNode(config Config) (*Node, error) {
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = DefaultElectionTimeout
+	}
+	if config.CompactAfter <= 0 {
+		config.CompactAfter = DefaultCompactAfter
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	n := &Node{
+		id:              config.ID,
+		transport:       config.Transport,
+		storage:         config.Storage,
+		sm:              config.StateMachine,
+		heartbeat:       config.HeartbeatInterval,
+		electionTimeout: config.ElectionTimeout,
+		compactAfter:    uint64(config.CompactAfter),
+		logger:          config.Logger.With("member", config.ID),
+		ctx:             ctx,
+		stop:            stop,
+		role:            Follower,
+		waiters:         map[uint64]waiter{},
+		changed:         make(chan struct{}),
+	}
+
+	state, snapshot, entries, err := n.storage.Load()
+	if err != nil {
+		return nil, err
+	}
+	if state.Term == 0 && snapshot.Index == 0 && len(snapshot.Members) == 0 && len(entries) == 0 && len(config.Members) > 0 {
+		// The members of a new cluster are those of an empty compaction, so that every member starts with them
+		snapshot.Members = sortedMembers(config.Members)
+		if err := n.storage.Compact(snapshot); err != nil {
+			return nil, err
+		}
+	}
+	n.term, n.vote = state.Term, state.Vote
+	n.snapshot, n.entries = snapshot, entries
+	// Entries after the compaction are applied again once the leader says they are committed
+	n.commitIndex, n.applied = snapshot.Index, snapshot.Index
+	n.updateMembers()
+	return n, nil
+}
+
+// Start starts the node taking part in the cluster
+func (n *Node) Start() {
+	n.startOnce.Do(func() {
+		n.mu.Lock()
+		n.resetElectionDue()
+		n.mu.Unlock()
+		n.wg.Add(2)
+		go n.tick()
+		go n.apply()
+	})
+}
+
+// Stop stops the node, failing any proposals waiting to be applied
+func (n *Node) Stop() {
+	n.finish.Do(func() {
+		n.stop()
+		n.mu.Lock()
+		n.stopPeers()
+		for index, w := range n.waiters {
+			w.done <- ErrStopped
+			delete(n.waiters, index)
+		}
+		n.notify()
+		n.mu.Unlock()
+		n.wg.Wait()
+	})
+}
+
+// Propose appends a command to the log, returning once it has been committed and applied by this member, with the
+// error from applying it
+func (n *Node) Propose(ctx context.Context, command json.RawMessage) error {
+	return n.propose(ctx, Entry{Type: EntryCommand, Command: command})
+}
+
+// Barrier returns once the leader has applied every entry committed before it became leader, so that its state
+// includes every write acknowledged by earlier leaders
+func (n *Node) Barrier(ctx context.Context) error {
+	return n.await(ctx, func() (bool, error) {
+		if n.role != Leader {
+			return false, ErrNotLeader
+		}
+		return n.applied >= n.leaderStart, nil
+	})
+}
+
+// ReadIndex returns once the state of the leader includes every write committed before it was called, having
+// confirmed with a majority of the members that it is still the leader, so that a read which follows is linearizable
+func (n *Node) ReadIndex(ctx context.Context) error {
+	n.mu.Lock()
+	if n.role != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	term := n.term
+	readIndex := max(n.commitIndex, n.leaderStart)
+	n.round++
+	round := n.round
+	for _, p := range n.peers {
+		wake(p)
+	}
+	n.mu.Unlock()
+
+	return n.await(ctx, func() (bool, error) {
+		if n.role != Leader || n.term != term {
+			return false, ErrNotLeader
+		}
+		acks := 0
+		for _, m := range n.members {
+			if p, ok := n.peers[m.ID]; m.ID == n.id || ok && p.round >= round {
+				acks++
+			}
+		}
+		return acks >= n.quorum() && n.applied >= readIndex, nil
+	})
+}
+
+// TransferLeadership hands leadership to the member with the specified ID, or if empty to the member whose log is
+// most up to date, once it has every entry, returning once another member has been elected. Transferring leadership
+// to the leader itself does nothing
+func (n *Node) TransferLeadership(ctx context.Context, id string) error {
+	n.mu.Lock()
+	if n.role != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	if id == n.id {
+		n.mu.Unlock()
+		return nil
+	}
+	if id == "" {
+		for _, p := range n.peers {
+			if id == "" || p.match > n.peers[id].match {
+				id = p.member.ID
+			}
+		}
+	}
+	p, ok := n.peers[id]
+	if !ok {
+		n.mu.Unlock()
+		return ErrUnknownMember
+	}
+	term := n.term
+	n.transferee = id
+	n.logger.Info("transferring leadership", "to", id)
+	if p.match == n.lastIndex() {
+		go n.timeoutNow(p.member, term)
+	}
+	wake(p)
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, 2*n.electionTimeout)
+	defer cancel()
+	err := n.await(ctx, func() (bool, error) {
+		return n.role != Leader || n.term != term, nil
+	})
+	n.mu.Lock()
+	if n.term == term && n.transferee == id {
+		n.transferee = ""
+	}
+	n.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrTransferFailed, err)
+	}
+	return nil
+}
+
+// AddMember adds a member to the cluster, returning once the change has been committed
+func (n *Node) AddMember(ctx context.Context, member Member) error {
+	n.mu.Lock()
+	members := append([]Member(nil), n.members...)
+	n.mu.Unlock()
+	for _, m := range members {
+		if m.ID == member.ID {
+			return ErrMemberExists
+		}
+	}
+	return n.propose(ctx, Entry{Type: EntryMembers, Members: sortedMembers(append(members, member))})
+}
+
+// RemoveMember removes a member from the cluster, returning once the change has been committed. A leader which
+// removes itself steps down once the change has been committed
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	n.mu.Lock()
+	members := make([]Member, 0, len(n.members))
+	for _, m := range n.members {
+		if m.ID != id {
+			members = append(members, m)
+		}
+	}
+	removed := len(members) < len(n.members)
+	n.mu.Unlock()
+	if !removed {
+		return ErrUnknownMember
+	}
+	if len(members) == 0 {
+		return ErrLastMember
+	}
+	return n.propose(ctx, Entry{Type: EntryMembers, Members: members})
+}
+
+// Status returns the member's view of the cluster
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	status := Status{
+		ID:           n.id,
+		Role:         n.role,
+		Term:         n.term,
+		Leader:       n.leader,
+		Members:      append([]Member{}, n.members...),
+		LastIndex:    n.lastIndex(),
+		CommitIndex:  n.commitIndex,
+		AppliedIndex: n.applied,
+	}
+	if n.applyErr != nil {
+		status.Error = n.applyErr.Error()
+	}
+	return status
+}
+
+// Leader returns the leader of the current term, if known
+func (n *Node) Leader() (Member, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, m := range n.members {
+		if m.ID == n.leader {
+			return m, true
+		}
+	}
+	return Member{}, false
+}
+
+// ID returns the ID of the member
+func (n *Node) ID() string {
+	return n.id
+}
+
+// propose appends the entry to the leader's log and waits for it to be applied
+func (n *Node) propose(ctx context.Context, entry Entry) error {
+	n.mu.Lock()
+	if n.ctx.Err() != nil {
+		n.mu.Unlock()
+		return ErrStopped
+	}
+	if n.role != Leader || n.transferee != "" {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	if entry.Type == EntryMembers && n.membersIndex() > n.commitIndex {
+		n.mu.Unlock()
+		return ErrMembershipChangePending
+	}
+	entry, err := n.appendEntry(entry)
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	done := make(chan error, 1)
+	n.waiters[entry.Index] = waiter{term: entry.Term, done: done}
+	n.mu.Unlock()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, entry.Index)
+		n.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// await waits until done, which is called with mu held whenever the state changes, returns true or an error
+func (n *Node) await(ctx context.Context, done func() (bool, error)) error {
+	n.mu.Lock()
+	for {
+		if n.ctx.Err() != nil {
+			n.mu.Unlock()
+			return ErrStopped
+		}
+		ok, err := done()
+		if ok || err != nil {
+			n.mu.Unlock()
+			return err
+		}
+		changed := n.changed
+		n.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		n.mu.Lock()
+	}
+}
+
+// notify wakes those waiting for the state to change. It must be called with mu held
+func (n *Node) notify() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// tick starts an election when a member has not heard from a leader within the election timeout, and makes a leader
+// which has not heard from a majority of the members within it step down
+func (n *Node) tick() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		switch {
+		case n.role == Leader:
+			acks := 0
+			for _, m := range n.members {
+				if p, ok := n.peers[m.ID]; m.ID == n.id || ok && time.Since(p.lastAck) < n.electionTimeout {
+					acks++
+				}
+			}
+			if acks < n.quorum() {
+				n.logger.Warn("stepping down as leader, having lost contact with a majority of members")
+				n.becomeFollower(n.term, "")
+			}
+			n.mu.Unlock()
+		case time.Now().After(n.electionDue) && n.isMember(n.id):
+			n.resetElectionDue()
+			n.mu.Unlock()
+			go n.campaign(false)
+		default:
+			n.mu.Unlock()
+		}
+	}
+}
+
+// campaign runs an election for leadership. Unless leadership is being transferred to it, the member first runs a
+// pre-vote, so that a member which cannot reach a majority does not increase its term and disrupt the others when
+// it rejoins them
+func (n *Node) campaign(transfer bool) {
+	n.mu.Lock()
+	if n.role == Leader {
+		n.mu.Unlock()
+		return
+	}
+	req := VoteRequest{Term: n.term + 1, Candidate: n.id, LastLogIndex: n.lastIndex(), LastLogTerm: n.lastTerm(), PreVote: !transfer, Transfer: transfer}
+	n.mu.Unlock()
+
+	if req.PreVote {
+		if !n.requestVotes(req) {
+			return
+		}
+		req.PreVote = false
+	}
+
+	n.mu.Lock()
+	if n.role == Leader || n.term+1 != req.Term {
+		n.mu.Unlock()
+		return
+	}
+	n.term++
+	n.role = Candidate
+	n.vote = n.id
+	n.leader = ""
+	if err := n.persist(); err != nil {
+		n.mu.Unlock()
+		return
+	}
+	n.resetElectionDue()
+	n.notify()
+	n.logger.Debug("starting election", "term", n.term)
+	n.mu.Unlock()
+
+	if n.requestVotes(req) {
+		n.mu.Lock()
+		if n.role == Candidate && n.term == req.Term {
+			n.becomeLeader()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// requestVotes asks each member for its vote, returning whether a majority, including this member, granted it
+func (n *Node) requestVotes(req VoteRequest) bool {
+	n.mu.Lock()
+	members := append([]Member(nil), n.members...)
+	quorum := n.quorum()
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(n.ctx, n.electionTimeout)
+	defer cancel()
+	responses := make(chan bool, len(members))
+	for _, m := range members {
+		if m.ID == n.id {
+			responses <- true
+			continue
+		}
+		go func(m Member) {
+			var resp VoteResponse
+			if err := n.transport.Call(ctx, m, rpcVote, &req, &resp); err != nil {
+				responses <- false
+				return
+			}
+			n.mu.Lock()
+			if resp.Term > n.term {
+				n.becomeFollower(resp.Term, "")
+			}
+			n.mu.Unlock()
+			responses <- resp.Granted
+		}(m)
+	}
+	granted := 0
+	for range members {
+		if <-responses {
+			granted++
+		}
+		if granted >= quorum {
+			return true
+		}
+	}
+	return false
+}
+
+// becomeFollower makes the member a follower, in the specified term if it is later than the current one. It must be
+// called with mu held
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term = term
+		n.vote = ""
+		n.persist()
+	}
+	if n.role == Leader {
+		n.logger.Info("stepped down as leader", "term", n.term)
+	}
+	n.role = Follower
+	n.leader = leader
+	n.transferee = ""
+	n.stopPeers()
+	n.notify()
+}
+
+// becomeLeader makes the member the leader, starting replication to the other members and appending a noop to
+// commit the entries of earlier terms. It must be called with mu held
+func (n *Node) becomeLeader() {
+	n.role = Leader
+	n.leader = n.id
+	n.peers = map[string]*peer{}
+	n.updatePeers()
+	n.logger.Info("elected leader", "term", n.term)
+	entry, err := n.appendEntry(Entry{Type: EntryNoop})
+	if err != nil {
+		n.becomeFollower(n.term, "")
+		return
+	}
+	n.leaderStart = entry.Index
+	n.notify()
+}
+
+// appendEntry appends an entry of the current term to the leader's log and starts replicating it. It must be called
+// with mu held
+func (n *Node) appendEntry(entry Entry) (Entry, error) {
+	entry.Index = n.lastIndex() + 1
+	entry.Term = n.term
+	if err := n.storage.Append([]Entry{entry}); err != nil {
+		n.logger.Error("appending to log", "error", err)
+		return entry, err
+	}
+	n.entries = append(n.entries, entry)
+	if entry.Type == EntryMembers {
+		n.updateMembers()
+		n.updatePeers()
+	}
+	for _, p := range n.peers {
+		wake(p)
+	}
+	n.advanceCommit()
+	return entry, nil
+}
+
+// updatePeers starts replicating to members added to the cluster, and stops replicating to those removed. It must
+// be called with mu held
+func (n *Node) updatePeers() {
+	if n.role != Leader {
+		return
+	}
+	current := map[string]bool{}
+	for _, m := range n.members {
+		current[m.ID] = true
+		if _, ok := n.peers[m.ID]; ok || m.ID == n.id {
+			continue
+		}
+		p := &peer{member: m, next: n.lastIndex() + 1, lastAck: time.Now(), wake: make(chan struct{}, 1), stop: make(chan struct{})}
+		n.peers[m.ID] = p
+		n.wg.Add(1)
+		go n.replicate(p, n.term)
+	}
+	for id, p := range n.peers {
+		if !current[id] {
+			close(p.stop)
+			delete(n.peers, id)
+		}
+	}
+}
+
+// stopPeers stops replicating to every member. It must be called with mu held
+func (n *Node) stopPeers() {
+	for id, p := range n.peers {
+		close(p.stop)
+		delete(n.peers, id)
+	}
+}
+
+func wake(p *peer) {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// replicate sends entries, or a snapshot if they have been discarded, to the peer while the member is the leader in
+// the specified term, and a heartbeat whenever it has nothing to send
+func (n *Node) replicate(p *peer, term uint64) {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		if n.role != Leader || n.term != term {
+			n.mu.Unlock()
+			return
+		}
+		if p.next <= n.snapshot.Index {
+			n.mu.Unlock()
+			if !n.sendSnapshot(p, term) && !n.pause(p) {
+				return
+			}
+			continue
+		}
+		prevTerm, _ := n.termAt(p.next - 1)
+		req := AppendRequest{
+			Term:         term,
+			Leader:       n.id,
+			PrevLogIndex: p.next - 1,
+			PrevLogTerm:  prevTerm,
+			Entries:      n.entriesFrom(p.next, maxAppendEntries),
+			LeaderCommit: n.commitIndex,
+		}
+		round := n.round
+		n.mu.Unlock()
+
+		var resp AppendResponse
+		ctx, cancel := context.WithTimeout(n.ctx, n.electionTimeout)
+		err := n.transport.Call(ctx, p.member, rpcAppend, &req, &resp)
+		cancel()
+
+		n.mu.Lock()
+		if n.role != Leader || n.term != term {
+			n.mu.Unlock()
+			return
+		}
+		if err != nil {
+			n.mu.Unlock()
+			if !n.pause(p) {
+				return
+			}
+			continue
+		}
+		if resp.Term > n.term {
+			n.becomeFollower(resp.Term, "")
+			n.mu.Unlock()
+			return
+		}
+		p.lastAck = time.Now()
+		p.round = max(p.round, round)
+		if resp.Success {
+			p.match = max(p.match, req.PrevLogIndex+uint64(len(req.Entries)))
+			p.next = p.match + 1
+			n.advanceCommit()
+			if n.transferee == p.member.ID && p.match == n.lastIndex() {
+				go n.timeoutNow(p.member, term)
+			}
+		} else {
+			p.next = max(1, min(p.next-1, resp.LastLogIndex+1))
+		}
+		n.notify()
+		more := p.next <= n.lastIndex()
+		n.mu.Unlock()
+		if !more && !n.pause(p) {
+			return
+		}
+	}
+}
+
+// pause waits until the peer is woken or the next heartbeat is due, returning false if replication to it has stopped
+func (n *Node) pause(p *peer) bool {
+	timer := time.NewTimer(n.heartbeat)
+	defer timer.Stop()
+	select {
+	case <-p.wake:
+	case <-timer.C:
+	case <-p.stop:
+		return false
+	case <-n.ctx.Done():
+		return false
+	}
+	return true
+}
+
+// sendSnapshot sends the peer a snapshot of the state machine, returning whether it was installed
+func (n *Node) sendSnapshot(p *peer, term uint64) bool {
+	n.applyMu.Lock()
+	n.mu.Lock()
+	indexTerm, _ := n.termAt(n.applied)
+	meta := SnapshotMeta{Index: n.applied, Term: indexTerm, Members: n.membersAt(n.applied)}
+	n.mu.Unlock()
+	snapshot, err := n.sm.Snapshot()
+	n.applyMu.Unlock()
+	if err != nil {
+		n.logger.Error("taking snapshot", "error", err)
+		return false
+	}
+
+	var resp SnapshotResponse
+	ctx, cancel := context.WithTimeout(n.ctx, 10*n.electionTimeout)
+	defer cancel()
+	if err := n.transport.Call(ctx, p.member, rpcSnapshot, &SnapshotRequest{Term: term, Leader: n.id, Meta: meta, Snapshot: snapshot}, &resp); err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term, "")
+		return false
+	}
+	p.lastAck = time.Now()
+	p.match = max(p.match, meta.Index)
+	p.next = p.match + 1
+	n.advanceCommit()
+	n.notify()
+	return true
+}
+
+// timeoutNow asks the member to start an election, to transfer leadership to it
+func (n *Node) timeoutNow(m Member, term uint64) {
+	ctx, cancel := context.WithTimeout(n.ctx, n.electionTimeout)
+	defer cancel()
+	var resp TimeoutNowResponse
+	if err := n.transport.Call(ctx, m, rpcTimeoutNow, &TimeoutNowRequest{Term: term, Leader: n.id}, &resp); err != nil {
+		n.logger.Warn("transferring leadership", "to", m.ID, "error", err)
+	}
+}
+
+// advanceCommit commits the latest entry of the current term which a majority of the members have stored. A leader
+// which has removed itself from the cluster steps down once the removal is committed. It must be called with mu held
+func (n *Node) advanceCommit() {
+	if n.role != Leader {
+		return
+	}
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.termAt(index); term != n.term {
+			// Entries of earlier terms are only committed by committing a later entry of the current term
+			break
+		}
+		stored := 0
+		for _, m := range n.members {
+			if p, ok := n.peers[m.ID]; m.ID == n.id || ok && p.match >= index {
+				stored++
+			}
+		}
+		if stored >= n.quorum() {
+			n.commitIndex = index
+			n.notify()
+			break
+		}
+	}
+	if !n.isMember(n.id) && n.commitIndex >= n.membersIndex() {
+		n.logger.Info("stepping down as leader, having been removed from the cluster")
+		n.becomeFollower(n.term, "")
+	}
+}
+
+// apply applies the committed entries to the state machine in order, resolving the proposals waiting for them
+func (n *Node) apply() {
+	defer n.wg.Done()
+	for {
+		n.applyMu.Lock()
+		n.mu.Lock()
+		for n.applied >= n.commitIndex {
+			changed := n.changed
+			n.mu.Unlock()
+			n.applyMu.Unlock()
+			select {
+			case <-changed:
+			case <-n.ctx.Done():
+				return
+			}
+			n.applyMu.Lock()
+			n.mu.Lock()
+		}
+		entry := n.entriesFrom(n.applied+1, 1)[0]
+		n.mu.Unlock()
+
+		var err error
+		if entry.Type == EntryCommand {
+			err = n.sm.Apply(entry.Command)
+		}
+
+		n.mu.Lock()
+		w, waiting := n.waiters[entry.Index]
+		if waiting {
+			delete(n.waiters, entry.Index)
+			if w.term != entry.Term {
+				w.done <- ErrLeadershipLost
+			} else {
+				w.done <- err
+			}
+		}
+		n.applyErr = err
+		if err != nil {
+			// The entry is applied again until it succeeds, as later entries must not be applied before it
+			n.logger.Error("applying committed entry", "index", entry.Index, "error", err)
+			n.mu.Unlock()
+			n.applyMu.Unlock()
+			select {
+			case <-time.After(n.heartbeat):
+			case <-n.ctx.Done():
+				return
+			}
+			continue
+		}
+		n.applied = entry.Index
+		if n.applied-n.snapshot.Index >= n.compactAfter {
+			n.compact()
+		}
+		n.notify()
+		n.mu.Unlock()
+		n.applyMu.Unlock()
+	}
+}
+
+// compact discards the applied entries from the log, as their effect has been persisted by the state machine. It
+// must be called with mu held
+func (n *Node) compact() {
+	term, _ := n.termAt(n.applied)
+	meta := SnapshotMeta{Index: n.applied, Term: term, Members: n.membersAt(n.applied)}
+	if err := n.storage.Compact(meta); err != nil {
+		n.logger.Error("compacting log", "error", err)
+		return
+	}
+	n.snapshot = meta
+	n.entries = entriesAfter(n.entries, meta.Index)
+}
+
+// handleVote responds to a request for the member's vote
+func (n *Node) handleVote(req *VoteRequest) *VoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	resp := &VoteResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp
+	}
+	// A member which has heard from the leader within the election timeout refuses candidates, unless the leader is
+	// transferring leadership, so that a member which cannot hear the leader does not disrupt the others
+	if !req.Transfer && (n.role == Leader || n.leader != "" && time.Since(n.lastContact) < n.electionTimeout) {
+		return resp
+	}
+	upToDate := req.LastLogTerm > n.lastTerm() || req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex()
+	if req.PreVote {
+		resp.Granted = upToDate
+		return resp
+	}
+	if req.Term > n.term {
+		n.becomeFollower(req.Term, "")
+		resp.Term = n.term
+	}
+	if (n.vote == "" || n.vote == req.Candidate) && upToDate {
+		n.vote = req.Candidate
+		if n.persist() == nil {
+			n.resetElectionDue()
+			resp.Granted = true
+		}
+	}
+	return resp
+}
+
+// handleAppend appends the leader's entries to the log, replacing any which conflict with them
+func (n *Node) handleAppend(req *AppendRequest) *AppendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	resp := &AppendResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp
+	}
+	n.heardFrom(req.Term, req.Leader)
+	resp.Term = n.term
+
+	entries := req.Entries
+	if req.PrevLogIndex < n.snapshot.Index {
+		// The entries up to the compaction are committed, so match the leader's
+		entries = entriesAfter(entries, n.snapshot.Index)
+		req.PrevLogIndex, req.PrevLogTerm = n.snapshot.Index, n.snapshot.Term
+	}
+	if req.PrevLogIndex > n.lastIndex() {
+		resp.LastLogIndex = n.lastIndex()
+		return resp
+	}
+	if term, _ := n.termAt(req.PrevLogIndex); term != req.PrevLogTerm {
+		// Skip back past every entry of the conflicting term, rather than retrying one entry at a time
+		index := req.PrevLogIndex
+		for index-1 > n.snapshot.Index {
+			if earlier, _ := n.termAt(index - 1); earlier != term {
+				break
+			}
+			index--
+		}
+		resp.LastLogIndex = index - 1
+		return resp
+	}
+
+	for i, entry := range entries {
+		if term, ok := n.termAt(entry.Index); ok && term == entry.Term {
+			continue
+		}
+		if err := n.storage.Append(entries[i:]); err != nil {
+			n.logger.Error("appending to log", "error", err)
+			resp.LastLogIndex = req.PrevLogIndex
+			return resp
+		}
+		n.entries = append(entriesBefore(n.entries, entry.Index), entries[i:]...)
+		n.updateMembers()
+		break
+	}
+	if req.LeaderCommit > n.commitIndex {
+		n.commitIndex = min(req.LeaderCommit, req.PrevLogIndex+uint64(len(entries)))
+		n.notify()
+	}
+	resp.Success = true
+	resp.LastLogIndex = n.lastIndex()
+	return resp
+}
+
+// handleSnapshot replaces the state machine and log with the leader's snapshot
+func (n *Node) handleSnapshot(req *SnapshotRequest) (*SnapshotResponse, error) {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	if req.Term < n.term {
+		defer n.mu.Unlock()
+		return &SnapshotResponse{Term: n.term}, nil
+	}
+	n.heardFrom(req.Term, req.Leader)
+	if req.Meta.Index <= n.applied {
+		defer n.mu.Unlock()
+		return &SnapshotResponse{Term: n.term}, nil
+	}
+	n.mu.Unlock()
+
+	if err := n.sm.Restore(req.Snapshot); err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.storage.Compact(req.Meta); err != nil {
+		return nil, err
+	}
+	if term, ok := n.termAt(req.Meta.Index); ok && term == req.Meta.Term {
+		n.entries = entriesAfter(n.entries, req.Meta.Index)
+	} else {
+		n.entries = nil
+	}
+	n.snapshot = req.Meta
+	n.commitIndex = max(n.commitIndex, req.Meta.Index)
+	n.applied = req.Meta.Index
+	for index, w := range n.waiters {
+		if index <= n.applied {
+			w.done <- ErrLeadershipLost
+			delete(n.waiters, index)
+		}
+	}
+	n.updateMembers()
+	n.notify()
+	return &SnapshotResponse{Term: n.term}, nil
+}
+
+// handleTimeoutNow starts an election at once, at the request of the leader transferring leadership
+func (n *Node) handleTimeoutNow(req *TimeoutNowRequest) *TimeoutNowResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term == n.term && req.Leader == n.leader && n.role == Follower {
+		go n.campaign(true)
+	}
+	return &TimeoutNowResponse{Term: n.term}
+}
+
+// heardFrom records a request from the leader of the specified term. It must be called with mu held
+func (n *Node) heardFrom(term uint64, leader string) {
+	if term > n.term || n.role != Follower || n.leader != leader {
+		n.becomeFollower(term, leader)
+	}
+	n.lastContact = time.Now()
+	n.resetElectionDue()
+}
+
+// persist stores the term and vote. It must be called with mu held
+func (n *Node) persist() error {
+	err := n.storage.SetHardState(HardState{Term: n.term, Vote: n.vote})
+	if err != nil {
+		n.logger.Error("persisting state", "error", err)
+	}
+	return err
+}
+
+// resetElectionDue schedules an election after a random time between one and two election timeouts, so that members
+// rarely start elections together. It must be called with mu held
+func (n *Node) resetElectionDue() {
+	n.electionDue = time.Now().Add(n.electionTimeout + time.Duration(rand.Int63n(int64(n.electionTimeout))))
+}
+
+// updateMembers sets the members from the latest members entry in the log, or else the compaction. It must be called
+// with mu held
+func (n *Node) updateMembers() {
+	n.members = n.membersAt(n.lastIndex())
+}
+
+// membersAt returns the members as of the specified index. It must be called with mu held
+func (n *Node) membersAt(index uint64) []Member {
+	for i := len(n.entries) - 1; i >= 0; i-- {
+		if n.entries[i].Index <= index && n.entries[i].Type == EntryMembers {
+			return n.entries[i].Members
+		}
+	}
+	return n.snapshot.Members
+}
+
+// membersIndex returns the index of the latest members entry in the log, or else of the compaction. It must be called
+// with mu held
+func (n *Node) membersIndex() uint64 {
+	for i := len(n.entries) - 1; i >= 0; i-- {
+		if n.entries[i].Type == EntryMembers {
+			return n.entries[i].Index
+		}
+	}
+	return n.snapshot.Index
+}
+
+func (n *Node) isMember(id string) bool {
+	for _, m := range n.members {
+		if m.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// quorum is the number of members which make a majority
+func (n *Node) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+func (n *Node) lastIndex() uint64 {
+	if len(n.entries) > 0 {
+		return n.entries[len(n.entries)-1].Index
+	}
+	return n.snapshot.Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	if len(n.entries) > 0 {
+		return n.entries[len(n.entries)-1].Term
+	}
+	return n.snapshot.Term
+}
+
+// termAt returns the term of the entry at the specified index, if it is in the log or is the last compacted
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	if index == n.snapshot.Index {
+		return n.snapshot.Term, true
+	}
+	if index < n.snapshot.Index || index > n.lastIndex() {
+		return 0, false
+	}
+	return n.entries[index-n.snapshot.Index-1].Term, true
+}
+
+// entriesFrom returns up to the specified number of entries from the index, which must be after the compaction
+func (n *Node) entriesFrom(index uint64, limit int) []Entry {
+	entries := n.entries[index-n.snapshot.Index-1:]
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return append([]Entry(nil), entries...)
+}
+
+func sortedMembers(members []Member) []Member {
+	members = append([]Member(nil), members...)
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
@@ -0,0 +1,427 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testHeartbeat       = 10 * time.Millisecond
+	testElectionTimeout = 50 * time.Millisecond
+	testWait            = 5 * time.Second
+)
+
+// kvStateMachine sets a key to a value for each command
+type kvStateMachine struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+type setCommand struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (sm *kvStateMachine) Apply(command json.RawMessage) error {
+	var set setCommand
+	if err := json.Unmarshal(command, &set); err != nil {
+		return err
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.data[set.Key] = set.Value
+	return nil
+}
+
+func (sm *kvStateMachine) Snapshot() (json.RawMessage, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return json.Marshal(sm.data)
+}
+
+func (sm *kvStateMachine) Restore(snapshot json.RawMessage) error {
+	data := map[string]string{}
+	if err := json.Unmarshal(snapshot, &data); err != nil {
+		return err
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.data = data
+	return nil
+}
+
+func (sm *kvStateMachine) get(key string) string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.data[key]
+}
+
+// testCluster is a cluster of nodes connected by a Network
+type testCluster struct {
+	t        *testing.T
+	network  *Network
+	nodes    map[string]*Node
+	machines map[string]*kvStateMachine
+	storages map[string]*MemoryStorage
+	compact  int
+}
+
+// newTestCluster starts a cluster with the specified member IDs, which compacts its log after the specified number
+// of entries if positive
+func newTestCluster(t *testing.T, compact int, ids ...string) *testCluster {
+	c := &testCluster{t: t, network: NewNetwork(), nodes: map[string]*Node{}, machines: map[string]*kvStateMachine{}, storages: map[string]*MemoryStorage{}, compact: compact}
+	var members []Member
+	for _, id := range ids {
+		members = append(members, Member{ID: id})
+	}
+	for _, id := range ids {
+		c.start(id, members)
+	}
+	t.Cleanup(func() {
+		for _, n := range c.nodes {
+			n.Stop()
+		}
+	})
+	return c
+}
+
+// start starts the member with the specified ID, resuming from its storage if it has been started before
+func (c *testCluster) start(id string, members []Member) *Node {
+	if c.storages[id] == nil {
+		c.storages[id] = NewMemoryStorage()
+		c.machines[id] = &kvStateMachine{data: map[string]string{}}
+	}
+	n, err := NewNode(Config{
+		ID:                id,
+		Members:           members,
+		Transport:         c.network.Transport(id),
+		Storage:           c.storages[id],
+		StateMachine:      c.machines[id],
+		HeartbeatInterval: testHeartbeat,
+		ElectionTimeout:   testElectionTimeout,
+		CompactAfter:      c.compact,
+	})
+	if !assert.NoError(c.t, err) {
+		c.t.FailNow()
+	}
+	c.nodes[id] = n
+	c.network.Register(id, Handler(n))
+	n.Start()
+	return n
+}
+
+// leader waits for one of the specified members to be elected leader, with the others following it
+func (c *testCluster) leader(ids ...string) *Node {
+	c.t.Helper()
+	var leader *Node
+	assert.Eventually(c.t, func() bool {
+		leader = nil
+		var term uint64
+		for _, id := range ids {
+			status := c.nodes[id].Status()
+			if status.Role == Leader {
+				leader = c.nodes[id]
+				term = status.Term
+			}
+		}
+		if leader == nil {
+			return false
+		}
+		for _, id := range ids {
+			if status := c.nodes[id].Status(); status.Term != term || status.Leader != leader.ID() {
+				return false
+			}
+		}
+		return true
+	}, testWait, testHeartbeat)
+	if leader == nil {
+		c.t.FailNow()
+	}
+	return leader
+}
+
+func (c *testCluster) set(n *Node, key, value string) error {
+	command, _ := json.Marshal(setCommand{Key: key, Value: value})
+	ctx, cancel := context.WithTimeout(context.Background(), testWait)
+	defer cancel()
+	return n.Propose(ctx, command)
+}
+
+// awaitValue waits for each of the specified members to apply the key's value
+func (c *testCluster) awaitValue(key, value string, ids ...string) {
+	c.t.Helper()
+	for _, id := range ids {
+		assert.Eventually(c.t, func() bool {
+			return c.machines[id].get(key) == value
+		}, testWait, testHeartbeat, id)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	c := newTestCluster(t, 0, "a", "b", "c")
+	leader := c.leader("a", "b", "c")
+
+	// A command is applied by the leader once committed, and by the others once they learn it is
+	assert.NoError(t, c.set(leader, "key1", "value1"))
+	assert.Equal(t, "value1", c.machines[leader.ID()].get("key1"))
+	c.awaitValue("key1", "value1", "a", "b", "c")
+
+	for _, n := range c.nodes {
+		if n != leader {
+			assert.ErrorIs(t, c.set(n, "key1", "value2"), ErrNotLeader)
+			assert.ErrorIs(t, n.Barrier(context.Background()), ErrNotLeader)
+			assert.ErrorIs(t, n.ReadIndex(context.Background()), ErrNotLeader)
+		}
+	}
+	assert.NoError(t, leader.Barrier(context.Background()))
+	assert.NoError(t, leader.ReadIndex(context.Background()))
+
+	status := leader.Status()
+	assert.Equal(t, []Member{{ID: "a"}, {ID: "b"}, {ID: "c"}}, status.Members)
+	// The noop of the election, then the command
+	assert.Equal(t, uint64(2), status.CommitIndex)
+	assert.Equal(t, uint64(2), status.AppliedIndex)
+}
+
+func TestPartition(t *testing.T) {
+	c := newTestCluster(t, 0, "a", "b", "c")
+	oldLeader := c.leader("a", "b", "c")
+	assert.NoError(t, c.set(oldLeader, "key1", "value1"))
+	var others []string
+	for id := range c.nodes {
+		if id != oldLeader.ID() {
+			others = append(others, id)
+		}
+	}
+
+	// The majority elects a new leader, while the old leader cannot commit, and steps down
+	c.network.Partition([]string{oldLeader.ID()}, others)
+	leader := c.leader(others...)
+	assert.Greater(t, leader.Status().Term, oldLeader.Status().Term)
+	assert.NoError(t, c.set(leader, "key1", "value2"))
+	assert.Eventually(t, func() bool {
+		return oldLeader.Status().Role == Follower
+	}, testWait, testHeartbeat)
+	assert.ErrorIs(t, c.set(oldLeader, "key1", "value3"), ErrNotLeader)
+	assert.Equal(t, "value1", c.machines[oldLeader.ID()].get("key1"))
+
+	// Once healed the old leader follows the new one, and catches up
+	c.network.Heal()
+	assert.Equal(t, leader, c.leader("a", "b", "c"))
+	c.awaitValue("key1", "value2", "a", "b", "c")
+}
+
+func TestPartitionUncommitted(t *testing.T) {
+	c := newTestCluster(t, 0, "a", "b", "c")
+	oldLeader := c.leader("a", "b", "c")
+	var others []string
+	for id := range c.nodes {
+		if id != oldLeader.ID() {
+			others = append(others, id)
+		}
+	}
+
+	// A proposal to a leader cut off from the majority is replaced by the new leader's entries once healed
+	c.network.Partition([]string{oldLeader.ID()}, others)
+	command, _ := json.Marshal(setCommand{Key: "key1", Value: "lost"})
+	proposed := make(chan error, 1)
+	go func() {
+		proposed <- oldLeader.Propose(context.Background(), command)
+	}()
+	leader := c.leader(others...)
+	assert.NoError(t, c.set(leader, "key1", "value1"))
+	c.network.Heal()
+	select {
+	case err := <-proposed:
+		assert.ErrorIs(t, err, ErrLeadershipLost)
+	case <-time.After(testWait):
+		assert.Fail(t, "the lost proposal should fail")
+	}
+	c.awaitValue("key1", "value1", "a", "b", "c")
+}
+
+func TestPreVote(t *testing.T) {
+	c := newTestCluster(t, 0, "a", "b", "c")
+	leader := c.leader("a", "b", "c")
+	term := leader.Status().Term
+	var isolated string
+	var others []string
+	for id := range c.nodes {
+		if id == leader.ID() || isolated != "" {
+			others = append(others, id)
+		} else {
+			isolated = id
+		}
+	}
+
+	// A member which cannot reach the others does not increase its term, so does not disrupt the leader on rejoining
+	c.network.Partition(others)
+	time.Sleep(10 * testElectionTimeout)
+	assert.Equal(t, term, c.nodes[isolated].Status().Term)
+	c.network.Heal()
+	assert.NoError(t, c.set(leader, "key1", "value1"))
+	c.awaitValue("key1", "value1", "a", "b", "c")
+	assert.Equal(t, leader, c.leader("a", "b", "c"))
+	assert.Equal(t, term, leader.Status().Term)
+}
+
+func TestReadIndexPartitioned(t *testing.T) {
+	c := newTestCluster(t, 0, "a", "b", "c")
+	leader := c.leader("a", "b", "c")
+
+	// A leader which cannot confirm its leadership with a majority does not serve linearizable reads
+	c.network.Partition([]string{leader.ID()})
+	ctx, cancel := context.WithTimeout(context.Background(), testElectionTimeout/2)
+	defer cancel()
+	assert.Error(t, leader.ReadIndex(ctx))
+}
+
+func TestTransferLeadership(t *testing.T) {
+	c := newTestCluster(t, 0, "a", "b", "c")
+	leader := c.leader("a", "b", "c")
+	assert.NoError(t, c.set(leader, "key1", "value1"))
+
+	var target string
+	for id := range c.nodes {
+		if id != leader.ID() {
+			target = id
+		}
+	}
+	assert.NoError(t, leader.TransferLeadership(context.Background(), target))
+	assert.Equal(t, target, c.leader("a", "b", "c").ID())
+	assert.NoError(t, c.set(c.nodes[target], "key1", "value2"))
+	c.awaitValue("key1", "value2", "a", "b", "c")
+
+	// Without a target, the most up-to-date member takes over
+	assert.NoError(t, c.nodes[target].TransferLeadership(context.Background(), ""))
+	assert.NotEqual(t, target, c.leader("a", "b", "c").ID())
+
+	leader = c.leader("a", "b", "c")
+	assert.ErrorIs(t, leader.TransferLeadership(context.Background(), "z"), ErrUnknownMember)
+	assert.NoError(t, leader.TransferLeadership(context.Background(), leader.ID()))
+	assert.Equal(t, Leader, leader.Status().Role)
+	assert.ErrorIs(t, c.nodes[target].TransferLeadership(context.Background(), ""), ErrNotLeader)
+}
+
+func TestMembership(t *testing.T) {
+	c := newTestCluster(t, 0, "a", "b", "c")
+	leader := c.leader("a", "b", "c")
+	assert.NoError(t, c.set(leader, "key1", "value1"))
+
+	// A new member starts with no members, and catches up once added
+	c.start("d", nil)
+	assert.Empty(t, c.nodes["d"].Status().Members)
+	assert.NoError(t, leader.AddMember(context.Background(), Member{ID: "d", Address: "d:9080"}))
+	assert.ErrorIs(t, leader.AddMember(context.Background(), Member{ID: "d"}), ErrMemberExists)
+	c.awaitValue("key1", "value1", "d")
+	assert.Equal(t, leader, c.leader("a", "b", "c", "d"))
+	member, ok := c.nodes["d"].Leader()
+	assert.True(t, ok)
+	assert.Equal(t, leader.ID(), member.ID)
+	assert.Len(t, c.nodes["d"].Status().Members, 4)
+
+	// A majority of the four members is needed to commit
+	var follower string
+	for _, id := range []string{"a", "b", "c"} {
+		if id != leader.ID() && follower == "" {
+			follower = id
+		}
+	}
+	assert.NoError(t, leader.RemoveMember(context.Background(), follower))
+	assert.ErrorIs(t, leader.RemoveMember(context.Background(), follower), ErrUnknownMember)
+	var remaining []string
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if id != follower {
+			remaining = append(remaining, id)
+		}
+	}
+	assert.NoError(t, c.set(leader, "key1", "value2"))
+	c.awaitValue("key1", "value2", remaining...)
+
+	// A leader which removes itself steps down, and the others elect a new leader
+	assert.NoError(t, leader.RemoveMember(context.Background(), leader.ID()))
+	assert.Eventually(t, func() bool {
+		return leader.Status().Role == Follower
+	}, testWait, testHeartbeat)
+	var rest []string
+	for _, id := range remaining {
+		if id != leader.ID() {
+			rest = append(rest, id)
+		}
+	}
+	newLeader := c.leader(rest...)
+	assert.NotEqual(t, leader, newLeader)
+	assert.Len(t, newLeader.Status().Members, 2)
+	assert.NoError(t, c.set(newLeader, "key1", "value3"))
+	c.awaitValue("key1", "value3", rest...)
+}
+
+func TestSnapshot(t *testing.T) {
+	c := newTestCluster(t, 5, "a", "b", "c")
+	leader := c.leader("a", "b", "c")
+	var lagging string
+	var others []string
+	for id := range c.nodes {
+		if id == leader.ID() || lagging != "" {
+			others = append(others, id)
+		} else {
+			lagging = id
+		}
+	}
+
+	// A member which misses entries discarded by compaction is sent a snapshot
+	c.network.Partition(others)
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, c.set(leader, fmt.Sprintf("key%d", i), "value1"))
+	}
+	assert.Greater(t, leader.snapshotIndex(), uint64(5))
+	c.network.Heal()
+	c.awaitValue("key19", "value1", lagging)
+	assert.Equal(t, "value1", c.machines[lagging].get("key0"))
+	assert.NoError(t, c.set(leader, "key0", "value2"))
+	c.awaitValue("key0", "value2", "a", "b", "c")
+}
+
+func TestRestart(t *testing.T) {
+	c := newTestCluster(t, 3, "a", "b", "c")
+	leader := c.leader("a", "b", "c")
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, c.set(leader, fmt.Sprintf("key%d", i), "value1"))
+	}
+	c.awaitValue("key4", "value1", "a", "b", "c")
+
+	// Restarted members resume from their storage, with the members of the cluster and the term they reached
+	term := leader.Status().Term
+	for _, id := range []string{"a", "b", "c"} {
+		c.nodes[id].Stop()
+		c.start(id, nil)
+	}
+	leader = c.leader("a", "b", "c")
+	assert.Greater(t, leader.Status().Term, term)
+	assert.NoError(t, c.set(leader, "key5", "value1"))
+	c.awaitValue("key5", "value1", "a", "b", "c")
+	assert.Equal(t, "value1", c.machines[leader.ID()].get("key4"))
+	assert.Len(t, leader.Status().Members, 3)
+}
+
+func TestStop(t *testing.T) {
+	c := newTestCluster(t, 0, "a")
+	leader := c.leader("a")
+	assert.NoError(t, c.set(leader, "key1", "value1"))
+	leader.Stop()
+	assert.ErrorIs(t, c.set(leader, "key1", "value2"), ErrStopped)
+	assert.ErrorIs(t, leader.RemoveMember(context.Background(), "a"), ErrLastMember)
+}
+
+// snapshotIndex returns the index of the latest compaction of the log
+func (n *Node) snapshotIndex() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.snapshot.Index
+}
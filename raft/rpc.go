@@ -0,0 +1,246 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// The RPCs between members, each served at its name under the path prefix of Handler
+const (
+	rpcVote       = "vote"
+	rpcAppend     = "append"
+	rpcSnapshot   = "snapshot"
+	rpcTimeoutNow = "timeout-now"
+)
+
+// ErrUnreachable is returned by a Network for calls between members it has partitioned
+var ErrUnreachable = errors.New("raft: member is unreachable")
+
+// VoteRequest asks a member to vote for the candidate in an election, or in a pre-vote whether it would
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+	// PreVote asks whether the member would vote for the candidate, without it changing its state
+	PreVote bool `json:"preVote,omitempty"`
+	// Transfer is set when the leader has asked the candidate to take over, so it is not refused for there being a
+	// leader
+	Transfer bool `json:"transfer,omitempty"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// AppendRequest replicates entries from the leader, or with none is a heartbeat
+type AppendRequest struct {
+	Term         uint64  `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevLogIndex uint64  `json:"prevLogIndex"`
+	PrevLogTerm  uint64  `json:"prevLogTerm"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leaderCommit"`
+}
+
+type AppendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// LastLogIndex is the member's last entry if the entries were appended, and otherwise the index after which the
+	// leader should retry
+	LastLogIndex uint64 `json:"lastLogIndex"`
+}
+
+// SnapshotRequest replaces the state of a member too far behind to be sent the entries it is missing
+type SnapshotRequest struct {
+	Term     uint64          `json:"term"`
+	Leader   string          `json:"leader"`
+	Meta     SnapshotMeta    `json:"meta"`
+	Snapshot json.RawMessage `json:"snapshot"`
+}
+
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// TimeoutNowRequest asks a member to start an election at once, to transfer leadership to it
+type TimeoutNowRequest struct {
+	Term   uint64 `json:"term"`
+	Leader string `json:"leader"`
+}
+
+type TimeoutNowResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// Transport calls an RPC of another member, which serves it with the handler returned by Handler
+type Transport interface {
+	Call(ctx context.Context, to Member, rpc string, req, resp interface{}) error
+}
+
+// Handler serves the RPCs of the node as POST requests to /raft/{rpc} with JSON bodies
+func Handler(n *Node) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var resp interface{}
+		var err error
+		switch rpc := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]; rpc {
+		case rpcVote:
+			var req VoteRequest
+			if err = json.NewDecoder(r.Body).Decode(&req); err == nil {
+				resp = n.handleVote(&req)
+			}
+		case rpcAppend:
+			var req AppendRequest
+			if err = json.NewDecoder(r.Body).Decode(&req); err == nil {
+				resp = n.handleAppend(&req)
+			}
+		case rpcSnapshot:
+			var req SnapshotRequest
+			if err = json.NewDecoder(r.Body).Decode(&req); err == nil {
+				resp, err = n.handleSnapshot(&req)
+			}
+		case rpcTimeoutNow:
+			var req TimeoutNowRequest
+			if err = json.NewDecoder(r.Body).Decode(&req); err == nil {
+				resp = n.handleTimeoutNow(&req)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		respBody, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(respBody)
+	})
+}
+
+// HTTPTransport calls RPCs over HTTP at the address of each member, authenticated with a bearer token if set
+type HTTPTransport struct {
+	Client *http.Client
+	Token  string
+}
+
+func (t HTTPTransport) Call(ctx context.Context, to Member, rpc string, req, resp interface{}) error {
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(to.Address, "/")+"/raft/"+rpc, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if t.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+t.Token)
+	}
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	return decodeResponse(httpResp.StatusCode, httpResp.Body, resp)
+}
+
+// Network is an in-process transport between the handlers of members, for tests, which can be partitioned to
+// simulate the failure of links between them
+type Network struct {
+	mu       sync.Mutex
+	handlers map[string]http.Handler
+	// groups holds the partition of each member while the network is partitioned
+	groups map[string]int
+}
+
+func NewNetwork() *Network {
+	return &Network{handlers: map[string]http.Handler{}}
+}
+
+// Register routes calls to the member with the specified ID to the handler, which serves Handler at /raft/
+func (nw *Network) Register(id string, handler http.Handler) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.handlers[id] = handler
+}
+
+// Partition splits the network so that members can only reach the other members in their group. Members in no group
+// can reach no one
+func (nw *Network) Partition(groups ...[]string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.groups = map[string]int{}
+	for i, group := range groups {
+		for _, id := range group {
+			nw.groups[id] = i + 1
+		}
+	}
+}
+
+// Heal ends any partition
+func (nw *Network) Heal() {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.groups = nil
+}
+
+// Transport returns the transport by which the member with the specified ID calls the others
+func (nw *Network) Transport(id string) Transport {
+	return networkTransport{network: nw, from: id}
+}
+
+type networkTransport struct {
+	network *Network
+	from    string
+}
+
+func (t networkTransport) Call(ctx context.Context, to Member, rpc string, req, resp interface{}) error {
+	nw := t.network
+	nw.mu.Lock()
+	handler := nw.handlers[to.ID]
+	reachable := handler != nil
+	if nw.groups != nil {
+		group := nw.groups[t.from]
+		reachable = reachable && group != 0 && group == nw.groups[to.ID]
+	}
+	nw.mu.Unlock()
+	if !reachable {
+		return ErrUnreachable
+	}
+
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq := httptest.NewRequest(http.MethodPost, "/raft/"+rpc, bytes.NewReader(reqBody)).WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httpReq)
+	return decodeResponse(recorder.Code, recorder.Body, resp)
+}
+
+func decodeResponse(code int, body io.Reader, resp interface{}) error {
+	if code != http.StatusOK {
+		message, _ := io.ReadAll(body)
+		return fmt.Errorf("raft: unexpected status %d: %s", code, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(body).Decode(resp)
+}
@@ -0,0 +1,334 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	stateFileName = "state.json"
+	logFileName   = "log"
+
+	// logHeaderSize is the size of the header of each log record: the length of the entry, then its checksum
+	logHeaderSize = 8
+)
+
+// HardState is the state a member must persist before responding to any RPC: its current term and its vote in it
+type HardState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote,omitempty"`
+}
+
+// SnapshotMeta describes the latest compaction of the log: the index and term of the last entry discarded, which the
+// state machine has applied, and the members of the cluster as of that entry
+type SnapshotMeta struct {
+	Index   uint64   `json:"index"`
+	Term    uint64   `json:"term"`
+	Members []Member `json:"members,omitempty"`
+}
+
+// Storage persists a member's hard state and log
+type Storage interface {
+	// Load returns the hard state, the latest compaction and the entries after it
+	Load() (HardState, SnapshotMeta, []Entry, error)
+	// SetHardState replaces the hard state
+	SetHardState(state HardState) error
+	// Append stores the entries, which follow on from each other, replacing any stored entries from the index of the
+	// first of them
+	Append(entries []Entry) error
+	// Compact discards the entries up to and including the index of the compaction, recording it
+	Compact(meta SnapshotMeta) error
+}
+
+// MemoryStorage holds the state in memory, for tests. A Node restarted with the same MemoryStorage resumes from it
+type MemoryStorage struct {
+	mu      sync.Mutex
+	state   HardState
+	meta    SnapshotMeta
+	entries []Entry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (s *MemoryStorage) Load() (HardState, SnapshotMeta, []Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.meta, append([]Entry(nil), s.entries...), nil
+}
+
+func (s *MemoryStorage) SetHardState(state HardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	return nil
+}
+
+func (s *MemoryStorage) Append(entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(entries) > 0 {
+		s.entries = append(entriesBefore(s.entries, entries[0].Index), entries...)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Compact(meta SnapshotMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.meta = meta
+	s.entries = entriesAfter(s.entries, meta.Index)
+	return nil
+}
+
+// FileStorage persists the state in a directory: the hard state and latest compaction in a JSON file which is
+// replaced atomically, and the entries in a log file to which each is appended and synced
+type FileStorage struct {
+	dir string
+
+	mu    sync.Mutex
+	state fileState
+	log   *os.File
+	// entries are the entries in the log file, with the offset of each record in offsets
+	entries []Entry
+	offsets []int64
+	size    int64
+}
+
+// fileState is the content of the state file
+type fileState struct {
+	HardState
+	Snapshot SnapshotMeta `json:"snapshot"`
+}
+
+// OpenFileStorage opens the storage in the specified directory, creating it if it does not exist. A record which was
+// not completely written, because the process stopped while appending it, ends the log and is truncated
+func OpenFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &FileStorage{dir: dir}
+	data, err := os.ReadFile(filepath.Join(dir, stateFileName))
+	if err == nil {
+		err = json.Unmarshal(data, &s.state)
+	} else if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.log, err = os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	data, err = io.ReadAll(s.log)
+	if err != nil {
+		s.log.Close()
+		return nil, err
+	}
+	for len(data) >= logHeaderSize {
+		length := binary.LittleEndian.Uint32(data)
+		checksum := binary.LittleEndian.Uint32(data[4:])
+		if uint64(len(data)-logHeaderSize) < uint64(length) {
+			break
+		}
+		payload := data[logHeaderSize : logHeaderSize+length]
+		var entry Entry
+		if crc32.ChecksumIEEE(payload) != checksum || json.Unmarshal(payload, &entry) != nil {
+			break
+		}
+		s.entries = append(s.entries, entry)
+		s.offsets = append(s.offsets, s.size)
+		s.size += logHeaderSize + int64(length)
+		data = data[logHeaderSize+length:]
+	}
+	if err := s.truncate(s.size); err != nil {
+		s.log.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileStorage) Load() (HardState, SnapshotMeta, []Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The log is rewritten after the state file records a compaction, so may still hold the entries it discarded
+	return s.state.HardState, s.state.Snapshot, entriesAfter(s.entries, s.state.Snapshot.Index), nil
+}
+
+func (s *FileStorage) SetHardState(state HardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.state
+	next.HardState = state
+	if err := s.writeState(next); err != nil {
+		return err
+	}
+	s.state = next
+	return nil
+}
+
+func (s *FileStorage) Append(entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	// Entries replacing those stored are rare, following a change of leader, so the log is truncated to them
+	kept := len(entriesBefore(s.entries, entries[0].Index))
+	if kept < len(s.entries) {
+		if err := s.truncate(s.offsets[kept]); err != nil {
+			return err
+		}
+		s.size = s.offsets[kept]
+		s.entries, s.offsets = s.entries[:kept], s.offsets[:kept]
+	}
+
+	var buf bytes.Buffer
+	offsets := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		offsets = append(offsets, s.size+int64(buf.Len()))
+		if err := appendRecord(&buf, entry); err != nil {
+			return err
+		}
+	}
+	_, err := s.log.Write(buf.Bytes())
+	if err == nil {
+		err = s.log.Sync()
+	}
+	if err != nil {
+		// Remove any part of the records which was written, so that later records are not lost behind it on replay
+		return errors.Join(err, s.truncate(s.size))
+	}
+	s.entries = append(s.entries, entries...)
+	s.offsets = append(s.offsets, offsets...)
+	s.size += int64(buf.Len())
+	return nil
+}
+
+func (s *FileStorage) Compact(meta SnapshotMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.state
+	next.Snapshot = meta
+	if err := s.writeState(next); err != nil {
+		return err
+	}
+	s.state = next
+
+	// Rewrite the log without the discarded entries, replacing it atomically
+	kept := entriesAfter(s.entries, meta.Index)
+	var buf bytes.Buffer
+	offsets := make([]int64, 0, len(kept))
+	for _, entry := range kept {
+		offsets = append(offsets, int64(buf.Len()))
+		if err := appendRecord(&buf, entry); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(s.dir, logFileName)
+	if err := writeFileSynced(path+".tmp", buf.Bytes()); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	log, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := log.Seek(0, io.SeekEnd); err != nil {
+		log.Close()
+		return err
+	}
+	s.log.Close()
+	s.log = log
+	s.entries, s.offsets, s.size = kept, offsets, int64(buf.Len())
+	return nil
+}
+
+// Close closes the log file
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
+
+// writeState replaces the state file atomically
+func (s *FileStorage) writeState(state fileState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, stateFileName)
+	if err := writeFileSynced(path+".tmp", data); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// truncate cuts the log file to the specified length, and positions it there for the next append
+func (s *FileStorage) truncate(length int64) error {
+	if err := s.log.Truncate(length); err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(length, io.SeekStart); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// appendRecord writes the entry as a log record: its length, its checksum and then the entry as JSON
+func appendRecord(buf *bytes.Buffer, entry Entry) error {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	var header [logHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	buf.Write(header[:])
+	buf.Write(payload)
+	return nil
+}
+
+func writeFileSynced(path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	return errors.Join(err, file.Close())
+}
+
+// entriesBefore returns the entries with an index less than the specified index
+func entriesBefore(entries []Entry, index uint64) []Entry {
+	for i, entry := range entries {
+		if entry.Index >= index {
+			return entries[:i]
+		}
+	}
+	return entries
+}
+
+// entriesAfter returns the entries with an index greater than the specified index
+func entriesAfter(entries []Entry, index uint64) []Entry {
+	for i, entry := range entries {
+		if entry.Index > index {
+			return entries[i:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package raft
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestStorage(t *testing.T, dir string) *FileStorage {
+	s, err := OpenFileStorage(dir)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func entries(term uint64, indexes ...uint64) []Entry {
+	var entries []Entry
+	for _, index := range indexes {
+		entries = append(entries, Entry{Index: index, Term: term, Type: EntryNoop})
+	}
+	return entries
+}
+
+func assertLoad(t *testing.T, s Storage, expectedState HardState, expectedMeta SnapshotMeta, expectedEntries []Entry) {
+	t.Helper()
+	state, meta, entries, err := s.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, expectedState, state)
+	assert.Equal(t, expectedMeta, meta)
+	assert.Equal(t, expectedEntries, entries)
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	assertLoad(t, s, HardState{}, SnapshotMeta{}, nil)
+
+	assert.NoError(t, s.SetHardState(HardState{Term: 2, Vote: "a"}))
+	assert.NoError(t, s.Append(entries(1, 1, 2, 3)))
+	// Entries from a new leader replace those they conflict with
+	assert.NoError(t, s.Append(entries(2, 3, 4)))
+	assert.NoError(t, s.Append(nil))
+	expected := append(entries(1, 1, 2), entries(2, 3, 4)...)
+	assertLoad(t, s, HardState{Term: 2, Vote: "a"}, SnapshotMeta{}, expected)
+
+	// The state survives reopening
+	s.Close()
+	s = openTestStorage(t, dir)
+	assertLoad(t, s, HardState{Term: 2, Vote: "a"}, SnapshotMeta{}, expected)
+
+	meta := SnapshotMeta{Index: 2, Term: 1, Members: []Member{{ID: "a"}}}
+	assert.NoError(t, s.Compact(meta))
+	assert.NoError(t, s.Append(entries(2, 5)))
+	expected = entries(2, 3, 4, 5)
+	assertLoad(t, s, HardState{Term: 2, Vote: "a"}, meta, expected)
+	s.Close()
+	s = openTestStorage(t, dir)
+	assertLoad(t, s, HardState{Term: 2, Vote: "a"}, meta, expected)
+
+	// A compaction beyond the log discards all of it
+	meta = SnapshotMeta{Index: 10, Term: 3}
+	assert.NoError(t, s.Compact(meta))
+	assertLoad(t, s, HardState{Term: 2, Vote: "a"}, meta, nil)
+}
+
+func TestFileStorageTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	assert.NoError(t, s.Append(entries(1, 1, 2)))
+	s.Close()
+
+	// A partly written record, from stopping while appending, ends the log and is truncated
+	path := filepath.Join(dir, logFileName)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(path, info.Size()-3))
+	s = openTestStorage(t, dir)
+	assertLoad(t, s, HardState{}, SnapshotMeta{}, entries(1, 1))
+	assert.NoError(t, s.Append(entries(1, 2, 3)))
+	s.Close()
+	s = openTestStorage(t, dir)
+	assertLoad(t, s, HardState{}, SnapshotMeta{}, entries(1, 1, 2, 3))
+}
+
+func TestMemoryStorage(t *testing.T) {
+	s := NewMemoryStorage()
+	assert.NoError(t, s.SetHardState(HardState{Term: 1}))
+	assert.NoError(t, s.Append(entries(1, 1, 2, 3)))
+	assert.NoError(t, s.Append(entries(2, 2)))
+	assertLoad(t, s, HardState{Term: 1}, SnapshotMeta{}, append(entries(1, 1), entries(2, 2)...))
+	assert.NoError(t, s.Compact(SnapshotMeta{Index: 1, Term: 1}))
+	assertLoad(t, s, HardState{Term: 1}, SnapshotMeta{Index: 1, Term: 1}, entries(2, 2))
+}
@@ -0,0 +1,75 @@
+package ratelimit
+
+import (
+	"context"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/crudpb"
+	"net/http"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// UnaryServerInterceptor limits each client's calls by the limiter, as Middleware does its requests, failing calls
+// with RESOURCE_EXHAUSTED once a client has used its budget. Calls for which writes returns true are writes
+func UnaryServerInterceptor(limiter *Limiter, writes func(fullMethod string) bool) grpc.UnaryServerInterceptor {
+	return unaryInterceptor(limiter, writes, clientID)
+}
+
+// StreamServerInterceptor limits each client's streaming calls, as UnaryServerInterceptor does its unary calls
+func StreamServerInterceptor(limiter *Limiter, writes func(fullMethod string) bool) grpc.StreamServerInterceptor {
+	return streamInterceptor(limiter, writes, clientID)
+}
+
+// AddressUnaryServerInterceptor limits the calls from each IP address by the limiter, as AddressMiddleware does the
+// requests. Placed before authentication, it limits calls which fail to authenticate too
+func AddressUnaryServerInterceptor(limiter *Limiter, writes func(fullMethod string) bool) grpc.UnaryServerInterceptor {
+	return unaryInterceptor(limiter, writes, remoteHost)
+}
+
+// AddressStreamServerInterceptor limits the streaming calls from each IP address, as AddressUnaryServerInterceptor
+// does the unary calls
+func AddressStreamServerInterceptor(limiter *Limiter, writes func(fullMethod string) bool) grpc.StreamServerInterceptor {
+	return streamInterceptor(limiter, writes, remoteHost)
+}
+
+func unaryInterceptor(limiter *Limiter, writes func(fullMethod string) bool, client func(r *http.Request) string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		header, err := allowCall(ctx, limiter, client, writes(info.FullMethod))
+		grpc.SetHeader(ctx, header)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func streamInterceptor(limiter *Limiter, writes func(fullMethod string) bool, client func(r *http.Request) string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		header, err := allowCall(ss.Context(), limiter, client, writes(info.FullMethod))
+		ss.SetHeader(header)
+		if err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// allowCall takes a token for the call's client, as identified by client, returning the header metadata describing
+// its budget, and an error if it has none left
+func allowCall(ctx context.Context, limiter *Limiter, client func(r *http.Request) string, write bool) (metadata.MD, error) {
+	result := limiter.Allow(client(auth.RequestFromIncomingContext(ctx)), write)
+	header := metadata.MD{}
+	if result.Limit > 0 {
+		header.Set("ratelimit-limit", strconv.Itoa(result.Limit))
+		header.Set("ratelimit-remaining", strconv.Itoa(result.Remaining))
+		header.Set("ratelimit-reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	}
+	if !result.Allowed {
+		header.Set("retry-after", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+		return header, crudpb.Error(codes.ResourceExhausted, crudpb.ReasonRateLimited, "Error: rate limit exceeded")
+	}
+	return header, nil
+}
@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"context"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/crudpb"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	limiter := NewLimiter(Budget{Rate: 1, Burst: 1}, Budget{})
+	interceptor := UnaryServerInterceptor(limiter, crudpb.Writes)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	call := func(method string, port int, id *auth.Identity) error {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: port}})
+		if id != nil {
+			ctx = auth.NewContext(ctx, *id)
+		}
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+
+	assert.NoError(t, call(crudpb.Crud_Get_FullMethodName, 1234, nil))
+
+	// Same IP from another port is the same client
+	err := call(crudpb.Crud_List_FullMethodName, 5678, nil)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, crudpb.ReasonRateLimited, crudpb.Reason(err))
+
+	// Authenticated clients are limited by identity rather than IP
+	assert.NoError(t, call(crudpb.Crud_Get_FullMethodName, 5678, &auth.Identity{Name: "apikey:ci"}))
+
+	// Writes are unlimited when no write budget is set
+	assert.NoError(t, call(crudpb.Crud_Update_FullMethodName, 1234, nil))
+}
+
+func TestAddressUnaryServerInterceptor(t *testing.T) {
+	limiter := NewLimiter(Budget{Rate: 1, Burst: 1}, Budget{})
+	interceptor := AddressUnaryServerInterceptor(limiter, crudpb.Writes)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	call := func(ip net.IP, id *auth.Identity) error {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: ip, Port: 1234}})
+		if id != nil {
+			ctx = auth.NewContext(ctx, *id)
+		}
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: crudpb.Crud_Get_FullMethodName}, handler)
+		return err
+	}
+
+	assert.NoError(t, call(net.IPv4(192, 0, 2, 1), nil))
+
+	// Clients are limited by IP even once authenticated
+	assert.Equal(t, codes.ResourceExhausted, status.Code(call(net.IPv4(192, 0, 2, 1), &auth.Identity{Name: "apikey:ci"})))
+	assert.NoError(t, call(net.IPv4(192, 0, 2, 2), &auth.Identity{Name: "apikey:ci"}))
+}
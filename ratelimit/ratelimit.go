@@ -0,0 +1,181 @@
+package ratelimit
+
+import (
+	"fmt"
+	"its-dave/simple-crud-rest-server/auth"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// sweepInterval is how often idle buckets are discarded
+	sweepInterval = time.Minute
+	// idleTimeout is how long a bucket must be unused before it is discarded, unless it takes longer to refill
+	idleTimeout = 10 * time.Minute
+)
+
+// Budget is the rate at which a client may make requests: Rate requests per second, with bursts of up to Burst
+type Budget struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// Enabled reports whether the budget limits anything
+func (budget Budget) Enabled() bool {
+	return budget.Rate > 0 && budget.Burst > 0
+}
+
+// idleTimeout returns how long a bucket must be unused before it is discarded: long enough to have refilled
+func (budget Budget) idleTimeout() time.Duration {
+	if refill := secondsToDuration(float64(budget.Burst) / budget.Rate); refill > idleTimeout {
+		return refill
+	}
+	return idleTimeout
+}
+
+// bucket is a token bucket holding up to burst tokens, refilled at rate tokens per second
+type bucket struct {
+	budget  Budget
+	tokens  float64
+	updated time.Time
+}
+
+// Limiter applies separate token bucket budgets to reads and writes by each client
+type Limiter struct {
+	read  Budget
+	write Budget
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSwept time.Time
+}
+
+// Result describes the state of a client's budget after a request
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// NewLimiter returns a limiter using the specified budgets; a budget which is not enabled does not limit requests
+func NewLimiter(read, write Budget) *Limiter {
+	return &Limiter{
+		read:    read,
+		write:   write,
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Allow takes a token from the client's read or write bucket if one is available
+func (limiter *Limiter) Allow(client string, write bool) Result {
+	budget, kind := limiter.read, "read"
+	if write {
+		budget, kind = limiter.write, "write"
+	}
+	if !budget.Enabled() {
+		return Result{Allowed: true}
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	now := limiter.now()
+	limiter.sweep(now)
+
+	b, exists := limiter.buckets[kind+":"+client]
+	if !exists {
+		b = &bucket{budget: budget, tokens: float64(budget.Burst), updated: now}
+		limiter.buckets[kind+":"+client] = b
+	}
+	b.tokens = math.Min(float64(budget.Burst), b.tokens+now.Sub(b.updated).Seconds()*budget.Rate)
+	b.updated = now
+
+	result := Result{Limit: budget.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - b.tokens) / budget.Rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = secondsToDuration((float64(budget.Burst) - b.tokens) / budget.Rate)
+	return result
+}
+
+// sweep discards buckets which have been idle long enough to have refilled; the caller must hold the lock
+func (limiter *Limiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSwept) < sweepInterval {
+		return
+	}
+	limiter.lastSwept = now
+	for client, b := range limiter.buckets {
+		if now.Sub(b.updated) > b.budget.idleTimeout() {
+			delete(limiter.buckets, client)
+		}
+	}
+}
+
+// Middleware wraps the specified handler so that each client's requests are limited by the limiter,
+// responding 429 once a client has used its budget
+func Middleware(limiter *Limiter, next http.Handler) http.Handler {
+	return limit(limiter, clientID, next)
+}
+
+// AddressMiddleware wraps the specified handler so that the requests from each IP address are limited by the limiter,
+// as Middleware does each client's. Placed before authentication, it limits requests which fail to authenticate too
+func AddressMiddleware(limiter *Limiter, next http.Handler) http.Handler {
+	return limit(limiter, remoteHost, next)
+}
+
+// limit wraps the specified handler so that the requests of each client, as identified by client, are limited
+func limit(limiter *Limiter, client func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		write := r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions
+		result := limiter.Allow(client(r), write)
+		if result.Limit > 0 {
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+		}
+		if !result.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, "Error: rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientID identifies the client making a request by its authenticated identity, or its IP address if unauthenticated
+func clientID(r *http.Request) string {
+	if id, ok := auth.FromContext(r.Context()); ok && id.Name != "" {
+		return id.Name
+	}
+	return remoteHost(r)
+}
+
+// remoteHost returns the IP address of the client making a request
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
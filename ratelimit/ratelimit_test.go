@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"its-dave/simple-crud-rest-server/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := NewLimiter(Budget{Rate: 1, Burst: 2}, Budget{Rate: 0.5, Burst: 1})
+	limiter.now = func() time.Time { return now }
+
+	// Reads use the burst then are limited
+	assert.True(t, limiter.Allow("client1", false).Allowed)
+	assert.True(t, limiter.Allow("client1", false).Allowed)
+	result := limiter.Allow("client1", false)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, time.Second, result.RetryAfter)
+
+	// Writes and other clients have separate budgets
+	assert.True(t, limiter.Allow("client1", true).Allowed)
+	assert.False(t, limiter.Allow("client1", true).Allowed)
+	assert.True(t, limiter.Allow("client2", false).Allowed)
+
+	// Tokens are refilled over time
+	now = now.Add(time.Second)
+	result = limiter.Allow("client1", false)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	assert.Equal(t, 2*time.Second, result.Reset)
+	result = limiter.Allow("client1", true)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, time.Second, result.RetryAfter)
+}
+
+func TestLimiterSweep(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := NewLimiter(Budget{Rate: 1, Burst: 2}, Budget{Rate: 0.001, Burst: 1})
+	limiter.now = func() time.Time { return now }
+	assert.True(t, limiter.Allow("client1", false).Allowed)
+	assert.True(t, limiter.Allow("client1", true).Allowed)
+
+	// Idle buckets are discarded once refilled, but not before
+	now = now.Add(idleTimeout + time.Minute)
+	assert.False(t, limiter.Allow("client1", true).Allowed)
+	limiter.mu.Lock()
+	assert.NotContains(t, limiter.buckets, "read:client1")
+	assert.Contains(t, limiter.buckets, "write:client1")
+	limiter.mu.Unlock()
+}
+
+func TestMiddleware(t *testing.T) {
+	limiter := NewLimiter(Budget{Rate: 1, Burst: 1}, Budget{})
+	handler := Middleware(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(method, remoteAddr string, id *auth.Identity) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/key1", nil)
+		r.RemoteAddr = remoteAddr
+		if id != nil {
+			r = r.WithContext(auth.NewContext(r.Context(), *id))
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, r)
+		return resp
+	}
+
+	resp := request(http.MethodGet, "192.0.2.1:1234", nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "1", resp.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", resp.Header().Get("RateLimit-Remaining"))
+
+	// Same IP from another port is the same client
+	resp = request(http.MethodGet, "192.0.2.1:5678", nil)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "1", resp.Header().Get("Retry-After"))
+	assert.Equal(t, "1", resp.Header().Get("RateLimit-Reset"))
+
+	// Authenticated clients are limited by identity rather than IP
+	resp = request(http.MethodGet, "192.0.2.1:5678", &auth.Identity{Name: "apikey:ci"})
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Writes are unlimited when no write budget is set
+	resp = request(http.MethodPut, "192.0.2.1:1234", nil)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Empty(t, resp.Header().Get("RateLimit-Limit"))
+}
+
+func TestAddressMiddleware(t *testing.T) {
+	limiter := NewLimiter(Budget{Rate: 1, Burst: 1}, Budget{})
+	handler := AddressMiddleware(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(remoteAddr string, id *auth.Identity) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/key1", nil)
+		r.RemoteAddr = remoteAddr
+		if id != nil {
+			r = r.WithContext(auth.NewContext(r.Context(), *id))
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, r)
+		return resp
+	}
+
+	assert.Equal(t, http.StatusOK, request("192.0.2.1:1234", nil).Code)
+
+	// Clients are limited by IP even once authenticated
+	assert.Equal(t, http.StatusTooManyRequests, request("192.0.2.1:5678", &auth.Identity{Name: "apikey:ci"}).Code)
+	assert.Equal(t, http.StatusOK, request("192.0.2.2:1234", &auth.Identity{Name: "apikey:ci"}).Code)
+}
@@ -0,0 +1,161 @@
+package repository
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	// ErrMigrationRequired is returned when reading data in an older format, before InitialiseData has migrated it
+	ErrMigrationRequired = errors.New("data file must be migrated to the current format")
+	// ErrUnsupportedVersion is returned for data in a format newer than this server understands
+	ErrUnsupportedVersion = errors.New("data file format version is not supported")
+	// ErrChecksumMismatch is returned by VerifyChecksum when the data does not match the checksum written with it,
+	// e.g. because the file has been edited by hand
+	ErrChecksumMismatch = errors.New("data does not match its checksum")
+)
+
+// migration upgrades the data from one format version to the next
+type migration func(dataMap map[string]interface{}) (map[string]interface{}, error)
+
+// migrations upgrade the data from each version to the next, in order: the first from version 1 to 2 and so on.
+// To change the format, append a migration; the current version is one more than the number of migrations
+var migrations = []migration{
+	// Version 2 wrapped the data in an envelope recording its version, which encode adds, without changing the data
+	func(dataMap map[string]interface{}) (map[string]interface{}, error) {
+		return dataMap, nil
+	},
+	// Version 3 added a checksum of the data to the envelope, which encode also adds
+	func(dataMap map[string]interface{}) (map[string]interface{}, error) {
+		return dataMap, nil
+	},
+}
+
+// envelope is the data file from version 2
+type envelope struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum,omitempty"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// CurrentVersion returns the version of the format in which data is written
+func CurrentVersion() int {
+	return len(migrations) + 1
+}
+
+// Migrate upgrades data in the specified format version to the current version
+func Migrate(dataMap map[string]interface{}, version int) (map[string]interface{}, error) {
+	return migrate(dataMap, version, CurrentVersion())
+}
+
+// migrate upgrades data in one format version to another by running each migration between them in order
+func migrate(dataMap map[string]interface{}, from, to int) (map[string]interface{}, error) {
+	if from < 1 || from > to || to > CurrentVersion() {
+		return nil, fmt.Errorf("%w: cannot migrate from version %d to %d", ErrUnsupportedVersion, from, to)
+	}
+	for version := from; version < to; version++ {
+		var err error
+		if dataMap, err = migrations[version-1](dataMap); err != nil {
+			return nil, fmt.Errorf("migrating data from version %d to %d: %w", version, version+1, err)
+		}
+	}
+	return dataMap, nil
+}
+
+// checkVersion returns an error unless data in the specified format version can be used without migrating it
+func checkVersion(version int) error {
+	switch {
+	case version > CurrentVersion():
+		return fmt.Errorf("%w: version %d is newer than %d", ErrUnsupportedVersion, version, CurrentVersion())
+	case version < CurrentVersion():
+		return fmt.Errorf("%w: version %d is older than %d", ErrMigrationRequired, version, CurrentVersion())
+	}
+	return nil
+}
+
+// encode returns the data file for the specified data in the current format
+func encode(dataMap map[string]interface{}) ([]byte, error) {
+	if dataMap == nil {
+		dataMap = map[string]interface{}{}
+	}
+	data, err := json.Marshal(dataMap)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope{Version: CurrentVersion(), Checksum: checksum(data), Data: data})
+}
+
+// decode parses a data file in any format, returning its version and data. Files without a version are version 1,
+// which was the map of keys to histories now held in the envelope's data; a key named "version" cannot be mistaken
+// for the envelope's, as its history is an array rather than a number
+func decode(data []byte) (int, map[string]interface{}, error) {
+	file, ok, err := decodeEnvelope(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	var dataMap map[string]interface{}
+	if !ok {
+		if err := json.Unmarshal(data, &dataMap); err != nil {
+			return 0, nil, err
+		}
+		return 1, dataMap, nil
+	}
+	if err := json.Unmarshal(file.Data, &dataMap); err != nil {
+		return 0, nil, err
+	}
+	if dataMap == nil {
+		return 0, nil, fmt.Errorf("data file format version %d has no data", file.Version)
+	}
+	return file.Version, dataMap, nil
+}
+
+// decodeEnvelope parses the envelope of a data file, reporting whether it has one
+func decodeEnvelope(data []byte) (envelope, bool, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return envelope{}, false, err
+	}
+	var file envelope
+	if err := json.Unmarshal(fields["version"], &file.Version); err != nil {
+		return envelope{}, false, nil
+	}
+	if file.Version < 1 {
+		return envelope{}, false, fmt.Errorf("invalid data file format version %d", file.Version)
+	}
+	if raw, ok := fields["checksum"]; ok {
+		if err := json.Unmarshal(raw, &file.Checksum); err != nil {
+			return envelope{}, false, fmt.Errorf("invalid data file checksum: %w", err)
+		}
+	}
+	file.Data = fields["data"]
+	return file, true, nil
+}
+
+// checksum returns the SHA-256 checksum of the data as written in the file
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// VerifyChecksum checks that the data file matches the checksum written with it, returning ErrChecksumMismatch if not
+func (repo Repo) VerifyChecksum() error {
+	data, err := os.ReadFile(repo.dataFilePath)
+	if err != nil {
+		return err
+	}
+	file, ok, err := decodeEnvelope(data)
+	if err != nil {
+		return err
+	}
+	if !ok || file.Version < 3 {
+		return fmt.Errorf("%w: version %d data has no checksum", ErrMigrationRequired, max(file.Version, 1))
+	}
+	if file.Checksum != checksum(file.Data) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"its-dave/simple-crud-rest-server/lsm"
+	"its-dave/simple-crud-rest-server/tracing"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Records of an LSM store. Each key has a record marking that it exists, followed in order by a record for each event
+// of its history, so that the histories of the keys with a prefix are read by a single scan
+var (
+	// versionRecord holds the format version of the data
+	versionRecord = []byte("v")
+	// historyPrefix begins the records of every key
+	historyPrefix = []byte("h")
+	// keyEnd ends the escaped key in the records of a key. It sorts before any escaped byte which could follow, so that
+	// the records of a key sort before those of the keys it is a prefix of
+	keyEnd = []byte{0x00, 0x01}
+)
+
+// LSM stores the data in an embedded log-structured merge tree in a directory, with a record for each event. Writes
+// append the new events of a key rather than rewriting its history or the rest of the data
+type LSM struct {
+	dir string
+	db  *lsm.DB
+	// mu serialises writes, each of which compares the stored histories with those written
+	mu       sync.Mutex
+	observer Observer
+}
+
+// OpenLSM opens the LSM store in the specified directory, creating it if it does not exist
+func OpenLSM(dir string) (*LSM, error) {
+	db, err := lsm.Open(dir, lsm.DefaultOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &LSM{dir: dir, db: db}, nil
+}
+
+// Close closes the store
+func (store *LSM) Close() error {
+	return store.db.Close()
+}
+
+// SetObserver sets a function to be called after each read or write of the data
+func (store *LSM) SetObserver(observer Observer) {
+	store.observer = observer
+}
+
+// Begin returns the specified context, as each write is applied atomically and writers are serialised by their
+// caller, so a read-modify-write needs no transaction
+func (store *LSM) Begin(ctx context.Context) (context.Context, func(), error) {
+	return ctx, func() {}, nil
+}
+
+// ReadData returns the history of every key
+func (store *LSM) ReadData(ctx context.Context) (dataMap map[string]interface{}, err error) {
+	defer observe(store.observer, OperationRead, time.Now(), &err)
+	_, span := tracing.Start(ctx, "storage.ReadData")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	histories, err := store.scan("")
+	if err != nil {
+		return nil, err
+	}
+	return decodeEvents(histories)
+}
+
+// ReadKeys returns the history of each of the specified keys which exists
+func (store *LSM) ReadKeys(ctx context.Context, keys ...string) (dataMap map[string]interface{}, err error) {
+	defer observe(store.observer, OperationRead, time.Now(), &err)
+	_, span := tracing.Start(ctx, "storage.ReadKeys")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	histories, err := store.read(keys)
+	if err != nil {
+		return nil, err
+	}
+	return decodeEvents(histories)
+}
+
+// ReadPrefix returns the history of every key with the specified prefix
+func (store *LSM) ReadPrefix(ctx context.Context, prefix string) (dataMap map[string]interface{}, err error) {
+	defer observe(store.observer, OperationRead, time.Now(), &err)
+	_, span := tracing.Start(ctx, "storage.ReadPrefix")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	histories, err := store.scan(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return decodeEvents(histories)
+}
+
+// WriteData replaces the stored data with the specified data. Only the changes are written: events appended to a
+// history are added, and other histories which differ are rewritten from the first event which differs
+func (store *LSM) WriteData(ctx context.Context, dataMap map[string]interface{}) (err error) {
+	defer observe(store.observer, OperationWrite, time.Now(), &err)
+	_, span := tracing.Start(ctx, "storage.WriteData")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	stored, err := store.scan("")
+	if err != nil {
+		return err
+	}
+	batch := &lsm.Batch{}
+	if err := replaceEvents(batch, stored, dataMap); err != nil {
+		return err
+	}
+	return store.db.Apply(batch)
+}
+
+// WriteKeys replaces the history of each key in the specified data, leaving other keys unchanged
+func (store *LSM) WriteKeys(ctx context.Context, dataMap map[string]interface{}) (err error) {
+	defer observe(store.observer, OperationWrite, time.Now(), &err)
+	_, span := tracing.Start(ctx, "storage.WriteKeys")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	keys := make([]string, 0, len(dataMap))
+	for key := range dataMap {
+		keys = append(keys, key)
+	}
+	stored, err := store.read(keys)
+	if err != nil {
+		return err
+	}
+	batch := &lsm.Batch{}
+	if err := writeEvents(batch, stored, dataMap); err != nil {
+		return err
+	}
+	return store.db.Apply(batch)
+}
+
+// read returns the JSON of each event of each of the specified keys which exists
+func (store *LSM) read(keys []string) (map[string][]string, error) {
+	histories := map[string][]string{}
+	for _, key := range keys {
+		if _, ok := histories[key]; ok {
+			continue
+		}
+		// The records of the key are its own and those of its events, which it begins
+		prefix := keyRecord(key)
+		err := store.db.Scan(prefix, func(record, value []byte) error {
+			if len(record) == len(prefix) {
+				histories[key] = []string{}
+			} else {
+				histories[key] = append(histories[key], string(value))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return histories, nil
+}
+
+// scan returns the JSON of each event of every key with the specified prefix
+func (store *LSM) scan(prefix string) (map[string][]string, error) {
+	histories := map[string][]string{}
+	err := store.db.Scan(appendEscaped(bytes.Clone(historyPrefix), prefix), func(record, value []byte) error {
+		key, isEvent, err := parseRecord(record)
+		if err != nil {
+			return err
+		}
+		if !isEvent {
+			histories[key] = []string{}
+		} else {
+			histories[key] = append(histories[key], string(value))
+		}
+		return nil
+	})
+	return histories, err
+}
+
+// writeEvents adds to the batch the writes which make the stored histories of the keys in the specified data match it
+func writeEvents(batch *lsm.Batch, stored map[string][]string, dataMap map[string]interface{}) error {
+	for key, keyArray := range dataMap {
+		events, err := encodeHistory(keyArray)
+		if err != nil {
+			return fmt.Errorf("history of key %q: %w", key, err)
+		}
+		storedEvents, exists := stored[key]
+		if !exists {
+			batch.Put(keyRecord(key), nil)
+		}
+		// Most writes append an event, so only the events after those already stored need writing
+		from := 0
+		for from < len(events) && from < len(storedEvents) && events[from] == storedEvents[from] {
+			from++
+		}
+		for seq := from; seq < len(events); seq++ {
+			batch.Put(eventRecord(key, seq), []byte(events[seq]))
+		}
+		for seq := len(events); seq < len(storedEvents); seq++ {
+			batch.Delete(eventRecord(key, seq))
+		}
+	}
+	return nil
+}
+
+// replaceEvents adds to the batch the writes which make the stored data match the specified data, deleting every
+// record of the keys which are not in it
+func replaceEvents(batch *lsm.Batch, stored map[string][]string, dataMap map[string]interface{}) error {
+	for key, events := range stored {
+		if _, ok := dataMap[key]; ok {
+			continue
+		}
+		batch.Delete(keyRecord(key))
+		for seq := range events {
+			batch.Delete(eventRecord(key, seq))
+		}
+	}
+	return writeEvents(batch, stored, dataMap)
+}
+
+// decodeEvents returns the events of each key as they were written
+func decodeEvents(histories map[string][]string) (map[string]interface{}, error) {
+	dataMap := make(map[string]interface{}, len(histories))
+	for key, events := range histories {
+		array := make([]interface{}, 0, len(events))
+		for _, event := range events {
+			var element interface{}
+			if err := json.Unmarshal([]byte(event), &element); err != nil {
+				return nil, fmt.Errorf("event of key %q: %w", key, err)
+			}
+			array = append(array, element)
+		}
+		dataMap[key] = array
+	}
+	return dataMap, nil
+}
+
+// keyRecord returns the record marking that a key exists, which sorts before those of its events
+func keyRecord(key string) []byte {
+	return append(appendEscaped(bytes.Clone(historyPrefix), key), keyEnd...)
+}
+
+// eventRecord returns the record of the event of a key at the specified position in its history
+func eventRecord(key string, seq int) []byte {
+	return binary.BigEndian.AppendUint64(keyRecord(key), uint64(seq))
+}
+
+// appendEscaped appends the key to buf with each zero byte followed by 0xff, so that no escaped key contains keyEnd
+// and escaped keys sort in the same order as the keys
+func appendEscaped(buf []byte, key string) []byte {
+	for i := 0; i < len(key); i++ {
+		buf = append(buf, key[i])
+		if key[i] == 0x00 {
+			buf = append(buf, 0xff)
+		}
+	}
+	return buf
+}
+
+// parseRecord returns the key of a history record, and whether it is the record of an event rather than of the key
+func parseRecord(record []byte) (string, bool, error) {
+	escaped := record[len(historyPrefix):]
+	var key []byte
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] != 0x00 {
+			key = append(key, escaped[i])
+			continue
+		}
+		if i+1 < len(escaped) && escaped[i+1] == 0xff {
+			key = append(key, 0x00)
+			i++
+			continue
+		}
+		if bytes.HasPrefix(escaped[i:], keyEnd) {
+			// The key is followed by nothing in its own record, and by the position of the event in an event's
+			if rest := len(escaped) - i - len(keyEnd); rest == 0 || rest == 8 {
+				return string(key), rest == 8, nil
+			}
+		}
+		break
+	}
+	return "", false, fmt.Errorf("%w: invalid record %q", ErrChecksumMismatch, record)
+}
+
+// InitialiseData creates the store if it does not exist, and migrates the data to the current format. As with
+// SQLite, the data is not backed up first; take a snapshot before upgrading
+func (store *LSM) InitialiseData() error {
+	value, ok, err := store.db.Get(versionRecord)
+	if err != nil {
+		return err
+	}
+	version := CurrentVersion()
+	if ok {
+		if version, err = strconv.Atoi(string(value)); err != nil {
+			return fmt.Errorf("invalid format version %q", value)
+		}
+	}
+	if version == CurrentVersion() {
+		if ok {
+			return nil
+		}
+		// A new store
+		batch := &lsm.Batch{}
+		batch.Put(versionRecord, []byte(strconv.Itoa(version)))
+		return store.db.Apply(batch)
+	}
+	if err := checkVersion(version); !errors.Is(err, ErrMigrationRequired) {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	stored, err := store.scan("")
+	if err != nil {
+		return err
+	}
+	dataMap, err := decodeEvents(stored)
+	if err != nil {
+		return err
+	}
+	if dataMap, err = Migrate(dataMap, version); err != nil {
+		return err
+	}
+	// The migrated data and its version are written together, so an interrupted migration is made again
+	batch := &lsm.Batch{}
+	if err := replaceEvents(batch, stored, dataMap); err != nil {
+		return err
+	}
+	batch.Put(versionRecord, []byte(strconv.Itoa(CurrentVersion())))
+	return store.db.Apply(batch)
+}
+
+// Check verifies that the store can be read and written, without modifying it
+func (store *LSM) Check() error {
+	return store.db.Check()
+}
+
+// Size returns the size in bytes of the store's files
+func (store *LSM) Size() (int64, error) {
+	return store.db.Size()
+}
+
+// VerifyChecksum checks each of the store's table files against its checksum, returning ErrChecksumMismatch if any
+// is corrupt
+func (store *LSM) VerifyChecksum() error {
+	err := store.db.Verify()
+	if errors.Is(err, lsm.ErrCorrupt) {
+		return fmt.Errorf("%w: %v", ErrChecksumMismatch, err)
+	}
+	return err
+}
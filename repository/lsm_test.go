@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"its-dave/simple-crud-rest-server/lsm"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestLSM(t *testing.T, dir string) *LSM {
+	store, err := OpenLSM(dir)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { store.Close() })
+	assert.NoError(t, store.InitialiseData())
+	return store
+}
+
+func TestLSM(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestLSM(t, dir)
+	ctx := context.Background()
+
+	dataMap, err := store.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, dataMap)
+
+	var initial map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(initialState), &initial))
+	initial["empty"] = []interface{}{}
+	assert.NoError(t, store.WriteData(ctx, initial))
+	dataMap, err = store.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, initial, dataMap)
+
+	// Appended events are added after those stored, and removed keys are deleted with their events
+	dataMap["key1"] = append(dataMap["key1"].([]interface{}), map[string]interface{}{"event": "update", "value": "value2", "identity": "apikey:ci"})
+	delete(dataMap, "key2")
+	assert.NoError(t, store.WriteData(ctx, dataMap))
+	read, err := store.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, read)
+
+	// Rewritten histories replace those stored
+	dataMap["key1"] = []interface{}{map[string]interface{}{"event": "create", "value": "value3"}}
+	assert.NoError(t, store.WriteData(ctx, dataMap))
+	read, err = store.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, read)
+
+	assert.ErrorContains(t, store.WriteData(ctx, map[string]interface{}{"key1": "value1"}), `history of key "key1"`)
+
+	// The data is kept when reopened
+	assert.NoError(t, store.Close())
+	store = openTestLSM(t, dir)
+	read, err = store.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, read)
+
+	assert.NoError(t, store.Check())
+	assert.NoError(t, store.VerifyChecksum())
+	size, err := store.Size()
+	assert.NoError(t, err)
+	assert.Positive(t, size)
+}
+
+func TestLSMInitialiseData(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestLSM(t, dir)
+	value, ok, err := store.db.Get(versionRecord)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, strconv.Itoa(CurrentVersion()), string(value))
+
+	// Data in an older format is migrated
+	var initial map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(initialState), &initial))
+	assert.NoError(t, store.WriteData(context.Background(), initial))
+	setLSMVersion(t, store, "1")
+	assert.NoError(t, store.InitialiseData())
+	dataMap, err := store.ReadData(context.Background())
+	assert.NoError(t, err)
+	data, err := json.Marshal(dataMap)
+	assert.NoError(t, err)
+	assert.JSONEq(t, migratedStates[CurrentVersion()], string(data))
+
+	// Newer formats are rejected
+	setLSMVersion(t, store, "99")
+	assert.ErrorIs(t, store.InitialiseData(), ErrUnsupportedVersion)
+}
+
+func setLSMVersion(t *testing.T, store *LSM, version string) {
+	batch := &lsm.Batch{}
+	batch.Put(versionRecord, []byte(version))
+	assert.NoError(t, store.db.Apply(batch))
+}
+
+func TestLSMVerifyChecksum(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestLSM(t, dir)
+	assert.NoError(t, store.WriteData(context.Background(), map[string]interface{}{"key1": []interface{}{map[string]interface{}{"event": "create", "value": "value1"}}}))
+	assert.NoError(t, store.db.Flush())
+	assert.NoError(t, store.Close())
+
+	tables, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if !assert.NoError(t, err) || !assert.Len(t, tables, 1) {
+		return
+	}
+	data, err := os.ReadFile(tables[0])
+	assert.NoError(t, err)
+	// A byte of a value is changed, which only the checksum reveals
+	i := bytes.Index(data, []byte("value1"))
+	if !assert.GreaterOrEqual(t, i, 0) {
+		return
+	}
+	data[i] = 'V'
+	assert.NoError(t, os.WriteFile(tables[0], data, 0644))
+	store = openTestLSM(t, dir)
+	assert.ErrorIs(t, store.VerifyChecksum(), ErrChecksumMismatch)
+}
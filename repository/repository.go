@@ -1,56 +1,180 @@
 package repository
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
+	"fmt"
+	"its-dave/simple-crud-rest-server/tracing"
 	"os"
+	"path/filepath"
+	"time"
 )
 
+const (
+	OperationRead  = "read"
+	OperationWrite = "write"
+)
+
+// Observer is called with the duration and outcome of each read or write of the data
+type Observer func(operation string, duration time.Duration, err error)
+
+// Repo stores the data in a JSON data file
 type Repo struct {
 	dataFilePath string
+	observer     Observer
 }
 
 func (repo *Repo) SetDataFilePath(dataFilePath string) {
 	repo.dataFilePath = dataFilePath
 }
 
-// ReadData parses the stored JSON data and returns it as a map
-func (repo Repo) ReadData() (map[string]interface{}, error) {
+// SetObserver sets a function to be called after each read or write of the data file
+func (repo *Repo) SetObserver(observer Observer) {
+	repo.observer = observer
+}
+
+// Size returns the size in bytes of the data file
+func (repo Repo) Size() (int64, error) {
+	info, err := os.Stat(repo.dataFilePath)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// ReadData parses the stored JSON data and returns it as a map. The data must be in the current format,
+// which InitialiseData migrates it to
+func (repo Repo) ReadData(ctx context.Context) (dataMap map[string]interface{}, err error) {
+	defer observe(repo.observer, OperationRead, time.Now(), &err)
+	ctx, span := tracing.Start(ctx, "storage.ReadData")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
 	// Parse stored data
 	data, err := os.ReadFile(repo.dataFilePath)
 	if err != nil {
 		return nil, err
 	}
-	var jsonData interface{}
-	err = json.Unmarshal(data, &jsonData)
+	span.SetAttribute("crud.storage.bytes", len(data))
+	_, decodeSpan := tracing.Start(ctx, "storage.decode")
+	version, dataMap, err := decode(data)
+	decodeSpan.RecordError(err)
+	decodeSpan.Finish()
 	if err != nil {
 		return nil, err
 	}
-	return jsonData.(map[string]interface{}), nil
+	if err := checkVersion(version); err != nil {
+		return nil, err
+	}
+	return dataMap, nil
 }
 
-// WriteData saves the specified JSON data to the data file
-func (repo Repo) WriteData(dataMap map[string]interface{}) error {
-	dataToWrite, err := json.Marshal(dataMap)
+// WriteData saves the specified JSON data to the data file in the current format
+func (repo Repo) WriteData(ctx context.Context, dataMap map[string]interface{}) (err error) {
+	defer observe(repo.observer, OperationWrite, time.Now(), &err)
+	_, span := tracing.Start(ctx, "storage.WriteData")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	dataToWrite, err := encode(dataMap)
 	if err != nil {
 		return err
 	}
+	span.SetAttribute("crud.storage.bytes", len(dataToWrite))
 	if err := repo.writeToDataFile(dataToWrite); err != nil {
 		return err
 	}
 	return nil
 }
 
-// InitialiseData ensures that the data file exists, creating an empty JSON object if not
+// InitialiseData ensures that the data file exists, creating it with no keys if not, and migrates it to the current
+// format. Before migrating, the file is copied to a backup named after its version, e.g. data.json.v1.bak
 func (repo Repo) InitialiseData() error {
-	_, err := os.Stat(repo.dataFilePath)
+	data, err := os.ReadFile(repo.dataFilePath)
 	if errors.Is(err, os.ErrNotExist) {
-		repo.writeToDataFile([]byte("{}"))
+		dataToWrite, err := encode(map[string]interface{}{})
+		if err != nil {
+			return err
+		}
+		return repo.writeToDataFile(dataToWrite)
+	}
+	if err != nil {
+		return err
+	}
+
+	version, dataMap, err := decode(data)
+	if err != nil {
+		return err
+	}
+	if version == CurrentVersion() {
+		return nil
+	}
+	// Check that the data can be migrated before taking a backup
+	if err := checkVersion(version); !errors.Is(err, ErrMigrationRequired) {
+		return err
+	}
+	if err := writeFile(fmt.Sprintf("%s.v%d.bak", repo.dataFilePath, version), data, 0600); err != nil {
+		return fmt.Errorf("backing up data file: %w", err)
+	}
+	if dataMap, err = Migrate(dataMap, version); err != nil {
+		return err
 	}
-	return err
+	dataToWrite, err := encode(dataMap)
+	if err != nil {
+		return err
+	}
+	return repo.writeToDataFile(dataToWrite)
 }
 
-// writeToDataFile overwrites the file at dataFilePath with the specified bytes
+// Check verifies that the data file can be opened for both reading and writing, without modifying it
+func (repo Repo) Check() error {
+	file, err := os.OpenFile(repo.dataFilePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// writeToDataFile overwrites the file at dataFilePath with the specified bytes, keeping the permissions of an existing
+// data file
 func (repo Repo) writeToDataFile(bytes []byte) error {
-	return os.WriteFile(repo.dataFilePath, bytes, 0666)
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(repo.dataFilePath); err == nil {
+		mode = info.Mode().Perm()
+	}
+	return writeFile(repo.dataFilePath, bytes, mode)
+}
+
+// writeFile overwrites the file at the specified path with the specified bytes; the bytes are written to a temporary
+// file which is synced and then renamed over the file, so that readers never see a partially written file and the
+// write is durable once this returns
+func writeFile(filePath string, bytes []byte, mode os.FileMode) error {
+	file, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(bytes); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filePath)
+}
+
+// observe reports an operation started at the specified time to the observer, if any
+func observe(observer Observer, operation string, start time.Time, err *error) {
+	if observer != nil {
+		observer(operation, time.Since(start), *err)
+	}
 }
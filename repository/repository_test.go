@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// initialState is the version 1 data used by the server tests
+const initialState = `{
+	"key1":[
+		{
+			"event":"create",
+			"value":"value1"
+		}
+	],
+	"key2":[
+		{
+			"event":"create",
+			"value":"value1"
+		},
+		{
+			"event":"delete",
+			"value":""
+		}
+	]
+}
+`
+
+// migratedStates is initialState as migrated to each newer version
+var migratedStates = map[int]string{
+	2: `{"key1":[{"event":"create","value":"value1"}],"key2":[{"event":"create","value":"value1"},{"event":"delete","value":""}]}`,
+	3: `{"key1":[{"event":"create","value":"value1"}],"key2":[{"event":"create","value":"value1"},{"event":"delete","value":""}]}`,
+}
+
+func TestMigrate(t *testing.T) {
+	for version := 2; version <= CurrentVersion(); version++ {
+		var dataMap map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(initialState), &dataMap))
+		migrated, err := migrate(dataMap, 1, version)
+		if !assert.NoError(t, err, version) {
+			continue
+		}
+		data, err := json.Marshal(migrated)
+		assert.NoError(t, err)
+		if assert.Contains(t, migratedStates, version, "add the expected state for the new version") {
+			assert.JSONEq(t, migratedStates[version], string(data), version)
+		}
+	}
+
+	_, err := Migrate(map[string]interface{}{}, CurrentVersion()+1)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestInitialiseData(t *testing.T) {
+	dataFilePath := filepath.Join(t.TempDir(), "data.json")
+	repo := Repo{}
+	repo.SetDataFilePath(dataFilePath)
+	ctx := context.Background()
+
+	// A new data file is in the current format
+	assert.NoError(t, repo.InitialiseData())
+	dataMap, err := repo.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, dataMap)
+
+	// Data in an older format is only read once migrated
+	assert.NoError(t, os.WriteFile(dataFilePath, []byte(initialState), 0600))
+	assert.NoError(t, os.Chmod(dataFilePath, 0600))
+	_, err = repo.ReadData(ctx)
+	assert.ErrorIs(t, err, ErrMigrationRequired)
+	assert.NoError(t, repo.InitialiseData())
+	dataMap, err = repo.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, dataMap, 2)
+	data, err := os.ReadFile(dataFilePath)
+	assert.NoError(t, err)
+	var file envelope
+	assert.NoError(t, json.Unmarshal(data, &file))
+	assert.Equal(t, CurrentVersion(), file.Version)
+	assert.NoError(t, repo.VerifyChecksum())
+	info, err := os.Stat(dataFilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The file is backed up as it was
+	backup, err := os.ReadFile(dataFilePath + ".v1.bak")
+	assert.NoError(t, err)
+	assert.Equal(t, initialState, string(backup))
+
+	// Migrating again changes nothing
+	assert.NoError(t, repo.InitialiseData())
+	migrated, err := os.ReadFile(dataFilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, data, migrated)
+
+	// Newer formats are rejected without being backed up
+	assert.NoError(t, os.WriteFile(dataFilePath, []byte(`{"version":99,"data":{}}`), 0600))
+	assert.ErrorIs(t, repo.InitialiseData(), ErrUnsupportedVersion)
+	_, err = repo.ReadData(ctx)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+	_, err = os.Stat(dataFilePath + ".v99.bak")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	dataFilePath := filepath.Join(t.TempDir(), "data.json")
+	repo := Repo{}
+	repo.SetDataFilePath(dataFilePath)
+	assert.NoError(t, repo.WriteData(context.Background(), map[string]interface{}{"key1": []interface{}{map[string]interface{}{"event": "create", "value": "value1"}}}))
+	assert.NoError(t, repo.VerifyChecksum())
+
+	// Editing the file by hand is detected, although the data can still be read
+	data, err := os.ReadFile(dataFilePath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(dataFilePath, bytes.Replace(data, []byte("value1"), []byte("value2"), 1), 0644))
+	assert.ErrorIs(t, repo.VerifyChecksum(), ErrChecksumMismatch)
+	dataMap, err := repo.ReadData(context.Background())
+	assert.NoError(t, err)
+	assert.Contains(t, dataMap, "key1")
+}
+
+func TestDecodeKeyNamedVersion(t *testing.T) {
+	version, dataMap, err := decode([]byte(`{"version":[{"event":"create","value":"value1"}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version)
+	assert.Contains(t, dataMap, "version")
+}
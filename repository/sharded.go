@@ -0,0 +1,501 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"its-dave/simple-crud-rest-server/tracing"
+)
+
+// shardVirtualNodes is the number of points each shard has on the hash ring, which spread its keys evenly
+const shardVirtualNodes = 128
+
+// Sharded partitions the keys across shards, each a Store of its own, by consistent hashing, so that a write rewrites
+// only the shard holding its keys, and adding a shard moves only the keys which the new shard takes. Writes of keys in
+// different shards can be made concurrently, each holding the lock of its own shard. Writes of keys in more than one
+// shard are not atomic across them
+type Sharded struct {
+	shards []Store
+	ring   hashRing
+	locks  []sync.Mutex
+
+	observer Observer
+}
+
+// NewSharded returns a store which partitions the keys across the specified shards. Changing the number of shards
+// changes the shard of some keys, which Rebalance moves
+func NewSharded(shards ...Store) *Sharded {
+	return &Sharded{shards: shards, ring: newHashRing(len(shards)), locks: make([]sync.Mutex, len(shards))}
+}
+
+// hashRing maps each key to the shard owning the first point on the ring at or after the key's hash
+type hashRing []ringPoint
+
+type ringPoint struct {
+	hash  uint32
+	shard int
+}
+
+// newHashRing returns the ring of the specified number of shards. The points of each shard do not depend on the
+// number of shards, so the ring of n+1 shards only adds points to that of n
+func newHashRing(shards int) hashRing {
+	ring := make(hashRing, 0, shards*shardVirtualNodes)
+	for shard := 0; shard < shards; shard++ {
+		for node := 0; node < shardVirtualNodes; node++ {
+			ring = append(ring, ringPoint{hash: hashString(strconv.Itoa(shard) + "#" + strconv.Itoa(node)), shard: shard})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash || ring[i].hash == ring[j].hash && ring[i].shard < ring[j].shard
+	})
+	return ring
+}
+
+// shard returns the shard which owns the key
+func (ring hashRing) shard(key string) int {
+	hash := hashString(key)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].shard
+}
+
+// hashString hashes the string with FNV-1a, mixed by the finaliser of MurmurHash3 so that strings differing only in
+// their last bytes, such as key1 and key2, are spread around the ring
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	hash := h.Sum32()
+	hash ^= hash >> 16
+	hash *= 0x85ebca6b
+	hash ^= hash >> 13
+	hash *= 0xc2b2ae35
+	hash ^= hash >> 16
+	return hash
+}
+
+// Shards returns the number of shards
+func (s *Sharded) Shards() int {
+	return len(s.shards)
+}
+
+// ShardOf returns the index of the shard holding the key
+func (s *Sharded) ShardOf(key string) int {
+	return s.ring.shard(key)
+}
+
+// LockKeys locks the shards of the specified keys until the returned function is called, so that writes of other keys
+// need not wait
+func (s *Sharded) LockKeys(keys ...string) func() {
+	var shards []int
+	for _, key := range keys {
+		if shard := s.ring.shard(key); !containsInt(shards, shard) {
+			shards = append(shards, shard)
+		}
+	}
+	// Shards are locked in order so that writes of keys in the same shards cannot deadlock
+	sort.Ints(shards)
+	for _, shard := range shards {
+		s.locks[shard].Lock()
+	}
+	return func() {
+		for _, shard := range shards {
+			s.locks[shard].Unlock()
+		}
+	}
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// shardedTxKey is the context key of the transaction begun by Begin
+type shardedTxKey struct{}
+
+// shardedTransaction holds the transaction of each shard read or written since Begin, each begun when the shard is
+// first used
+type shardedTransaction struct {
+	mu   sync.Mutex
+	ctxs map[int]context.Context
+	ends []func()
+}
+
+// Begin returns a context in which the reads and writes of each shard are made in a transaction of that shard, which
+// a write of the shard commits
+func (s *Sharded) Begin(ctx context.Context) (context.Context, func(), error) {
+	tx := &shardedTransaction{ctxs: map[int]context.Context{}}
+	return context.WithValue(ctx, shardedTxKey{}, tx), func() {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		for _, end := range tx.ends {
+			end()
+		}
+	}, nil
+}
+
+// shardContext returns the context in which to use the shard, beginning its transaction if needed
+func (s *Sharded) shardContext(ctx context.Context, shard int) (context.Context, error) {
+	tx, ok := ctx.Value(shardedTxKey{}).(*shardedTransaction)
+	if !ok {
+		return ctx, nil
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if shardCtx, ok := tx.ctxs[shard]; ok {
+		return shardCtx, nil
+	}
+	shardCtx, end, err := s.shards[shard].Begin(ctx)
+	if err != nil {
+		return ctx, fmt.Errorf("shard %d: %w", shard, err)
+	}
+	tx.ctxs[shard] = shardCtx
+	tx.ends = append(tx.ends, end)
+	return shardCtx, nil
+}
+
+// ReadData returns the history of every key in every shard
+func (s *Sharded) ReadData(ctx context.Context) (dataMap map[string]interface{}, err error) {
+	defer observe(s.observer, OperationRead, time.Now(), &err)
+	ctx, span := tracing.Start(ctx, "storage.ReadData")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	dataMap = map[string]interface{}{}
+	for shard := range s.shards {
+		shardData, err := s.readShard(ctx, shard, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, keyArray := range shardData {
+			dataMap[key] = keyArray
+		}
+	}
+	return dataMap, nil
+}
+
+// ReadKeys returns the history of each of the specified keys which exists, reading only their shards
+func (s *Sharded) ReadKeys(ctx context.Context, keys ...string) (dataMap map[string]interface{}, err error) {
+	defer observe(s.observer, OperationRead, time.Now(), &err)
+	ctx, span := tracing.Start(ctx, "storage.ReadKeys")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	dataMap = map[string]interface{}{}
+	for shard, shardKeys := range s.partitionKeys(keys) {
+		shardData, err := s.readShard(ctx, shard, shardKeys)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range shardKeys {
+			if keyArray, ok := shardData[key]; ok {
+				dataMap[key] = keyArray
+			}
+		}
+	}
+	return dataMap, nil
+}
+
+// ReadPrefix returns the history of every key with the specified prefix in every shard
+func (s *Sharded) ReadPrefix(ctx context.Context, prefix string) (dataMap map[string]interface{}, err error) {
+	defer observe(s.observer, OperationRead, time.Now(), &err)
+	ctx, span := tracing.Start(ctx, "storage.ReadPrefix")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	dataMap = map[string]interface{}{}
+	for shard, store := range s.shards {
+		shardCtx, err := s.shardContext(ctx, shard)
+		if err != nil {
+			return nil, err
+		}
+		var shardData map[string]interface{}
+		if keyStore, ok := store.(KeyStore); ok {
+			shardData, err = keyStore.ReadPrefix(shardCtx, prefix)
+		} else {
+			shardData, err = store.ReadData(shardCtx)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %w", shard, err)
+		}
+		for key, keyArray := range shardData {
+			if strings.HasPrefix(key, prefix) && s.ring.shard(key) == shard {
+				dataMap[key] = keyArray
+			}
+		}
+	}
+	return dataMap, nil
+}
+
+// readShard returns the histories of the specified keys in the shard, or if nil of every key it owns. Keys the shard
+// holds but does not own, left by an interrupted Rebalance, are ignored
+func (s *Sharded) readShard(ctx context.Context, shard int, keys []string) (map[string]interface{}, error) {
+	shardCtx, err := s.shardContext(ctx, shard)
+	if err != nil {
+		return nil, err
+	}
+	var shardData map[string]interface{}
+	if keyStore, ok := s.shards[shard].(KeyStore); ok && keys != nil {
+		shardData, err = keyStore.ReadKeys(shardCtx, keys...)
+	} else {
+		shardData, err = s.shards[shard].ReadData(shardCtx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("shard %d: %w", shard, err)
+	}
+	for key := range shardData {
+		if s.ring.shard(key) != shard {
+			delete(shardData, key)
+		}
+	}
+	return shardData, nil
+}
+
+// WriteData replaces the data of every shard with the keys it owns in the specified data
+func (s *Sharded) WriteData(ctx context.Context, dataMap map[string]interface{}) (err error) {
+	defer observe(s.observer, OperationWrite, time.Now(), &err)
+	ctx, span := tracing.Start(ctx, "storage.WriteData")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	parts := make([]map[string]interface{}, len(s.shards))
+	for shard := range parts {
+		parts[shard] = map[string]interface{}{}
+	}
+	for key, keyArray := range dataMap {
+		parts[s.ring.shard(key)][key] = keyArray
+	}
+	for shard, part := range parts {
+		shardCtx, err := s.shardContext(ctx, shard)
+		if err != nil {
+			return err
+		}
+		if err := s.shards[shard].WriteData(shardCtx, part); err != nil {
+			return fmt.Errorf("shard %d: %w", shard, err)
+		}
+	}
+	return nil
+}
+
+// WriteKeys replaces the history of each key in the specified data, writing only their shards. A shard which cannot
+// write part of its data is rewritten with the keys replaced
+func (s *Sharded) WriteKeys(ctx context.Context, dataMap map[string]interface{}) (err error) {
+	defer observe(s.observer, OperationWrite, time.Now(), &err)
+	ctx, span := tracing.Start(ctx, "storage.WriteKeys")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	keys := make([]string, 0, len(dataMap))
+	for key := range dataMap {
+		keys = append(keys, key)
+	}
+	for shard, shardKeys := range s.partitionKeys(keys) {
+		shardCtx, err := s.shardContext(ctx, shard)
+		if err != nil {
+			return err
+		}
+		part := make(map[string]interface{}, len(shardKeys))
+		for _, key := range shardKeys {
+			part[key] = dataMap[key]
+		}
+		if keyStore, ok := s.shards[shard].(KeyStore); ok {
+			err = keyStore.WriteKeys(shardCtx, part)
+		} else {
+			var shardData map[string]interface{}
+			if shardData, err = s.shards[shard].ReadData(shardCtx); err == nil {
+				for key, keyArray := range part {
+					shardData[key] = keyArray
+				}
+				err = s.shards[shard].WriteData(shardCtx, shardData)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", shard, err)
+		}
+	}
+	return nil
+}
+
+// partitionKeys returns the specified keys grouped by the shard which owns them
+func (s *Sharded) partitionKeys(keys []string) map[int][]string {
+	parts := map[int][]string{}
+	for _, key := range keys {
+		shard := s.ring.shard(key)
+		parts[shard] = append(parts[shard], key)
+	}
+	return parts
+}
+
+// InitialiseData creates and migrates every shard
+func (s *Sharded) InitialiseData() error {
+	return s.each(Store.InitialiseData)
+}
+
+// Check verifies that every shard can be read and written
+func (s *Sharded) Check() error {
+	return s.each(Store.Check)
+}
+
+// VerifyChecksum checks every shard for corruption
+func (s *Sharded) VerifyChecksum() error {
+	return s.each(Store.VerifyChecksum)
+}
+
+// Size returns the total size of the shards
+func (s *Sharded) Size() (int64, error) {
+	var total int64
+	for shard, store := range s.shards {
+		size, err := store.Size()
+		if err != nil {
+			return 0, fmt.Errorf("shard %d: %w", shard, err)
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// SetObserver sets a function to be called after each read or write, which may read or write several shards
+func (s *Sharded) SetObserver(observer Observer) {
+	s.observer = observer
+}
+
+// Close closes every shard which can be closed
+func (s *Sharded) Close() error {
+	var errs []error
+	for shard, store := range s.shards {
+		if closer, ok := store.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("shard %d: %w", shard, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// each calls the function with every shard, returning the errors it returned
+func (s *Sharded) each(f func(Store) error) error {
+	var errs []error
+	for shard, store := range s.shards {
+		if err := f(store); err != nil {
+			errs = append(errs, fmt.Errorf("shard %d: %w", shard, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RebalanceReport is the outcome of Rebalance
+type RebalanceReport struct {
+	// Keys is the number of keys in the shards
+	Keys int `json:"keys"`
+	// Moved is the number of keys whose shard changed
+	Moved int `json:"moved"`
+}
+
+// Rebalance moves each key from the shard which owns it among the specified shards to the shard which owns it among
+// the new shards; the same store may be in both. The server must be stopped. Each key is first added to its new shard,
+// then removed from the others. If interrupted while adding, the old shards still hold every key; if while removing,
+// each key is in its old shard or its new one, where it is found again, so running Rebalance again completes it either
+// way. Stores which are only old shards are left unchanged, to be removed by the caller
+func Rebalance(ctx context.Context, from, to []Store) (RebalanceReport, error) {
+	var report RebalanceReport
+	if len(to) == 0 {
+		return report, errors.New("rebalancing needs at least one shard")
+	}
+	// Read every shard, old or new, including keys left by an earlier interrupted rebalance
+	var stores []Store
+	held := map[Store]map[string]interface{}{}
+	for _, store := range append(append([]Store(nil), from...), to...) {
+		if _, ok := held[store]; ok {
+			continue
+		}
+		if err := store.InitialiseData(); err != nil {
+			return report, err
+		}
+		dataMap, err := store.ReadData(ctx)
+		if err != nil {
+			return report, err
+		}
+		stores = append(stores, store)
+		held[store] = dataMap
+	}
+
+	// The history of each key is that in its old shard, or if already moved in its new shard
+	fromRing, toRing := newHashRing(len(from)), newHashRing(len(to))
+	owned := map[Store]map[string]interface{}{}
+	for _, store := range to {
+		owned[store] = map[string]interface{}{}
+	}
+	for _, store := range stores {
+		for key, keyArray := range held[store] {
+			toStore := to[toRing.shard(key)]
+			if _, ok := owned[toStore][key]; ok {
+				continue
+			}
+			var fromStore Store
+			if len(from) > 0 {
+				fromStore = from[fromRing.shard(key)]
+			}
+			if history, ok := held[fromStore][key]; ok {
+				keyArray = history
+			} else if history, ok := held[toStore][key]; ok {
+				keyArray = history
+			}
+			owned[toStore][key] = keyArray
+			report.Keys++
+			if fromStore != toStore {
+				report.Moved++
+			}
+		}
+	}
+
+	// Add the keys each new shard owns, then remove those it does not
+	for _, store := range to {
+		added := map[string]interface{}{}
+		for key, keyArray := range held[store] {
+			added[key] = keyArray
+		}
+		changed := false
+		for key, keyArray := range owned[store] {
+			if !sameHistory(added[key], keyArray) {
+				added[key] = keyArray
+				changed = true
+			}
+		}
+		if changed {
+			if err := store.WriteData(ctx, added); err != nil {
+				return report, err
+			}
+			held[store] = added
+		}
+	}
+	for _, store := range to {
+		if len(held[store]) != len(owned[store]) {
+			if err := store.WriteData(ctx, owned[store]); err != nil {
+				return report, err
+			}
+			held[store] = owned[store]
+		}
+	}
+	return report, nil
+}
+
+// sameHistory reports whether the histories are equal
+func sameHistory(a, b interface{}) bool {
+	aJSON, errA := json.Marshal(a)
+	bJSON, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(aJSON) == string(bJSON)
+}
@@ -0,0 +1,223 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// openTestShards returns data files in a new directory, named data-0.json and so on
+func openTestShards(t *testing.T, dir string, count int) []Store {
+	var shards []Store
+	for i := 0; i < count; i++ {
+		repo := &Repo{}
+		repo.SetDataFilePath(filepath.Join(dir, fmt.Sprintf("data-%d.json", i)))
+		assert.NoError(t, repo.InitialiseData())
+		shards = append(shards, repo)
+	}
+	return shards
+}
+
+func testHistory(value string) []interface{} {
+	return []interface{}{map[string]interface{}{"event": "create", "value": value}}
+}
+
+func TestHashRing(t *testing.T) {
+	four, five := newHashRing(4), newHashRing(5)
+	counts := make([]int, 5)
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := "key" + strconv.Itoa(i)
+		shard := five.shard(key)
+		counts[shard]++
+		// Adding a shard only moves keys to the new shard
+		if shard != four.shard(key) {
+			assert.Equal(t, 4, shard, key)
+			moved++
+		}
+	}
+	for shard, count := range counts {
+		assert.InDelta(t, 2000, count, 500, "shard %d", shard)
+	}
+	assert.Equal(t, counts[4], moved)
+	assert.Equal(t, 0, newHashRing(1).shard("key1"))
+}
+
+func TestSharded(t *testing.T) {
+	dir := t.TempDir()
+	shards := openTestShards(t, dir, 3)
+	store := NewSharded(shards...)
+	ctx := context.Background()
+	dataMap := map[string]interface{}{}
+	for i := 0; i < 30; i++ {
+		dataMap["key"+strconv.Itoa(i)] = testHistory(strconv.Itoa(i))
+	}
+	assert.NoError(t, store.WriteData(ctx, dataMap))
+
+	// Each key is written to the shard which owns it
+	for shard, repo := range shards {
+		shardData, err := repo.ReadData(ctx)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, shardData)
+		for key := range shardData {
+			assert.Equal(t, shard, store.ShardOf(key), key)
+		}
+	}
+	read, err := store.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, read)
+
+	// Writing a key rewrites only its shard
+	shard := store.ShardOf("key1")
+	other := (shard + 1) % 3
+	otherPath := filepath.Join(dir, fmt.Sprintf("data-%d.json", other))
+	otherTime := modTime(t, otherPath)
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, store.WriteKeys(ctx, map[string]interface{}{"key1": testHistory("updated")}))
+	assert.Equal(t, otherTime, modTime(t, otherPath))
+	read, err = store.ReadKeys(ctx, "key1", "key2", "missing")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"key1": testHistory("updated"), "key2": testHistory("2")}, read)
+	read, err = store.ReadPrefix(ctx, "key2")
+	assert.NoError(t, err)
+	assert.Len(t, read, 11)
+
+	// A key held by a shard which does not own it is ignored
+	strayData, err := shards[other].ReadData(ctx)
+	assert.NoError(t, err)
+	strayData["key1"] = testHistory("stray")
+	assert.NoError(t, shards[other].WriteData(ctx, strayData))
+	read, err = store.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, testHistory("updated"), read["key1"])
+
+	assert.NoError(t, store.Check())
+	assert.NoError(t, store.VerifyChecksum())
+	size, err := store.Size()
+	assert.NoError(t, err)
+	assert.Positive(t, size)
+}
+
+func modTime(t *testing.T, path string) time.Time {
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	return info.ModTime()
+}
+
+func TestShardedTransaction(t *testing.T) {
+	shards := []Store{openTestSQLite(t), openTestSQLite(t)}
+	store := NewSharded(shards...)
+	ctx := context.Background()
+
+	// Each shard used is begun in a transaction, which writing the shard commits
+	txCtx, end, err := store.Begin(ctx)
+	assert.NoError(t, err)
+	read, err := store.ReadKeys(txCtx, "key1")
+	assert.NoError(t, err)
+	assert.Empty(t, read)
+	assert.NoError(t, store.WriteKeys(txCtx, map[string]interface{}{"key1": testHistory("1")}))
+	end()
+	read, err = store.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"key1": testHistory("1")}, read)
+}
+
+func TestShardedLockKeys(t *testing.T) {
+	store := NewSharded(openTestShards(t, t.TempDir(), 2)...)
+	var key0, key1 string
+	for i := 0; key0 == "" || key1 == ""; i++ {
+		if key := "key" + strconv.Itoa(i); store.ShardOf(key) == 0 {
+			key0 = key
+		} else {
+			key1 = key
+		}
+	}
+
+	// Keys in other shards can be locked while a shard is locked, but not keys in the same shard
+	unlock := store.LockKeys(key0)
+	store.LockKeys(key1)()
+	locked := make(chan struct{})
+	go func() {
+		store.LockKeys(key1, key0)()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		assert.Fail(t, "locked a locked shard")
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+}
+
+func TestRebalance(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	unsharded := &Repo{}
+	unsharded.SetDataFilePath(filepath.Join(dir, "data.json"))
+	assert.NoError(t, unsharded.InitialiseData())
+	dataMap := map[string]interface{}{}
+	for i := 0; i < 100; i++ {
+		dataMap["key"+strconv.Itoa(i)] = testHistory(strconv.Itoa(i))
+	}
+	assert.NoError(t, unsharded.WriteData(ctx, dataMap))
+
+	// Sharding moves every key out of the unsharded data file
+	shards := openTestShards(t, dir, 4)
+	report, err := Rebalance(ctx, []Store{unsharded}, shards)
+	assert.NoError(t, err)
+	assert.Equal(t, RebalanceReport{Keys: 100, Moved: 100}, report)
+	read, err := NewSharded(shards...).ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, read)
+
+	// Adding a shard moves only the keys it takes, and removes them from the others
+	five := append(shards, openTestShards(t, t.TempDir(), 1)...)
+	firstShard, err := shards[0].ReadData(ctx)
+	assert.NoError(t, err)
+	report, err = Rebalance(ctx, shards, five)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, report.Keys)
+	assert.Positive(t, report.Moved)
+	assert.Less(t, report.Moved, 40)
+	assertShardedKeys := func() {
+		t.Helper()
+		total := 0
+		for _, shard := range five {
+			shardData, err := shard.ReadData(ctx)
+			assert.NoError(t, err)
+			total += len(shardData)
+		}
+		assert.Equal(t, 100, total)
+		read, err := NewSharded(five...).ReadData(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, dataMap, read)
+	}
+	assertShardedKeys()
+
+	// Rebalancing again completes one interrupted while removing the moved keys, when the first shard still holds its
+	// moved keys but the others do not
+	assert.NoError(t, shards[0].WriteData(ctx, firstShard))
+	_, err = Rebalance(ctx, shards, five)
+	assert.NoError(t, err)
+	assertShardedKeys()
+
+	// Rebalancing again changes nothing
+	report, err = Rebalance(ctx, five, five)
+	assert.NoError(t, err)
+	assert.Equal(t, RebalanceReport{Keys: 100}, report)
+
+	// Removing shards moves their keys to the rest
+	report, err = Rebalance(ctx, five, five[:2])
+	assert.NoError(t, err)
+	assert.Equal(t, 100, report.Keys)
+	read, err = NewSharded(five[:2]...).ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, read)
+}
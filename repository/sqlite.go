@@ -0,0 +1,469 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"its-dave/simple-crud-rest-server/tracing"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	// Registers the pure-Go "sqlite" driver, so that the server builds without cgo
+	_ "modernc.org/sqlite"
+)
+
+// schema creates the tables of an SQLite store: each key, and each event of its history in order of seq. Events are
+// stored as the JSON of the event, so that they round trip exactly as they do in the data file
+const schema = `
+CREATE TABLE IF NOT EXISTS keys (
+	id INTEGER PRIMARY KEY,
+	key TEXT NOT NULL UNIQUE
+);
+CREATE TABLE IF NOT EXISTS events (
+	key_id INTEGER NOT NULL REFERENCES keys (id) ON DELETE CASCADE,
+	seq INTEGER NOT NULL,
+	event TEXT NOT NULL,
+	PRIMARY KEY (key_id, seq)
+);
+`
+
+// SQLite stores the data in an SQLite database, with a row for each key and for each event of its history. The format
+// version of the data is recorded as the database's user_version
+type SQLite struct {
+	path     string
+	db       *sql.DB
+	observer Observer
+}
+
+// OpenSQLite opens the SQLite database at the specified path, which InitialiseData creates if it does not exist
+func OpenSQLite(path string) (*SQLite, error) {
+	query := url.Values{}
+	// Let readers continue while a write is in progress, and wait for the lock rather than failing when contended
+	query.Add("_pragma", "journal_mode(WAL)")
+	query.Add("_pragma", "busy_timeout(5000)")
+	query.Add("_pragma", "foreign_keys(1)")
+	// Take the write lock when a transaction begins, so that its reads see the data it then writes over
+	query.Set("_txlock", "immediate")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return &SQLite{path: path, db: db}, nil
+}
+
+// Close closes the database
+func (store *SQLite) Close() error {
+	return store.db.Close()
+}
+
+// SetObserver sets a function to be called after each read or write of the data
+func (store *SQLite) SetObserver(observer Observer) {
+	store.observer = observer
+}
+
+// txKey is the context key of the transaction begun by Begin
+type txKey struct{}
+
+// transaction is a transaction begun by Begin, which is committed by WriteData
+type transaction struct {
+	tx   *sql.Tx
+	done bool
+}
+
+// Begin returns a context in which ReadData and WriteData are made in a single transaction, which WriteData commits
+func (store *SQLite) Begin(ctx context.Context) (context.Context, func(), error) {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ctx, func() {}, err
+	}
+	t := &transaction{tx: tx}
+	end := func() {
+		if !t.done {
+			t.done = true
+			tx.Rollback()
+		}
+	}
+	return context.WithValue(ctx, txKey{}, t), end, nil
+}
+
+// querier is the part of *sql.DB and *sql.Tx used to read and write the data
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// transaction returns the transaction begun by Begin in the specified context, if it has not ended
+func (store *SQLite) transaction(ctx context.Context) (*transaction, bool) {
+	t, ok := ctx.Value(txKey{}).(*transaction)
+	return t, ok && !t.done
+}
+
+// ReadData returns the history of every key
+func (store *SQLite) ReadData(ctx context.Context) (dataMap map[string]interface{}, err error) {
+	defer observe(store.observer, OperationRead, time.Now(), &err)
+	ctx, span := tracing.Start(ctx, "storage.ReadData")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	histories, err := readHistories(ctx, store.querier(ctx), "")
+	if err != nil {
+		return nil, err
+	}
+	return decodeHistories(histories)
+}
+
+// ReadKeys returns the history of each of the specified keys which exists
+func (store *SQLite) ReadKeys(ctx context.Context, keys ...string) (dataMap map[string]interface{}, err error) {
+	defer observe(store.observer, OperationRead, time.Now(), &err)
+	ctx, span := tracing.Start(ctx, "storage.ReadKeys")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	if len(keys) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	condition, args := keyIn(keys)
+	histories, err := readHistories(ctx, store.querier(ctx), condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	return decodeHistories(histories)
+}
+
+// ReadPrefix returns the history of every key with the specified prefix
+func (store *SQLite) ReadPrefix(ctx context.Context, prefix string) (dataMap map[string]interface{}, err error) {
+	defer observe(store.observer, OperationRead, time.Now(), &err)
+	ctx, span := tracing.Start(ctx, "storage.ReadPrefix")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	// A range of keys, unlike LIKE or GLOB, is matched using the index of the keys and needs no escaping
+	condition, args := "", []interface{}{}
+	if prefix != "" {
+		condition, args = "keys.key >= ?", append(args, prefix)
+		if end, ok := prefixEnd(prefix); ok {
+			condition, args = condition+" AND keys.key < ?", append(args, end)
+		}
+	}
+	histories, err := readHistories(ctx, store.querier(ctx), condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	return decodeHistories(histories)
+}
+
+// querier returns the transaction begun by Begin in the specified context, or the database if there is none
+func (store *SQLite) querier(ctx context.Context) querier {
+	if t, ok := store.transaction(ctx); ok {
+		return t.tx
+	}
+	return store.db
+}
+
+// keyIn returns a condition matching the specified keys, and its arguments
+func keyIn(keys []string) (string, []interface{}) {
+	args := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	return "keys.key IN (?" + strings.Repeat(", ?", len(keys)-1) + ")", args
+}
+
+// prefixEnd returns the first string after every string with the specified prefix, or false if there is none
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// decodeHistories returns the events of each key as they were written
+func decodeHistories(histories map[string]*storedHistory) (map[string]interface{}, error) {
+	dataMap := make(map[string]interface{}, len(histories))
+	for key, history := range histories {
+		array := make([]interface{}, 0, len(history.events))
+		for _, event := range history.events {
+			var element interface{}
+			if err := json.Unmarshal([]byte(event), &element); err != nil {
+				return nil, fmt.Errorf("event of key %q: %w", key, err)
+			}
+			array = append(array, element)
+		}
+		dataMap[key] = array
+	}
+	return dataMap, nil
+}
+
+// storedHistory is a key's row ID and the JSON of each of its events
+type storedHistory struct {
+	id     int64
+	events []string
+}
+
+// readHistories reads the history of every key matching the specified condition, or of every key if it is empty
+func readHistories(ctx context.Context, q querier, condition string, args ...interface{}) (map[string]*storedHistory, error) {
+	query := `SELECT keys.id, keys.key, events.event FROM keys LEFT JOIN events ON events.key_id = keys.id`
+	if condition != "" {
+		query += ` WHERE ` + condition
+	}
+	rows, err := q.QueryContext(ctx, query+` ORDER BY keys.id, events.seq`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	histories := map[string]*storedHistory{}
+	for rows.Next() {
+		var id int64
+		var key string
+		var event sql.NullString
+		if err := rows.Scan(&id, &key, &event); err != nil {
+			return nil, err
+		}
+		history, ok := histories[key]
+		if !ok {
+			history = &storedHistory{id: id, events: []string{}}
+			histories[key] = history
+		}
+		if event.Valid {
+			history.events = append(history.events, event.String)
+		}
+	}
+	return histories, rows.Err()
+}
+
+// WriteData replaces the stored data with the specified data, committing the transaction begun by Begin, if any.
+// Only the changes are written: events appended to a history are inserted, and other histories which differ are
+// rewritten
+func (store *SQLite) WriteData(ctx context.Context, dataMap map[string]interface{}) (err error) {
+	defer observe(store.observer, OperationWrite, time.Now(), &err)
+	ctx, span := tracing.Start(ctx, "storage.WriteData")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	return store.write(ctx, dataMap, true)
+}
+
+// WriteKeys replaces the history of each key in the specified data, leaving other keys unchanged, and commits the
+// transaction begun by Begin, if any
+func (store *SQLite) WriteKeys(ctx context.Context, dataMap map[string]interface{}) (err error) {
+	defer observe(store.observer, OperationWrite, time.Now(), &err)
+	ctx, span := tracing.Start(ctx, "storage.WriteKeys")
+	defer span.Finish()
+	defer func() { span.RecordError(err) }()
+
+	return store.write(ctx, dataMap, false)
+}
+
+// write writes the specified data in the transaction begun by Begin, or a new one, and commits it. If replace is set,
+// keys which are not in the data are deleted
+func (store *SQLite) write(ctx context.Context, dataMap map[string]interface{}, replace bool) error {
+	t, ok := store.transaction(ctx)
+	if !ok {
+		tx, err := store.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		t = &transaction{tx: tx}
+	}
+	defer func() {
+		// The transaction ends with the write, whether or not it succeeds
+		if !t.done {
+			t.done = true
+			t.tx.Rollback()
+		}
+	}()
+
+	if err := writeHistories(ctx, t.tx, dataMap, replace); err != nil {
+		return err
+	}
+	t.done = true
+	return t.tx.Commit()
+}
+
+// writeHistories makes the stored histories of the keys in the specified data match it. If replace is set, keys which
+// are not in the data are deleted
+func writeHistories(ctx context.Context, tx *sql.Tx, dataMap map[string]interface{}, replace bool) error {
+	var stored map[string]*storedHistory
+	var err error
+	if replace {
+		stored, err = readHistories(ctx, tx, "")
+	} else if len(dataMap) > 0 {
+		keys := make([]string, 0, len(dataMap))
+		for key := range dataMap {
+			keys = append(keys, key)
+		}
+		condition, args := keyIn(keys)
+		stored, err = readHistories(ctx, tx, condition, args...)
+	}
+	if err != nil {
+		return err
+	}
+	for key, history := range stored {
+		if _, ok := dataMap[key]; !ok {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM keys WHERE id = ?`, history.id); err != nil {
+				return err
+			}
+		}
+	}
+
+	for key, keyArray := range dataMap {
+		events, err := encodeHistory(keyArray)
+		if err != nil {
+			return fmt.Errorf("history of key %q: %w", key, err)
+		}
+		history, ok := stored[key]
+		if !ok {
+			result, err := tx.ExecContext(ctx, `INSERT INTO keys (key) VALUES (?)`, key)
+			if err != nil {
+				return err
+			}
+			id, err := result.LastInsertId()
+			if err != nil {
+				return err
+			}
+			history = &storedHistory{id: id}
+		}
+
+		// Most writes append an event, so only the events after those already stored need inserting
+		from := 0
+		for from < len(events) && from < len(history.events) && events[from] == history.events[from] {
+			from++
+		}
+		if from == len(events) && from == len(history.events) {
+			continue
+		}
+		if from < len(history.events) {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM events WHERE key_id = ? AND seq >= ?`, history.id, from); err != nil {
+				return err
+			}
+		}
+		for seq := from; seq < len(events); seq++ {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO events (key_id, seq, event) VALUES (?, ?, ?)`, history.id, seq, events[seq]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encodeHistory returns the JSON of each event of a key's history, in the form read back by ReadData so that unchanged
+// events compare equal to those stored
+func encodeHistory(keyArray interface{}) ([]string, error) {
+	data, err := json.Marshal(keyArray)
+	if err != nil {
+		return nil, err
+	}
+	var array []interface{}
+	if err := json.Unmarshal(data, &array); err != nil || array == nil {
+		return nil, errors.New("history is not an array of events")
+	}
+	events := make([]string, 0, len(array))
+	for _, element := range array {
+		event, err := json.Marshal(element)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, string(event))
+	}
+	return events, nil
+}
+
+// InitialiseData creates the database and its tables if they do not exist, and migrates the data to the current
+// format. Unlike the data file, the database is not backed up first; take a snapshot before upgrading
+func (store *SQLite) InitialiseData() error {
+	ctx := context.Background()
+	if _, err := store.db.ExecContext(ctx, schema); err != nil {
+		return err
+	}
+	var version int
+	if err := store.db.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version == CurrentVersion() {
+		return nil
+	}
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if version == 0 {
+		// A new database, as user_version starts at 0
+		version = CurrentVersion()
+	} else {
+		if err := checkVersion(version); !errors.Is(err, ErrMigrationRequired) {
+			return err
+		}
+		dataMap, err := store.ReadData(context.WithValue(ctx, txKey{}, &transaction{tx: tx}))
+		if err != nil {
+			return err
+		}
+		if dataMap, err = Migrate(dataMap, version); err != nil {
+			return err
+		}
+		if err := writeHistories(ctx, tx, dataMap, true); err != nil {
+			return err
+		}
+	}
+	// PRAGMA does not accept parameters
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d`, CurrentVersion())); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Check verifies that the database can be read and written, without modifying it
+func (store *SQLite) Check() error {
+	file, err := os.OpenFile(store.path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return store.db.Ping()
+}
+
+// Size returns the size in bytes of the database file
+func (store *SQLite) Size() (int64, error) {
+	info, err := os.Stat(store.path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// VerifyChecksum checks the integrity of the database, returning ErrChecksumMismatch if it is corrupt
+func (store *SQLite) VerifyChecksum() error {
+	rows, err := store.db.Query(`PRAGMA quick_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %v", ErrChecksumMismatch, problems)
+	}
+	return nil
+}
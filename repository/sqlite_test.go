@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestSQLite(t *testing.T) *SQLite {
+	store, err := OpenSQLite(filepath.Join(t.TempDir(), "data.db"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { store.Close() })
+	assert.NoError(t, store.InitialiseData())
+	return store
+}
+
+func TestSQLite(t *testing.T) {
+	store := openTestSQLite(t)
+	ctx := context.Background()
+
+	dataMap, err := store.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, dataMap)
+
+	var initial map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(initialState), &initial))
+	initial["empty"] = []interface{}{}
+	assert.NoError(t, store.WriteData(ctx, initial))
+	dataMap, err = store.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, initial, dataMap)
+
+	// Appended events are inserted after those stored, and removed keys are deleted with their events
+	dataMap["key1"] = append(dataMap["key1"].([]interface{}), map[string]interface{}{"event": "update", "value": "value2", "identity": "apikey:ci"})
+	delete(dataMap, "key2")
+	assert.NoError(t, store.WriteData(ctx, dataMap))
+	read, err := store.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, read)
+	var events int
+	assert.NoError(t, store.db.QueryRow(`SELECT COUNT(*) FROM events`).Scan(&events))
+	assert.Equal(t, 2, events)
+
+	// Rewritten histories replace those stored
+	dataMap["key1"] = []interface{}{map[string]interface{}{"event": "create", "value": "value3"}}
+	assert.NoError(t, store.WriteData(ctx, dataMap))
+	read, err = store.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, read)
+
+	assert.ErrorContains(t, store.WriteData(ctx, map[string]interface{}{"key1": "value1"}), `history of key "key1"`)
+	read, err = store.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, read)
+
+	assert.NoError(t, store.Check())
+	assert.NoError(t, store.VerifyChecksum())
+	size, err := store.Size()
+	assert.NoError(t, err)
+	assert.Positive(t, size)
+}
+
+func TestSQLiteTransaction(t *testing.T) {
+	store := openTestSQLite(t)
+	ctx := context.Background()
+	assert.NoError(t, store.WriteData(ctx, map[string]interface{}{"key1": []interface{}{map[string]interface{}{"event": "create", "value": "value1"}}}))
+
+	// A transaction which is not written is rolled back
+	txCtx, end, err := store.Begin(ctx)
+	assert.NoError(t, err)
+	dataMap, err := store.ReadData(txCtx)
+	assert.NoError(t, err)
+	assert.Len(t, dataMap, 1)
+	end()
+
+	// A write commits the transaction, after which ending it does nothing
+	txCtx, end, err = store.Begin(ctx)
+	assert.NoError(t, err)
+	dataMap, err = store.ReadData(txCtx)
+	assert.NoError(t, err)
+	dataMap["key2"] = []interface{}{map[string]interface{}{"event": "create", "value": "value2"}}
+	assert.NoError(t, store.WriteData(txCtx, dataMap))
+	end()
+	read, err := store.ReadData(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, read)
+}
+
+func TestSQLiteInitialiseData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.db")
+	store, err := OpenSQLite(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer store.Close()
+	assert.NoError(t, store.InitialiseData())
+	var version int
+	assert.NoError(t, store.db.QueryRow(`PRAGMA user_version`).Scan(&version))
+	assert.Equal(t, CurrentVersion(), version)
+
+	// Data in an older format is migrated
+	var initial map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(initialState), &initial))
+	assert.NoError(t, store.WriteData(context.Background(), initial))
+	_, err = store.db.Exec(`PRAGMA user_version = 1`)
+	assert.NoError(t, err)
+	assert.NoError(t, store.InitialiseData())
+	assert.NoError(t, store.db.QueryRow(`PRAGMA user_version`).Scan(&version))
+	assert.Equal(t, CurrentVersion(), version)
+	dataMap, err := store.ReadData(context.Background())
+	assert.NoError(t, err)
+	data, err := json.Marshal(dataMap)
+	assert.NoError(t, err)
+	assert.JSONEq(t, migratedStates[CurrentVersion()], string(data))
+
+	// Newer formats are rejected
+	_, err = store.db.Exec(`PRAGMA user_version = 99`)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, store.InitialiseData(), ErrUnsupportedVersion)
+}
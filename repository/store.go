@@ -0,0 +1,45 @@
+package repository
+
+import "context"
+
+// Store holds the history of every key. Repo stores it in a JSON data file, SQLite in an SQLite database and LSM in an
+// embedded log-structured merge tree, and Sharded partitions the keys across several stores
+type Store interface {
+	// ReadData returns the history of every key
+	ReadData(ctx context.Context) (map[string]interface{}, error)
+	// WriteData replaces the stored data with the specified data, committing the transaction begun by Begin, if any
+	WriteData(ctx context.Context, dataMap map[string]interface{}) error
+	// Begin returns a context in which ReadData and WriteData are made in a single transaction, which WriteData
+	// commits. The returned function ends the transaction, rolling it back if it has not been committed, and must
+	// be called
+	Begin(ctx context.Context) (context.Context, func(), error)
+	// InitialiseData creates the store if it does not exist, and migrates it to the current format
+	InitialiseData() error
+	// Check verifies that the store can be read and written, without modifying it
+	Check() error
+	// Size returns the size in bytes of the stored data
+	Size() (int64, error)
+	// VerifyChecksum checks the stored data for corruption, returning ErrChecksumMismatch if it finds any
+	VerifyChecksum() error
+	// SetObserver sets a function to be called after each read or write of the data
+	SetObserver(observer Observer)
+}
+
+// Begin returns the specified context, as the data file is replaced atomically by each write and writers are
+// serialised by their caller, so a read-modify-write needs no transaction
+func (repo Repo) Begin(ctx context.Context) (context.Context, func(), error) {
+	return ctx, func() {}, nil
+}
+
+// KeyStore is a Store which can read and write the histories of some keys without the rest of the data, so that
+// requests about a few keys take time independent of the number stored. SQLite, LSM and Sharded are KeyStores
+type KeyStore interface {
+	Store
+	// ReadKeys returns the history of each of the specified keys which exists
+	ReadKeys(ctx context.Context, keys ...string) (map[string]interface{}, error)
+	// ReadPrefix returns the history of every key with the specified prefix
+	ReadPrefix(ctx context.Context, prefix string) (map[string]interface{}, error)
+	// WriteKeys replaces the history of each key in the specified data, leaving other keys unchanged, and commits the
+	// transaction begun by Begin, if any
+	WriteKeys(ctx context.Context, dataMap map[string]interface{}) error
+}
@@ -0,0 +1,63 @@
+package repository
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyStores(t *testing.T) {
+	for name, open := range map[string]func(t *testing.T) KeyStore{
+		"sqlite": func(t *testing.T) KeyStore { return openTestSQLite(t) },
+		"lsm":    func(t *testing.T) KeyStore { return openTestLSM(t, filepath.Join(t.TempDir(), "data")) },
+		"sharded": func(t *testing.T) KeyStore {
+			return NewSharded(openTestSQLite(t), openTestLSM(t, filepath.Join(t.TempDir(), "data")), openTestSQLite(t))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			ctx := context.Background()
+			history := func(value string) []interface{} {
+				return []interface{}{map[string]interface{}{"event": "create", "value": value}}
+			}
+			// Keys which are prefixes of others, or hold bytes sorting before any other, are kept apart
+			assert.NoError(t, store.WriteData(ctx, map[string]interface{}{
+				"a":      history("1"),
+				"a\x00b": history("2"),
+				"ab":     history("3"),
+				"b":      history("4"),
+				"a\xff":  history("5"),
+				"empty":  []interface{}{},
+			}))
+
+			dataMap, err := store.ReadKeys(ctx, "a", "b", "empty", "missing")
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]interface{}{"a": history("1"), "b": history("4"), "empty": []interface{}{}}, dataMap)
+			dataMap, err = store.ReadKeys(ctx)
+			assert.NoError(t, err)
+			assert.Empty(t, dataMap)
+
+			dataMap, err = store.ReadPrefix(ctx, "a")
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]interface{}{"a": history("1"), "a\x00b": history("2"), "ab": history("3"), "a\xff": history("5")}, dataMap)
+			dataMap, err = store.ReadPrefix(ctx, "a\x00")
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]interface{}{"a\x00b": history("2")}, dataMap)
+			dataMap, err = store.ReadPrefix(ctx, "")
+			assert.NoError(t, err)
+			assert.Len(t, dataMap, 6)
+
+			// Only the keys written are changed
+			updated := append(history("1"), map[string]interface{}{"event": "update", "value": "6"})
+			assert.NoError(t, store.WriteKeys(ctx, map[string]interface{}{"a": updated, "c": history("7")}))
+			dataMap, err = store.ReadData(ctx)
+			assert.NoError(t, err)
+			assert.Len(t, dataMap, 7)
+			assert.Equal(t, updated, dataMap["a"])
+			assert.Equal(t, history("7"), dataMap["c"])
+			assert.Equal(t, history("3"), dataMap["ab"])
+		})
+	}
+}
@@ -0,0 +1,673 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"its-dave/simple-crud-rest-server/client"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	errorSyntax     = "ERR syntax error"
+	errorNotInteger = "ERR value is not an integer or out of range"
+	errorInvalidKey = "ERR keys must not be empty or contain '/'"
+
+	// defaultScanCount is the number of keys SCAN examines if not given a COUNT
+	defaultScanCount = 10
+	// maxCursors is the most SCAN cursors a connection holds, beyond which the oldest are forgotten
+	maxCursors = 1000
+)
+
+// conn is a client connection, served one command at a time
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	id      int64
+	r       *bufio.Reader
+	w       *writer
+
+	token  string
+	client *client.Client
+
+	// cursors maps each SCAN cursor returned to the last key it examined
+	cursors    map[int64]string
+	nextCursor int64
+}
+
+// command is a command's handler, which writes its reply, and its arity: the exact number of arguments including the
+// command's name, or if negative the minimum
+type command struct {
+	arity  int
+	handle func(c *conn, ctx context.Context, args []string)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":    {-1, (*conn).ping},
+		"echo":    {2, (*conn).echo},
+		"hello":   {-1, (*conn).hello},
+		"auth":    {-2, (*conn).auth},
+		"select":  {2, (*conn).selectDB},
+		"command": {-1, (*conn).command},
+		"client":  {-2, (*conn).clientCmd},
+		"get":     {2, (*conn).get},
+		"set":     {-3, (*conn).set},
+		"del":     {-2, (*conn).del},
+		"exists":  {-2, (*conn).exists},
+		"incr":    {2, (*conn).incr},
+		"scan":    {-2, (*conn).scan},
+		"keys":    {2, (*conn).keys},
+		"history": {2, (*conn).history},
+	}
+}
+
+// serve reads and runs commands until the connection is closed or quits. Replies to pipelined commands are written
+// together once every command read has run
+func (c *conn) serve() {
+	defer c.server.untrack(c)
+	for {
+		args, err := readCommand(c.r)
+		if err != nil {
+			var protoErr protocolError
+			if errors.As(err, &protoErr) {
+				c.w.error("ERR " + protoErr.Error())
+				c.w.Flush()
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, net.ErrClosed) {
+				c.server.logger.Debug("reading command", "remoteAddr", c.netConn.RemoteAddr().String(), "error", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := c.execute(args)
+		if quit || c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// execute runs a command, returning whether the client quit
+func (c *conn) execute(args []string) bool {
+	name := strings.ToLower(args[0])
+	if name == "quit" {
+		c.w.simple("OK")
+		return true
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		var quoted []string
+		for _, arg := range args[1:] {
+			quoted = append(quoted, "'"+arg+"'")
+		}
+		c.w.error(fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", args[0], strings.Join(quoted, " ")))
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || len(args) < -cmd.arity {
+		c.w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return false
+	}
+	cmd.handle(c, context.Background(), args[1:])
+	return false
+}
+
+// replyError writes the error of a request as an error reply, with the code Redis clients expect for its cause
+func (c *conn) replyError(err error) {
+	message := err.Error()
+	var clientErr *client.Error
+	if errors.As(err, &clientErr) && clientErr.Message != "" {
+		message = strings.TrimPrefix(clientErr.Message, "Error: ")
+	}
+	switch {
+	case errors.Is(err, client.ErrUnauthorised) && c.token == "":
+		c.w.error("NOAUTH Authentication required.")
+	case errors.Is(err, client.ErrUnauthorised):
+		c.w.error("WRONGPASS " + message)
+	case errors.Is(err, client.ErrForbidden):
+		c.w.error("NOPERM " + message)
+	case errors.Is(err, client.ErrQuotaExceeded):
+		c.w.error("OOM " + message)
+	case errors.Is(err, client.ErrRateLimited), errors.Is(err, client.ErrNotReady):
+		c.w.error("TRYAGAIN " + message)
+	default:
+		c.w.error("ERR " + message)
+	}
+}
+
+// validKey writes an error reply and returns false if the key cannot be written, as it could not then be read at
+// /api/{key}
+func (c *conn) validKey(key string) bool {
+	if key == "" || strings.Contains(key, "/") {
+		c.w.error(errorInvalidKey)
+		return false
+	}
+	return true
+}
+
+// setToken authenticates the connection's later commands with the specified API key or JWT
+func (c *conn) setToken(token string) {
+	c.token = token
+	c.client = c.server.newClient(token, c.netConn.RemoteAddr().String())
+}
+
+func (c *conn) ping(ctx context.Context, args []string) {
+	switch len(args) {
+	case 0:
+		c.w.simple("PONG")
+	case 1:
+		c.w.bulk(args[0])
+	default:
+		c.w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func (c *conn) echo(ctx context.Context, args []string) {
+	c.w.bulk(args[0])
+}
+
+// hello switches the protocol version and authenticates, replying with a description of the server
+func (c *conn) hello(ctx context.Context, args []string) {
+	proto := c.w.proto
+	token := c.token
+	if len(args) > 0 {
+		version, err := strconv.Atoi(args[0])
+		if err != nil {
+			c.w.error("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if version != 2 && version != 3 {
+			c.w.error("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = version
+		for i := 1; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "AUTH":
+				if i+2 >= len(args) {
+					c.w.error(errorSyntax)
+					return
+				}
+				token = args[i+2]
+				i += 2
+			case "SETNAME":
+				if i+1 >= len(args) {
+					c.w.error(errorSyntax)
+					return
+				}
+				i++
+			default:
+				c.w.error(errorSyntax)
+				return
+			}
+		}
+	}
+	if token != c.token {
+		c.setToken(token)
+	}
+	c.w.proto = proto
+	c.w.mapHeader(6)
+	c.w.bulk("server")
+	c.w.bulk("simple-crud-rest-server")
+	c.w.bulk("proto")
+	c.w.integer(int64(proto))
+	c.w.bulk("id")
+	c.w.integer(c.id)
+	c.w.bulk("mode")
+	c.w.bulk("standalone")
+	c.w.bulk("role")
+	c.w.bulk("master")
+	c.w.bulk("modules")
+	c.w.array(0)
+}
+
+// auth sets the API key or JWT to authenticate later commands with, given as the password. The username, if any, is
+// ignored. The token is checked by each command, which fails with WRONGPASS if it is invalid
+func (c *conn) auth(ctx context.Context, args []string) {
+	if len(args) > 2 {
+		c.w.error(errorSyntax)
+		return
+	}
+	c.setToken(args[len(args)-1])
+	c.w.simple("OK")
+}
+
+// selectDB accepts only database 0, as there is a single keyspace
+func (c *conn) selectDB(ctx context.Context, args []string) {
+	if args[0] != "0" {
+		c.w.error("ERR DB index is out of range")
+		return
+	}
+	c.w.simple("OK")
+}
+
+// command describes no commands, which clients such as redis-cli ask for only to give hints
+func (c *conn) command(ctx context.Context, args []string) {
+	c.w.array(0)
+}
+
+// clientCmd accepts the connection's name and library, which clients set on connecting, but does not record them
+func (c *conn) clientCmd(ctx context.Context, args []string) {
+	switch strings.ToUpper(args[0]) {
+	case "SETNAME", "SETINFO":
+		c.w.simple("OK")
+	case "GETNAME":
+		c.w.null()
+	case "ID":
+		c.w.integer(c.id)
+	default:
+		c.w.error(fmt.Sprintf("ERR unknown subcommand '%s'.", args[0]))
+	}
+}
+
+// get replies with the current value of the key, or null if it has none
+func (c *conn) get(ctx context.Context, args []string) {
+	value, err := c.client.Get(ctx, args[0])
+	if errors.Is(err, client.ErrNotFound) || errors.Is(err, client.ErrDeleted) {
+		c.w.null()
+		return
+	}
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	c.w.bulk(value)
+}
+
+// set sets the value of the key: by creating it with NX, by updating it with XX, or otherwise whichever applies. A
+// key set with EX or PX is deleted once that many seconds or milliseconds have passed, and setting it again without
+// KEEPTTL cancels its expiry. Replies null if NX or XX prevented the write
+func (c *conn) set(ctx context.Context, args []string) {
+	key, value := args[0], args[1]
+	var nx, xx, keepTTL bool
+	var ttl time.Duration
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); option {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX":
+			if i+1 >= len(args) || ttl != 0 {
+				c.w.error(errorSyntax)
+				return
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				c.w.error(errorNotInteger)
+				return
+			}
+			unit := time.Second
+			if option == "PX" {
+				unit = time.Millisecond
+			}
+			if n <= 0 || n > math.MaxInt64/int64(unit) {
+				c.w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			ttl = time.Duration(n) * unit
+			i++
+		default:
+			c.w.error(errorSyntax)
+			return
+		}
+	}
+	if (nx && xx) || (keepTTL && ttl != 0) {
+		c.w.error(errorSyntax)
+		return
+	}
+	if !c.validKey(key) {
+		return
+	}
+
+	var err error
+	switch {
+	case nx:
+		err = c.client.Create(ctx, key, value)
+		if errors.Is(err, client.ErrExists) {
+			c.w.null()
+			return
+		}
+	case xx:
+		err = c.client.Update(ctx, key, value)
+		if errors.Is(err, client.ErrNotFound) || errors.Is(err, client.ErrDeleted) {
+			c.w.null()
+			return
+		}
+	default:
+		err = c.put(ctx, key, value)
+	}
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	if ttl != 0 {
+		c.server.expire(key, ttl, c.client)
+	} else if !keepTTL {
+		c.server.persist(key)
+	}
+	c.w.simple("OK")
+}
+
+// put updates the value of the key if it has one, and otherwise creates it
+func (c *conn) put(ctx context.Context, key, value string) error {
+	for attempt := 0; ; attempt++ {
+		err := c.client.Update(ctx, key, value)
+		if !errors.Is(err, client.ErrNotFound) && !errors.Is(err, client.ErrDeleted) {
+			return err
+		}
+		err = c.client.Create(ctx, key, value)
+		// The key may have been created by another client since it was found to have no value, so is updated again
+		if !errors.Is(err, client.ErrExists) || attempt == 2 {
+			return err
+		}
+	}
+}
+
+// del deletes the value of each key, replying with the number which had a value
+func (c *conn) del(ctx context.Context, args []string) {
+	deleted := 0
+	for _, key := range args {
+		err := c.client.Delete(ctx, key)
+		if errors.Is(err, client.ErrNotFound) || errors.Is(err, client.ErrDeleted) {
+			continue
+		}
+		if err != nil {
+			c.replyError(err)
+			return
+		}
+		c.server.persist(key)
+		deleted++
+	}
+	c.w.integer(int64(deleted))
+}
+
+// exists replies with the number of keys which have a value, counting a key given more than once each time
+func (c *conn) exists(ctx context.Context, args []string) {
+	existing := 0
+	for _, key := range args {
+		_, err := c.client.Get(ctx, key)
+		if errors.Is(err, client.ErrNotFound) || errors.Is(err, client.ErrDeleted) {
+			continue
+		}
+		if err != nil {
+			c.replyError(err)
+			return
+		}
+		existing++
+	}
+	c.w.integer(int64(existing))
+}
+
+// incr adds one to the integer value of the key, treating a key without a value as 0, and replies with the result.
+// The value is only written if the key is unchanged since it was read, and is otherwise read again, so an increment
+// is not lost to a concurrent write through any API
+func (c *conn) incr(ctx context.Context, args []string) {
+	key := args[0]
+	if !c.validKey(key) {
+		return
+	}
+
+	for {
+		var n int64
+		value, version, err := c.client.GetVersion(ctx, key)
+		exists := err == nil
+		switch {
+		case errors.Is(err, client.ErrNotFound) || errors.Is(err, client.ErrDeleted):
+		case err != nil:
+			c.replyError(err)
+			return
+		default:
+			if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+				c.w.error(errorNotInteger)
+				return
+			}
+		}
+		if n == math.MaxInt64 {
+			c.w.error("ERR increment or decrement would overflow")
+			return
+		}
+		n++
+
+		if exists {
+			err = c.client.UpdateVersion(ctx, key, strconv.FormatInt(n, 10), version)
+		} else {
+			err = c.client.Create(ctx, key, strconv.FormatInt(n, 10))
+		}
+		// The key has been written since it was read, so the increment is retried with its new value
+		if errors.Is(err, client.ErrChanged) || errors.Is(err, client.ErrExists) {
+			continue
+		}
+		if err != nil {
+			c.replyError(err)
+			return
+		}
+		c.w.integer(n)
+		return
+	}
+}
+
+// scan replies with a cursor and some of the keys with a value which match the pattern, in key order. Scanning from
+// cursor 0 until the cursor returned is 0 again returns every key which had a value throughout
+func (c *conn) scan(ctx context.Context, args []string) {
+	pattern, count, stringsOnly := "*", defaultScanCount, true
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			c.w.error(errorSyntax)
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				c.w.error(errorNotInteger)
+				return
+			}
+			if n < 1 {
+				c.w.error(errorSyntax)
+				return
+			}
+			count = n
+		case "TYPE":
+			// Every value is a string
+			stringsOnly = strings.EqualFold(args[i+1], "string")
+		default:
+			c.w.error(errorSyntax)
+			return
+		}
+	}
+	var after string
+	if args[0] != "0" {
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		key, ok := c.cursors[id]
+		if err != nil || !ok {
+			c.w.error("ERR invalid cursor")
+			return
+		}
+		delete(c.cursors, id)
+		after = key
+	}
+
+	entries, err := c.client.List(ctx, literalPrefix(pattern))
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	matched := []string{}
+	examined := 0
+	next := "0"
+	for _, entry := range entries {
+		if args[0] != "0" && entry.Key <= after {
+			continue
+		}
+		if examined == count {
+			next = c.newCursor(after)
+			break
+		}
+		examined++
+		after = entry.Key
+		if stringsOnly && match(pattern, entry.Key) {
+			matched = append(matched, entry.Key)
+		}
+	}
+	c.w.array(2)
+	c.w.bulk(next)
+	c.w.bulks(matched)
+}
+
+// newCursor returns a cursor continuing a scan after the specified key, forgetting the oldest if there are too many
+func (c *conn) newCursor(after string) string {
+	if len(c.cursors) >= maxCursors {
+		oldest := int64(math.MaxInt64)
+		for id := range c.cursors {
+			oldest = min(oldest, id)
+		}
+		delete(c.cursors, oldest)
+	}
+	c.nextCursor++
+	c.cursors[c.nextCursor] = after
+	return strconv.FormatInt(c.nextCursor, 10)
+}
+
+// keys replies with every key with a value which matches the pattern, in key order
+func (c *conn) keys(ctx context.Context, args []string) {
+	pattern := args[0]
+	entries, err := c.client.List(ctx, literalPrefix(pattern))
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	matched := []string{}
+	for _, entry := range entries {
+		if match(pattern, entry.Key) {
+			matched = append(matched, entry.Key)
+		}
+	}
+	c.w.bulks(matched)
+}
+
+// history replies with every event of the key, oldest first, each a map of its fields as in /api/{key}/history, or
+// null if the key has never existed
+func (c *conn) history(ctx context.Context, args []string) {
+	events, err := c.client.History(ctx, args[0])
+	if errors.Is(err, client.ErrNotFound) {
+		c.w.null()
+		return
+	}
+	if err != nil {
+		c.replyError(err)
+		return
+	}
+	c.w.array(len(events))
+	for _, event := range events {
+		fields := [][2]string{{"event", event.Event}, {"value", event.Value}}
+		if event.Identity != "" {
+			fields = append(fields, [2]string{"identity", event.Identity})
+		}
+		if event.Time != "" {
+			fields = append(fields, [2]string{"time", event.Time})
+		}
+		c.w.mapHeader(len(fields))
+		for _, field := range fields {
+			c.w.bulk(field[0])
+			c.w.bulk(field[1])
+		}
+	}
+}
+
+// literalPrefix returns the part of a glob pattern before its first special character, which every key it matches
+// starts with
+func literalPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// match reports whether the string matches the glob pattern as Redis matches them: * matches any bytes, ? any one
+// byte, [abc], [^abc] and [a-c] one of a set of bytes, and \ escapes the next byte
+func match(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if match(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			negate := len(pattern) > 0 && pattern[0] == '^'
+			if negate {
+				pattern = pattern[1:]
+			}
+			matched := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) > 1:
+					matched = matched || pattern[1] == s[0]
+					pattern = pattern[2:]
+				case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+					lo, hi := min(pattern[0], pattern[2]), max(pattern[0], pattern[2])
+					matched = matched || (lo <= s[0] && s[0] <= hi)
+					pattern = pattern[3:]
+				default:
+					matched = matched || pattern[0] == s[0]
+					pattern = pattern[1:]
+				}
+			}
+			if len(pattern) > 0 {
+				// The closing ]
+				pattern = pattern[1:]
+			}
+			if matched == negate {
+				return false
+			}
+			s = s[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,370 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/client"
+	"its-dave/simple-crud-rest-server/repository"
+	"its-dave/simple-crud-rest-server/server"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testConn is a connection to a server speaking the protocol
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// replyError is an error reply
+type replyError string
+
+// newTestServer serves the API with its data in a temporary file, returning its HTTP handler and a connection to a
+// RESP server in front of it
+func newTestServer(t *testing.T, opts ...server.Option) (http.Handler, *testConn) {
+	dataFilePath := filepath.Join(t.TempDir(), "data.json")
+	assert.NoError(t, os.WriteFile(dataFilePath, []byte("{}"), 0644))
+	repo := repository.Repo{}
+	repo.SetDataFilePath(dataFilePath)
+	handler := server.Create(&repo, opts...)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	srv := NewServer(handler, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return handler, dial(t, listener.Addr().String())
+}
+
+func dial(t *testing.T, addr string) *testConn {
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends a command and returns its reply
+func (c *testConn) do(args ...string) interface{} {
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(c.conn, command)
+	assert.NoError(c.t, err)
+	return c.read()
+}
+
+// read reads a reply, as a string, int64, replyError, nil, slice or map
+func (c *testConn) read() interface{} {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if !assert.NoError(c.t, err) {
+		c.t.FailNow()
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return replyError(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		assert.NoError(c.t, err)
+		return n
+	case '_':
+		return nil
+	case '$':
+		length, _ := strconv.Atoi(line[1:])
+		if length < 0 {
+			return nil
+		}
+		bulk := make([]byte, length+2)
+		_, err := io.ReadFull(c.r, bulk)
+		assert.NoError(c.t, err)
+		return string(bulk[:length])
+	case '*':
+		count, _ := strconv.Atoi(line[1:])
+		array := []interface{}{}
+		for i := 0; i < count; i++ {
+			array = append(array, c.read())
+		}
+		return array
+	case '%':
+		count, _ := strconv.Atoi(line[1:])
+		m := map[string]interface{}{}
+		for i := 0; i < count; i++ {
+			key := c.read().(string)
+			m[key] = c.read()
+		}
+		return m
+	}
+	c.t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+// history returns the events of the key served by the HTTP API
+func history(t *testing.T, handler http.Handler, key string) []map[string]interface{} {
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/api/"+key+"/history", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var events []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &events))
+	return events
+}
+
+func eventsOf(events []map[string]interface{}) []string {
+	var names []string
+	for _, event := range events {
+		names = append(names, fmt.Sprintf("%s %s", event["event"], event["value"]))
+	}
+	return names
+}
+
+func TestCommands(t *testing.T) {
+	handler, c := newTestServer(t)
+
+	assert.Equal(t, "PONG", c.do("PING"))
+	assert.Nil(t, c.do("GET", "key1"))
+	assert.Equal(t, "OK", c.do("SET", "key1", "value1"))
+	assert.Equal(t, "value1", c.do("get", "key1"))
+	assert.Equal(t, "OK", c.do("SET", "key1", "value2"))
+	// NX sets only a key without a value, and XX only a key with one
+	assert.Nil(t, c.do("SET", "key1", "value3", "NX"))
+	assert.Nil(t, c.do("SET", "key2", "value1", "XX"))
+	assert.Equal(t, "OK", c.do("SET", "key2", "value1", "NX"))
+	assert.Equal(t, "OK", c.do("SET", "key2", "value2", "xx"))
+	assert.Equal(t, int64(2), c.do("EXISTS", "key1", "key2", "key3"))
+	assert.Equal(t, int64(1), c.do("DEL", "key1", "key3"))
+	assert.Equal(t, int64(0), c.do("DEL", "key1"))
+	assert.Nil(t, c.do("GET", "key1"))
+	assert.Equal(t, int64(3), c.do("EXISTS", "key2", "key2", "key1", "key2"))
+	// A deleted key is created again
+	assert.Equal(t, "OK", c.do("SET", "key1", "value3"))
+
+	// Every change is an event in the key's history
+	assert.Equal(t, []string{"create value1", "update value2", "delete ", "create value3"}, eventsOf(history(t, handler, "key1")))
+	events := c.do("HISTORY", "key1").([]interface{})
+	assert.Len(t, events, 4)
+	assert.Equal(t, []interface{}{"event", "update", "value", "value2"}, events[1])
+	assert.Nil(t, c.do("HISTORY", "missing"))
+
+	assert.Equal(t, int64(1), c.do("INCR", "counter"))
+	assert.Equal(t, int64(2), c.do("INCR", "counter"))
+	assert.Equal(t, replyError("ERR value is not an integer or out of range"), c.do("INCR", "key1"))
+	assert.Equal(t, []string{"create 1", "update 2"}, eventsOf(history(t, handler, "counter")))
+
+	assert.Equal(t, []interface{}{"counter", "key1", "key2"}, c.do("KEYS", "*"))
+	assert.Equal(t, []interface{}{"key1", "key2"}, c.do("KEYS", "key[0-9]"))
+	assert.Equal(t, []interface{}{}, c.do("KEYS", "missing*"))
+
+	// RESP3 has maps and a null type
+	hello := c.do("HELLO", "3").(map[string]interface{})
+	assert.Equal(t, int64(3), hello["proto"])
+	assert.Nil(t, c.do("GET", "missing"))
+	events = c.do("HISTORY", "key1").([]interface{})
+	assert.Equal(t, map[string]interface{}{"event": "delete", "value": ""}, events[2])
+
+	assert.Equal(t, replyError("ERR wrong number of arguments for 'get' command"), c.do("GET"))
+	assert.Equal(t, replyError("ERR syntax error"), c.do("SET", "key1", "value1", "NX", "XX"))
+	assert.Equal(t, replyError("ERR keys must not be empty or contain '/'"), c.do("SET", "a/b", "value1"))
+	assert.Equal(t, replyError("ERR unknown command 'FLUSHALL', with args beginning with: "), c.do("FLUSHALL"))
+	assert.Equal(t, "OK", c.do("QUIT"))
+}
+
+func TestHello(t *testing.T) {
+	_, c := newTestServer(t)
+	// RESP2 has no map type, so the fields are a flat array
+	_, err := io.WriteString(c.conn, "HELLO\r\n")
+	assert.NoError(t, err)
+	hello := c.read().([]interface{})
+	assert.Equal(t, []interface{}{"proto", int64(2)}, hello[2:4])
+	assert.Equal(t, replyError("NOPROTO unsupported protocol version"), c.do("HELLO", "4"))
+}
+
+func TestScan(t *testing.T) {
+	_, c := newTestServer(t)
+	for i := 0; i < 25; i++ {
+		assert.Equal(t, "OK", c.do("SET", fmt.Sprintf("key%02d", i), "value"))
+	}
+	assert.Equal(t, "OK", c.do("SET", "other", "value"))
+
+	// Scanning from cursor 0 back to 0 returns every matching key once, even as keys are deleted
+	var keys []interface{}
+	cursor := "0"
+	for pages := 0; pages == 0 || cursor != "0"; pages++ {
+		reply := c.do("SCAN", cursor, "MATCH", "key*", "COUNT", "10").([]interface{})
+		cursor = reply[0].(string)
+		keys = append(keys, reply[1].([]interface{})...)
+		if pages == 0 {
+			assert.Len(t, keys, 10)
+			assert.Equal(t, int64(1), c.do("DEL", "key00"))
+		}
+		assert.Less(t, pages, 3)
+	}
+	assert.Len(t, keys, 25)
+	assert.Equal(t, "key00", keys[0])
+	assert.Equal(t, "key24", keys[24])
+
+	reply := c.do("SCAN", "0", "COUNT", "100", "TYPE", "hash").([]interface{})
+	assert.Equal(t, []interface{}{"0", []interface{}{}}, reply)
+	assert.Equal(t, replyError("ERR invalid cursor"), c.do("SCAN", "99"))
+}
+
+func TestIncrConcurrent(t *testing.T) {
+	handler, c := newTestServer(t)
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	httpClient := client.New(srv.URL)
+	ctx := context.Background()
+
+	// Increments through RESP and read-modify-writes through the HTTP API race on the same key, and none is lost
+	const workers, increments = 4, 10
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			conn := dial(t, c.conn.RemoteAddr().String())
+			for j := 0; j < increments; j++ {
+				_, ok := conn.do("INCR", "counter").(int64)
+				assert.True(t, ok)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				for {
+					value, version, err := httpClient.GetVersion(ctx, "counter")
+					if errors.Is(err, client.ErrNotFound) {
+						if err = httpClient.Create(ctx, "counter", "1"); errors.Is(err, client.ErrExists) {
+							continue
+						}
+						assert.NoError(t, err)
+						break
+					}
+					if !assert.NoError(t, err) {
+						return
+					}
+					n, err := strconv.Atoi(value)
+					assert.NoError(t, err)
+					err = httpClient.UpdateVersion(ctx, "counter", strconv.Itoa(n+1), version)
+					if !errors.Is(err, client.ErrChanged) {
+						assert.NoError(t, err)
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, strconv.Itoa(2*workers*increments), c.do("GET", "counter"))
+}
+
+func TestExpiry(t *testing.T) {
+	handler, c := newTestServer(t)
+	assert.Equal(t, "OK", c.do("SET", "key1", "value1", "PX", "50"))
+	assert.Equal(t, "OK", c.do("SET", "key2", "value1", "PX", "50"))
+	// Setting a key again cancels its expiry unless KEEPTTL is given
+	assert.Equal(t, "OK", c.do("SET", "key2", "value2"))
+	assert.Equal(t, "OK", c.do("SET", "key3", "value1", "EX", "60"))
+	assert.Equal(t, "OK", c.do("SET", "key3", "value2", "KEEPTTL"))
+	assert.Eventually(t, func() bool {
+		return c.do("GET", "key1") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"create value1", "delete "}, eventsOf(history(t, handler, "key1")))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "value2", c.do("GET", "key2"))
+	assert.Equal(t, replyError("ERR invalid expire time in 'set' command"), c.do("SET", "key1", "value1", "EX", "0"))
+}
+
+func TestAuth(t *testing.T) {
+	keyStore, err := auth.NewKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	assert.NoError(t, err)
+	token, _, err := keyStore.Create("team-a", []auth.Grant{
+		{Permission: auth.PermissionRead, Namespace: "team-a"},
+		{Permission: auth.PermissionWrite, Namespace: "team-a"},
+		{Permission: auth.PermissionHistory, Namespace: "team-a"},
+	})
+	assert.NoError(t, err)
+	_, c := newTestServer(t, server.WithAPIKeys(keyStore))
+
+	assert.Equal(t, replyError("NOAUTH Authentication required."), c.do("GET", "team-a:key1"))
+	assert.Equal(t, "OK", c.do("AUTH", "invalid"))
+	reply, ok := c.do("GET", "team-a:key1").(replyError)
+	assert.True(t, ok)
+	assert.Regexp(t, "^WRONGPASS ", reply)
+	assert.Equal(t, "OK", c.do("AUTH", "default", token))
+	assert.Equal(t, "OK", c.do("SET", "team-a:key1", "value1"))
+	assert.Equal(t, replyError("NOPERM the caller does not have permission for the specified key"), c.do("SET", "team-b:key1", "value1"))
+	assert.Equal(t, []interface{}{"team-a:key1"}, c.do("KEYS", "*"))
+
+	// Events record the identity which made them
+	events := c.do("HISTORY", "team-a:key1").([]interface{})
+	assert.Equal(t, []interface{}{"event", "create", "value", "value1", "identity", "apikey:team-a"}, events[0])
+}
+
+func TestShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv := NewServer(http.NotFoundHandler(), slog.Default())
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(listener) }()
+	c := dial(t, listener.Addr().String())
+	assert.Equal(t, "PONG", c.do("PING"))
+
+	// An idle connection is closed
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, srv.Shutdown(ctx))
+	assert.True(t, errors.Is(<-served, ErrServerClosed))
+	_, err = c.r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"key*", "key1", true},
+		{"key*", "ke", false},
+		{"*1", "key1", true},
+		{"k*y*1", "key1", true},
+		{"k?y1", "key1", true},
+		{"k?y1", "ky1", false},
+		{"key[12]", "key2", true},
+		{"key[^12]", "key2", false},
+		{"key[^12]", "key3", true},
+		{"key[a-c]", "keyb", true},
+		{"key[c-a]", "keyb", true},
+		{"key[a-c]", "keyd", false},
+		{`key\*`, "key*", true},
+		{`key\*`, "key1", false},
+		{`key[\]]`, "key]", true},
+	} {
+		assert.Equal(t, tc.match, match(tc.pattern, tc.s), "%s %s", tc.pattern, tc.s)
+	}
+	assert.Equal(t, "team-a:", literalPrefix("team-a:*"))
+	assert.Equal(t, "key", literalPrefix("key"))
+}
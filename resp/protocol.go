@@ -0,0 +1,146 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxBulkLength is the longest argument accepted, which bounds the memory a client can make a command use
+	maxBulkLength = 16 << 20
+	// maxArguments is the most arguments accepted in a command
+	maxArguments = 1 << 20
+	// maxInlineLength is the longest inline command accepted
+	maxInlineLength = 64 << 10
+)
+
+// protocolError is returned for a command which is not valid RESP, after which the connection is closed as the rest of
+// its input cannot be framed
+type protocolError string
+
+func (err protocolError) Error() string {
+	return "Protocol error: " + string(err)
+}
+
+// readCommand reads a command, either an array of bulk strings as sent by clients or an inline command of
+// space-separated arguments as typed into a terminal. An empty inline command returns no arguments
+func readCommand(r *bufio.Reader) ([]string, error) {
+	prefix, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if prefix[0] != '*' {
+		line, err := readLine(r, maxInlineLength)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(line), nil
+	}
+
+	header, err := readLine(r, maxInlineLength)
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(header[1:])
+	if err != nil || count > maxArguments {
+		return nil, protocolError("invalid multibulk length")
+	}
+	args := make([]string, 0, max(count, 0))
+	for i := 0; i < count; i++ {
+		header, err := readLine(r, maxInlineLength)
+		if err != nil {
+			return nil, err
+		}
+		if header == "" || header[0] != '$' {
+			return nil, protocolError(fmt.Sprintf("expected '$', got '%s'", header[:min(len(header), 1)]))
+		}
+		length, err := strconv.Atoi(header[1:])
+		if err != nil || length < 0 || length > maxBulkLength {
+			return nil, protocolError("invalid bulk length")
+		}
+		bulk := make([]byte, length+2)
+		if _, err := io.ReadFull(r, bulk); err != nil {
+			return nil, err
+		}
+		if bulk[length] != '\r' || bulk[length+1] != '\n' {
+			return nil, protocolError("bulk string not terminated by CRLF")
+		}
+		args = append(args, string(bulk[:length]))
+	}
+	return args, nil
+}
+
+// readLine reads a line terminated by CRLF, or by LF alone as sent by some terminals, without its terminator
+func readLine(r *bufio.Reader, maxLength int) (string, error) {
+	var line []byte
+	for {
+		fragment, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, fragment...)
+		if len(line) > maxLength {
+			return "", protocolError("too big inline request")
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// writer writes replies in the version of the protocol chosen by the client: RESP2 by default, or RESP3 after
+// HELLO 3, which adds a null and a map type
+type writer struct {
+	*bufio.Writer
+	proto int
+}
+
+func (w *writer) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+// error writes an error reply. Its first word is the error code, such as ERR or NOAUTH
+func (w *writer) error(s string) {
+	w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(s) + "\r\n")
+}
+
+func (w *writer) integer(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *writer) bulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w *writer) null() {
+	if w.proto == 3 {
+		w.WriteString("_\r\n")
+	} else {
+		w.WriteString("$-1\r\n")
+	}
+}
+
+// array writes the header of an array, whose elements follow
+func (w *writer) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// mapHeader writes the header of a map, whose keys and values follow alternately. RESP2 has no map type, so its
+// pairs are written as a flat array as HGETALL does
+func (w *writer) mapHeader(n int) {
+	if w.proto == 3 {
+		w.WriteString("%" + strconv.Itoa(n) + "\r\n")
+	} else {
+		w.array(2 * n)
+	}
+}
+
+func (w *writer) bulks(values []string) {
+	w.array(len(values))
+	for _, value := range values {
+		w.bulk(value)
+	}
+}
@@ -0,0 +1,63 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCommand(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$4\r\nkey1\r\n$8\r\nva\r\nlue1\r\nGET  key1\n\r\n*0\r\n"))
+	args, err := readCommand(r)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SET", "key1", "va\r\nlue1"}, args)
+	// Inline commands are split on spaces
+	args, err = readCommand(r)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"GET", "key1"}, args)
+	args, err = readCommand(r)
+	assert.NoError(t, err)
+	assert.Empty(t, args)
+	args, err = readCommand(r)
+	assert.NoError(t, err)
+	assert.Empty(t, args)
+
+	for input, message := range map[string]string{
+		"*x\r\n":                   "Protocol error: invalid multibulk length",
+		"*1\r\n+GET\r\n":           "Protocol error: expected '$', got '+'",
+		"*1\r\n$-1\r\n":            "Protocol error: invalid bulk length",
+		"*1\r\n$3\r\nGETX\r\n":     "Protocol error: bulk string not terminated by CRLF",
+		"*1\r\n$99999999999\r\n":   "Protocol error: invalid bulk length",
+		strings.Repeat("a", 1<<17): "Protocol error: too big inline request",
+	} {
+		_, err := readCommand(bufio.NewReader(strings.NewReader(input)))
+		assert.EqualError(t, err, message, input[:min(len(input), 20)])
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &writer{Writer: bufio.NewWriter(&buf), proto: 2}
+	write := func() {
+		w.simple("OK")
+		w.error("ERR bad\r\nrequest")
+		w.integer(-1)
+		w.bulk("")
+		w.null()
+		w.mapHeader(1)
+		w.bulks([]string{"key", "value"})
+	}
+	write()
+	assert.NoError(t, w.Flush())
+	assert.Equal(t, "+OK\r\n-ERR bad  request\r\n:-1\r\n$0\r\n\r\n$-1\r\n*2\r\n*2\r\n$3\r\nkey\r\n$5\r\nvalue\r\n", buf.String())
+
+	// RESP3 has its own null and map types
+	buf.Reset()
+	w.proto = 3
+	write()
+	assert.NoError(t, w.Flush())
+	assert.Equal(t, "+OK\r\n-ERR bad  request\r\n:-1\r\n$0\r\n\r\n_\r\n%1\r\n*2\r\n$3\r\nkey\r\n$5\r\nvalue\r\n", buf.String())
+}
@@ -0,0 +1,203 @@
+// Package resp serves a subset of the Redis protocol, RESP2 and RESP3, so that Redis clients such as redis-cli can read
+// and write keys. Each command is made as requests to the HTTP API served in the same process, so has the same
+// semantics: every change is an event in the key's history, and is authorised, rate limited and replicated as any other
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"its-dave/simple-crud-rest-server/client"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve once Shutdown has been called
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Server serves the Redis protocol on the connections accepted by Serve
+type Server struct {
+	handler http.Handler
+	logger  *slog.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[*conn]struct{}
+	nextID   int64
+	closing  bool
+	// active counts the connections being served and keys being expired, which Shutdown waits for
+	active sync.WaitGroup
+
+	expiryMu sync.Mutex
+	expiries map[string]*time.Timer
+}
+
+// NewServer returns a server which makes the requests of each command to the specified handler of the HTTP API
+func NewServer(handler http.Handler, logger *slog.Logger) *Server {
+	return &Server{
+		handler:  handler,
+		logger:   logger,
+		conns:    map[*conn]struct{}{},
+		expiries: map[string]*time.Timer{},
+	}
+}
+
+// Serve accepts connections on the listener and serves each until it is closed, returning ErrServerClosed once
+// Shutdown has been called
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+			if closing {
+				return ErrServerClosed
+			}
+			return err
+		}
+		c := s.track(netConn)
+		if c == nil {
+			netConn.Close()
+			continue
+		}
+		go c.serve()
+	}
+}
+
+// Shutdown stops accepting connections and pending expiries, and closes each connection once its current command has
+// been replied to. If the context ends first, the remaining connections are closed at once
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	// A connection waiting for a command stops waiting, whereas one running a command replies to it first
+	for c := range s.conns {
+		c.netConn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	s.expiryMu.Lock()
+	for key, timer := range s.expiries {
+		timer.Stop()
+		delete(s.expiries, key)
+	}
+	s.expiryMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for c := range s.conns {
+			c.netConn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// track returns a connection to serve, or nil if the server is shutting down
+func (s *Server) track(netConn net.Conn) *conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return nil
+	}
+	s.nextID++
+	c := &conn{
+		server:  s,
+		netConn: netConn,
+		id:      s.nextID,
+		r:       bufio.NewReader(netConn),
+		w:       &writer{Writer: bufio.NewWriter(netConn), proto: 2},
+		client:  s.newClient("", netConn.RemoteAddr().String()),
+		cursors: map[int64]string{},
+	}
+	s.conns[c] = struct{}{}
+	s.active.Add(1)
+	return c
+}
+
+func (s *Server) untrack(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+	c.netConn.Close()
+	s.active.Done()
+}
+
+// newClient returns a client making requests with the specified token, if any, as if from the specified address
+func (s *Server) newClient(token, remoteAddr string) *client.Client {
+	opts := []client.Option{
+		client.WithHTTPClient(&http.Client{Transport: handlerTransport{handler: s.handler, remoteAddr: remoteAddr}}),
+	}
+	if token != "" {
+		opts = append(opts, client.WithToken(token))
+	}
+	return client.New("http://resp", opts...)
+}
+
+// expire deletes the key after the specified duration, as the client which set it, unless it is set again first.
+// Expiries are held in memory, so are lost if the server stops
+func (s *Server) expire(key string, ttl time.Duration, c *client.Client) {
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+	if timer, ok := s.expiries[key]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(ttl, func() {
+		s.expiryMu.Lock()
+		current := s.expiries[key] == timer
+		if current {
+			delete(s.expiries, key)
+		}
+		s.expiryMu.Unlock()
+		if !current {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			return
+		}
+		s.active.Add(1)
+		s.mu.Unlock()
+		defer s.active.Done()
+		err := c.Delete(context.Background(), key)
+		if err != nil && !errors.Is(err, client.ErrNotFound) && !errors.Is(err, client.ErrDeleted) {
+			s.logger.Warn("expiring key", "key", key, "error", err)
+		}
+	})
+	s.expiries[key] = timer
+}
+
+// persist cancels the expiry of the key, if any
+func (s *Server) persist(key string) {
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+	if timer, ok := s.expiries[key]; ok {
+		timer.Stop()
+		delete(s.expiries, key)
+	}
+}
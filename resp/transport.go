@@ -0,0 +1,59 @@
+package resp
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// handlerTransport makes HTTP requests by serving them with a handler in the same process, so that commands pass
+// through the same authentication, rate limits, quotas, logging and replication as requests to the HTTP API
+type handlerTransport struct {
+	handler    http.Handler
+	remoteAddr string
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.RemoteAddr = t.remoteAddr
+	req.RequestURI = req.URL.RequestURI()
+	recorder := &responseRecorder{header: http.Header{}}
+	t.handler.ServeHTTP(recorder, req)
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(recorder.status) + " " + http.StatusText(recorder.status),
+		StatusCode:    recorder.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        recorder.header,
+		Body:          io.NopCloser(&recorder.body),
+		ContentLength: int64(recorder.body.Len()),
+		Request:       req,
+	}, nil
+}
+
+// responseRecorder holds the response written by a handler
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(p)
+}
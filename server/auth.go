@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"its-dave/simple-crud-rest-server/auth"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type apiKeyRequest struct {
+	Name   string       `json:"name"`
+	Grants []auth.Grant `json:"grants"`
+}
+
+type apiKeyResponse struct {
+	ID      string       `json:"id"`
+	Name    string       `json:"name"`
+	Grants  []auth.Grant `json:"grants"`
+	Created string       `json:"created"`
+	Token   string       `json:"token,omitempty"`
+}
+
+// authenticated wraps the specified handler so that it is only called once the caller has been identified,
+// responding 401 if an authenticator is configured and the request does not satisfy it
+func authenticated(authenticator auth.Authenticator, handler http.HandlerFunc) http.HandlerFunc {
+	if authenticator == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := auth.FromContext(r.Context()); ok {
+			// Identity already established by an outer middleware
+			annotateIdentity(r, id)
+			handler(w, r)
+			return
+		}
+		id, err := authenticator.Authenticate(r)
+		if err != nil {
+			w.Header().Add("WWW-Authenticate", "Bearer")
+			w.Header().Add(contentType, contentTypeText)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, errorUnauthorised)
+			return
+		}
+		annotateIdentity(r, id)
+		handler(w, r.WithContext(auth.NewContext(r.Context(), id)))
+	}
+}
+
+// authorised reports whether the caller of the specified request holds the permission for the key;
+// unauthenticated requests are only ever seen when no authentication is configured, so are always allowed
+func authorised(r *http.Request, permission auth.Permission, key string) bool {
+	return allowed(r.Context(), permission, key)
+}
+
+// allowed reports whether the caller whose identity is in the context holds the permission for the key, as authorised
+// does for a request
+func allowed(ctx context.Context, permission auth.Permission, key string) bool {
+	id, ok := auth.FromContext(ctx)
+	return !ok || id.Allowed(permission, key)
+}
+
+// callerName returns the name of the identity in the context, if known
+func callerName(ctx context.Context) string {
+	id, _ := auth.FromContext(ctx)
+	return id.Name
+}
+
+// writeForbidden responds 403 to a caller without the required permission
+func writeForbidden(w http.ResponseWriter) {
+	w.Header().Add(contentType, contentTypeText)
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprint(w, errorForbidden)
+}
+
+// handleAPIKeys serves the /admin/keys endpoints used to manage API keys
+func handleAPIKeys(keyStore *auth.KeyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorised(r, auth.PermissionAdmin, "") {
+			writeForbidden(w)
+			return
+		}
+
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/keys"), "/")
+		if id != "" {
+			if r.Method != http.MethodDelete {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			// Revoke key
+
+			err := keyStore.Delete(id)
+			if errors.Is(err, auth.ErrKeyNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				respBody, respCode := unexpectedError(r, err)
+				w.Header().Add(contentType, contentTypeText)
+				w.WriteHeader(respCode)
+				fmt.Fprint(w, respBody)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			// List keys
+
+			keys := []apiKeyResponse{}
+			for _, key := range keyStore.List() {
+				keys = append(keys, apiKeyResponseFromKey(key, ""))
+			}
+			respBody, _ := json.Marshal(keys)
+			w.Header().Add(contentType, contentTypeJson)
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, string(respBody))
+		case http.MethodPost:
+			// Create key
+
+			respBody, respCode := handleCreateAPIKeyReq(keyStore, r)
+			if respCode == http.StatusCreated {
+				w.Header().Add(contentType, contentTypeJson)
+			} else {
+				w.Header().Add(contentType, contentTypeText)
+			}
+			w.WriteHeader(respCode)
+			fmt.Fprint(w, respBody)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleCreateAPIKeyReq handles a request to create an API key and returns the desired response body and code
+func handleCreateAPIKeyReq(keyStore *auth.KeyStore, r *http.Request) (string, int) {
+	if r.Header.Get(contentType) != contentTypeJson {
+		return errorInvalidKeyBody, http.StatusUnsupportedMediaType
+	}
+
+	body, err := body(r)
+	if body == nil {
+		return errorInvalidKeyBody, http.StatusBadRequest
+	}
+	if err != nil {
+		return unexpectedError(r, err)
+	}
+	var keyReq apiKeyRequest
+	if err := json.Unmarshal(body, &keyReq); err != nil || keyReq.Name == "" || len(keyReq.Grants) == 0 {
+		return errorInvalidKeyBody, http.StatusBadRequest
+	}
+	for _, grant := range keyReq.Grants {
+		if !grant.Valid() {
+			return errorInvalidKeyBody, http.StatusBadRequest
+		}
+	}
+
+	token, key, err := keyStore.Create(keyReq.Name, keyReq.Grants)
+	if err != nil {
+		return unexpectedError(r, err)
+	}
+	respBody, err := json.Marshal(apiKeyResponseFromKey(key, token))
+	if err != nil {
+		return unexpectedError(r, err)
+	}
+	return string(respBody), http.StatusCreated
+}
+
+// apiKeyResponseFromKey converts a stored key to its API representation, which never includes the hash
+func apiKeyResponseFromKey(key auth.APIKey, token string) apiKeyResponse {
+	return apiKeyResponse{
+		ID:      key.ID,
+		Name:    key.Name,
+		Grants:  key.Grants,
+		Created: key.Created.Format(time.RFC3339),
+		Token:   token,
+	}
+}
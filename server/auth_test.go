@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"its-dave/simple-crud-rest-server/auth"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+	repo := initialiseData(t, "{}")
+	keyStore, err := auth.NewKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	assert.NoError(t, err)
+	adminToken, _, err := keyStore.Create("admin", []auth.Grant{{Permission: auth.PermissionAdmin}})
+	assert.NoError(t, err)
+	mux := Create(repo, WithAPIKeys(keyStore))
+
+	// Missing and invalid keys are rejected
+	authRequestAndCheckResponse(t, mux, "", http.MethodGet, "/api/key1", "", "", http.StatusUnauthorized, errorUnauthorised)
+	authRequestAndCheckResponse(t, mux, "invalid", http.MethodGet, "/api/key1", "", "", http.StatusUnauthorized, errorUnauthorised)
+
+	// Create a key for team-a
+	resp := authRequest(t, mux, adminToken, http.MethodPost, "/admin/keys", `{"name":"team-a","grants":[{"permission":"write","namespace":"team-a"},{"permission":"read","prefix":"team-a:"},{"permission":"history","prefix":"team-a:"}]}`, contentTypeJson)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	var created apiKeyResponse
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &created))
+	assert.NotEmpty(t, created.Token)
+	teamToken := created.Token
+
+	// Non-admin keys cannot manage keys
+	authRequestAndCheckResponse(t, mux, teamToken, http.MethodGet, "/admin/keys", "", "", http.StatusForbidden, errorForbidden)
+
+	// Granted operations succeed and are attributed to the key
+	authRequestAndCheckResponse(t, mux, teamToken, http.MethodPost, "/api", `{"team-a:key1":"value1"}`, contentTypeJson, http.StatusCreated, "")
+	authRequestAndCheckResponse(t, mux, teamToken, http.MethodPut, "/api/team-a:key1", "value2", contentTypeText, http.StatusNoContent, "")
+	authRequestAndCheckResponse(t, mux, teamToken, http.MethodGet, "/api/team-a:key1", "", "", http.StatusOK, "value2")
+	authRequestAndCheckResponse(t, mux, teamToken, http.MethodGet, "/api/team-a:key1/history", "", "", http.StatusOK, `[{"event":"create","identity":"apikey:team-a","value":"value1"},{"event":"update","identity":"apikey:team-a","value":"value2"}]`)
+
+	// Operations without a grant are forbidden
+	authRequestAndCheckResponse(t, mux, teamToken, http.MethodDelete, "/api/team-a:key1", "", "", http.StatusForbidden, errorForbidden)
+	authRequestAndCheckResponse(t, mux, teamToken, http.MethodPost, "/api", `{"team-b:key1":"value1"}`, contentTypeJson, http.StatusForbidden, errorForbidden)
+	authRequestAndCheckResponse(t, mux, teamToken, http.MethodGet, "/api/team-b:key1", "", "", http.StatusForbidden, errorForbidden)
+
+	// Revoked keys are rejected
+	authRequestAndCheckResponse(t, mux, adminToken, http.MethodDelete, "/admin/keys/"+created.ID, "", "", http.StatusNoContent, "")
+	authRequestAndCheckResponse(t, mux, teamToken, http.MethodGet, "/api/team-a:key1", "", "", http.StatusUnauthorized, errorUnauthorised)
+	authRequestAndCheckResponse(t, mux, adminToken, http.MethodDelete, "/admin/keys/"+created.ID, "", "", http.StatusNotFound, "")
+}
+
+// authRequest makes the specified request to the specified handler using the specified bearer token, if any
+func authRequest(t *testing.T, handler http.Handler, token, reqMethod, reqUrl, reqBody, reqContentType string) *httptest.ResponseRecorder {
+	var reqBodyBytes io.Reader
+	if reqBody != "" {
+		reqBodyBytes = bytes.NewReader([]byte(reqBody))
+	}
+	req, err := http.NewRequest(reqMethod, reqUrl, reqBodyBytes)
+	if err != nil {
+		assert.Fail(t, err.Error())
+	}
+	req.Header.Add(contentType, reqContentType)
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
+	}
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	return resp
+}
+
+// authRequestAndCheckResponse makes the specified authenticated request and asserts the specified response code and body
+func authRequestAndCheckResponse(t *testing.T, handler http.Handler, token, reqMethod, reqUrl, reqBody, reqContentType string, expRespCode int, expRespBody string) {
+	resp := authRequest(t, handler, token, reqMethod, reqUrl, reqBody, reqContentType)
+	assert.Equal(t, expRespCode, resp.Code)
+	assert.Equal(t, expRespBody, resp.Body.String())
+}
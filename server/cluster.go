@@ -0,0 +1,464 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/raft"
+	"its-dave/simple-crud-rest-server/repository"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	errorNoLeader        = "Error: the cluster has no leader; retry shortly"
+	errorInvalidMember   = "Error: request body must be of the form {\"id\":\"id\",\"address\":\"http://host:port\"} with Content-Type application/json"
+	errorMemberExists    = "Error: a member with the specified ID already exists"
+	errorChangePending   = "Error: another membership change has not yet been committed"
+	errorLastMember      = "Error: the last member of the cluster cannot be removed"
+	errorInvalidTransfer = "Error: request body must be empty or of the form {\"id\":\"id\"} with Content-Type application/json"
+
+	// clusterForwardedHeader marks a request forwarded to the leader, which does not forward it again
+	clusterForwardedHeader = "X-Cluster-Forwarded-By"
+)
+
+// clusterProposeTimeout bounds the wait for a write to be committed, such as while the leader is cut off from the
+// other members
+var clusterProposeTimeout = 10 * time.Second
+
+// ClusterConfig configures the membership of a server in a Raft cluster
+type ClusterConfig struct {
+	// ID identifies the member, and Members are those of a new cluster, including this one. A member joining an
+	// existing cluster is started without members, and added by POST /admin/cluster/members
+	ID      string
+	Members []raft.Member
+	// Transport reaches the other members' /raft endpoints, and Storage persists the member's log
+	Transport raft.Transport
+	Storage   raft.Storage
+	// LinearizableReads serves every read of the API from the leader, once it has confirmed that it is still the
+	// leader, rather than from the member's own store, which may not yet have the latest writes
+	LinearizableReads bool
+	// HeartbeatInterval and ElectionTimeout are the raft package's defaults if zero
+	HeartbeatInterval time.Duration
+	ElectionTimeout   time.Duration
+	Logger            *slog.Logger
+}
+
+// Cluster replicates the data across the members of a Raft cluster: each write is committed to the cluster's log
+// before it is applied to the store of every member and acknowledged. Members other than the leader forward writes
+// to it
+type Cluster struct {
+	node  *raft.Node
+	store *clusterStore
+}
+
+// NewCluster returns the member of a cluster which stores the data in the specified store. It takes part in the
+// cluster once passed to Create with WithCluster, until stopped
+func NewCluster(repo repository.Store, config ClusterConfig) (*Cluster, error) {
+	store := &clusterStore{Store: repo, id: config.ID, linearizable: config.LinearizableReads}
+	node, err := raft.NewNode(raft.Config{
+		ID:                config.ID,
+		Members:           config.Members,
+		Transport:         config.Transport,
+		Storage:           config.Storage,
+		StateMachine:      store,
+		HeartbeatInterval: config.HeartbeatInterval,
+		ElectionTimeout:   config.ElectionTimeout,
+		Logger:            config.Logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	store.node = node
+	return &Cluster{node: node, store: store}, nil
+}
+
+// Stop stops the member taking part in the cluster, failing any writes waiting to be committed
+func (c *Cluster) Stop() {
+	c.node.Stop()
+}
+
+// clusterCommand is a write committed to the cluster's log
+type clusterCommand struct {
+	// Origin is the member which made the write, and has already published its events to its watchers
+	Origin string `json:"origin"`
+	// Keys are the new histories of the keys written, or if All is set the whole new data
+	Keys map[string]interface{} `json:"keys"`
+	All  bool                   `json:"all,omitempty"`
+}
+
+// clusterStore is a store whose writes are proposed to the cluster, and applied to the member's own store once
+// committed. Since each command holds the new histories of the keys it writes, applying one again has no effect
+type clusterStore struct {
+	repository.Store
+	node         *raft.Node
+	id           string
+	linearizable bool
+	ws           *watchers
+}
+
+// clusterWriteKey marks the context of a read-modify-write, whose reads need no confirmation of leadership
+type clusterWriteKey struct{}
+
+// Begin waits until the leader's store has every write committed by earlier leaders, so that a read-modify-write
+// does not overwrite them
+func (s *clusterStore) Begin(ctx context.Context) (context.Context, func(), error) {
+	if err := s.node.Barrier(ctx); err != nil {
+		return ctx, func() {}, err
+	}
+	return context.WithValue(ctx, clusterWriteKey{}, true), func() {}, nil
+}
+
+func (s *clusterStore) ReadData(ctx context.Context) (map[string]interface{}, error) {
+	if err := s.confirmRead(ctx); err != nil {
+		return nil, err
+	}
+	return s.Store.ReadData(ctx)
+}
+
+func (s *clusterStore) ReadKeys(ctx context.Context, keys ...string) (map[string]interface{}, error) {
+	if err := s.confirmRead(ctx); err != nil {
+		return nil, err
+	}
+	if keyStore, ok := s.Store.(repository.KeyStore); ok {
+		return keyStore.ReadKeys(ctx, keys...)
+	}
+	dataMap, err := s.Store.ReadData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	read := map[string]interface{}{}
+	for _, key := range keys {
+		if keyArray, ok := dataMap[key]; ok {
+			read[key] = keyArray
+		}
+	}
+	return read, nil
+}
+
+func (s *clusterStore) ReadPrefix(ctx context.Context, prefix string) (map[string]interface{}, error) {
+	if err := s.confirmRead(ctx); err != nil {
+		return nil, err
+	}
+	if keyStore, ok := s.Store.(repository.KeyStore); ok {
+		return keyStore.ReadPrefix(ctx, prefix)
+	}
+	dataMap, err := s.Store.ReadData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for key := range dataMap {
+		if !strings.HasPrefix(key, prefix) {
+			delete(dataMap, key)
+		}
+	}
+	return dataMap, nil
+}
+
+func (s *clusterStore) WriteData(ctx context.Context, dataMap map[string]interface{}) error {
+	return s.propose(ctx, clusterCommand{Origin: s.id, Keys: dataMap, All: true})
+}
+
+func (s *clusterStore) WriteKeys(ctx context.Context, dataMap map[string]interface{}) error {
+	return s.propose(ctx, clusterCommand{Origin: s.id, Keys: dataMap})
+}
+
+// confirmRead makes a read by the leader linearizable, if configured, by waiting until its store has every write
+// committed before the read, having confirmed that it is still the leader. Other members serve reads from their own
+// store, and forward those of the API to the leader
+func (s *clusterStore) confirmRead(ctx context.Context) error {
+	if !s.linearizable || ctx.Value(clusterWriteKey{}) != nil || s.node.Status().Role != raft.Leader {
+		return nil
+	}
+	return s.node.ReadIndex(ctx)
+}
+
+// propose commits the command to the cluster's log, returning once the member has applied it. A command which is not
+// committed in time, as the member was cut off from the others, may yet be committed by a new leader, or discarded
+func (s *clusterStore) propose(ctx context.Context, command clusterCommand) error {
+	data, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	proposeCtx, cancel := context.WithTimeout(ctx, clusterProposeTimeout)
+	defer cancel()
+	err = s.node.Propose(proposeCtx, data)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return raft.ErrLeadershipLost
+	}
+	return err
+}
+
+// Apply writes a committed command to the member's store. The events of writes made by other members are published
+// to this member's watchers
+func (s *clusterStore) Apply(command json.RawMessage) error {
+	var c clusterCommand
+	if err := json.Unmarshal(command, &c); err != nil {
+		return err
+	}
+	ctx, end, err := s.Store.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer end()
+
+	var before map[string]interface{}
+	if c.All {
+		if before, err = s.Store.ReadData(ctx); err == nil {
+			err = s.Store.WriteData(ctx, c.Keys)
+		}
+	} else {
+		keys := make([]string, 0, len(c.Keys))
+		for key := range c.Keys {
+			keys = append(keys, key)
+		}
+		var dataMap map[string]interface{}
+		if dataMap, err = readKeys(ctx, s.Store, nil, keys...); err == nil {
+			before = make(map[string]interface{}, len(keys))
+			for key, keyArray := range c.Keys {
+				if previous, ok := dataMap[key]; ok {
+					before[key] = previous
+				}
+				dataMap[key] = keyArray
+			}
+			err = writeKeys(ctx, s.Store, dataMap, keys...)
+		}
+	}
+	if err != nil || c.Origin == s.id {
+		return err
+	}
+	s.publish(before, c)
+	return nil
+}
+
+// publish sends the events added by a write to the watchers, and records the keys it otherwise rewrote or removed
+func (s *clusterStore) publish(before map[string]interface{}, c clusterCommand) {
+	if c.All {
+		for key := range before {
+			if _, ok := c.Keys[key]; !ok {
+				s.ws.remove(key)
+			}
+		}
+	}
+	for key, keyArray := range c.Keys {
+		array, err := sliceFromArray(keyArray)
+		if err != nil {
+			continue
+		}
+		events, err := eventsFromSlice(array)
+		if err != nil {
+			continue
+		}
+		previous, _ := before[key].([]interface{})
+		if !extends(array, previous) {
+			s.ws.rewrite(key, events)
+			continue
+		}
+		for _, event := range events[len(previous):] {
+			s.ws.publish(key, event)
+		}
+	}
+}
+
+// extends reports whether the history begins with every event of the previous history
+func extends(array, previous []interface{}) bool {
+	if len(previous) > len(array) {
+		return false
+	}
+	for i := range previous {
+		a, _ := json.Marshal(array[i])
+		b, _ := json.Marshal(previous[i])
+		if string(a) != string(b) {
+			return false
+		}
+	}
+	return true
+}
+
+// Snapshot returns the member's data, for a member too far behind to be sent the writes it is missing
+func (s *clusterStore) Snapshot() (json.RawMessage, error) {
+	dataMap, err := s.Store.ReadData(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(dataMap)
+}
+
+// Restore replaces the member's data with the leader's snapshot
+func (s *clusterStore) Restore(snapshot json.RawMessage) error {
+	var dataMap map[string]interface{}
+	if err := json.Unmarshal(snapshot, &dataMap); err != nil {
+		return err
+	}
+	if err := s.Store.WriteData(context.Background(), dataMap); err != nil {
+		return err
+	}
+	// The changes made by the snapshot are not recorded, so this member's followers must fetch a new snapshot
+	s.ws.log.reset()
+	return nil
+}
+
+// route wraps the specified handler so that a member other than the leader forwards writes, and with linearizable
+// reads every request to the API, to the leader, which authenticates them itself
+func (c *Cluster) route(handler http.HandlerFunc) http.HandlerFunc {
+	if c == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		reads := (r.URL.Path == "/api" || strings.HasPrefix(r.URL.Path, "/api/")) && (r.Method == http.MethodGet || r.Method == http.MethodHead)
+		if !writes(r) && !(c.store.linearizable && reads) || c.node.Status().Role == raft.Leader {
+			handler(w, r)
+			return
+		}
+		leader, ok := c.node.Leader()
+		var target *url.URL
+		if ok && leader.ID != c.node.ID() && r.Header.Get(clusterForwardedHeader) == "" {
+			target, _ = url.Parse(leader.Address)
+		}
+		if target == nil {
+			writeNoLeader(w)
+			return
+		}
+		annotate(r, "", "forward")
+		r.Header.Set(clusterForwardedHeader, c.node.ID())
+		httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+	}
+}
+
+// check reports an error while the member does not know of a leader
+func (c *Cluster) check() error {
+	if _, ok := c.node.Leader(); !ok {
+		return errors.New("no leader has been elected")
+	}
+	return nil
+}
+
+func writeNoLeader(w http.ResponseWriter) {
+	w.Header().Add(contentType, contentTypeText)
+	w.Header().Add("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprint(w, errorNoLeader)
+}
+
+// handleRaft serves the RPCs between members, which require admin permission
+func handleRaft(c *Cluster) http.HandlerFunc {
+	handler := raft.Handler(c.node)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorised(r, auth.PermissionAdmin, "") {
+			writeForbidden(w)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}
+}
+
+// handleCluster serves the member's view of the cluster at /admin/cluster, and the changes to it: adding and
+// removing members at /admin/cluster/members, and transferring leadership at /admin/cluster/transfer
+func handleCluster(c *Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorised(r, auth.PermissionAdmin, "") {
+			writeForbidden(w)
+			return
+		}
+		path := strings.TrimSuffix(r.URL.Path, "/")
+		var respBody string
+		var respCode int
+		switch {
+		case path == "/admin/cluster" && r.Method == http.MethodGet:
+			annotate(r, "", "cluster")
+			status, _ := json.Marshal(c.node.Status())
+			w.Header().Add(contentType, contentTypeJson)
+			w.WriteHeader(http.StatusOK)
+			w.Write(status)
+			return
+		case path == "/admin/cluster/members" && r.Method == http.MethodPost:
+			respBody, respCode = handleAddMemberReq(c, r)
+		case strings.HasPrefix(path, "/admin/cluster/members/") && r.Method == http.MethodDelete:
+			respBody, respCode = handleRemoveMemberReq(c, r, strings.TrimPrefix(path, "/admin/cluster/members/"))
+		case path == "/admin/cluster/transfer" && r.Method == http.MethodPost:
+			respBody, respCode = handleTransferReq(c, r)
+		case path == "/admin/cluster" || path == "/admin/cluster/members" || path == "/admin/cluster/transfer" || strings.HasPrefix(path, "/admin/cluster/members/"):
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Add(contentType, contentTypeText)
+		if respCode == http.StatusServiceUnavailable {
+			w.Header().Add("Retry-After", "1")
+		}
+		w.WriteHeader(respCode)
+		fmt.Fprint(w, respBody)
+	}
+}
+
+// handleAddMemberReq adds the member in the request body to the cluster
+func handleAddMemberReq(c *Cluster, r *http.Request) (string, int) {
+	annotate(r, "", "add member")
+	if r.Header.Get(contentType) != contentTypeJson {
+		return errorInvalidMember, http.StatusUnsupportedMediaType
+	}
+	var member raft.Member
+	if err := json.NewDecoder(r.Body).Decode(&member); err != nil || member.ID == "" {
+		return errorInvalidMember, http.StatusBadRequest
+	}
+	if address, err := url.Parse(member.Address); err != nil || address.Scheme != "http" && address.Scheme != "https" || address.Host == "" {
+		return errorInvalidMember, http.StatusBadRequest
+	}
+	annotate(r, member.ID, "add member")
+	return clusterChangeResponse(r, c.node.AddMember(r.Context(), member))
+}
+
+// handleRemoveMemberReq removes the member with the specified ID from the cluster
+func handleRemoveMemberReq(c *Cluster, r *http.Request, id string) (string, int) {
+	annotate(r, id, "remove member")
+	return clusterChangeResponse(r, c.node.RemoveMember(r.Context(), id))
+}
+
+// handleTransferReq transfers leadership to the member in the request body, or if none to the most up-to-date member
+func handleTransferReq(c *Cluster, r *http.Request) (string, int) {
+	annotate(r, "", "transfer leadership")
+	body, err := body(r)
+	if err != nil {
+		return unexpectedError(r, err)
+	}
+	var target struct {
+		ID string `json:"id"`
+	}
+	if len(body) > 0 {
+		if r.Header.Get(contentType) != contentTypeJson {
+			return errorInvalidTransfer, http.StatusUnsupportedMediaType
+		}
+		if err := json.Unmarshal(body, &target); err != nil {
+			return errorInvalidTransfer, http.StatusBadRequest
+		}
+	}
+	annotate(r, target.ID, "transfer leadership")
+	return clusterChangeResponse(r, c.node.TransferLeadership(r.Context(), target.ID))
+}
+
+// clusterChangeResponse returns the response to a change to the cluster which returned the specified error
+func clusterChangeResponse(r *http.Request, err error) (string, int) {
+	switch {
+	case err == nil:
+		return "", http.StatusNoContent
+	case errors.Is(err, raft.ErrUnknownMember):
+		return "", http.StatusNotFound
+	case errors.Is(err, raft.ErrMemberExists):
+		return errorMemberExists, http.StatusConflict
+	case errors.Is(err, raft.ErrMembershipChangePending):
+		return errorChangePending, http.StatusConflict
+	case errors.Is(err, raft.ErrLastMember):
+		return errorLastMember, http.StatusBadRequest
+	case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrTransferFailed):
+		return errorNoLeader, http.StatusServiceUnavailable
+	}
+	return unexpectedError(r, err)
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"its-dave/simple-crud-rest-server/raft"
+	"its-dave/simple-crud-rest-server/repository"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testMember is a member of a cluster served over HTTP, so that it can forward requests to the leader
+type testMember struct {
+	id      string
+	mux     *http.ServeMux
+	server  *httptest.Server
+	cluster *Cluster
+}
+
+// startMember starts a member of a cluster served by the specified server with a new data file, which reaches the
+// other members over the network
+func startMember(t *testing.T, network *raft.Network, server *httptest.Server, id string, members []raft.Member, linearizable bool) *testMember {
+	repo := &repository.Repo{}
+	repo.SetDataFilePath(filepath.Join(t.TempDir(), id+".json"))
+	cluster, err := NewCluster(repo, ClusterConfig{
+		ID:                id,
+		Members:           members,
+		Transport:         network.Transport(id),
+		Storage:           raft.NewMemoryStorage(),
+		LinearizableReads: linearizable,
+		HeartbeatInterval: 10 * time.Millisecond,
+		ElectionTimeout:   50 * time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	mux := Create(repo, WithCluster(cluster))
+	network.Register(id, mux)
+	server.Config.Handler = mux
+	server.Start()
+	t.Cleanup(func() {
+		cluster.Stop()
+		server.Close()
+	})
+	return &testMember{id: id, mux: mux, server: server, cluster: cluster}
+}
+
+// startCluster starts a cluster of members with the specified IDs
+func startCluster(t *testing.T, linearizable bool, ids ...string) (*raft.Network, map[string]*testMember) {
+	network := raft.NewNetwork()
+	servers := map[string]*httptest.Server{}
+	var members []raft.Member
+	for _, id := range ids {
+		// Members are started once the addresses of all of them are known
+		servers[id] = httptest.NewUnstartedServer(nil)
+		members = append(members, raft.Member{ID: id, Address: "http://" + servers[id].Listener.Addr().String()})
+	}
+	started := map[string]*testMember{}
+	for _, id := range ids {
+		started[id] = startMember(t, network, servers[id], id, members, linearizable)
+	}
+	return network, started
+}
+
+// clusterStatusOf returns the status of the cluster reported by the member
+func clusterStatusOf(t *testing.T, member *testMember) raft.Status {
+	resp := httptest.NewRecorder()
+	member.mux.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/admin/cluster", nil))
+	var status raft.Status
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &status))
+	return status
+}
+
+// awaitLeader waits until one of the specified members is the leader which the others follow, returning it
+func awaitLeader(t *testing.T, members ...*testMember) *testMember {
+	t.Helper()
+	var leader *testMember
+	assert.Eventually(t, func() bool {
+		leader = nil
+		var leaderID string
+		for _, member := range members {
+			status := clusterStatusOf(t, member)
+			if status.Leader == "" || leaderID != "" && status.Leader != leaderID {
+				return false
+			}
+			leaderID = status.Leader
+			if status.Role == raft.Leader {
+				leader = member
+			}
+		}
+		return leader != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	if leader == nil {
+		t.FailNow()
+	}
+	return leader
+}
+
+// awaitValue waits until each of the members serves the specified value of the key
+func awaitValue(t *testing.T, key, value string, members ...*testMember) {
+	t.Helper()
+	for _, member := range members {
+		assert.Eventually(t, func() bool {
+			resp := httptest.NewRecorder()
+			member.mux.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/api/"+key, nil))
+			return resp.Code == http.StatusOK && resp.Body.String() == value
+		}, 5*time.Second, 10*time.Millisecond, member.id)
+	}
+}
+
+// followersOf returns the members other than the leader
+func followersOf(leader *testMember, members map[string]*testMember) []*testMember {
+	var followers []*testMember
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if member, ok := members[id]; ok && member != leader {
+			followers = append(followers, member)
+		}
+	}
+	return followers
+}
+
+func TestCluster(t *testing.T) {
+	_, members := startCluster(t, false, "a", "b", "c")
+	leader := awaitLeader(t, members["a"], members["b"], members["c"])
+	followers := followersOf(leader, members)
+	requestAndCheckResponse(t, followers[0].mux, http.MethodGet, "/readyz", "", "", http.StatusOK, `{"status":"ok","checks":{"cluster":{"status":"ok"},"initialisation":{"status":"ok"},"storage":{"status":"ok"}}}`, contentTypeJson)
+
+	// Writes to a follower are forwarded to the leader, and applied by every member once committed
+	requestAndCheckResponse(t, followers[0].mux, http.MethodPost, "/api", `{"key1":"value1"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+	requestAndCheckResponse(t, leader.mux, http.MethodPut, "/api/key1", "value2", contentTypeText, http.StatusNoContent, "", contentTypeText)
+	requestAndCheckResponse(t, followers[1].mux, http.MethodPost, "/api", `{"key2":"value1"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+	requestAndCheckResponse(t, followers[1].mux, http.MethodDelete, "/api/key2", "", "", http.StatusNoContent, "", contentTypeText)
+	// Conflicts are detected by the leader
+	requestAndCheckResponse(t, followers[0].mux, http.MethodPost, "/api", `{"key1":"value3"}`, contentTypeJson, http.StatusBadRequest, errorKeyExists, contentTypeText)
+	awaitValue(t, "key1", "value2", leader, followers[0], followers[1])
+	for _, member := range members {
+		requestAndCheckResponse(t, member.mux, http.MethodGet, "/api/key2/history", "", "", http.StatusOK, `[{"event":"create","value":"value1"},{"event":"delete","value":""}]`, contentTypeJson)
+	}
+
+	// Watchers of any member see the events of every write
+	resp, err := http.Get(followers[1].server.URL + "/watch?prefix=key3")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	requestAndCheckResponse(t, leader.mux, http.MethodPost, "/api", `{"key3":"value1"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+	scanner := bufio.NewScanner(resp.Body)
+	var lines []string
+	for len(lines) < 2 && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	assert.Equal(t, []string{"event: create", `data: {"key":"key3","event":"create","value":"value1"}`}, lines)
+
+	status := clusterStatusOf(t, followers[0])
+	assert.Equal(t, raft.Follower, status.Role)
+	assert.Equal(t, leader.id, status.Leader)
+	assert.Len(t, status.Members, 3)
+	requestAndCheckResponse(t, leader.mux, http.MethodPut, "/admin/cluster", "", "", http.StatusMethodNotAllowed, "", "")
+}
+
+func TestClusterPartition(t *testing.T) {
+	timeout := clusterProposeTimeout
+	clusterProposeTimeout = 500 * time.Millisecond
+	defer func() { clusterProposeTimeout = timeout }()
+	network, members := startCluster(t, true, "a", "b", "c")
+	leader := awaitLeader(t, members["a"], members["b"], members["c"])
+	followers := followersOf(leader, members)
+	requestAndCheckResponse(t, leader.mux, http.MethodPost, "/api", `{"key1":"value1"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+
+	// A leader cut off from the other members can neither commit writes nor serve reads which may be stale
+	network.Partition([]string{followers[0].id, followers[1].id})
+	requestAndCheckResponse(t, leader.mux, http.MethodPut, "/api/key1", "value2", contentTypeText, http.StatusServiceUnavailable, errorNoLeader, contentTypeText)
+	requestAndCheckResponse(t, leader.mux, http.MethodGet, "/api/key1", "", "", http.StatusServiceUnavailable, errorNoLeader, contentTypeText)
+
+	// The other members elect a new leader, which serves reads made of any of them
+	newLeader := awaitLeader(t, followers[0], followers[1])
+	requestAndCheckResponse(t, newLeader.mux, http.MethodPut, "/api/key1", "value3", contentTypeText, http.StatusNoContent, "", contentTypeText)
+	for _, follower := range followers {
+		requestAndCheckResponse(t, follower.mux, http.MethodGet, "/api/key1", "", "", http.StatusOK, "value3", contentTypeText)
+	}
+
+	// Once the partition heals, the old leader follows the new one, and has discarded the write it did not commit
+	network.Heal()
+	assert.Equal(t, newLeader, awaitLeader(t, leader, followers[0], followers[1]))
+	requestAndCheckResponse(t, leader.mux, http.MethodGet, "/api/key1/history", "", "", http.StatusOK, `[{"event":"create","value":"value1"},{"event":"update","value":"value3"}]`, contentTypeJson)
+}
+
+func TestClusterMembership(t *testing.T) {
+	network, members := startCluster(t, false, "a", "b", "c")
+	leader := awaitLeader(t, members["a"], members["b"], members["c"])
+	followers := followersOf(leader, members)
+	requestAndCheckResponse(t, leader.mux, http.MethodPost, "/api", `{"key1":"value1"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+
+	// A new member starts with no members, and catches up once added by any member
+	members["d"] = startMember(t, network, httptest.NewUnstartedServer(nil), "d", nil, false)
+	member := `{"id":"d","address":"` + members["d"].server.URL + `"}`
+	requestAndCheckResponse(t, followers[0].mux, http.MethodPost, "/admin/cluster/members", member, contentTypeJson, http.StatusNoContent, "", contentTypeText)
+	requestAndCheckResponse(t, leader.mux, http.MethodPost, "/admin/cluster/members", member, contentTypeJson, http.StatusConflict, errorMemberExists, contentTypeText)
+	requestAndCheckResponse(t, leader.mux, http.MethodPost, "/admin/cluster/members", `{"id":"e"}`, contentTypeJson, http.StatusBadRequest, errorInvalidMember, contentTypeText)
+	awaitValue(t, "key1", "value1", members["d"])
+	assert.Equal(t, leader, awaitLeader(t, members["a"], members["b"], members["c"], members["d"]))
+
+	// Writes to the new member are forwarded to the leader
+	requestAndCheckResponse(t, members["d"].mux, http.MethodPut, "/api/key1", "value2", contentTypeText, http.StatusNoContent, "", contentTypeText)
+	awaitValue(t, "key1", "value2", members["a"], members["b"], members["c"], members["d"])
+
+	// Removed members no longer receive writes
+	requestAndCheckResponse(t, members["d"].mux, http.MethodDelete, "/admin/cluster/members/"+followers[0].id, "", "", http.StatusNoContent, "", contentTypeText)
+	requestAndCheckResponse(t, leader.mux, http.MethodDelete, "/admin/cluster/members/"+followers[0].id, "", "", http.StatusNotFound, "", contentTypeText)
+	assert.Len(t, clusterStatusOf(t, leader).Members, 3)
+	requestAndCheckResponse(t, leader.mux, http.MethodPut, "/api/key1", "value3", contentTypeText, http.StatusNoContent, "", contentTypeText)
+	awaitValue(t, "key1", "value3", leader, followers[1], members["d"])
+	requestAndCheckResponse(t, followers[0].mux, http.MethodGet, "/api/key1", "", "", http.StatusOK, "value2", contentTypeText)
+}
+
+func TestClusterTransfer(t *testing.T) {
+	_, members := startCluster(t, false, "a", "b", "c")
+	leader := awaitLeader(t, members["a"], members["b"], members["c"])
+	followers := followersOf(leader, members)
+
+	requestAndCheckResponse(t, followers[0].mux, http.MethodPost, "/admin/cluster/transfer", `{"id":"`+followers[1].id+`"}`, contentTypeJson, http.StatusNoContent, "", contentTypeText)
+	assert.Equal(t, followers[1], awaitLeader(t, members["a"], members["b"], members["c"]))
+	requestAndCheckResponse(t, leader.mux, http.MethodPost, "/admin/cluster/transfer", `{"id":"z"}`, contentTypeJson, http.StatusNotFound, "", contentTypeText)
+
+	// Without a member, leadership is transferred to the most up-to-date one
+	requestAndCheckResponse(t, leader.mux, http.MethodPost, "/admin/cluster/transfer", "", "", http.StatusNoContent, "", contentTypeText)
+	assert.NotEqual(t, followers[1], awaitLeader(t, members["a"], members["b"], members["c"]))
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/crudpb"
+	"its-dave/simple-crud-rest-server/raft"
+	"its-dave/simple-crud-rest-server/tracing"
+	"log/slog"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	errorKeyNotFound  = "Error: the specified key does not exist"
+	errorInvalidKey   = "Error: the key must not be empty or contain '/'"
+	errorInvalidValue = "Error: the value must not be empty; delete the key instead"
+	errorNotLeader    = "Error: this member is not the leader of the cluster; call the leader instead"
+	errorWatchDropped = "Error: the watcher could not keep up with the events; watch again"
+)
+
+// grpcServer serves the Crud service of the gRPC API from the same service as the HTTP handlers. Each call is checked
+// and logged as the handler chain does each request, except that a follower or cluster member which cannot serve a
+// write itself fails it rather than forwarding it to the leader
+type grpcServer struct {
+	crudpb.UnimplementedCrudServer
+	svc           *service
+	authenticator auth.Authenticator
+	rd            *readiness
+	f             *follower
+	cluster       *Cluster
+	logger        *slog.Logger
+	tracer        *tracing.Tracer
+	shutdown      <-chan struct{}
+}
+
+func (g *grpcServer) Get(ctx context.Context, req *crudpb.GetRequest) (*crudpb.GetResponse, error) {
+	resp := &crudpb.GetResponse{}
+	err := g.call(ctx, crudpb.Crud_Get_FullMethodName, req.Key, "", func(ctx context.Context) error {
+		if !validKey(req.Key) {
+			return crudpb.Error(codes.InvalidArgument, crudpb.ReasonInvalidKey, errorInvalidKey)
+		}
+		value, _, err := g.svc.get(ctx, req.Key)
+		resp.Value = value
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) Create(ctx context.Context, req *crudpb.CreateRequest) (*crudpb.CreateResponse, error) {
+	err := g.call(ctx, crudpb.Crud_Create_FullMethodName, req.Key, "create", func(ctx context.Context) error {
+		if err := validEntry(req.Key, req.Value); err != nil {
+			return err
+		}
+		return g.svc.create(ctx, req.Key, req.Value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &crudpb.CreateResponse{}, nil
+}
+
+func (g *grpcServer) Update(ctx context.Context, req *crudpb.UpdateRequest) (*crudpb.UpdateResponse, error) {
+	err := g.call(ctx, crudpb.Crud_Update_FullMethodName, req.Key, "update", func(ctx context.Context) error {
+		if err := validEntry(req.Key, req.Value); err != nil {
+			return err
+		}
+		return g.svc.update(ctx, req.Key, req.Value, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &crudpb.UpdateResponse{}, nil
+}
+
+func (g *grpcServer) Delete(ctx context.Context, req *crudpb.DeleteRequest) (*crudpb.DeleteResponse, error) {
+	err := g.call(ctx, crudpb.Crud_Delete_FullMethodName, req.Key, "delete", func(ctx context.Context) error {
+		if !validKey(req.Key) {
+			return crudpb.Error(codes.InvalidArgument, crudpb.ReasonInvalidKey, errorInvalidKey)
+		}
+		return g.svc.delete(ctx, req.Key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &crudpb.DeleteResponse{}, nil
+}
+
+func (g *grpcServer) History(ctx context.Context, req *crudpb.HistoryRequest) (*crudpb.HistoryResponse, error) {
+	resp := &crudpb.HistoryResponse{}
+	err := g.call(ctx, crudpb.Crud_History_FullMethodName, req.Key, "", func(ctx context.Context) error {
+		if !validKey(req.Key) {
+			return crudpb.Error(codes.InvalidArgument, crudpb.ReasonInvalidKey, errorInvalidKey)
+		}
+		array, err := g.svc.history(ctx, req.Key)
+		if err != nil {
+			return err
+		}
+		events, err := eventsFromSlice(array)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			resp.Events = append(resp.Events, eventMessage(event))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) List(ctx context.Context, req *crudpb.ListRequest) (*crudpb.ListResponse, error) {
+	resp := &crudpb.ListResponse{}
+	err := g.call(ctx, crudpb.Crud_List_FullMethodName, req.Prefix, "", func(ctx context.Context) error {
+		entries, err := g.svc.list(ctx, req.Prefix)
+		for _, entry := range entries {
+			resp.Entries = append(resp.Entries, &crudpb.Entry{Key: entry.Key, Value: entry.Value})
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Watch streams the events of the keys with the prefix which the caller may read, until the call is cancelled or the
+// server shuts down
+func (g *grpcServer) Watch(req *crudpb.WatchRequest, stream crudpb.Crud_WatchServer) error {
+	return g.call(stream.Context(), crudpb.Crud_Watch_FullMethodName, req.Prefix, "watch", func(ctx context.Context) error {
+		wt := g.svc.ws.watch(req.Prefix)
+		defer g.svc.ws.unwatch(wt)
+		// Sending the header tells the client that the stream is open, as events are only sent once written
+		if err := stream.SendHeader(metadata.MD{}); err != nil {
+			return err
+		}
+
+		for {
+			select {
+			case event, ok := <-wt.events:
+				if !ok {
+					return crudpb.Error(codes.Aborted, crudpb.ReasonWatchDropped, errorWatchDropped)
+				}
+				if !allowed(ctx, auth.PermissionRead, event.Key) {
+					continue
+				}
+				if err := stream.Send(&crudpb.WatchResponse{Key: event.Key, Event: eventMessage(event.eventObj)}); err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-g.shutdown:
+				return nil
+			}
+		}
+	})
+}
+
+// call makes a call of the specified method on the key or prefix, once the server is able to serve it and the caller
+// has been authenticated, and logs it. Errors returned by the service are converted to those of the API
+func (g *grpcServer) call(ctx context.Context, method, key, event string, handle func(ctx context.Context) error) error {
+	start := time.Now()
+	r := auth.RequestFromIncomingContext(ctx)
+	rl := &requestLog{id: requestID(r)}
+	grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(headerRequestID), rl.id))
+	ctx = context.WithValue(ctx, requestLogKey{}, rl)
+	var span *tracing.Span
+	if g.tracer != nil {
+		ctx, span = g.tracer.StartRoot(ctx, strings.TrimPrefix(method, "/"), tracing.SpanKindServer, tracing.Extract(r.Header))
+		span.SetAttribute("rpc.system", "grpc")
+		span.SetAttribute("rpc.method", method)
+	}
+	annotateContext(ctx, key, event)
+
+	err := g.serve(ctx, method, rl, handle)
+	code := status.Code(err)
+	if span != nil {
+		span.SetAttribute("rpc.grpc.status_code", int(code))
+		if code == codes.Internal {
+			span.SetStatus(tracing.StatusError, code.String())
+		}
+		span.Finish()
+	}
+
+	attrs := []slog.Attr{
+		slog.String("requestId", rl.id),
+		slog.String("method", method),
+		slog.String("code", code.String()),
+		slog.Duration("latency", time.Since(start)),
+		slog.String("remoteAddr", r.RemoteAddr),
+	}
+	if rl.key != "" {
+		attrs = append(attrs, slog.String("key", rl.key))
+	}
+	if rl.event != "" {
+		attrs = append(attrs, slog.String("event", rl.event))
+	}
+	if rl.identity != "" {
+		attrs = append(attrs, slog.String("identity", rl.identity))
+	}
+	level := slog.LevelInfo
+	if rl.err != nil {
+		attrs = append(attrs, slog.String("error", rl.err.Error()))
+		level = slog.LevelError
+	}
+	g.logger.LogAttrs(ctx, level, "grpc call", attrs...)
+	return err
+}
+
+// serve checks that the call can be served, as the handler chain does a request, before handling it
+func (g *grpcServer) serve(ctx context.Context, method string, rl *requestLog, handle func(ctx context.Context) error) error {
+	if err := g.rd.initialise(); err != nil {
+		return crudpb.Error(codes.Unavailable, crudpb.ReasonNotReady, errorNotReady)
+	}
+	writes := crudpb.Writes(method)
+	if g.f != nil && writes {
+		return crudpb.Error(codes.FailedPrecondition, crudpb.ReasonReadOnly, errorFollower)
+	}
+	if g.cluster != nil && (writes || g.cluster.store.linearizable && method != crudpb.Crud_Watch_FullMethodName) && g.cluster.node.Status().Role != raft.Leader {
+		if _, ok := g.cluster.node.Leader(); !ok {
+			return crudpb.Error(codes.Unavailable, crudpb.ReasonNoLeader, errorNoLeader)
+		}
+		return crudpb.Error(codes.Unavailable, crudpb.ReasonNoLeader, errorNotLeader)
+	}
+
+	id, ok := auth.FromContext(ctx)
+	if !ok && g.authenticator != nil {
+		var err error
+		id, err = g.authenticator.Authenticate(auth.RequestFromIncomingContext(ctx))
+		if err != nil {
+			return crudpb.Error(codes.Unauthenticated, crudpb.ReasonUnauthenticated, errorUnauthorised)
+		}
+		ctx = auth.NewContext(ctx, id)
+	}
+	rl.identity = id.Name
+
+	return grpcError(ctx, handle(ctx))
+}
+
+// grpcError returns the error of the API for an error returned by the service
+func grpcError(ctx context.Context, err error) error {
+	if _, ok := status.FromError(err); ok || err == nil {
+		return err
+	}
+	switch {
+	case errors.Is(err, errKeyNotFound):
+		return crudpb.Error(codes.NotFound, crudpb.ReasonKeyNotFound, errorKeyNotFound)
+	case errors.Is(err, errKeyDeleted):
+		return crudpb.Error(codes.FailedPrecondition, crudpb.ReasonKeyDeleted, errorKeyDeleted)
+	case errors.Is(err, errKeyExists):
+		return crudpb.Error(codes.AlreadyExists, crudpb.ReasonKeyExists, errorKeyExists)
+	case errors.Is(err, errForbidden):
+		return crudpb.Error(codes.PermissionDenied, crudpb.ReasonForbidden, errorForbidden)
+	case errors.Is(err, errQuotaExceeded):
+		return crudpb.Error(codes.ResourceExhausted, crudpb.ReasonQuotaExceeded, errorQuotaExceeded)
+	case errors.Is(err, errValueTooLarge):
+		return crudpb.Error(codes.ResourceExhausted, crudpb.ReasonValueTooLarge, errorValueTooLarge)
+	case errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost):
+		// A write made while the cluster changed leader can be retried once it has a new one
+		return crudpb.Error(codes.Unavailable, crudpb.ReasonNoLeader, errorNoLeader)
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, recordError(ctx, err))
+}
+
+// validKey reports whether the key can also be addressed by the HTTP API, whose paths cannot hold an empty key or '/'
+func validKey(key string) bool {
+	return key != "" && !strings.Contains(key, "/")
+}
+
+// validEntry returns the error of the API for a key or value which cannot be set. An empty value marks a key deleted,
+// so is not a value which can be set
+func validEntry(key, value string) error {
+	if !validKey(key) {
+		return crudpb.Error(codes.InvalidArgument, crudpb.ReasonInvalidKey, errorInvalidKey)
+	}
+	if value == "" {
+		return crudpb.Error(codes.InvalidArgument, crudpb.ReasonInvalidValue, errorInvalidValue)
+	}
+	return nil
+}
+
+// eventMessage converts an event to its message in the API
+func eventMessage(event eventObj) *crudpb.Event {
+	return &crudpb.Event{Type: event.Event, Value: event.Value, Identity: event.Identity, Time: event.Time}
+}
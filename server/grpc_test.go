@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/crudpb"
+	"its-dave/simple-crud-rest-server/repository"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPC(t *testing.T) {
+	repo := initialiseData(t, "{}")
+	client, mux := newGRPCClient(t, repo, WithQuotas(Quota{Namespace: "team-a", MaxBytes: 5}))
+	ctx := context.Background()
+
+	_, err := client.Create(ctx, &crudpb.CreateRequest{Key: "key1", Value: "value1"})
+	assert.NoError(t, err)
+	get, err := client.Get(ctx, &crudpb.GetRequest{Key: "key1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "value1", get.Value)
+	_, err = client.Update(ctx, &crudpb.UpdateRequest{Key: "key1", Value: "value2"})
+	assert.NoError(t, err)
+	_, err = client.Delete(ctx, &crudpb.DeleteRequest{Key: "key1"})
+	assert.NoError(t, err)
+	history, err := client.History(ctx, &crudpb.HistoryRequest{Key: "key1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"create", "update", "delete"}, []string{history.Events[0].Type, history.Events[1].Type, history.Events[2].Type})
+	assert.Equal(t, "value2", history.Events[1].Value)
+
+	// The HTTP API shares the data
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key1/history", "", "", http.StatusOK, `[{"event":"create","value":"value1"},{"event":"update","value":"value2"},{"event":"delete","value":""}]`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/api", `{"key2":"value3"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+	list, err := client.List(ctx, &crudpb.ListRequest{Prefix: "key"})
+	assert.NoError(t, err)
+	if !assert.Len(t, list.Entries, 1) {
+		return
+	}
+	assert.Equal(t, "key2", list.Entries[0].Key)
+	assert.Equal(t, "value3", list.Entries[0].Value)
+
+	// Errors have typed codes and reasons
+	for _, tc := range []struct {
+		name   string
+		call   func() error
+		code   codes.Code
+		reason string
+	}{
+		{"get missing key", func() error { _, err := client.Get(ctx, &crudpb.GetRequest{Key: "key3"}); return err }, codes.NotFound, crudpb.ReasonKeyNotFound},
+		{"get deleted key", func() error { _, err := client.Get(ctx, &crudpb.GetRequest{Key: "key1"}); return err }, codes.FailedPrecondition, crudpb.ReasonKeyDeleted},
+		{"create existing key", func() error {
+			_, err := client.Create(ctx, &crudpb.CreateRequest{Key: "key2", Value: "value"})
+			return err
+		}, codes.AlreadyExists, crudpb.ReasonKeyExists},
+		{"update deleted key", func() error {
+			_, err := client.Update(ctx, &crudpb.UpdateRequest{Key: "key1", Value: "value"})
+			return err
+		}, codes.FailedPrecondition, crudpb.ReasonKeyDeleted},
+		{"delete missing key", func() error { _, err := client.Delete(ctx, &crudpb.DeleteRequest{Key: "key3"}); return err }, codes.NotFound, crudpb.ReasonKeyNotFound},
+		{"history of missing key", func() error {
+			_, err := client.History(ctx, &crudpb.HistoryRequest{Key: "key3"})
+			return err
+		}, codes.NotFound, crudpb.ReasonKeyNotFound},
+		{"create empty key", func() error { _, err := client.Create(ctx, &crudpb.CreateRequest{Value: "value"}); return err }, codes.InvalidArgument, crudpb.ReasonInvalidKey},
+		{"create key with slash", func() error {
+			_, err := client.Create(ctx, &crudpb.CreateRequest{Key: "a/b", Value: "value"})
+			return err
+		}, codes.InvalidArgument, crudpb.ReasonInvalidKey},
+		{"update to empty value", func() error { _, err := client.Update(ctx, &crudpb.UpdateRequest{Key: "key2"}); return err }, codes.InvalidArgument, crudpb.ReasonInvalidValue},
+		{"create value over quota", func() error {
+			_, err := client.Create(ctx, &crudpb.CreateRequest{Key: "team-a:key1", Value: "value1"})
+			return err
+		}, codes.ResourceExhausted, crudpb.ReasonValueTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.call()
+			assert.Equal(t, tc.code, status.Code(err))
+			assert.Equal(t, tc.reason, crudpb.Reason(err))
+		})
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	repo := initialiseData(t, "{}")
+	keyStore, err := auth.NewKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	teamToken, _, err := keyStore.Create("team-a", []auth.Grant{
+		{Permission: auth.PermissionWrite, Namespace: "team-a"},
+		{Permission: auth.PermissionRead, Prefix: "team-a:"},
+		{Permission: auth.PermissionHistory, Prefix: "team-a:"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	client, _ := newGRPCClient(t, repo, WithAPIKeys(keyStore))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+teamToken)
+
+	// Missing and invalid keys are rejected
+	_, err = client.Get(context.Background(), &crudpb.GetRequest{Key: "team-a:key1"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.Get(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer invalid"), &crudpb.GetRequest{Key: "team-a:key1"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// Granted operations succeed and are attributed to the key
+	_, err = client.Create(ctx, &crudpb.CreateRequest{Key: "team-a:key1", Value: "value1"})
+	assert.NoError(t, err)
+	history, err := client.History(ctx, &crudpb.HistoryRequest{Key: "team-a:key1"})
+	assert.NoError(t, err)
+	if !assert.Len(t, history.Events, 1) {
+		return
+	}
+	assert.Equal(t, "apikey:team-a", history.Events[0].Identity)
+
+	// Operations without a grant are forbidden
+	_, err = client.Delete(ctx, &crudpb.DeleteRequest{Key: "team-a:key1"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Create(ctx, &crudpb.CreateRequest{Key: "team-b:key1", Value: "value1"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, crudpb.ReasonForbidden, crudpb.Reason(err))
+}
+
+func TestGRPCWatch(t *testing.T) {
+	repo := initialiseData(t, "{}")
+	client, mux := newGRPCClient(t, repo)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &crudpb.WatchRequest{Prefix: "key"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	// The header is sent once the watcher is registered
+	_, err = stream.Header()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	requestAndCheckResponse(t, mux, http.MethodPost, "/api", `{"other":"value"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+	_, err = client.Create(ctx, &crudpb.CreateRequest{Key: "key1", Value: "value1"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	requestAndCheckResponse(t, mux, http.MethodDelete, "/api/key1", "", "", http.StatusNoContent, "", contentTypeText)
+
+	event, err := stream.Recv()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "key1", event.Key)
+	assert.Equal(t, "create", event.Event.Type)
+	assert.Equal(t, "value1", event.Event.Value)
+	event, err = stream.Recv()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "key1", event.Key)
+	assert.Equal(t, "delete", event.Event.Type)
+
+	cancel()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Canceled, status.Code(err))
+}
+
+// newGRPCClient returns a client of the gRPC API of a server created with the specified options, and its HTTP mux
+func newGRPCClient(t *testing.T, repo repository.Store, opts ...Option) (crudpb.CrudClient, *http.ServeMux) {
+	srv := grpc.NewServer()
+	mux := Create(repo, append(opts, WithGRPC(srv))...)
+	listener := bufconn.Listen(1 << 20)
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	return crudpb.NewCrudClient(conn), mux
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"its-dave/simple-crud-rest-server/repository"
+	"net/http"
+	"sync"
+)
+
+const (
+	checkStatusOK   = "ok"
+	checkStatusFail = "fail"
+)
+
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// readiness tracks whether the server has finished starting up and can serve requests
+type readiness struct {
+	repo repository.Store
+	// replica is set if the server is a follower, which is not ready until it has replicated its leader's data
+	replica *follower
+	// cluster is set if the server is a member of a cluster, which is not ready while it knows of no leader
+	cluster *Cluster
+
+	mu          sync.Mutex
+	initialised bool
+	initErr     error
+}
+
+// initialise runs the startup initialisation of the data store if it has not yet succeeded,
+// returning the error from the latest attempt
+func (rd *readiness) initialise() error {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if rd.initialised {
+		return nil
+	}
+	rd.initErr = rd.repo.InitialiseData()
+	rd.initialised = rd.initErr == nil
+	return rd.initErr
+}
+
+// ready wraps the specified handler so that requests are refused with 503 until initialisation has succeeded
+func (rd *readiness) ready(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := rd.initialise(); err != nil {
+			w.Header().Add(contentType, contentTypeText)
+			w.Header().Add("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, errorNotReady)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// handleLiveness reports that the process is alive and serving requests
+func (rd *readiness) handleLiveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, r, map[string]checkResult{
+		"process": {Status: checkStatusOK},
+	})
+}
+
+// handleReadiness reports whether startup initialisation has finished and the data store is readable and writable,
+// and for a follower whether it has replicated its leader's data
+func (rd *readiness) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]checkResult{}
+	checks["initialisation"] = checkResultFromError(rd.initialise())
+	checks["storage"] = checkResultFromError(rd.repo.Check())
+	if rd.replica != nil {
+		checks["replication"] = checkResultFromError(rd.replica.check())
+	}
+	if rd.cluster != nil {
+		checks["cluster"] = checkResultFromError(rd.cluster.check())
+	}
+	writeHealth(w, r, checks)
+}
+
+func checkResultFromError(err error) checkResult {
+	if err != nil {
+		return checkResult{Status: checkStatusFail, Error: err.Error()}
+	}
+	return checkResult{Status: checkStatusOK}
+}
+
+// writeHealth responds 200 if every check passed, otherwise 503, with the result of each check as JSON
+func writeHealth(w http.ResponseWriter, r *http.Request, checks map[string]checkResult) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	resp := healthResponse{Status: checkStatusOK, Checks: checks}
+	respCode := http.StatusOK
+	for _, check := range checks {
+		if check.Status != checkStatusOK {
+			resp.Status = checkStatusFail
+			respCode = http.StatusServiceUnavailable
+		}
+	}
+	respBody, _ := json.Marshal(resp)
+	w.Header().Add(contentType, contentTypeJson)
+	w.WriteHeader(respCode)
+	fmt.Fprint(w, string(respBody))
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"its-dave/simple-crud-rest-server/repository"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	// Data directory does not exist yet, so initialisation fails
+	dataDir := filepath.Join(t.TempDir(), "data")
+	repo := repository.Repo{}
+	repo.SetDataFilePath(filepath.Join(dataDir, "data.json"))
+	mux := Create(&repo)
+
+	resp := healthRequest(t, mux, "/healthz", http.StatusOK)
+	assert.Equal(t, checkStatusOK, resp.Checks["process"].Status)
+
+	resp = healthRequest(t, mux, "/readyz", http.StatusServiceUnavailable)
+	assert.Equal(t, checkStatusFail, resp.Status)
+	assert.Equal(t, checkStatusFail, resp.Checks["initialisation"].Status)
+	assert.Contains(t, resp.Checks["initialisation"].Error, "data.json")
+	assert.Equal(t, checkStatusFail, resp.Checks["storage"].Status)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key1", "", "", http.StatusServiceUnavailable, errorNotReady, contentTypeText)
+
+	// Initialisation is retried once the problem is fixed
+	assert.NoError(t, os.Mkdir(dataDir, 0777))
+	resp = healthRequest(t, mux, "/readyz", http.StatusOK)
+	assert.Equal(t, checkStatusOK, resp.Status)
+	assert.Equal(t, checkStatusOK, resp.Checks["initialisation"].Status)
+	assert.Equal(t, checkStatusOK, resp.Checks["storage"].Status)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key1", "", "", http.StatusNotFound, "", contentTypeText)
+
+	// Storage becoming unavailable is reported
+	assert.NoError(t, os.Remove(filepath.Join(dataDir, "data.json")))
+	resp = healthRequest(t, mux, "/readyz", http.StatusServiceUnavailable)
+	assert.Equal(t, checkStatusOK, resp.Checks["initialisation"].Status)
+	assert.Equal(t, checkStatusFail, resp.Checks["storage"].Status)
+}
+
+// healthRequest gets the specified probe endpoint, asserts the response code and returns the parsed response
+func healthRequest(t *testing.T, handler http.Handler, url string, expRespCode int) healthResponse {
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, url, nil))
+	assert.Equal(t, expRespCode, resp.Code)
+	assert.Equal(t, contentTypeJson, resp.Header().Get(contentType))
+	var health healthResponse
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &health))
+	return health
+}
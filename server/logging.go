@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/raft"
+	"its-dave/simple-crud-rest-server/tracing"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	headerRequestID = "X-Request-ID"
+	// maxRequestIDLength is the longest incoming request ID which is honoured
+	maxRequestIDLength = 128
+)
+
+// requestLog accumulates the details of a request which are logged once it completes
+type requestLog struct {
+	id       string
+	key      string
+	event    string
+	identity string
+	err      error
+}
+
+type requestLogKey struct{}
+
+// logged wraps the specified handler so that each request is given a request ID, echoed in the X-Request-ID
+// response header, and logged once it completes
+func logged(logger *slog.Logger, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rl := &requestLog{id: requestID(r)}
+		w.Header().Set(headerRequestID, rl.id)
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl)))
+
+		if rl.identity == "" {
+			// Identity established by an outer middleware
+			if id, ok := auth.FromContext(r.Context()); ok {
+				rl.identity = id.Name
+			}
+		}
+		attrs := []slog.Attr{
+			slog.String("requestId", rl.id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", routeLabel(r.URL.Path)),
+			slog.Int("status", recorder.status),
+			slog.Duration("latency", time.Since(start)),
+			slog.Int("bytes", recorder.bytes),
+			slog.String("remoteAddr", r.RemoteAddr),
+		}
+		if rl.key != "" {
+			attrs = append(attrs, slog.String("key", rl.key))
+		}
+		if rl.event != "" {
+			attrs = append(attrs, slog.String("event", rl.event))
+		}
+		if rl.identity != "" {
+			attrs = append(attrs, slog.String("identity", rl.identity))
+		}
+		level := slog.LevelInfo
+		if rl.err != nil {
+			attrs = append(attrs, slog.String("error", rl.err.Error()))
+			level = slog.LevelError
+		}
+		logger.LogAttrs(r.Context(), level, "request", attrs...)
+	}
+}
+
+// requestID returns the request's incoming X-Request-ID if it is reasonable, or generates a new one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(headerRequestID); id != "" && len(id) <= maxRequestIDLength && printable(id) {
+		return id
+	}
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+func printable(s string) bool {
+	for _, c := range s {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestLogFrom returns the log record of the specified request, if it is being logged
+func requestLogFrom(r *http.Request) *requestLog {
+	rl, _ := r.Context().Value(requestLogKey{}).(*requestLog)
+	return rl
+}
+
+// annotate records the key and event type of a request on its log record and trace span
+func annotate(r *http.Request, key, event string) {
+	annotateContext(r.Context(), key, event)
+}
+
+// annotateContext records the key and event type on the log record and trace span of the request or call in ctx
+func annotateContext(ctx context.Context, key, event string) {
+	span := tracing.SpanFromContext(ctx)
+	rl, _ := ctx.Value(requestLogKey{}).(*requestLog)
+	if key != "" {
+		span.SetAttribute("crud.key", key)
+		if rl != nil {
+			rl.key = key
+		}
+	}
+	if event != "" {
+		span.SetAttribute("crud.event", event)
+		if rl != nil {
+			rl.event = event
+		}
+	}
+}
+
+// annotateIdentity records the identity of the caller on the request's log record
+func annotateIdentity(r *http.Request, id auth.Identity) {
+	if rl := requestLogFrom(r); rl != nil {
+		rl.identity = id.Name
+	}
+}
+
+// unexpectedError records the specified error to be logged with the request, and returns a response body and code
+// which refer to the request ID rather than exposing the error's details
+func unexpectedError(r *http.Request, err error) (string, int) {
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+		// A write made while the cluster changed leader is not unexpected, and can be retried once it has a new one
+		return errorNoLeader, http.StatusServiceUnavailable
+	}
+	return recordError(r.Context(), err), http.StatusInternalServerError
+}
+
+// recordError records the specified error to be logged with the request or call in ctx, and returns a message which
+// refers to its request ID rather than exposing the error's details
+func recordError(ctx context.Context, err error) string {
+	tracing.SpanFromContext(ctx).RecordError(err)
+	rl, _ := ctx.Value(requestLogKey{}).(*requestLog)
+	if rl == nil {
+		return errorUnexpected
+	}
+	rl.err = err
+	return errorUnexpected + rl.id
+}
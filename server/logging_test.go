@@ -0,0 +1,54 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLogging(t *testing.T) {
+	repo := initialiseData(t, `{"key1":[{"event":"create","value":"value1"}],"empty":[]}`)
+	var logs bytes.Buffer
+	mux := Create(repo, WithLogger(slog.New(slog.NewJSONHandler(&logs, nil))))
+
+	// Incoming request ID is honoured
+	req := httptest.NewRequest(http.MethodGet, "/api/key1", nil)
+	req.Header.Set(headerRequestID, "req-123")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "req-123", resp.Header().Get(headerRequestID))
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(logs.Bytes(), &entry))
+	assert.Equal(t, "INFO", entry["level"])
+	assert.Equal(t, "req-123", entry["requestId"])
+	assert.Equal(t, http.MethodGet, entry["method"])
+	assert.Equal(t, "/api/key1", entry["path"])
+	assert.Equal(t, "key1", entry["key"])
+	assert.Equal(t, float64(http.StatusOK), entry["status"])
+	assert.Equal(t, float64(len("value1")), entry["bytes"])
+	assert.Contains(t, entry, "latency")
+
+	// Unexpected errors are logged rather than returned
+	logs.Reset()
+	req = httptest.NewRequest(http.MethodGet, "/api/empty", nil)
+	req.Header.Set(headerRequestID, "invalid request id")
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	generatedID := resp.Header().Get(headerRequestID)
+	assert.Len(t, generatedID, 32)
+	assert.Equal(t, errorUnexpected+generatedID, resp.Body.String())
+
+	entry = nil
+	assert.NoError(t, json.Unmarshal(logs.Bytes(), &entry))
+	assert.Equal(t, "ERROR", entry["level"])
+	assert.Equal(t, generatedID, entry["requestId"])
+	assert.Contains(t, entry["error"], "history is empty")
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/metrics"
+	"its-dave/simple-crud-rest-server/repository"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverMetrics are the metrics recorded by the server when configured WithMetrics
+type serverMetrics struct {
+	requests        *metrics.Counter
+	requestDuration *metrics.Histogram
+	storageDuration *metrics.Histogram
+	storageErrors   *metrics.Counter
+	dataFileSize    *metrics.Gauge
+	keys            *metrics.Gauge
+	events          *metrics.Gauge
+}
+
+// newServerMetrics registers the server's metrics with the specified registry,
+// collecting statistics about the stored data from the repo at each scrape
+func newServerMetrics(registry *metrics.Registry, repo repository.Store) *serverMetrics {
+	m := &serverMetrics{
+		requests:        registry.NewCounter("crud_http_requests_total", "Total HTTP requests by route, method and status.", "route", "method", "status"),
+		requestDuration: registry.NewHistogram("crud_http_request_duration_seconds", "HTTP request latency by route, method and status.", metrics.DefBuckets, "route", "method", "status"),
+		storageDuration: registry.NewHistogram("crud_storage_operation_duration_seconds", "Duration of reads and writes of the data store.", metrics.DefBuckets, "operation"),
+		storageErrors:   registry.NewCounter("crud_storage_errors_total", "Total failed reads and writes of the data store.", "operation"),
+		dataFileSize:    registry.NewGauge("crud_data_file_size_bytes", "Size of the data file."),
+		keys:            registry.NewGauge("crud_keys", "Number of keys by whether they have a current value.", "state"),
+		events:          registry.NewGauge("crud_events", "Total number of events in all key histories."),
+	}
+	registry.OnCollect(func() {
+		m.collectData(repo)
+	})
+	return m
+}
+
+// observeStorage records a read or write of the data store
+func (m *serverMetrics) observeStorage(operation string, duration time.Duration, err error) {
+	m.storageDuration.Observe(duration.Seconds(), operation)
+	if err != nil {
+		m.storageErrors.Inc(operation)
+	}
+}
+
+// collectData updates the gauges describing the stored data
+func (m *serverMetrics) collectData(repo repository.Store) {
+	if size, err := repo.Size(); err == nil {
+		m.dataFileSize.Set(float64(size))
+	}
+	dataMap, err := repo.ReadData(context.Background())
+	if err != nil {
+		return
+	}
+	live, deleted, events := 0, 0, 0
+	for _, keyArray := range dataMap {
+		array, err := sliceFromArray(keyArray)
+		if err != nil || len(array) == 0 {
+			continue
+		}
+		events += len(array)
+		latestEventObj, err := latestEventFromSlice(array)
+		if err != nil {
+			continue
+		}
+		if latestEventObj.Value == "" {
+			deleted++
+		} else {
+			live++
+		}
+	}
+	m.keys.Set(float64(live), "live")
+	m.keys.Set(float64(deleted), "deleted")
+	m.events.Set(float64(events))
+}
+
+// instrumented wraps the specified handler to record the count and latency of its requests
+func (m *serverMetrics) instrumented(handler http.HandlerFunc) http.HandlerFunc {
+	if m == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r)
+
+		route, status := routeLabel(r.URL.Path), strconv.Itoa(recorder.status)
+		m.requests.Inc(route, r.Method, status)
+		m.requestDuration.Observe(time.Since(start).Seconds(), route, r.Method, status)
+	}
+}
+
+// handleMetrics serves the metrics in the registry to callers with admin permission
+func handleMetrics(registry *metrics.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorised(r, auth.PermissionAdmin, "") {
+			writeForbidden(w)
+			return
+		}
+		registry.Handler().ServeHTTP(w, r)
+	}
+}
+
+// routeLabel returns the route matching the specified path, with keys and IDs replaced by placeholders
+// so that the number of distinct labels is bounded
+func routeLabel(path string) string {
+	urlParts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case urlParts[0] == "api" && len(urlParts) == 1:
+		return "/api"
+	case urlParts[0] == "api" && len(urlParts) == 2:
+		return "/api/{key}"
+	case urlParts[0] == "api" && len(urlParts) == 3 && urlParts[2] == "history":
+		return "/api/{key}/history"
+	case len(urlParts) == 2 && (urlParts[0] == "admin" || urlParts[0] == "replication" || urlParts[0] == "raft"):
+		return "/" + urlParts[0] + "/" + urlParts[1]
+	case len(urlParts) == 3 && urlParts[0] == "admin" && urlParts[1] == "cluster":
+		return "/admin/cluster/" + urlParts[2]
+	case len(urlParts) == 4 && urlParts[0] == "admin" && urlParts[1] == "cluster" && urlParts[2] == "members":
+		return "/admin/cluster/members/{id}"
+	case len(urlParts) == 3 && urlParts[0] == "admin":
+		return "/admin/" + urlParts[1] + "/{id}"
+	case len(urlParts) == 1 && (urlParts[0] == "metrics" || urlParts[0] == "watch"):
+		return "/" + urlParts[0]
+	}
+	return "other"
+}
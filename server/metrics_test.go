@@ -0,0 +1,79 @@
+package server
+
+import (
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/metrics"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	repo := initialiseData(t, `{"key1":[{"event":"create","value":"value1"}],"key2":[{"event":"create","value":"value1"},{"event":"delete","value":""}]}`)
+	mux := Create(repo, WithMetrics(metrics.NewRegistry()))
+
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key1", "", "", http.StatusOK, "value1", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key3", "", "", http.StatusNotFound, "", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/api", `{"key3":"value3"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	body := resp.Body.String()
+
+	for _, expLine := range []string{
+		`crud_http_requests_total{route="/api/{key}",method="GET",status="200"} 1`,
+		`crud_http_requests_total{route="/api/{key}",method="GET",status="404"} 1`,
+		`crud_http_requests_total{route="/api",method="POST",status="201"} 1`,
+		`crud_http_request_duration_seconds_count{route="/api",method="POST",status="201"} 1`,
+		// Including the read made by the scrape to count the keys
+		`crud_storage_operation_duration_seconds_count{operation="read"} 4`,
+		`crud_storage_operation_duration_seconds_count{operation="write"} 1`,
+		`crud_keys{state="live"} 2`,
+		`crud_keys{state="deleted"} 1`,
+		`crud_events 4`,
+	} {
+		assert.Contains(t, body, expLine+"\n")
+	}
+	assert.Contains(t, body, "crud_data_file_size_bytes ")
+}
+
+func TestMetricsAuth(t *testing.T) {
+	repo := initialiseData(t, "{}")
+	keyStore, err := auth.NewKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	assert.NoError(t, err)
+	adminToken, _, err := keyStore.Create("admin", []auth.Grant{{Permission: auth.PermissionAdmin}})
+	assert.NoError(t, err)
+	readToken, _, err := keyStore.Create("reader", []auth.Grant{{Permission: auth.PermissionRead}})
+	assert.NoError(t, err)
+	mux := Create(repo, WithAPIKeys(keyStore), WithMetrics(metrics.NewRegistry()))
+
+	// Only admin keys can read the metrics
+	authRequestAndCheckResponse(t, mux, "", http.MethodGet, "/metrics", "", "", http.StatusUnauthorized, errorUnauthorised)
+	authRequestAndCheckResponse(t, mux, readToken, http.MethodGet, "/metrics", "", "", http.StatusForbidden, errorForbidden)
+	resp := authRequest(t, mux, adminToken, http.MethodGet, "/metrics", "", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), "crud_http_requests_total")
+}
+
+func TestRouteLabel(t *testing.T) {
+	for path, expRoute := range map[string]string{
+		"/api":                     "/api",
+		"/api/":                    "/api",
+		"/api/key1":                "/api/{key}",
+		"/api/key1/history":        "/api/{key}/history",
+		"/api/key1/other":          "other",
+		"/admin/keys":              "/admin/keys",
+		"/admin/keys/abc123":       "/admin/keys/{id}",
+		"/admin/cluster/members/b": "/admin/cluster/members/{id}",
+		"/admin/cluster/members":   "/admin/cluster/members",
+		"/raft/append":             "/raft/append",
+		"/metrics":                 "/metrics",
+		"/watch":                   "/watch",
+	} {
+		assert.Equal(t, expRoute, routeLabel(path), path)
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+)
+
+// openAPISpec is the OpenAPI 3.1 document describing every endpoint served by Create
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// swaggerUI holds the Swagger UI assets, vendored from the swagger-ui-dist package at the version in swaggerui/VERSION
+// so that the docs page loads nothing from outside the server
+//
+//go:generate sh -c "v=$(cat swaggerui/VERSION) && for f in swagger-ui.css swagger-ui-bundle.js LICENSE; do curl -fsSL -o swaggerui/$f https://unpkg.com/swagger-ui-dist@$v/$f || exit 1; done"
+//go:embed swaggerui
+var swaggerUI embed.FS
+
+// swaggerUIPath is the path under which the Swagger UI assets are served
+const swaggerUIPath = "/docs/swagger-ui/"
+
+// docsPage renders openAPISpec with Swagger UI
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Simple CRUD REST server</title>
+  <link rel="stylesheet" href="` + swaggerUIPath + `swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="` + swaggerUIPath + `swagger-ui-bundle.js"></script>
+  <script>
+    window.onload = () => { window.ui = SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"}); };
+  </script>
+</body>
+</html>
+`
+
+// handleOpenAPI serves the OpenAPI document
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Add(contentType, contentTypeJson)
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpec)
+}
+
+// handleDocs serves a page for browsing the OpenAPI document
+func handleDocs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Add(contentType, "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, docsPage)
+}
+
+// handleSwaggerUI serves the Swagger UI assets used by the docs page
+func handleSwaggerUI() http.HandlerFunc {
+	assets, _ := fs.Sub(swaggerUI, "swaggerui")
+	files := http.StripPrefix(swaggerUIPath, http.FileServer(http.FS(assets)))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/metrics"
+	"its-dave/simple-crud-rest-server/raft"
+	"its-dave/simple-crud-rest-server/snapshot"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type openAPIOperation struct {
+	RequestBody map[string]interface{}            `json:"requestBody"`
+	Responses   map[string]map[string]interface{} `json:"responses"`
+}
+
+type openAPIDocument struct {
+	OpenAPI    string                                `json:"openapi"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components map[string]map[string]json.RawMessage `json:"components"`
+}
+
+// testBodies are valid request bodies for each operation with a body, so that the operation can succeed
+var testBodies = map[string]string{
+	"POST /api":                    `{"key2":"value2"}`,
+	"PUT /api/{key}":               "value2",
+	"PATCH /api/{key}":             "value3",
+	"POST /admin/keys":             `{"name":"ci","grants":[{"permission":"read"}]}`,
+	"DELETE /admin/keys/{id}":      "",
+	"POST /admin/import":           `{"key":"key3","events":[{"event":"create","value":"value3"}]}`,
+	"POST /admin/cluster/members":  `{"id":"b","address":"http://b:9080"}`,
+	"POST /admin/cluster/transfer": `{"id":"a"}`,
+	"POST /raft/{rpc}":             `{"term":0,"leader":"b"}`,
+}
+
+func TestOpenAPI(t *testing.T) {
+	repo := initialiseData(t, `{"key1":[{"event":"create","value":"value1"}]}`)
+	keyStore, err := auth.NewKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	assert.NoError(t, err)
+	var grants []auth.Grant
+	for _, permission := range []auth.Permission{auth.PermissionRead, auth.PermissionWrite, auth.PermissionDelete, auth.PermissionHistory, auth.PermissionAdmin} {
+		grants = append(grants, auth.Grant{Permission: permission})
+	}
+	token, _, err := keyStore.Create("all", grants)
+	assert.NoError(t, err)
+	_, revokedKey, err := keyStore.Create("revoked", []auth.Grant{{Permission: auth.PermissionRead}})
+	assert.NoError(t, err)
+	// The server is the only member of a cluster, which another member can join
+	network := raft.NewNetwork()
+	cluster, err := NewCluster(repo, ClusterConfig{ID: "a", Members: []raft.Member{{ID: "a", Address: "http://a:9080"}}, Transport: network.Transport("a"), Storage: raft.NewMemoryStorage(), HeartbeatInterval: 10 * time.Millisecond, ElectionTimeout: 50 * time.Millisecond})
+	assert.NoError(t, err)
+	defer cluster.Stop()
+	joining := startMember(t, network, httptest.NewUnstartedServer(nil), "b", nil, false)
+	mux := Create(repo, WithAPIKeys(keyStore), WithMetrics(metrics.NewRegistry()), WithDocs(), WithSnapshots(0, snapshot.NewStore(t.TempDir(), snapshot.Retention{})), WithRetention(0, RetentionPolicy{KeepLast: 10}), WithReplicationLog(100), WithCluster(cluster))
+	network.Register("a", mux)
+	assert.Eventually(t, func() bool {
+		return cluster.node.Status().Role == raft.Leader
+	}, 5*time.Second, 10*time.Millisecond)
+
+	resp := authRequest(t, mux, "", http.MethodGet, "/openapi.json", "", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, contentTypeJson, resp.Header().Get(contentType))
+	var doc openAPIDocument
+	if !assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &doc)) {
+		return
+	}
+	assert.Equal(t, "3.1.0", doc.OpenAPI)
+
+	// Every reference resolves
+	for _, ref := range regexp.MustCompile(`"\$ref": ?"#/components/(\w+)/(\w+)"`).FindAllStringSubmatch(string(openAPISpec), -1) {
+		assert.Contains(t, doc.Components[ref[1]], ref[2], ref[0])
+	}
+
+	// The replication stream starts from the latest change
+	var status replicationStatus
+	assert.NoError(t, json.Unmarshal(authRequest(t, mux, token, http.MethodGet, "/admin/replication", "", "").Body.Bytes(), &status))
+	testQueries := map[string]string{"GET /replication/stream": fmt.Sprintf("?epoch=%s&after=%d", status.Epoch, status.Seq)}
+
+	// Every documented path is routed by its own pattern, and each of its operations returns a documented response
+	paths := make([]string, 0, len(doc.Paths))
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		url := strings.NewReplacer("{key}", "key1", "{id}", revokedKey.ID, "{member}", joining.id, "{rpc}", "append", "{asset}", "swagger-ui.css").Replace(path)
+		pattern := path
+		if i := strings.Index(path, "{"); i >= 0 {
+			pattern = path[:i]
+		}
+		_, routed := mux.Handler(httptest.NewRequest(http.MethodGet, url, nil))
+		assert.Equal(t, pattern, routed, path)
+
+		// Deletes last so that the key still exists for the other operations
+		for _, method := range []string{"get", "post", "put", "patch", "delete"} {
+			raw, ok := doc.Paths[path][method]
+			if !ok {
+				continue
+			}
+			var op openAPIOperation
+			assert.NoError(t, json.Unmarshal(raw, &op))
+			operation := strings.ToUpper(method) + " " + path
+			reqContentType := ""
+			if op.RequestBody != nil {
+				reqContentType = contentTypeJson
+				if strings.Contains(string(raw), "#/components/requestBodies/Value") {
+					reqContentType = contentTypeText
+				} else if content, ok := op.RequestBody["content"].(map[string]interface{}); ok && content[contentTypeNDJSON] != nil {
+					reqContentType = contentTypeNDJSON
+				}
+			}
+			req := httptest.NewRequest(strings.ToUpper(method), url+testQueries[operation], strings.NewReader(testBodies[operation]))
+			req.Header.Add(contentType, reqContentType)
+			req.Header.Add("Authorization", "Bearer "+token)
+			if content, ok := op.Responses["200"]["content"].(map[string]interface{}); ok && content[contentTypeEventStream] != nil {
+				// Streams last until the client disconnects
+				ctx, cancel := context.WithCancel(req.Context())
+				cancel()
+				req = req.WithContext(ctx)
+			}
+			resp := httptest.NewRecorder()
+			mux.ServeHTTP(resp, req)
+			assert.Contains(t, op.Responses, strconv.Itoa(resp.Code), operation)
+			if resp.Code/100 != 2 {
+				t.Errorf("%s: unexpected status %d: %s", operation, resp.Code, resp.Body.String())
+			}
+		}
+	}
+
+	// Every asset the docs page loads is served
+	resp = authRequest(t, mux, "", http.MethodGet, "/docs", "", "")
+	assets := regexp.MustCompile(`"(/docs/swagger-ui/[^"]+)"`).FindAllStringSubmatch(resp.Body.String(), -1)
+	assert.Len(t, assets, 2)
+	for _, asset := range assets {
+		resp := authRequest(t, mux, "", http.MethodGet, asset[1], "", "")
+		assert.Equal(t, http.StatusOK, resp.Code, asset[1])
+		assert.NotEmpty(t, resp.Body.Bytes(), asset[1])
+	}
+
+	// Every registered route is documented
+	for _, url := range []string{"/", "/api", "/api/key1", "/api/key1/history", "/admin", "/admin/keys", "/admin/keys/id", "/admin/export", "/admin/import", "/admin/snapshot", "/admin/verify", "/admin/compact", "/admin/replication", "/admin/cluster", "/admin/cluster/members", "/admin/cluster/members/b", "/admin/cluster/transfer", "/replication/snapshot", "/replication/stream", "/raft/append", "/metrics", "/healthz", "/readyz", "/openapi.json", "/docs", "/docs/index.html", "/docs/swagger-ui/swagger-ui.css", "/watch"} {
+		_, pattern := mux.Handler(httptest.NewRequest(http.MethodGet, url, nil))
+		if pattern == "" {
+			continue
+		}
+		documented := false
+		for path := range doc.Paths {
+			documented = documented || path == pattern || strings.HasPrefix(path, pattern) && strings.HasSuffix(pattern, "/")
+		}
+		assert.True(t, documented, "%s is routed by %s which is not documented", url, pattern)
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/metrics"
+	"its-dave/simple-crud-rest-server/snapshot"
+	"its-dave/simple-crud-rest-server/tracing"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// Option configures optional behaviour of the server returned by Create
+type Option func(*options)
+
+type options struct {
+	authenticator auth.Authenticator
+	keyStore      *auth.KeyStore
+	quotas        quotas
+	metrics       *metrics.Registry
+	tracer        *tracing.Tracer
+	logger        *slog.Logger
+	docs          bool
+	shutdown      <-chan struct{}
+	snapshots     *snapshot.Store
+	snapshotEvery time.Duration
+	clock         clock
+	retention     []RetentionPolicy
+	compactEvery  time.Duration
+	changeLogSize int
+	leader        *url.URL
+	leaderToken   string
+	forwardWrites bool
+	cluster       *Cluster
+	grpc          *grpc.Server
+}
+
+// WithAuthenticator requires every request to be authenticated by the specified authenticator,
+// unless an identity has already been established by an outer middleware
+func WithAuthenticator(authenticator auth.Authenticator) Option {
+	return func(o *options) {
+		o.authenticator = authenticator
+	}
+}
+
+// WithAPIKeys authenticates requests using the specified API key store and serves the /admin/keys endpoints to manage it
+func WithAPIKeys(keyStore *auth.KeyStore) Option {
+	return func(o *options) {
+		o.authenticator = keyStore
+		o.keyStore = keyStore
+	}
+}
+
+// WithQuotas limits the storage used by the keys in each namespace
+func WithQuotas(quotas ...Quota) Option {
+	return func(o *options) {
+		o.quotas = append(o.quotas, quotas...)
+	}
+}
+
+// WithMetrics records request and storage metrics in the specified registry and serves them at /metrics
+func WithMetrics(registry *metrics.Registry) Option {
+	return func(o *options) {
+		o.metrics = registry
+	}
+}
+
+// WithTracer produces a trace span for each request, and for the storage operations it performs
+func WithTracer(tracer *tracing.Tracer) Option {
+	return func(o *options) {
+		o.tracer = tracer
+	}
+}
+
+// WithLogger logs each request, and the details of unexpected errors, to the specified logger instead of slog.Default()
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithDocs serves a page for browsing the OpenAPI document at /docs
+func WithDocs() Option {
+	return func(o *options) {
+		o.docs = true
+	}
+}
+
+// WithShutdown ends long-lived responses, such as watch streams, when the specified channel is closed
+// so that they do not hold up a graceful shutdown
+func WithShutdown(shutdown <-chan struct{}) Option {
+	return func(o *options) {
+		o.shutdown = shutdown
+	}
+}
+
+// WithSnapshots serves the /admin/snapshot endpoint, which saves snapshots of the data to the specified snapshot store.
+// A snapshot is also saved at the specified interval, if positive, until the channel given by WithShutdown is closed
+func WithSnapshots(interval time.Duration, store *snapshot.Store) Option {
+	return func(o *options) {
+		o.snapshotEvery = interval
+		o.snapshots = store
+	}
+}
+
+// WithClock records the time of each event, as given by the specified clock, so that retention policies can remove
+// events by age. Events are not timed by default
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.clock = now
+	}
+}
+
+// WithRetention limits the history of each key by the first of the specified policies which applies to it, and serves
+// the /admin/compact endpoint which applies them. The history is also compacted at the specified interval, if positive,
+// until the channel given by WithShutdown is closed
+func WithRetention(interval time.Duration, policies ...RetentionPolicy) Option {
+	return func(o *options) {
+		o.compactEvery = interval
+		o.retention = append(o.retention, policies...)
+	}
+}
+
+// WithReplicationLog records the latest changes to the data, up to the specified number, and serves the
+// /replication/snapshot and /replication/stream endpoints from which followers replicate the data
+func WithReplicationLog(size int) Option {
+	return func(o *options) {
+		o.changeLogSize = size
+	}
+}
+
+// WithFollower makes the server a read-only follower of the leader at the specified URL, replicating its data into the
+// store until the channel given by WithShutdown is closed. Requests to the leader are authenticated with the token, if
+// set. Writes are forwarded to the leader if forwardWrites is set, and otherwise rejected with 421
+func WithFollower(leader *url.URL, token string, forwardWrites bool) Option {
+	return func(o *options) {
+		o.leader = leader
+		o.leaderToken = token
+		o.forwardWrites = forwardWrites
+	}
+}
+
+// WithCluster makes the server a member of the specified cluster, which replicates its writes, and serves the
+// /admin/cluster endpoints to manage it. The repository passed to Create must be the one the cluster was created with
+func WithCluster(cluster *Cluster) Option {
+	return func(o *options) {
+		o.cluster = cluster
+	}
+}
+
+// WithGRPC registers the gRPC API on the specified server, sharing the data store, permissions and other options with
+// the HTTP API. Calls must be authenticated by the authenticator given by WithAuthenticator or WithAPIKeys, if any,
+// unless an identity has already been established by an interceptor
+func WithGRPC(srv *grpc.Server) Option {
+	return func(o *options) {
+		o.grpc = srv
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"its-dave/simple-crud-rest-server/auth"
+)
+
+// Quota limits the storage used by the keys in a namespace; limits which are zero are not enforced
+type Quota struct {
+	// Namespace is the namespace the quota applies to, or an empty string for keys without a namespace
+	Namespace string `json:"namespace"`
+	// MaxKeys is the maximum number of keys with a current value
+	MaxKeys int `json:"maxKeys,omitempty"`
+	// MaxBytes is the maximum total size of the current values
+	MaxBytes int `json:"maxBytes,omitempty"`
+	// MaxHistory is the maximum number of events in the history of a single key
+	MaxHistory int `json:"maxHistory,omitempty"`
+}
+
+type quotas []Quota
+
+// forKey returns the quota applying to the specified key, if any
+func (q quotas) forKey(key string) (Quota, bool) {
+	namespace := auth.Namespace(key)
+	for _, quota := range q {
+		if quota.Namespace == namespace {
+			return quota, true
+		}
+	}
+	return Quota{}, false
+}
+
+// check returns errQuotaExceeded, or errValueTooLarge, unless setting the key to the specified value is within its
+// namespace's quota
+func (q quotas) check(dataMap map[string]interface{}, key, value string) error {
+	quota, ok := q.forKey(key)
+	if !ok {
+		return nil
+	}
+	if quota.MaxBytes > 0 && len(value) > quota.MaxBytes {
+		// The value could never fit
+		return errValueTooLarge
+	}
+
+	keys, bytes := 0, 0
+	currentValue, historyLength := "", 0
+	namespace := auth.Namespace(key)
+	for k, keyArray := range dataMap {
+		if auth.Namespace(k) != namespace {
+			continue
+		}
+		array, err := sliceFromArray(keyArray)
+		if err != nil || len(array) == 0 {
+			continue
+		}
+		latestEventObj, err := latestEventFromSlice(array)
+		if err != nil {
+			continue
+		}
+		if k == key {
+			currentValue, historyLength = latestEventObj.Value, len(array)
+		}
+		if latestEventObj.Value != "" {
+			keys++
+			bytes += len(latestEventObj.Value)
+		}
+	}
+
+	if quota.MaxHistory > 0 && historyLength+1 > quota.MaxHistory {
+		return errQuotaExceeded
+	}
+	if quota.MaxKeys > 0 && currentValue == "" && keys+1 > quota.MaxKeys {
+		return errQuotaExceeded
+	}
+	if quota.MaxBytes > 0 && bytes-len(currentValue)+len(value) > quota.MaxBytes {
+		return errQuotaExceeded
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestQuotas(t *testing.T) {
+	repo := initialiseData(t, "{}")
+	mux := Create(repo, WithQuotas(Quota{Namespace: "team-a", MaxKeys: 2, MaxBytes: 10, MaxHistory: 3}))
+
+	// Within quota
+	requestAndCheckResponse(t, mux, http.MethodPost, "/api", `{"team-a:key1":"abcd"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/api", `{"team-a:key2":"abcd"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+	// Too many keys
+	requestAndCheckResponse(t, mux, http.MethodPost, "/api", `{"team-a:key3":"a"}`, contentTypeJson, http.StatusInsufficientStorage, errorQuotaExceeded, contentTypeText)
+	// Other namespaces are unaffected
+	requestAndCheckResponse(t, mux, http.MethodPost, "/api", `{"team-b:key3":"a"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+	// Too many bytes in total
+	requestAndCheckResponse(t, mux, http.MethodPut, "/api/team-a:key1", "abcdefg", contentTypeText, http.StatusInsufficientStorage, errorQuotaExceeded, contentTypeText)
+	// Value larger than the whole quota
+	requestAndCheckResponse(t, mux, http.MethodPut, "/api/team-a:key1", "abcdefghijk", contentTypeText, http.StatusRequestEntityTooLarge, errorValueTooLarge, contentTypeText)
+	// Replacing a value only counts the difference in size
+	requestAndCheckResponse(t, mux, http.MethodPut, "/api/team-a:key1", "abcdef", contentTypeText, http.StatusNoContent, "", contentTypeText)
+	// Deleting frees a key
+	requestAndCheckResponse(t, mux, http.MethodDelete, "/api/team-a:key2", "", "", http.StatusNoContent, "", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/api", `{"team-a:key3":"a"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+	// History too long
+	requestAndCheckResponse(t, mux, http.MethodPut, "/api/team-a:key1", "a", contentTypeText, http.StatusNoContent, "", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodPut, "/api/team-a:key1", "b", contentTypeText, http.StatusInsufficientStorage, errorQuotaExceeded, contentTypeText)
+}
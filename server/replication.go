@@ -0,0 +1,615 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/repository"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	errorFollower        = "Error: this server is a read-only follower; send writes to the leader"
+	errorReplicationGone = "Error: the change log no longer holds the requested changes; fetch a new snapshot"
+)
+
+var (
+	// replicationHeartbeat is the interval between heartbeats sent to followers, from which they measure their lag
+	replicationHeartbeat = 5 * time.Second
+	// replicationRetry is the time a follower waits before reconnecting to its leader after an error
+	replicationRetry = time.Second
+)
+
+// errReplicationGone is returned by a follower's stream when the leader no longer holds the changes it needs
+var errReplicationGone = errors.New("the leader's change log no longer holds the changes after those applied")
+
+// change is a change to the history of a key, as recorded in the change log
+type change struct {
+	Seq uint64 `json:"seq"`
+	Key string `json:"key"`
+	// Events are the events appended to the key's history, or its whole new history if Replace is set
+	Events  []eventObj `json:"events,omitempty"`
+	Replace bool       `json:"replace,omitempty"`
+	// Removed is set if the key was removed
+	Removed bool `json:"removed,omitempty"`
+}
+
+// changeLog records the latest changes to the data in the order they were written, numbering each in sequence, so
+// that followers can apply them to a snapshot. The epoch identifies the sequence, which restarts with the process
+type changeLog struct {
+	size int
+
+	mu      sync.Mutex
+	epoch   string
+	seq     uint64
+	changes []change
+	// updated is closed and replaced when a change is recorded, waking the streams waiting for one
+	updated chan struct{}
+}
+
+func newChangeLog(size int) *changeLog {
+	return &changeLog{size: size, epoch: newEpoch(), updated: make(chan struct{})}
+}
+
+// newEpoch returns a random identifier for a sequence of changes
+func newEpoch() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// record numbers the change and adds it to the log, dropping the oldest change if the log is full
+func (l *changeLog) record(c change) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	c.Seq = l.seq
+	l.changes = append(l.changes, c)
+	if len(l.changes) > l.size {
+		l.changes = l.changes[len(l.changes)-l.size:]
+	}
+	close(l.updated)
+	l.updated = make(chan struct{})
+}
+
+// reset starts a new epoch, so that followers fetch a new snapshot, when the data has been replaced without recording
+// the changes
+func (l *changeLog) reset() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.epoch = newEpoch()
+	l.changes = nil
+	close(l.updated)
+	l.updated = make(chan struct{})
+}
+
+// position returns the epoch and the sequence number of the latest change
+func (l *changeLog) position() (string, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.epoch, l.seq
+}
+
+// since returns the changes in the epoch after the specified sequence number, the sequence number of the latest
+// change, and a channel closed when another is recorded. It returns false if the log no longer holds every change
+// after the sequence number
+func (l *changeLog) since(epoch string, after uint64) ([]change, uint64, <-chan struct{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	oldest := l.seq - uint64(len(l.changes)) + 1
+	if epoch != l.epoch || after > l.seq || after+1 < oldest {
+		return nil, l.seq, nil, false
+	}
+	changes := make([]change, l.seq-after)
+	copy(changes, l.changes[len(l.changes)-len(changes):])
+	return changes, l.seq, l.updated, true
+}
+
+// replicationSnapshot is the data at a position in the change log
+type replicationSnapshot struct {
+	Epoch string                 `json:"epoch"`
+	Seq   uint64                 `json:"seq"`
+	Data  map[string]interface{} `json:"data"`
+}
+
+// replicationHeartbeatObj tells a follower the sequence number of the latest change
+type replicationHeartbeatObj struct {
+	Seq uint64 `json:"seq"`
+}
+
+// handleReplicationSnapshot responds with the data and the position in the change log it was read at, from which a
+// follower streams the changes since
+func handleReplicationSnapshot(repo repository.Store, writeMu *sync.RWMutex, log *changeLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorised(r, auth.PermissionAdmin, "") {
+			writeForbidden(w)
+			return
+		}
+		annotate(r, "", "replicate")
+
+		// Changes are recorded while writes are serialised, so holding the lock reads the data at a position in the log
+		snapshot := replicationSnapshot{}
+		ctx, done, err := beginWrite(r.Context(), repo, writeMu)
+		if err == nil {
+			snapshot.Data, err = repo.ReadData(ctx)
+			snapshot.Epoch, snapshot.Seq = log.position()
+			done()
+		}
+		var respBody []byte
+		if err == nil {
+			respBody, err = json.Marshal(snapshot)
+		}
+		if err != nil {
+			respBody, respCode := unexpectedError(r, err)
+			w.Header().Add(contentType, contentTypeText)
+			w.WriteHeader(respCode)
+			fmt.Fprint(w, respBody)
+			return
+		}
+		w.Header().Add(contentType, contentTypeJson)
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBody)
+	}
+}
+
+// handleReplicationStream streams the changes in the epoch given by the query after the sequence number it gives as
+// server-sent events, with a heartbeat giving the latest sequence number at intervals, until the client disconnects
+// or shutdown is closed. If the changes are no longer held it responds 410, and the follower must fetch a new snapshot
+func handleReplicationStream(log *changeLog, shutdown <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorised(r, auth.PermissionAdmin, "") {
+			writeForbidden(w)
+			return
+		}
+		annotate(r, "", "replicate")
+
+		epoch := r.URL.Query().Get("epoch")
+		after, err := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+		changes, seq, updated, ok := log.since(epoch, after)
+		if err != nil || !ok {
+			w.Header().Add(contentType, contentTypeText)
+			w.WriteHeader(http.StatusGone)
+			fmt.Fprint(w, errorReplicationGone)
+			return
+		}
+
+		// The stream outlives the server's write timeout
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Time{})
+		w.Header().Add(contentType, contentTypeEventStream)
+		w.Header().Add("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		heartbeat := time.NewTicker(replicationHeartbeat)
+		defer heartbeat.Stop()
+		send := func(event string, v interface{}) bool {
+			data, _ := json.Marshal(v)
+			_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+			return err == nil
+		}
+		if !send("heartbeat", replicationHeartbeatObj{Seq: seq}) {
+			return
+		}
+		for {
+			for _, c := range changes {
+				if !send("change", c) {
+					return
+				}
+				after = c.Seq
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+
+			select {
+			case <-updated:
+			case <-heartbeat.C:
+				if !send("heartbeat", replicationHeartbeatObj{Seq: seq}) {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			case <-shutdown:
+				return
+			}
+			// A follower which falls so far behind that its next change is dropped from the log must fetch a snapshot
+			if changes, seq, updated, ok = log.since(epoch, after); !ok {
+				return
+			}
+		}
+	}
+}
+
+// replicationStatus describes the replication of the data to or from the server
+type replicationStatus struct {
+	Role string `json:"role"`
+	// Epoch and Seq are the position of a leader's latest change, or of the change a follower last applied
+	Epoch string `json:"epoch,omitempty"`
+	Seq   uint64 `json:"seq"`
+	// Leader is the URL of a follower's leader
+	Leader string `json:"leader,omitempty"`
+	// LeaderSeq is the sequence number of the leader's latest change, as last heard by a follower
+	LeaderSeq uint64 `json:"leaderSeq,omitempty"`
+	// Lag is the number of the leader's changes which a follower has not applied
+	Lag uint64 `json:"lag"`
+	// Connected is set while a follower is streaming changes from its leader
+	Connected bool `json:"connected"`
+	// LastContact is when a follower last heard from its leader
+	LastContact string `json:"lastContact,omitempty"`
+	// Error is the reason a follower last failed to replicate, if it has not since succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// handleReplicationStatus responds with the replication status of a follower, or else of the leader's change log
+func handleReplicationStatus(log *changeLog, f *follower) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorised(r, auth.PermissionAdmin, "") {
+			writeForbidden(w)
+			return
+		}
+		annotate(r, "", "replication")
+
+		status := replicationStatus{Role: "leader"}
+		if f != nil {
+			status = f.status()
+		} else if log != nil {
+			status.Epoch, status.Seq = log.position()
+		}
+		respBody, _ := json.Marshal(status)
+		w.Header().Add(contentType, contentTypeJson)
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBody)
+	}
+}
+
+// follower replicates the data of a leader into its store: it restores a snapshot of the leader's data, then applies
+// each change streamed from the leader's change log. Writes are rejected, or forwarded to the leader
+type follower struct {
+	leader  *url.URL
+	token   string
+	forward *httputil.ReverseProxy
+	client  *http.Client
+	repo    repository.Store
+	writeMu *sync.RWMutex
+	ws      *watchers
+	logger  *slog.Logger
+
+	mu          sync.Mutex
+	epoch       string
+	applied     uint64
+	leaderSeq   uint64
+	synced      bool
+	connected   bool
+	lastContact time.Time
+	err         error
+}
+
+func newFollower(leader *url.URL, token string, forwardWrites bool, repo repository.Store, writeMu *sync.RWMutex, ws *watchers, logger *slog.Logger) *follower {
+	f := &follower{leader: leader, token: token, client: &http.Client{}, repo: repo, writeMu: writeMu, ws: ws, logger: logger}
+	if forwardWrites {
+		f.forward = httputil.NewSingleHostReverseProxy(leader)
+	}
+	return f
+}
+
+// readOnly wraps the specified handler so that a follower rejects writes, or forwards them to its leader, which
+// authenticates them itself
+func (f *follower) readOnly(handler http.HandlerFunc) http.HandlerFunc {
+	if f == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !writes(r) {
+			handler(w, r)
+			return
+		}
+		if f.forward != nil {
+			annotate(r, "", "forward")
+			f.forward.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add(contentType, contentTypeText)
+		w.WriteHeader(http.StatusMisdirectedRequest)
+		fmt.Fprint(w, errorFollower)
+	}
+}
+
+// writes reports whether the request modifies the data, or the API keys, snapshots or cluster membership, which are
+// managed by the leader
+func writes(r *http.Request) bool {
+	switch path := strings.TrimSuffix(r.URL.Path, "/"); {
+	case path == "/api" || strings.HasPrefix(path, "/api/"):
+		return r.Method != http.MethodGet && r.Method != http.MethodHead
+	case path == "/admin/import" || path == "/admin/verify" || path == "/admin/compact" || path == "/admin/snapshot":
+		return r.Method == http.MethodPost
+	case path == "/admin/keys" || strings.HasPrefix(path, "/admin/keys/") || strings.HasPrefix(path, "/admin/cluster/"):
+		return r.Method == http.MethodPost || r.Method == http.MethodDelete
+	}
+	return false
+}
+
+// run replicates the leader's data until shutdown is closed, reconnecting after any error
+func (f *follower) run(shutdown <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		err := f.replicate(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errReplicationGone) {
+			// Start again from a new snapshot
+			f.logger.Info("fetching a new snapshot from the leader", "reason", err)
+			f.mu.Lock()
+			f.epoch = ""
+			f.mu.Unlock()
+			continue
+		}
+		f.mu.Lock()
+		f.err = err
+		f.mu.Unlock()
+		if err != nil {
+			f.logger.Warn("replicating from the leader", "leader", f.leader.String(), "error", err)
+		}
+		select {
+		case <-time.After(replicationRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// replicate restores a snapshot of the leader's data if there is no epoch to continue, then applies the changes the
+// leader streams until the stream ends
+func (f *follower) replicate(ctx context.Context) error {
+	f.mu.Lock()
+	epoch, applied := f.epoch, f.applied
+	f.mu.Unlock()
+	if epoch == "" {
+		var err error
+		if epoch, applied, err = f.restore(ctx); err != nil {
+			return err
+		}
+	}
+
+	query := url.Values{"epoch": {epoch}, "after": {strconv.FormatUint(applied, 10)}}
+	resp, err := f.get(ctx, "/replication/stream?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return errReplicationGone
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("streaming changes: leader responded %s", resp.Status)
+	}
+	f.setConnected(true)
+	defer f.setConnected(false)
+
+	var event string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := []byte(strings.TrimPrefix(line, "data: "))
+			switch event {
+			case "heartbeat":
+				var heartbeat replicationHeartbeatObj
+				if err := json.Unmarshal(data, &heartbeat); err != nil {
+					return err
+				}
+				f.heard(heartbeat.Seq)
+			case "change":
+				var c change
+				if err := json.Unmarshal(data, &c); err != nil {
+					return err
+				}
+				if c.Seq != applied+1 {
+					return fmt.Errorf("%w: expected change %d but received %d", errReplicationGone, applied+1, c.Seq)
+				}
+				if err := f.apply(ctx, c); err != nil {
+					return err
+				}
+				applied = c.Seq
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("the leader ended the stream")
+}
+
+// restore replaces the data with a snapshot of the leader's, returning its position in the leader's change log
+func (f *follower) restore(ctx context.Context) (string, uint64, error) {
+	resp, err := f.get(ctx, "/replication/snapshot")
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("fetching a snapshot: leader responded %s", resp.Status)
+	}
+	var snapshot replicationSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		return "", 0, fmt.Errorf("fetching a snapshot: %w", err)
+	}
+
+	writeCtx, done, err := beginWrite(ctx, f.repo, f.writeMu)
+	if err != nil {
+		return "", 0, err
+	}
+	defer done()
+	if err := f.repo.WriteData(writeCtx, snapshot.Data); err != nil {
+		return "", 0, err
+	}
+	// Followers of this server cannot apply a change to the snapshot, so must fetch a new one too
+	f.ws.log.reset()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.epoch, f.applied, f.synced = snapshot.Epoch, snapshot.Seq, true
+	f.leaderSeq = max(f.leaderSeq, snapshot.Seq)
+	f.lastContact = time.Now()
+	f.logger.Info("restored a snapshot from the leader", "leader", f.leader.String(), "seq", snapshot.Seq, "keys", len(snapshot.Data))
+	return snapshot.Epoch, snapshot.Seq, nil
+}
+
+// apply makes the change to the data, sending appended events to watchers as the leader did
+func (f *follower) apply(ctx context.Context, c change) error {
+	ctx, done, err := beginWrite(ctx, f.repo, f.writeMu)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if c.Removed {
+		// Keys are only removed by repairs, so the rare removal rewrites the whole data
+		dataMap, err := f.repo.ReadData(ctx)
+		if err != nil {
+			return err
+		}
+		delete(dataMap, c.Key)
+		if err := f.repo.WriteData(ctx, dataMap); err != nil {
+			return err
+		}
+		f.ws.remove(c.Key)
+	} else {
+		dataMap, err := readKeys(ctx, f.repo, nil, c.Key)
+		if err != nil {
+			return err
+		}
+		array := []interface{}{}
+		if keyArray, exists := dataMap[c.Key]; exists && !c.Replace {
+			if array, err = sliceFromArray(keyArray); err != nil {
+				return err
+			}
+		}
+		dataMap[c.Key] = append(array, arrayFromEvents(c.Events)...)
+		if err := writeKeys(ctx, f.repo, dataMap, c.Key); err != nil {
+			return err
+		}
+		if c.Replace {
+			f.ws.rewrite(c.Key, c.Events)
+		} else {
+			for _, event := range c.Events {
+				f.ws.publish(c.Key, event)
+			}
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.applied = c.Seq
+	f.leaderSeq = max(f.leaderSeq, c.Seq)
+	f.lastContact = time.Now()
+	f.err = nil
+	return nil
+}
+
+// get requests the specified path from the leader, authenticated with the follower's token
+func (f *follower) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(f.leader.String(), "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+	return f.client.Do(req)
+}
+
+// heard records a heartbeat from the leader giving the sequence number of its latest change
+func (f *follower) heard(seq uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.leaderSeq = max(f.leaderSeq, seq)
+	f.lastContact = time.Now()
+	f.err = nil
+}
+
+func (f *follower) setConnected(connected bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected = connected
+}
+
+// status returns the follower's replication status
+func (f *follower) status() replicationStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := replicationStatus{
+		Role:      "follower",
+		Epoch:     f.epoch,
+		Seq:       f.applied,
+		Leader:    f.leader.String(),
+		LeaderSeq: f.leaderSeq,
+		Connected: f.connected,
+	}
+	if f.leaderSeq > f.applied {
+		status.Lag = f.leaderSeq - f.applied
+	}
+	if !f.lastContact.IsZero() {
+		status.LastContact = f.lastContact.UTC().Format(time.RFC3339Nano)
+	}
+	if f.err != nil {
+		status.Error = f.err.Error()
+	}
+	return status
+}
+
+// check returns an error until the follower has restored a snapshot of the leader's data
+func (f *follower) check() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.synced {
+		if f.err != nil {
+			return fmt.Errorf("not yet replicated from the leader: %w", f.err)
+		}
+		return errors.New("not yet replicated from the leader")
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"encoding/json"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/repository"
+	"its-dave/simple-crud-rest-server/snapshot"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startFollower starts a follower of the leader at the specified URL with a new data file, returning its mux
+func startFollower(t *testing.T, leader string, token string, forwardWrites bool) *http.ServeMux {
+	leaderURL, err := url.Parse(leader)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	repo := &repository.Repo{}
+	repo.SetDataFilePath(filepath.Join(t.TempDir(), "follower.json"))
+	shutdown := make(chan struct{})
+	t.Cleanup(func() { close(shutdown) })
+	return Create(repo, WithShutdown(shutdown), WithReplicationLog(100), WithFollower(leaderURL, token, forwardWrites))
+}
+
+// replicationStatusOf returns the replication status reported by the specified mux
+func replicationStatusOf(t *testing.T, mux *http.ServeMux) replicationStatus {
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/admin/replication", nil))
+	var status replicationStatus
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &status))
+	return status
+}
+
+// awaitReplication waits until the follower has applied every change made by the leader
+func awaitReplication(t *testing.T, leader, follower *http.ServeMux) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		leaderStatus, followerStatus := replicationStatusOf(t, leader), replicationStatusOf(t, follower)
+		return followerStatus.Connected && followerStatus.Seq == leaderStatus.Seq
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplication(t *testing.T) {
+	repo := initialiseData(t, `{"key1":[{"event":"create","value":"value1"}],"key2":[{"event":"create","value":"value1"},{"event":"delete","value":""}]}`)
+	shutdown := make(chan struct{})
+	leaderMux := Create(repo, WithShutdown(shutdown), WithReplicationLog(100), WithRetention(0, RetentionPolicy{Prefix: "compacted", KeepLast: 1}))
+	leader := httptest.NewServer(leaderMux)
+	// The leader's replication streams end on shutdown, which must come first for the server to close
+	defer leader.Close()
+	defer close(shutdown)
+
+	// Changes made before the follower starts are restored from a snapshot
+	requestAndCheckResponse(t, leaderMux, http.MethodPut, "/api/key1", "value2", contentTypeText, http.StatusNoContent, "", contentTypeText)
+	followerMux := startFollower(t, leader.URL, "", false)
+	awaitReplication(t, leaderMux, followerMux)
+	requestAndCheckResponse(t, followerMux, http.MethodGet, "/api/key1", "", "", http.StatusOK, "value2", contentTypeText)
+	requestAndCheckResponse(t, followerMux, http.MethodGet, "/api/key2/history", "", "", http.StatusOK, `[{"event":"create","value":"value1"},{"event":"delete","value":""}]`, contentTypeJson)
+	requestAndCheckResponse(t, followerMux, http.MethodGet, "/readyz", "", "", http.StatusOK, `{"status":"ok","checks":{"initialisation":{"status":"ok"},"replication":{"status":"ok"},"storage":{"status":"ok"}}}`, contentTypeJson)
+
+	// Later changes are streamed to the follower in order
+	requestAndCheckResponse(t, leaderMux, http.MethodPost, "/api", `{"key3":"value1"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+	requestAndCheckResponse(t, leaderMux, http.MethodPost, "/api", `{"compacted":"value1"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+	requestAndCheckResponse(t, leaderMux, http.MethodPut, "/api/compacted", "value2", contentTypeText, http.StatusNoContent, "", contentTypeText)
+	requestAndCheckResponse(t, leaderMux, http.MethodPut, "/api/compacted", "value3", contentTypeText, http.StatusNoContent, "", contentTypeText)
+	requestAndCheckResponse(t, leaderMux, http.MethodDelete, "/api/key1", "", "", http.StatusNoContent, "", contentTypeText)
+	requestAndCheckResponse(t, leaderMux, http.MethodPost, "/admin/import?mode=replace", `{"key":"key2","events":[{"event":"create","value":"imported"}]}`, contentTypeNDJSON, http.StatusOK, `{"dryRun":false,"created":0,"merged":0,"replaced":1,"skipped":0}`, contentTypeJson)
+	requestAndCheckResponse(t, leaderMux, http.MethodPost, "/admin/compact", "", "", http.StatusOK, `{"keys":[{"key":"compacted","removed":1,"kept":2}],"removed":1}`, contentTypeJson)
+	awaitReplication(t, leaderMux, followerMux)
+	for _, key := range []string{"key1", "key2", "key3", "compacted"} {
+		resp := httptest.NewRecorder()
+		leaderMux.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/api/"+key+"/history", nil))
+		requestAndCheckResponse(t, followerMux, http.MethodGet, "/api/"+key+"/history", "", "", http.StatusOK, resp.Body.String(), contentTypeJson)
+	}
+
+	status := replicationStatusOf(t, followerMux)
+	assert.Equal(t, "follower", status.Role)
+	assert.Equal(t, leader.URL, status.Leader)
+	assert.Equal(t, uint64(0), status.Lag)
+	assert.NotEmpty(t, status.LastContact)
+	assert.Empty(t, status.Error)
+
+	// The follower rejects writes
+	requestAndCheckResponse(t, followerMux, http.MethodPut, "/api/key3", "value2", contentTypeText, http.StatusMisdirectedRequest, errorFollower, contentTypeText)
+	requestAndCheckResponse(t, followerMux, http.MethodPost, "/api", `{"key4":"value1"}`, contentTypeJson, http.StatusMisdirectedRequest, errorFollower, contentTypeText)
+	requestAndCheckResponse(t, followerMux, http.MethodPost, "/admin/import", `{"key":"key4","events":[{"event":"create","value":"value1"}]}`, contentTypeNDJSON, http.StatusMisdirectedRequest, errorFollower, contentTypeText)
+	requestAndCheckResponse(t, followerMux, http.MethodGet, "/api/key4", "", "", http.StatusNotFound, "", contentTypeText)
+}
+
+func TestReplicationForwardWrites(t *testing.T) {
+	repo := initialiseData(t, `{"key1":[{"event":"create","value":"value1"}]}`)
+	keyStore, err := auth.NewKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	assert.NoError(t, err)
+	adminToken, _, err := keyStore.Create("replica", []auth.Grant{{Permission: auth.PermissionAdmin}})
+	assert.NoError(t, err)
+	writeToken, _, err := keyStore.Create("rw", []auth.Grant{{Permission: auth.PermissionRead}, {Permission: auth.PermissionWrite}})
+	assert.NoError(t, err)
+	shutdown := make(chan struct{})
+	leaderMux := Create(repo, WithShutdown(shutdown), WithReplicationLog(100), WithAPIKeys(keyStore))
+	leader := httptest.NewServer(leaderMux)
+	// The leader's replication streams end on shutdown, which must come first for the server to close
+	defer leader.Close()
+	defer close(shutdown)
+
+	// Replication requires an admin key
+	authRequestAndCheckResponse(t, leaderMux, writeToken, http.MethodGet, "/replication/snapshot", "", "", http.StatusForbidden, errorForbidden)
+
+	followerMux := startFollower(t, leader.URL, adminToken, true)
+	assert.Eventually(t, func() bool {
+		return replicationStatusOf(t, followerMux).Connected
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Writes to the follower are made by the leader, with the caller's credentials, then replicated back
+	authRequestAndCheckResponse(t, followerMux, writeToken, http.MethodPut, "/api/key1", "value2", contentTypeText, http.StatusNoContent, "")
+	requestAndCheckResponse(t, followerMux, http.MethodPut, "/api/key1", "value3", contentTypeText, http.StatusUnauthorized, errorUnauthorised, contentTypeText)
+	assert.Eventually(t, func() bool {
+		resp := httptest.NewRecorder()
+		followerMux.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/api/key1", nil))
+		return resp.Body.String() == "value2"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplicationRejectsAdminWrites(t *testing.T) {
+	repo := initialiseData(t, "{}")
+	shutdown := make(chan struct{})
+	leader := httptest.NewServer(Create(repo, WithShutdown(shutdown), WithReplicationLog(100)))
+	// The leader's replication streams end on shutdown, which must come first for the server to close
+	defer leader.Close()
+	defer close(shutdown)
+	leaderURL, err := url.Parse(leader.URL)
+	assert.NoError(t, err)
+	keyStore, err := auth.NewKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	assert.NoError(t, err)
+	adminToken, adminKey, err := keyStore.Create("admin", []auth.Grant{{Permission: auth.PermissionAdmin}})
+	assert.NoError(t, err)
+	followerRepo := &repository.Repo{}
+	followerRepo.SetDataFilePath(filepath.Join(t.TempDir(), "follower.json"))
+	followerShutdown := make(chan struct{})
+	defer close(followerShutdown)
+	followerMux := Create(followerRepo, WithShutdown(followerShutdown), WithReplicationLog(100), WithFollower(leaderURL, "", false), WithAPIKeys(keyStore), WithSnapshots(0, snapshot.NewStore(t.TempDir(), snapshot.Retention{})))
+
+	// API keys and snapshots are managed by the leader, but can be read
+	authRequestAndCheckResponse(t, followerMux, adminToken, http.MethodPost, "/admin/keys", `{"name":"ci","grants":[{"permission":"read"}]}`, contentTypeJson, http.StatusMisdirectedRequest, errorFollower)
+	authRequestAndCheckResponse(t, followerMux, adminToken, http.MethodDelete, "/admin/keys/"+adminKey.ID, "", "", http.StatusMisdirectedRequest, errorFollower)
+	authRequestAndCheckResponse(t, followerMux, adminToken, http.MethodPost, "/admin/snapshot", "", "", http.StatusMisdirectedRequest, errorFollower)
+	assert.Equal(t, http.StatusOK, authRequest(t, followerMux, adminToken, http.MethodGet, "/admin/keys", "", "").Code)
+	assert.Len(t, keyStore.List(), 1)
+}
+
+func TestReplicationLag(t *testing.T) {
+	// The lag is the number of changes the leader has recorded which the follower has not applied
+	f := &follower{leader: &url.URL{Scheme: "http", Host: "leader"}, epoch: "epoch", applied: 7}
+	f.heard(10)
+	status := f.status()
+	assert.Equal(t, uint64(10), status.LeaderSeq)
+	assert.Equal(t, uint64(3), status.Lag)
+	assert.NotEmpty(t, status.LastContact)
+
+	// The follower reports an error, and is not ready, while it cannot reach its leader
+	leader := httptest.NewServer(http.NotFoundHandler())
+	leader.Close()
+	unreachable := startFollower(t, leader.URL, "", false)
+	assert.Eventually(t, func() bool {
+		return replicationStatusOf(t, unreachable).Error != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	resp := httptest.NewRecorder()
+	unreachable.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.Code)
+	assert.Contains(t, resp.Body.String(), "not yet replicated from the leader")
+}
+
+func TestChangeLog(t *testing.T) {
+	log := newChangeLog(2)
+	epoch, seq := log.position()
+	changes, _, _, ok := log.since(epoch, seq)
+	assert.True(t, ok)
+	assert.Empty(t, changes)
+
+	updated := func() <-chan struct{} {
+		_, _, updated, _ := log.since(epoch, 0)
+		return updated
+	}()
+	log.record(change{Key: "key1", Events: []eventObj{{Event: "create", Value: "value1"}}})
+	select {
+	case <-updated:
+	default:
+		assert.Fail(t, "a recorded change should wake streams")
+	}
+	log.record(change{Key: "key1", Events: []eventObj{{Event: "update", Value: "value2"}}})
+	log.record(change{Key: "key1", Removed: true})
+
+	// Only the latest changes are held
+	changes, seq, _, ok = log.since(epoch, 1)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(3), seq)
+	assert.Equal(t, []change{
+		{Seq: 2, Key: "key1", Events: []eventObj{{Event: "update", Value: "value2"}}},
+		{Seq: 3, Key: "key1", Removed: true},
+	}, changes)
+	_, _, _, ok = log.since(epoch, 0)
+	assert.False(t, ok)
+	_, _, _, ok = log.since(epoch, 4)
+	assert.False(t, ok)
+	_, _, _, ok = log.since("other", 3)
+	assert.False(t, ok)
+
+	// A reset starts a new epoch
+	log.reset()
+	newEpoch, seq := log.position()
+	assert.NotEqual(t, epoch, newEpoch)
+	_, _, _, ok = log.since(epoch, 3)
+	assert.False(t, ok)
+	changes, _, _, ok = log.since(newEpoch, seq)
+	assert.True(t, ok)
+	assert.Empty(t, changes)
+}
+
+func TestWrites(t *testing.T) {
+	for _, test := range []struct {
+		method, path string
+		writes       bool
+	}{
+		{http.MethodGet, "/api", false},
+		{http.MethodPost, "/api", true},
+		{http.MethodPost, "/api/", true},
+		{http.MethodGet, "/api/key1/history", false},
+		{http.MethodPut, "/api/key1", true},
+		{http.MethodPatch, "/api/key1", true},
+		{http.MethodDelete, "/api/key1", true},
+		{http.MethodGet, "/admin/verify", false},
+		{http.MethodPost, "/admin/verify", true},
+		{http.MethodPost, "/admin/import", true},
+		{http.MethodPost, "/admin/snapshot", true},
+		{http.MethodGet, "/admin/keys", false},
+		{http.MethodPost, "/admin/keys", true},
+		{http.MethodDelete, "/admin/keys/id", true},
+		{http.MethodGet, "/watch", false},
+		{http.MethodGet, "/admin/cluster", false},
+		{http.MethodPost, "/admin/cluster/transfer", true},
+		{http.MethodDelete, "/admin/cluster/members/b", true},
+	} {
+		assert.Equal(t, test.writes, writes(httptest.NewRequest(test.method, test.path, strings.NewReader(""))), test.method+" "+test.path)
+	}
+}
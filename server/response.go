@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net/http"
+)
+
+// responseRecorder records the status code and size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *responseRecorder) Write(b []byte) (int, error) {
+	n, err := recorder.ResponseWriter.Write(b)
+	recorder.bytes += n
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer
+func (recorder *responseRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/raft"
+	"its-dave/simple-crud-rest-server/repository"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetentionPolicy limits the history kept for the keys with a prefix or in a namespace; limits which are zero are not
+// applied. The latest event of a key, which holds its current value, is never removed
+type RetentionPolicy struct {
+	// Prefix is the prefix of the keys the policy applies to, unless Namespace is set
+	Prefix string `json:"prefix,omitempty"`
+	// Namespace is the namespace of the keys the policy applies to
+	Namespace string `json:"namespace,omitempty"`
+	// KeepLast is the number of most recent events to keep
+	KeepLast int `json:"keepLast,omitempty"`
+	// MaxAge is the age beyond which events are removed
+	MaxAge Duration `json:"maxAge,omitempty"`
+	// CompactAfter is the age beyond which events are collapsed into a single snapshot event holding the value they
+	// left the key with
+	CompactAfter Duration `json:"compactAfter,omitempty"`
+}
+
+// Duration is a time.Duration written as a string such as "720h" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// applies reports whether the policy applies to the specified key
+func (p RetentionPolicy) applies(key string) bool {
+	if p.Namespace != "" {
+		return auth.Namespace(key) == p.Namespace
+	}
+	return strings.HasPrefix(key, p.Prefix)
+}
+
+// apply returns the history which the policy keeps of the specified events at the specified time. Events removed from
+// the start of a history are replaced by a snapshot event holding the value they left the key with, unless the events
+// kept begin with a create and so do not depend on it. Events recorded without a time are never older than a limit
+func (p RetentionPolicy) apply(events []eventObj, now time.Time) []eventObj {
+	// An earlier compaction's snapshot is replaced, rather than counted as an event
+	var base *eventObj
+	history := events
+	if len(history) > 0 && history[0].Event == eventSnapshot {
+		base, history = &history[0], history[1:]
+	}
+	if len(history) < 2 {
+		return events
+	}
+	// The latest event holds the current value, so is always kept
+	older := history[:len(history)-1]
+
+	removed := 0
+	if p.KeepLast > 0 && len(history) > p.KeepLast {
+		removed = len(history) - p.KeepLast
+	}
+	if p.MaxAge > 0 {
+		removed = max(removed, countOlder(older, now.Add(-time.Duration(p.MaxAge))))
+	}
+	collapsed := removed
+	if p.CompactAfter > 0 {
+		collapsed = max(collapsed, countOlder(older, now.Add(-time.Duration(p.CompactAfter))))
+	}
+	if collapsed == 0 {
+		return events
+	}
+
+	kept := history[collapsed:]
+	if collapsed > removed || kept[0].Event == "update" || kept[0].Event == "delete" {
+		last := history[collapsed-1]
+		base = &eventObj{Event: eventSnapshot, Value: last.Value, Time: last.Time}
+	} else {
+		base = nil
+	}
+	compacted := make([]eventObj, 0, len(kept)+1)
+	if base != nil {
+		compacted = append(compacted, *base)
+	}
+	compacted = append(compacted, kept...)
+	if len(compacted) >= len(events) {
+		// A history is only rewritten when it is shortened
+		return events
+	}
+	return compacted
+}
+
+// countOlder returns the number of events at the start of the history recorded before the cutoff
+func countOlder(events []eventObj, cutoff time.Time) int {
+	for i, event := range events {
+		recorded, err := time.Parse(time.RFC3339Nano, event.Time)
+		if err != nil || !recorded.Before(cutoff) {
+			return i
+		}
+	}
+	return len(events)
+}
+
+// eventSnapshot is the type of event which holds the value left by the events it replaced
+const eventSnapshot = "snapshot"
+
+// clock returns the time to record on each event, if events are timed
+type clock func() time.Time
+
+// stamp returns the time to record on a new event, or an empty string if events are not timed
+func (c clock) stamp() string {
+	if c == nil {
+		return ""
+	}
+	return c().UTC().Format(time.RFC3339Nano)
+}
+
+// now returns the current time, which is the system time if events are not timed
+func (c clock) now() time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c()
+}
+
+// compactedKey is the history removed from a key by compaction
+type compactedKey struct {
+	Key     string `json:"key"`
+	Removed int    `json:"removed"`
+	Kept    int    `json:"kept"`
+}
+
+// compactionReport is the result of compacting every key
+type compactionReport struct {
+	Keys    []compactedKey `json:"keys"`
+	Removed int            `json:"removed"`
+}
+
+// compactor applies retention policies to the stored history
+type compactor struct {
+	repo     repository.Store
+	policies []RetentionPolicy
+	writeMu  *sync.RWMutex
+	ws       *watchers
+	now      func() time.Time
+}
+
+// compact applies the first policy which applies to each key, rewriting the data if any history was shortened.
+// Histories which verification would report a problem with are left alone, as compacting them could hide it
+func (c *compactor) compact(ctx context.Context) (compactionReport, error) {
+	report := compactionReport{Keys: []compactedKey{}}
+	compactedEvents := map[string][]eventObj{}
+
+	ctx, done, err := beginWrite(ctx, c.repo, c.writeMu)
+	if err != nil {
+		return report, err
+	}
+	defer done()
+	dataMap, err := c.repo.ReadData(ctx)
+	if err != nil {
+		return report, err
+	}
+	invalid := map[string]bool{}
+	for _, p := range verifyData(dataMap).Problems {
+		invalid[p.Key] = true
+	}
+	keys := make([]string, 0, len(dataMap))
+	for key := range dataMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := c.now()
+	for _, key := range keys {
+		policy, ok := c.policyFor(key)
+		if !ok || invalid[key] {
+			continue
+		}
+		array, err := sliceFromArray(dataMap[key])
+		if err != nil {
+			return report, err
+		}
+		events, err := eventsFromSlice(array)
+		if err != nil {
+			return report, err
+		}
+		compacted := policy.apply(events, now)
+		if len(compacted) == len(events) {
+			continue
+		}
+		dataMap[key] = arrayFromEvents(compacted)
+		compactedEvents[key] = compacted
+		report.Keys = append(report.Keys, compactedKey{Key: key, Removed: len(events) - len(compacted), Kept: len(compacted)})
+		report.Removed += len(events) - len(compacted)
+	}
+
+	if len(report.Keys) > 0 {
+		if err := c.repo.WriteData(ctx, dataMap); err != nil {
+			return compactionReport{Keys: []compactedKey{}}, err
+		}
+		for _, compacted := range report.Keys {
+			c.ws.rewrite(compacted.Key, compactedEvents[compacted.Key])
+		}
+	}
+	return report, nil
+}
+
+// policyFor returns the first policy which applies to the specified key, if any
+func (c *compactor) policyFor(key string) (RetentionPolicy, bool) {
+	for _, policy := range c.policies {
+		if policy.applies(key) {
+			return policy, true
+		}
+	}
+	return RetentionPolicy{}, false
+}
+
+// run compacts the history at the specified interval until shutdown is closed, logging what was removed
+func (c *compactor) run(interval time.Duration, shutdown <-chan struct{}, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-ticker.C:
+		}
+		report, err := c.compact(context.Background())
+		if errors.Is(err, raft.ErrNotLeader) {
+			// The history of a member of a cluster is compacted by its leader
+			continue
+		}
+		if err != nil {
+			logger.Error("compacting history", "error", err)
+			continue
+		}
+		if report.Removed > 0 {
+			logger.Info("compacted history", "keys", len(report.Keys), "removed", report.Removed)
+		}
+	}
+}
+
+// handleCompact applies the retention policies now, responding with what was removed from each key
+func handleCompact(c *compactor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorised(r, auth.PermissionAdmin, "") {
+			writeForbidden(w)
+			return
+		}
+		annotate(r, "", "compact")
+
+		report, err := c.compact(r.Context())
+		var respBody []byte
+		if err == nil {
+			respBody, err = json.Marshal(report)
+		}
+		if err != nil {
+			respBody, respCode := unexpectedError(r, err)
+			w.Header().Add(contentType, contentTypeText)
+			w.WriteHeader(respCode)
+			fmt.Fprint(w, respBody)
+			return
+		}
+		w.Header().Add(contentType, contentTypeJson)
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBody)
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	repo := initialiseData(t, `{
+		"team-a:key1":[
+			{"event":"create","value":"v1","time":"2024-05-01T00:00:00Z"},
+			{"event":"update","value":"v2","time":"2024-05-01T01:00:00Z"},
+			{"event":"update","value":"v3","time":"2024-05-01T02:00:00Z"},
+			{"event":"delete","value":"","time":"2024-05-01T03:00:00Z"}
+		],
+		"team-a:key2":[
+			{"event":"create","value":"v1"},
+			{"event":"delete","value":""},
+			{"event":"create","value":"v2"},
+			{"event":"update","value":"v3"}
+		],
+		"logs:key1":[
+			{"event":"create","value":"a","time":"2024-05-01T00:00:00Z"},
+			{"event":"update","value":"b","time":"2024-05-01T01:00:00Z"},
+			{"event":"update","value":"c","time":"2024-05-01T11:00:00Z"},
+			{"event":"update","value":"d","time":"2024-05-01T11:30:00Z"}
+		],
+		"key3":[
+			{"event":"create","value":"x","time":"2024-05-01T00:00:00Z"},
+			{"event":"update","value":"y","time":"2024-05-01T09:00:00Z"},
+			{"event":"delete","value":"","time":"2024-05-01T09:30:00Z"},
+			{"event":"create","value":"z","time":"2024-05-01T10:30:00Z"},
+			{"event":"update","value":"w","time":"2024-05-01T11:00:00Z"}
+		],
+		"key4":[{"event":"create","value":"v1","time":"2024-05-01T00:00:00Z"}],
+		"key5":[{"event":"create","value":"v1"},{"event":"update","value":"v2"},{"event":"update","value":"v3"}],
+		"key6":[
+			{"event":"create","value":"v1","time":"2024-05-01T00:00:00Z"},
+			{"event":"delete","value":"","time":"2024-05-01T01:00:00Z"},
+			{"event":"update","value":"v2","time":"2024-05-01T02:00:00Z"}
+		]
+	}`)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	mux := Create(repo, WithClock(func() time.Time { return now }), WithRetention(0,
+		RetentionPolicy{Namespace: "team-a", KeepLast: 2},
+		RetentionPolicy{Prefix: "logs:", MaxAge: Duration(6 * time.Hour)},
+		RetentionPolicy{CompactAfter: Duration(2 * time.Hour)},
+	))
+
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/compact", "", "", http.StatusOK, `{"keys":[`+
+		`{"key":"key3","removed":2,"kept":3},`+
+		`{"key":"logs:key1","removed":1,"kept":3},`+
+		`{"key":"team-a:key1","removed":1,"kept":3},`+
+		`{"key":"team-a:key2","removed":2,"kept":2}],"removed":6}`, contentTypeJson)
+
+	// The removed events are replaced by a snapshot of the value they left, unless the history kept starts with a create
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/team-a:key1/history", "", "", http.StatusOK,
+		`[{"event":"snapshot","time":"2024-05-01T01:00:00Z","value":"v2"},{"event":"update","time":"2024-05-01T02:00:00Z","value":"v3"},{"event":"delete","time":"2024-05-01T03:00:00Z","value":""}]`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/team-a:key2/history", "", "", http.StatusOK,
+		`[{"event":"create","value":"v2"},{"event":"update","value":"v3"}]`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/logs:key1/history", "", "", http.StatusOK,
+		`[{"event":"snapshot","time":"2024-05-01T01:00:00Z","value":"b"},{"event":"update","time":"2024-05-01T11:00:00Z","value":"c"},{"event":"update","time":"2024-05-01T11:30:00Z","value":"d"}]`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key3/history", "", "", http.StatusOK,
+		`[{"event":"snapshot","time":"2024-05-01T09:30:00Z","value":""},{"event":"create","time":"2024-05-01T10:30:00Z","value":"z"},{"event":"update","time":"2024-05-01T11:00:00Z","value":"w"}]`, contentTypeJson)
+	// A single event is the current value, untimed events are never too old and invalid histories are left alone
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key4", "", "", http.StatusOK, "v1", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key5/history", "", "", http.StatusOK,
+		`[{"event":"create","value":"v1"},{"event":"update","value":"v2"},{"event":"update","value":"v3"}]`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key6/history", "", "", http.StatusOK,
+		`[{"event":"create","time":"2024-05-01T00:00:00Z","value":"v1"},{"event":"delete","time":"2024-05-01T01:00:00Z","value":""},{"event":"update","time":"2024-05-01T02:00:00Z","value":"v2"}]`, contentTypeJson)
+
+	// Compacted histories are valid, and compacting again removes nothing more
+	requestAndCheckResponse(t, mux, http.MethodGet, "/admin/verify", "", "", http.StatusOK,
+		`{"keys":7,"events":18,"problems":[{"key":"key6","event":2,"problem":"update after delete","repaired":false}]}`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/compact", "", "", http.StatusOK, `{"keys":[],"removed":0}`, contentTypeJson)
+
+	// A later snapshot replaces the earlier one
+	requestAndCheckResponse(t, mux, http.MethodPut, "/api/team-a:key2", "v4", contentTypeText, http.StatusNoContent, "", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodPut, "/api/team-a:key2", "v5", contentTypeText, http.StatusNoContent, "", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/compact", "", "", http.StatusOK, `{"keys":[{"key":"team-a:key2","removed":1,"kept":3}],"removed":1}`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodPut, "/api/team-a:key2", "v6", contentTypeText, http.StatusNoContent, "", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/compact", "", "", http.StatusOK, `{"keys":[{"key":"team-a:key2","removed":1,"kept":3}],"removed":1}`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/team-a:key2/history", "", "", http.StatusOK,
+		`[{"event":"snapshot","time":"2024-05-01T12:00:00Z","value":"v4"},{"event":"update","time":"2024-05-01T12:00:00Z","value":"v5"},{"event":"update","time":"2024-05-01T12:00:00Z","value":"v6"}]`, contentTypeJson)
+
+	requestAndCheckResponse(t, mux, http.MethodGet, "/admin/compact", "", "", http.StatusMethodNotAllowed, "", "")
+}
+
+func TestEventTimes(t *testing.T) {
+	repo := initialiseData(t, "{}")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("BST", 60*60))
+	mux := Create(repo, WithClock(func() time.Time { return now }))
+
+	requestAndCheckResponse(t, mux, http.MethodPost, "/api", `{"key1":"value1"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+	now = now.Add(90 * time.Second)
+	requestAndCheckResponse(t, mux, http.MethodPut, "/api/key1", "value2", contentTypeText, http.StatusNoContent, "", contentTypeText)
+	now = now.Add(time.Millisecond)
+	requestAndCheckResponse(t, mux, http.MethodDelete, "/api/key1", "", "", http.StatusNoContent, "", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key1/history", "", "", http.StatusOK,
+		`[{"event":"create","time":"2024-05-01T11:00:00Z","value":"value1"},{"event":"update","time":"2024-05-01T11:01:30Z","value":"value2"},{"event":"delete","time":"2024-05-01T11:01:30.001Z","value":""}]`, contentTypeJson)
+}
@@ -1,13 +1,19 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/crudpb"
 	"its-dave/simple-crud-rest-server/repository"
+	"its-dave/simple-crud-rest-server/tracing"
+	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 )
 
 const (
@@ -15,62 +21,150 @@ const (
 	contentTypeText = "text/plain"
 	contentTypeJson = "application/json"
 
-	errorUnexpected      = "Unexpected error:"
+	errorUnexpected      = "Unexpected error: see the server logs for request ID "
 	errorKeyDeleted      = "Error: the specified key has been deleted"
 	errorKeyExists       = "Error: the specified key already exists"
+	errorKeyChanged      = "Error: the specified key has changed since the version given by If-Match"
 	errorInvalidPutBody  = "Error: request body must be a single value with Content-Type text/plain"
 	errorInvalidPostBody = "Error: request body must be of the form {\"key\":\"value\"} with Content-Type application/json"
+	errorInvalidKeyBody  = "Error: request body must be of the form {\"name\":\"name\",\"grants\":[{\"permission\":\"read\",\"prefix\":\"prefix\"}]} with Content-Type application/json"
+	errorUnauthorised    = "Error: a valid API key must be provided as a bearer token"
+	errorForbidden       = "Error: the caller does not have permission for the specified key"
+	errorQuotaExceeded   = "Error: the storage quota for the key's namespace has been exceeded"
+	errorValueTooLarge   = "Error: the value is larger than the storage quota for the key's namespace"
+	errorNotReady        = "Error: the server is not ready to serve requests"
 )
 
-type eventObj struct {
-	Event string `json:"event"`
+// entryObj is a key with its current value
+type entryObj struct {
+	Key   string `json:"key"`
 	Value string `json:"value"`
 }
 
+type eventObj struct {
+	Event    string `json:"event"`
+	Value    string `json:"value"`
+	Identity string `json:"identity,omitempty"`
+	Time     string `json:"time,omitempty"`
+}
+
 // Create returns a simple rest server mux using an existing data file if found
-func Create(repo repository.Repo) *http.ServeMux {
-	if err := repo.InitialiseData(); err != nil {
-		panic(err)
+func Create(repo repository.Store, opts ...Option) *http.ServeMux {
+	o := options{
+		logger: slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// A member of a cluster proposes its writes to the cluster, and applies them to the repository once committed
+	if o.cluster != nil {
+		repo = o.cluster.store
+	}
+
+	// A failed initialisation is retried until it succeeds, with the server reporting itself unready meanwhile
+	rd := &readiness{repo: repo, cluster: o.cluster}
+	if err := rd.initialise(); err != nil {
+		o.logger.Error("initialising data store", "error", err)
+	}
+
+	var m *serverMetrics
+	if o.metrics != nil {
+		m = newServerMetrics(o.metrics, repo)
+		repo.SetObserver(m.observeStorage)
+	}
+
+	// Mutations read, modify and rewrite the whole data file, so must not run concurrently. Those of a few keys in a
+	// sharded store share the lock, holding only the locks of their shards as well
+	writeMu := &sync.RWMutex{}
+	ws := newWatchers()
+	if o.changeLogSize > 0 {
+		ws.log = newChangeLog(o.changeLogSize)
+	}
+	var f *follower
+	if o.leader != nil {
+		f = newFollower(o.leader, o.leaderToken, o.forwardWrites, repo, writeMu, ws, o.logger)
+		rd.replica = f
+		go f.run(o.shutdown)
+	}
+	if o.cluster != nil {
+		o.cluster.store.ws = ws
+		o.cluster.node.Start()
+	}
+	svc := &service{repo: repo, quotas: o.quotas, clock: o.clock, writeMu: writeMu, ws: ws}
+	if o.grpc != nil {
+		crudpb.RegisterCrudServer(o.grpc, &grpcServer{
+			svc:           svc,
+			authenticator: o.authenticator,
+			rd:            rd,
+			f:             f,
+			cluster:       o.cluster,
+			logger:        o.logger,
+			tracer:        o.tracer,
+			shutdown:      o.shutdown,
+		})
 	}
 
-	handlePostFunc := func(w http.ResponseWriter, r *http.Request) {
-		// Create new key:value
+	handleRootFunc := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			// List keys
 
-		if r.Method != http.MethodPost {
+			respBody, respCode := handleListReq(svc, r)
+			w.Header().Add(contentType, contentTypeJson)
+			w.WriteHeader(respCode)
+			fmt.Fprint(w, respBody)
+		case http.MethodPost:
+			// Create new key:value
+
+			respBody, respCode := handleCreateReq(svc, r)
+			w.Header().Add(contentType, contentTypeText)
+			w.WriteHeader(respCode)
+			fmt.Fprint(w, respBody)
+		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
 		}
-
-		respBody, respCode := handleCreateReq(repo, r)
-		w.Header().Add(contentType, contentTypeText)
-		w.WriteHeader(respCode)
-		fmt.Fprint(w, respBody)
 	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api", handlePostFunc)
-	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, m.instrumented(logged(o.logger, traced(o.tracer, f.readOnly(o.cluster.route(authenticated(o.authenticator, rd.ready(handler))))))))
+	}
+	// Probes are not authenticated, and must respond while the server is not ready
+	mux.HandleFunc("/healthz", rd.handleLiveness)
+	mux.HandleFunc("/readyz", rd.handleReadiness)
+	// The API description is public
+	mux.HandleFunc("/openapi.json", handleOpenAPI)
+	if o.docs {
+		mux.HandleFunc("/docs", handleDocs)
+		mux.HandleFunc(swaggerUIPath, handleSwaggerUI())
+	}
+	handle("/api", handleRootFunc)
+	handle("/api/", func(w http.ResponseWriter, r *http.Request) {
 		url := strings.TrimPrefix(r.URL.Path, "/")
 		url = strings.TrimSuffix(url, "/")
 		urlParts := strings.Split(url, "/")
 		switch len(urlParts) {
 		case 1:
-			handlePostFunc(w, r)
+			handleRootFunc(w, r)
 			return
 		case 2:
 			switch r.Method {
 			case http.MethodGet:
 				// Get value for key
 
-				respBody, respCode := handleReadReq(repo, r, urlParts[1])
+				respBody, version, respCode := handleReadReq(svc, r, urlParts[1])
 				w.Header().Add(contentType, contentTypeText)
+				if version != "" {
+					w.Header().Set("ETag", version)
+				}
 				w.WriteHeader(respCode)
 				fmt.Fprint(w, respBody)
 				return
 			case http.MethodPatch, http.MethodPut:
 				// Update key:value
 
-				respBody, respCode := handleUpdateReq(repo, r, urlParts[1])
+				respBody, respCode := handleUpdateReq(svc, r, urlParts[1])
 				w.Header().Add(contentType, contentTypeText)
 				w.WriteHeader(respCode)
 				fmt.Fprint(w, respBody)
@@ -78,7 +172,7 @@ func Create(repo repository.Repo) *http.ServeMux {
 			case http.MethodDelete:
 				// Delete value for key
 
-				respBody, respCode := handleDeleteReq(repo, r, urlParts[1])
+				respBody, respCode := handleDeleteReq(svc, r, urlParts[1])
 				w.Header().Add(contentType, contentTypeText)
 				w.WriteHeader(respCode)
 				fmt.Fprint(w, respBody)
@@ -94,8 +188,7 @@ func Create(repo repository.Repo) *http.ServeMux {
 				w.WriteHeader(http.StatusNotFound)
 				return
 			}
-
-			respBody, respCode := handleHistoryReq(repo, r, urlParts[1])
+			respBody, respCode := handleHistoryReq(svc, r, urlParts[1])
 			w.Header().Add(contentType, contentTypeJson)
 			w.WriteHeader(respCode)
 			fmt.Fprint(w, respBody)
@@ -105,48 +198,68 @@ func Create(repo repository.Repo) *http.ServeMux {
 			return
 		}
 	})
-	return mux
-}
-
-// handleDeleteReq handles a delete request and returns the desired response body and code
-func handleDeleteReq(repo repository.Repo, r *http.Request, key string) (string, int) {
-	dataMap, err := repo.ReadData()
-	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
+	handle("/watch", handleWatch(ws, o.shutdown))
+	handle("/admin/export", handleExport(repo))
+	handle("/admin/import", handleImport(repo, writeMu, ws))
+	handle("/admin/verify", handleVerify(repo, writeMu, ws))
+	if len(o.retention) > 0 {
+		c := &compactor{repo: repo, policies: o.retention, writeMu: writeMu, ws: ws, now: o.clock.now}
+		handle("/admin/compact", handleCompact(c))
+		// A follower's history is compacted by replicating the leader's compaction
+		if o.compactEvery > 0 && f == nil {
+			go c.run(o.compactEvery, o.shutdown, o.logger)
+		}
 	}
-	keyArray, exists := dataMap[key]
-	if !exists {
-		// Key does not exist
-		return "", http.StatusNotFound
+	if ws.log != nil {
+		handle("/replication/snapshot", handleReplicationSnapshot(repo, writeMu, ws.log))
+		handle("/replication/stream", handleReplicationStream(ws.log, o.shutdown))
 	}
-
-	array, err := sliceFromArray(keyArray)
-	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
+	if ws.log != nil || f != nil {
+		handle("/admin/replication", handleReplicationStatus(ws.log, f))
 	}
-	latestEventObj, err := latestEventFromSlice(array)
-	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
+	if o.cluster != nil {
+		handle("/raft/", handleRaft(o.cluster))
+		for _, pattern := range []string{"/admin/cluster", "/admin/cluster/members", "/admin/cluster/members/", "/admin/cluster/transfer"} {
+			handle(pattern, handleCluster(o.cluster))
+		}
 	}
-
-	if latestEventObj.Value == "" {
-		return errorKeyDeleted, http.StatusBadRequest
+	if o.snapshots != nil {
+		handle("/admin/snapshot", handleSnapshot(repo, writeMu, o.snapshots))
+		if o.snapshotEvery > 0 {
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				<-o.shutdown
+				cancel()
+			}()
+			go o.snapshots.Run(ctx, o.snapshotEvery, func(ctx context.Context) (map[string]interface{}, error) {
+				return readSnapshotData(ctx, repo, writeMu)
+			}, o.logger)
+		}
+	}
+	if o.keyStore != nil {
+		handle("/admin/keys", handleAPIKeys(o.keyStore))
+		handle("/admin/keys/", handleAPIKeys(o.keyStore))
 	}
+	if o.metrics != nil {
+		handle("/metrics", handleMetrics(o.metrics))
+	}
+	return mux
+}
 
-	// Set new key:value
-	dataMap[key] = append(array, eventObj{
-		Event: "delete",
-	})
+// handleDeleteReq handles a delete request and returns the desired response body and code
+func handleDeleteReq(svc *service, r *http.Request, key string) (string, int) {
+	annotate(r, key, "delete")
 
-	err = repo.WriteData(dataMap)
-	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
+	if err := svc.delete(r.Context(), key); err != nil {
+		return errorResponse(r, err)
 	}
 	return "", http.StatusNoContent
 }
 
 // handleUpdateReq handles a put/patch request and returns the desired response body and code
-func handleUpdateReq(repo repository.Repo, r *http.Request, key string) (string, int) {
+func handleUpdateReq(svc *service, r *http.Request, key string) (string, int) {
+	annotate(r, key, "update")
+
 	if r.Header.Get(contentType) != contentTypeText {
 		return errorInvalidPutBody, http.StatusUnsupportedMediaType
 	}
@@ -157,48 +270,19 @@ func handleUpdateReq(repo repository.Repo, r *http.Request, key string) (string,
 		return errorInvalidPutBody, http.StatusBadRequest
 	}
 	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
-	}
-	value := string(body)
-
-	dataMap, err := repo.ReadData()
-	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
+		return unexpectedError(r, err)
 	}
-	keyArray, exists := dataMap[key]
-	if !exists {
-		// Key does not exist
-		return "", http.StatusNotFound
-	}
-
-	array, err := sliceFromArray(keyArray)
-	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
-	}
-	latestEventObj, err := latestEventFromSlice(array)
-	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
-	}
-
-	if latestEventObj.Value == "" {
-		return errorKeyDeleted, http.StatusBadRequest
-	}
-
-	// Set new key:value
-	dataMap[key] = append(array, eventObj{
-		Event: "update",
-		Value: value,
-	})
 
-	err = repo.WriteData(dataMap)
-	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
+	if err := svc.update(r.Context(), key, string(body), r.Header.Get("If-Match")); err != nil {
+		return errorResponse(r, err)
 	}
 	return "", http.StatusNoContent
 }
 
 // handleCreateReq handles a post request and returns the desired response body and code
-func handleCreateReq(repo repository.Repo, r *http.Request) (string, int) {
+func handleCreateReq(svc *service, r *http.Request) (string, int) {
+	annotate(r, "", "create")
+
 	if r.Header.Get(contentType) != contentTypeJson {
 		return errorInvalidPostBody, http.StatusUnsupportedMediaType
 	}
@@ -209,117 +293,204 @@ func handleCreateReq(repo repository.Repo, r *http.Request) (string, int) {
 		return errorInvalidPostBody, http.StatusBadRequest
 	}
 	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
-	}
-	var bodyJson interface{}
-	if err = json.Unmarshal(body, &bodyJson); err != nil {
-		return errorInvalidPostBody, http.StatusBadRequest
+		return unexpectedError(r, err)
 	}
-	bodyMap := bodyJson.(map[string]interface{})
-	if len(bodyMap) != 1 {
+	var bodyMap map[string]interface{}
+	if err = json.Unmarshal(body, &bodyMap); err != nil || len(bodyMap) != 1 {
 		return errorInvalidPostBody, http.StatusBadRequest
 	}
 
-	dataMap, err := repo.ReadData()
-	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
-	}
-
 	for key, valueInterface := range bodyMap {
+		annotate(r, key, "create")
 		value, ok := valueInterface.(string)
 		if !ok {
 			return errorInvalidPostBody, http.StatusBadRequest
 		}
-		event := eventObj{
-			Event: "create",
-			Value: value,
-		}
-
-		keyArray, exists := dataMap[key]
-		if !exists {
-			// Set new key:value
-			dataMap[key] = []eventObj{event}
-			continue
-		}
-
-		array, err := sliceFromArray(keyArray)
-		if err != nil {
-			return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
-		}
-		latestEventObj, err := latestEventFromSlice(array)
-		if err != nil {
-			return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
+		if err := svc.create(r.Context(), key, value); err != nil {
+			return errorResponse(r, err)
 		}
+	}
+	return "", http.StatusCreated
+}
 
-		if latestEventObj.Value != "" {
-			return errorKeyExists, http.StatusBadRequest
-		}
+// handleReadReq handles a get request and returns the desired response body, the version of the key for If-Match if
+// it exists, and code
+func handleReadReq(svc *service, r *http.Request, key string) (string, string, int) {
+	annotate(r, key, "")
 
-		// Set new key:value
-		dataMap[key] = append(array, event)
+	value, version, err := svc.get(r.Context(), key)
+	if errors.Is(err, errKeyDeleted) {
+		return "", version, http.StatusNoContent
 	}
-
-	err = repo.WriteData(dataMap)
 	if err != nil {
-		return err.Error(), http.StatusInternalServerError
+		respBody, respCode := errorResponse(r, err)
+		return respBody, "", respCode
 	}
-	return "", http.StatusCreated
+	return value, version, http.StatusOK
 }
 
-// handleReadReq handles a get request and returns the desired response body and code
-func handleReadReq(repo repository.Repo, r *http.Request, key string) (string, int) {
-	dataMap, err := repo.ReadData()
+// handleListReq handles a list request and returns the keys with a current value, and the prefix given by the query,
+// which the caller may read
+func handleListReq(svc *service, r *http.Request) (string, int) {
+	prefix := r.URL.Query().Get("prefix")
+	annotate(r, prefix, "")
+
+	entries, err := svc.list(r.Context(), prefix)
 	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
+		return errorResponse(r, err)
 	}
-	keyArray, exists := dataMap[key]
-	if !exists {
-		// Key does not exist
-		return "", http.StatusNotFound
+	respBody, err := json.Marshal(entries)
+	if err != nil {
+		return unexpectedError(r, err)
 	}
+	return string(respBody), http.StatusOK
+}
+
+// handleHistoryReq handles a get history request and returns the desired response body and code
+func handleHistoryReq(svc *service, r *http.Request, key string) (string, int) {
+	annotate(r, key, "")
 
-	array, err := sliceFromArray(keyArray)
+	events, err := svc.history(r.Context(), key)
 	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
+		return errorResponse(r, err)
 	}
-	latestEventObj, err := latestEventFromSlice(array)
+	respBody, err := json.Marshal(events)
 	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
+		return unexpectedError(r, err)
 	}
+	return string(respBody), http.StatusOK
+}
+
+// errorResponse returns the response body and code for an error returned by the service
+func errorResponse(r *http.Request, err error) (string, int) {
+	switch {
+	case errors.Is(err, errKeyNotFound):
+		return "", http.StatusNotFound
+	case errors.Is(err, errKeyDeleted):
+		return errorKeyDeleted, http.StatusBadRequest
+	case errors.Is(err, errKeyExists):
+		return errorKeyExists, http.StatusBadRequest
+	case errors.Is(err, errKeyChanged):
+		return errorKeyChanged, http.StatusPreconditionFailed
+	case errors.Is(err, errForbidden):
+		return errorForbidden, http.StatusForbidden
+	case errors.Is(err, errQuotaExceeded):
+		return errorQuotaExceeded, http.StatusInsufficientStorage
+	case errors.Is(err, errValueTooLarge):
+		return errorValueTooLarge, http.StatusRequestEntityTooLarge
+	}
+	return unexpectedError(r, err)
+}
 
-	// Key has been deleted
-	if latestEventObj.Value == "" {
-		return "", http.StatusNoContent
+// beginWrite serialises a read-modify-write of the store with other writes, returning a context in which its read and
+// write are made in a single transaction. The returned function ends both, and must be called
+func beginWrite(ctx context.Context, repo repository.Store, writeMu *sync.RWMutex) (context.Context, func(), error) {
+	writeMu.Lock()
+	ctx, end, err := repo.Begin(ctx)
+	if err != nil {
+		writeMu.Unlock()
+		return ctx, func() {}, err
 	}
+	return ctx, func() {
+		end()
+		writeMu.Unlock()
+	}, nil
+}
 
-	return latestEventObj.Value, http.StatusOK
+// keyLocker is a store which can serialise the writes of some keys without the others, such as a sharded store
+type keyLocker interface {
+	LockKeys(keys ...string) func()
 }
 
-// handleHistoryReq handles a get history request and returns the desired response body and code
-func handleHistoryReq(repo repository.Repo, r *http.Request, key string) (string, int) {
-	dataMap, err := repo.ReadData()
-	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
+// beginKeyWrite serialises a read-modify-write of the specified keys like beginWrite. For a store which can lock the
+// keys alone, other writes of a few keys may run concurrently unless a quota applies, as quotas are checked against
+// the other keys in the namespace
+func beginKeyWrite(ctx context.Context, repo repository.Store, writeMu *sync.RWMutex, quotas quotas, keys ...string) (context.Context, func(), error) {
+	locker, ok := repo.(keyLocker)
+	for _, key := range keys {
+		if _, quota := quotas.forKey(key); quota {
+			ok = false
+		}
 	}
-	keyArray, exists := dataMap[key]
-	if !exists {
-		// Key does not exist
-		return "", http.StatusNotFound
+	if !ok {
+		return beginWrite(ctx, repo, writeMu)
 	}
+	writeMu.RLock()
+	unlock := locker.LockKeys(keys...)
+	ctx, end, err := repo.Begin(ctx)
+	if err != nil {
+		unlock()
+		writeMu.RUnlock()
+		return ctx, func() {}, err
+	}
+	return ctx, func() {
+		end()
+		unlock()
+		writeMu.RUnlock()
+	}, nil
+}
 
-	array, err := json.Marshal(keyArray)
+// readKeys returns the histories of the specified keys, and those of the other keys in their namespaces if a quota
+// applies to them. Stores which cannot read part of the data return all of it, as do quotas for keys outside any
+// namespace, which have no prefix in common
+func readKeys(ctx context.Context, repo repository.Store, quotas quotas, keys ...string) (map[string]interface{}, error) {
+	keyStore, ok := repo.(repository.KeyStore)
+	if !ok {
+		return repo.ReadData(ctx)
+	}
+	dataMap, err := keyStore.ReadKeys(ctx, keys...)
 	if err != nil {
-		return fmt.Sprint(errorUnexpected, err.Error()), http.StatusInternalServerError
+		return nil, err
 	}
+	for _, key := range keys {
+		if _, ok := quotas.forKey(key); !ok {
+			continue
+		}
+		namespace := auth.Namespace(key)
+		if namespace == "" {
+			return repo.ReadData(ctx)
+		}
+		inNamespace, err := keyStore.ReadPrefix(ctx, namespace+auth.NamespaceSeparator)
+		if err != nil {
+			return nil, err
+		}
+		for k, keyArray := range inNamespace {
+			dataMap[k] = keyArray
+		}
+	}
+	return dataMap, nil
+}
 
-	return string(array), http.StatusOK
+// readPrefix returns the histories of the keys with the specified prefix. Stores which cannot read part of the data
+// return all of it
+func readPrefix(ctx context.Context, repo repository.Store, prefix string) (map[string]interface{}, error) {
+	if keyStore, ok := repo.(repository.KeyStore); ok {
+		return keyStore.ReadPrefix(ctx, prefix)
+	}
+	return repo.ReadData(ctx)
+}
+
+// writeKeys writes the histories of the specified keys in data returned by readKeys, which for stores that cannot
+// write part of the data is all of it
+func writeKeys(ctx context.Context, repo repository.Store, dataMap map[string]interface{}, keys ...string) error {
+	keyStore, ok := repo.(repository.KeyStore)
+	if !ok {
+		return repo.WriteData(ctx, dataMap)
+	}
+	written := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		if keyArray, ok := dataMap[key]; ok {
+			written[key] = keyArray
+		}
+	}
+	return keyStore.WriteKeys(ctx, written)
 }
 
 // sliceFromArray parses the specified data for a specific key and returns it as a slice
 func sliceFromArray(keyArray interface{}) ([]interface{}, error) {
 	array, ok := keyArray.([]interface{})
 	if !ok {
-		return nil, errors.New("type assertion failed")
+		return nil, fmt.Errorf("history is %s rather than an array of events", jsonType(keyArray))
 	}
 	return array, nil
 }
@@ -327,6 +498,9 @@ func sliceFromArray(keyArray interface{}) ([]interface{}, error) {
 // latestEventFromSlice parses the specified slice for a key and returns the final element
 func latestEventFromSlice(array []interface{}) (eventObj, error) {
 	var latestEventObj eventObj
+	if len(array) == 0 {
+		return latestEventObj, errors.New("history is empty")
+	}
 	latest := array[len(array)-1]
 	latestJson, _ := json.Marshal(latest)
 	err := json.Unmarshal(latestJson, &latestEventObj)
@@ -338,13 +512,18 @@ func latestEventFromSlice(array []interface{}) (eventObj, error) {
 
 // body gets the body data from the specified request
 func body(r *http.Request) ([]byte, error) {
+	_, span := tracing.Start(r.Context(), "parse body")
+	defer span.Finish()
+
 	if r.Body == nil {
 		return nil, nil
 	}
 	body, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
+		span.RecordError(err)
 		return nil, err
 	}
+	span.SetAttribute("crud.payload_size", len(body))
 	return body, nil
 }
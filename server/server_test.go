@@ -2,11 +2,15 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"its-dave/simple-crud-rest-server/repository"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -67,9 +71,25 @@ func TestMain(t *testing.T) {
 			expContentType:  contentTypeText,
 		},
 		{
-			name:            "get wrong endpoint",
+			name:            "list keys",
 			url:             "/api/",
 			method:          http.MethodGet,
+			expResponseBody: `[{"key":"key1","value":"value1"}]`,
+			expResponseCode: http.StatusOK,
+			expContentType:  contentTypeJson,
+		},
+		{
+			name:            "list keys with prefix",
+			url:             "/api?prefix=other",
+			method:          http.MethodGet,
+			expResponseBody: `[]`,
+			expResponseCode: http.StatusOK,
+			expContentType:  contentTypeJson,
+		},
+		{
+			name:            "wrong method for endpoint",
+			url:             "/api",
+			method:          http.MethodPut,
 			expResponseCode: http.StatusMethodNotAllowed,
 		},
 		{
@@ -360,15 +380,116 @@ func Test_CRCRURDRHH(t *testing.T) {
 	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key2/history", "", "", http.StatusOK, `[{"event":"create","value":"value3"},{"event":"delete","value":""}]`, contentTypeJson)
 }
 
-// initialiseData sets the data file to the specified data to ensure a known testing state, then returns a new Repo pointing to that file
-func initialiseData(t *testing.T, data string) repository.Repo {
+func TestIfMatch(t *testing.T) {
+	repo := initialiseData(t, "{}")
+	mux := Create(repo)
+
+	update := func(value, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/key1", bytes.NewReader([]byte(value)))
+		req.Header.Set(contentType, contentTypeText)
+		req.Header.Set("If-Match", ifMatch)
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+		return resp
+	}
+	version := func() string {
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/api/key1", nil))
+		return resp.Header().Get("ETag")
+	}
+
+	// A key which does not exist cannot match
+	resp := update("value1", "*")
+	assert.Equal(t, http.StatusPreconditionFailed, resp.Code)
+	assert.Equal(t, errorKeyChanged, resp.Body.String())
+
+	requestAndCheckResponse(t, mux, http.MethodPost, "/api/", `{"key1":"value1"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+	first := version()
+	assert.NotEmpty(t, first)
+
+	// The version read matches until the key is written
+	assert.Equal(t, http.StatusNoContent, update("value2", first).Code)
+	second := version()
+	assert.NotEqual(t, first, second)
+	resp = update("value3", first)
+	assert.Equal(t, http.StatusPreconditionFailed, resp.Code)
+	assert.Equal(t, errorKeyChanged, resp.Body.String())
+	assert.Equal(t, http.StatusNoContent, update("value3", "*").Code)
+
+	// A deleted key still has a version, which changes when it is deleted
+	requestAndCheckResponse(t, mux, http.MethodDelete, "/api/key1", "", "", http.StatusNoContent, "", contentTypeText)
+	deleted := version()
+	assert.NotEmpty(t, deleted)
+	assert.NotEqual(t, second, deleted)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key1/history", "", "", http.StatusOK, `[{"event":"create","value":"value1"},{"event":"update","value":"value2"},{"event":"update","value":"value3"},{"event":"delete","value":""}]`, contentTypeJson)
+}
+
+// testStorageBackend is the storage backend which the handler tests run against: the data file by default, or SQLite,
+// the LSM store or data files in four shards if CRUD_TEST_STORAGE_BACKEND is sqlite, lsm or sharded
+var testStorageBackend = os.Getenv("CRUD_TEST_STORAGE_BACKEND")
+
+// initialiseData sets the data file to the specified data to ensure a known testing state, then returns a new Repo pointing to that file.
+// Data without a format version is migrated when the server starts. When testing another backend the data is instead
+// loaded into a new store, which is returned
+func initialiseData(t *testing.T, data string) repository.Store {
 	if err := os.WriteFile(testDataFilePath, []byte(data), 0666); err != nil {
 		assert.Fail(t, err.Error())
 	}
+	t.Cleanup(func() {
+		backups, _ := filepath.Glob(testDataFilePath + ".v*.bak")
+		for _, backup := range backups {
+			os.Remove(backup)
+		}
+	})
 
-	repo := repository.Repo{}
+	repo := &repository.Repo{}
 	repo.SetDataFilePath(testDataFilePath)
-	return repo
+	var store interface {
+		repository.Store
+		Close() error
+	}
+	var err error
+	switch testStorageBackend {
+	case "sqlite":
+		store, err = repository.OpenSQLite(filepath.Join(t.TempDir(), "testdata.db"))
+	case "lsm":
+		store, err = repository.OpenLSM(filepath.Join(t.TempDir(), "testdata"))
+	case "sharded":
+		dir := t.TempDir()
+		var shards []repository.Store
+		for i := 0; i < 4; i++ {
+			shard := &repository.Repo{}
+			shard.SetDataFilePath(filepath.Join(dir, fmt.Sprintf("testdata-%d.json", i)))
+			shards = append(shards, shard)
+		}
+		store = repository.NewSharded(shards...)
+	default:
+		return repo
+	}
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { store.Close() })
+	assert.NoError(t, store.InitialiseData())
+	dataMap, err := repo.ReadData(context.Background())
+	if errors.Is(err, repository.ErrMigrationRequired) {
+		assert.NoError(t, repo.InitialiseData())
+		dataMap, err = repo.ReadData(context.Background())
+	}
+	if err == nil {
+		err = store.WriteData(context.Background(), dataMap)
+	}
+	if err != nil {
+		t.Fatalf("the test data cannot be stored in %s: %v", testStorageBackend, err)
+	}
+	return store
+}
+
+// requireFileBackend skips a test of the data file itself when the handler tests run against another backend
+func requireFileBackend(t *testing.T) {
+	if testStorageBackend != "" {
+		t.Skip("tests the data file")
+	}
 }
 
 // requestAndCheckResponse makes the specified request to the specified mux and asserts the specified response code, body, and content type
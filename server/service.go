@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/repository"
+	"its-dave/simple-crud-rest-server/tracing"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Errors returned by the service, which the HTTP handlers and the gRPC server each map to their own responses
+var (
+	errKeyNotFound   = errors.New("the specified key does not exist")
+	errKeyDeleted    = errors.New("the specified key has been deleted")
+	errKeyExists     = errors.New("the specified key already exists")
+	errKeyChanged    = errors.New("the specified key has changed since the version given")
+	errForbidden     = errors.New("the caller does not have permission for the specified key")
+	errQuotaExceeded = errors.New("the storage quota for the key's namespace has been exceeded")
+	errValueTooLarge = errors.New("the value is larger than the storage quota for the key's namespace")
+)
+
+// service makes the operations of the API on the store, for both the HTTP handlers and the gRPC server. The caller's
+// identity, if any, is taken from the context, and each operation checks that it holds the permission required
+type service struct {
+	repo    repository.Store
+	quotas  quotas
+	clock   clock
+	writeMu *sync.RWMutex
+	ws      *watchers
+}
+
+// get returns the current value of the key and its version, which is returned with errKeyDeleted too
+func (s *service) get(ctx context.Context, key string) (string, string, error) {
+	if !allowed(ctx, auth.PermissionRead, key) {
+		return "", "", errForbidden
+	}
+	dataMap, err := readKeys(ctx, s.repo, nil, key)
+	if err != nil {
+		return "", "", err
+	}
+	_, latestEventObj, err := latestEvent(dataMap, key)
+	if err != nil {
+		return "", "", err
+	}
+	version, err := keyVersion(dataMap[key])
+	if err != nil {
+		return "", "", err
+	}
+	if latestEventObj.Value == "" {
+		return "", version, errKeyDeleted
+	}
+	return latestEventObj.Value, version, nil
+}
+
+// list returns the keys with a current value and the specified prefix which the caller may read, in order
+func (s *service) list(ctx context.Context, prefix string) ([]entryObj, error) {
+	dataMap, err := readPrefix(ctx, s.repo, prefix)
+	if err != nil {
+		return nil, err
+	}
+	entries := []entryObj{}
+	for key, keyArray := range dataMap {
+		if !strings.HasPrefix(key, prefix) || !allowed(ctx, auth.PermissionRead, key) {
+			continue
+		}
+		array, err := sliceFromArray(keyArray)
+		if err != nil {
+			return nil, err
+		}
+		latestEventObj, err := latestEventFromSlice(array)
+		if err != nil {
+			return nil, err
+		}
+		if latestEventObj.Value == "" {
+			// Key has been deleted
+			continue
+		}
+		entries = append(entries, entryObj{Key: key, Value: latestEventObj.Value})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries, nil
+}
+
+// history returns every event of the key, as stored
+func (s *service) history(ctx context.Context, key string) ([]interface{}, error) {
+	if !allowed(ctx, auth.PermissionHistory, key) {
+		return nil, errForbidden
+	}
+	dataMap, err := readKeys(ctx, s.repo, nil, key)
+	if err != nil {
+		return nil, err
+	}
+	keyArray, exists := dataMap[key]
+	if !exists {
+		return nil, errKeyNotFound
+	}
+	return sliceFromArray(keyArray)
+}
+
+// create sets the value of a key which does not exist or has been deleted
+func (s *service) create(ctx context.Context, key, value string) error {
+	if !allowed(ctx, auth.PermissionWrite, key) {
+		return errForbidden
+	}
+	txCtx, done, err := beginKeyWrite(ctx, s.repo, s.writeMu, s.quotas, key)
+	if err != nil {
+		return err
+	}
+	defer done()
+	dataMap, err := readKeys(txCtx, s.repo, s.quotas, key)
+	if err != nil {
+		return err
+	}
+	_, mutateSpan := tracing.Start(ctx, "mutate")
+	defer mutateSpan.Finish()
+
+	var array []interface{}
+	if _, exists := dataMap[key]; exists {
+		var latestEventObj eventObj
+		array, latestEventObj, err = latestEvent(dataMap, key)
+		if err != nil {
+			return err
+		}
+		if latestEventObj.Value != "" {
+			return errKeyExists
+		}
+	}
+	if err := s.quotas.check(dataMap, key, value); err != nil {
+		return err
+	}
+	event := eventObj{
+		Event:    "create",
+		Value:    value,
+		Identity: callerName(ctx),
+		Time:     s.clock.stamp(),
+	}
+	if array == nil {
+		dataMap[key] = []eventObj{event}
+	} else {
+		dataMap[key] = append(array, event)
+	}
+	mutateSpan.Finish()
+
+	if err := writeKeys(txCtx, s.repo, dataMap, key); err != nil {
+		return err
+	}
+	s.ws.publish(key, event)
+	return nil
+}
+
+// update sets the value of a key which has a current value, and if ifMatch is set, whose version is ifMatch or which
+// exists if it is "*"
+func (s *service) update(ctx context.Context, key, value, ifMatch string) error {
+	if !allowed(ctx, auth.PermissionWrite, key) {
+		return errForbidden
+	}
+	return s.append(ctx, key, s.quotas, ifMatch, func(dataMap map[string]interface{}) (eventObj, error) {
+		if err := s.quotas.check(dataMap, key, value); err != nil {
+			return eventObj{}, err
+		}
+		return eventObj{Event: "update", Value: value}, nil
+	})
+}
+
+// delete removes the current value of a key which has one, leaving its history
+func (s *service) delete(ctx context.Context, key string) error {
+	if !allowed(ctx, auth.PermissionDelete, key) {
+		return errForbidden
+	}
+	return s.append(ctx, key, nil, "", func(map[string]interface{}) (eventObj, error) {
+		return eventObj{Event: "delete"}, nil
+	})
+}
+
+// append appends the event returned by the specified function to the history of a key which has a current value,
+// and the version ifMatch if set, stamped with the caller and time, and publishes it once written
+func (s *service) append(ctx context.Context, key string, quotas quotas, ifMatch string, newEvent func(dataMap map[string]interface{}) (eventObj, error)) error {
+	txCtx, done, err := beginKeyWrite(ctx, s.repo, s.writeMu, quotas, key)
+	if err != nil {
+		return err
+	}
+	defer done()
+	dataMap, err := readKeys(txCtx, s.repo, quotas, key)
+	if err != nil {
+		return err
+	}
+	_, mutateSpan := tracing.Start(ctx, "mutate")
+	defer mutateSpan.Finish()
+	// The key is only written if unchanged since the read which returned the version, so that the caller can write
+	// a value based on the one read without losing a concurrent write
+	if ifMatch != "" {
+		keyArray, exists := dataMap[key]
+		if !exists {
+			return errKeyChanged
+		}
+		version, err := keyVersion(keyArray)
+		if err != nil {
+			return err
+		}
+		if ifMatch != "*" && ifMatch != version {
+			return errKeyChanged
+		}
+	}
+	array, latestEventObj, err := latestEvent(dataMap, key)
+	if err != nil {
+		return err
+	}
+	if latestEventObj.Value == "" {
+		return errKeyDeleted
+	}
+
+	event, err := newEvent(dataMap)
+	if err != nil {
+		return err
+	}
+	event.Identity = callerName(ctx)
+	event.Time = s.clock.stamp()
+	dataMap[key] = append(array, event)
+	mutateSpan.Finish()
+
+	if err := writeKeys(txCtx, s.repo, dataMap, key); err != nil {
+		return err
+	}
+	s.ws.publish(key, event)
+	return nil
+}
+
+// latestEvent returns the history of the key and its latest event, or errKeyNotFound if it does not exist
+func latestEvent(dataMap map[string]interface{}, key string) ([]interface{}, eventObj, error) {
+	keyArray, exists := dataMap[key]
+	if !exists {
+		return nil, eventObj{}, errKeyNotFound
+	}
+	array, err := sliceFromArray(keyArray)
+	if err != nil {
+		return nil, eventObj{}, err
+	}
+	latestEventObj, err := latestEventFromSlice(array)
+	return array, latestEventObj, err
+}
+
+// keyVersion returns an ETag identifying the history of a key, which changes with every event
+func keyVersion(keyArray interface{}) (string, error) {
+	data, err := json.Marshal(keyArray)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`, nil
+}
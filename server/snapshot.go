@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/repository"
+	"its-dave/simple-crud-rest-server/snapshot"
+	"net/http"
+	"sync"
+)
+
+// handleSnapshot saves a snapshot of the store, responding with its path and metadata
+func handleSnapshot(repo repository.Store, writeMu *sync.RWMutex, store *snapshot.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorised(r, auth.PermissionAdmin, "") {
+			writeForbidden(w)
+			return
+		}
+		annotate(r, "", "snapshot")
+
+		dataMap, err := readSnapshotData(r.Context(), repo, writeMu)
+		var respBody []byte
+		if err == nil {
+			var created snapshot.Snapshot
+			if created, err = store.Create(r.Context(), dataMap); err == nil {
+				respBody, err = json.Marshal(created)
+			}
+		}
+		if err != nil {
+			respBody, respCode := unexpectedError(r, err)
+			w.Header().Add(contentType, contentTypeText)
+			w.WriteHeader(respCode)
+			fmt.Fprint(w, respBody)
+			return
+		}
+		w.Header().Add(contentType, contentTypeJson)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(respBody)
+	}
+}
+
+// readSnapshotData returns the data as it was between two writes. A sharded store writes its shards separately, and
+// writes of a few keys hold only the locks of their shards, so the read holds the write lock to exclude them all
+func readSnapshotData(ctx context.Context, repo repository.Store, writeMu *sync.RWMutex) (map[string]interface{}, error) {
+	ctx, done, err := beginWrite(ctx, repo, writeMu)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return repo.ReadData(ctx)
+}
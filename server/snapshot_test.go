@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"its-dave/simple-crud-rest-server/snapshot"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	repo := initialiseData(t, `{"key1":[{"event":"create","value":"value1"},{"event":"update","value":"value2"}]}`)
+	mux := Create(repo, WithSnapshots(0, snapshot.NewStore(filepath.Join(t.TempDir(), "snapshots"), snapshot.Retention{})))
+
+	resp := authRequest(t, mux, "", http.MethodPost, "/admin/snapshot", "", "")
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	assert.Equal(t, contentTypeJson, resp.Header().Get(contentType))
+	var created snapshot.Snapshot
+	if !assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &created)) {
+		return
+	}
+	assert.Equal(t, 1, created.Keys)
+	assert.Equal(t, 2, created.Events)
+
+	// Later writes do not change the snapshot
+	requestAndCheckResponse(t, mux, http.MethodPut, "/api/key1", "value3", contentTypeText, http.StatusNoContent, "", contentTypeText)
+	dataMap, metadata, err := snapshot.Read(created.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, created.Metadata, metadata)
+	assert.Equal(t, map[string]interface{}{"key1": []interface{}{
+		map[string]interface{}{"event": "create", "value": "value1"},
+		map[string]interface{}{"event": "update", "value": "value2"},
+	}}, dataMap)
+
+	requestAndCheckResponse(t, mux, http.MethodGet, "/admin/snapshot", "", "", http.StatusMethodNotAllowed, "", "")
+}
+
+func TestScheduledSnapshots(t *testing.T) {
+	repo := initialiseData(t, `{"key1":[{"event":"create","value":"value1"}]}`)
+	dir := filepath.Join(t.TempDir(), "snapshots")
+	shutdown := make(chan struct{})
+	defer close(shutdown)
+	Create(repo, WithShutdown(shutdown), WithSnapshots(10*time.Millisecond, snapshot.NewStore(dir, snapshot.Retention{})))
+
+	assert.Eventually(t, func() bool {
+		entries, _ := os.ReadDir(dir)
+		return len(entries) > 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"its-dave/simple-crud-rest-server/tracing"
+	"net/http"
+)
+
+// traced wraps the specified handler so that each request produces a server span,
+// continuing the trace of an incoming W3C traceparent header if present
+func traced(tracer *tracing.Tracer, handler http.HandlerFunc) http.HandlerFunc {
+	if tracer == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		route := routeLabel(r.URL.Path)
+		ctx, span := tracer.StartRoot(r.Context(), r.Method+" "+route, tracing.SpanKindServer, tracing.Extract(r.Header))
+		defer span.Finish()
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("url.path", r.URL.Path)
+		if r.ContentLength > 0 {
+			span.SetAttribute("http.request.body.size", r.ContentLength)
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r.WithContext(ctx))
+
+		span.SetAttribute("http.response.status_code", recorder.status)
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(tracing.StatusError, http.StatusText(recorder.status))
+		}
+	}
+}
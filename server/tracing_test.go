@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"its-dave/simple-crud-rest-server/repository"
+	"its-dave/simple-crud-rest-server/tracing"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryExporter collects exported spans for inspection
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*tracing.Span
+}
+
+func (exporter *memoryExporter) Export(ctx context.Context, spans []*tracing.Span) error {
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	exporter.spans = append(exporter.spans, spans...)
+	return nil
+}
+
+func (exporter *memoryExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	repo := initialiseData(t, `{"key1":[{"event":"create","value":"value1"}]}`)
+	exporter := &memoryExporter{}
+	tracer := tracing.NewTracer("test", exporter, time.Hour)
+	mux := Create(repo, WithTracer(tracer))
+
+	req := httptest.NewRequest(http.MethodPut, "/api/key1", strings.NewReader("value2"))
+	req.Header.Set(contentType, contentTypeText)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.NoError(t, tracer.Shutdown(context.Background()))
+
+	spans := map[string]*tracing.Span{}
+	for _, span := range exporter.spans {
+		spans[span.Name] = span
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.Context.TraceID.String())
+	}
+	root := spans["PUT /api/{key}"]
+	if !assert.NotNil(t, root) {
+		return
+	}
+	assert.Equal(t, "00f067aa0ba902b7", root.ParentSpanID.String())
+	assert.Equal(t, "key1", root.Attributes["crud.key"])
+	assert.Equal(t, "update", root.Attributes["crud.event"])
+	assert.Equal(t, http.StatusNoContent, root.Attributes["http.response.status_code"])
+
+	// Stores which can read and write a single key do so
+	read, write := "storage.ReadData", "storage.WriteData"
+	if _, ok := repo.(repository.KeyStore); ok {
+		read, write = "storage.ReadKeys", "storage.WriteKeys"
+	}
+	for _, name := range []string{"parse body", read, "mutate", write} {
+		if assert.Contains(t, spans, name) {
+			assert.Equal(t, root.Context.SpanID, spans[name].ParentSpanID, name)
+		}
+	}
+	assert.Equal(t, 6, spans["parse body"].Attributes["crud.payload_size"])
+	if testStorageBackend != "" {
+		return
+	}
+	if assert.Contains(t, spans, "storage.decode") {
+		assert.Equal(t, spans["storage.ReadData"].Context.SpanID, spans["storage.decode"].ParentSpanID)
+	}
+}
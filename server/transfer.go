@@ -0,0 +1,294 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/repository"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	contentTypeNDJSON = "application/x-ndjson"
+
+	importModeMerge   = "merge"
+	importModeReplace = "replace"
+	importModeSkip    = "skip"
+
+	errorInvalidImport = "Error: request body must be NDJSON with a {\"key\":\"key\",\"events\":[{\"event\":\"create\",\"value\":\"value\"}]} object per line and Content-Type application/x-ndjson"
+	errorInvalidMode   = "Error: mode must be merge, replace or skip"
+	errorInvalidOrder  = "Error: the history of each imported key must be in an order the server could have produced"
+)
+
+// exportRecord is a line of an export: a key with its full history
+type exportRecord struct {
+	Key    string     `json:"key"`
+	Events []eventObj `json:"events"`
+}
+
+// importSummary is the response to an import, counting the keys by what was done with each
+type importSummary struct {
+	DryRun   bool `json:"dryRun"`
+	Created  int  `json:"created"`
+	Merged   int  `json:"merged"`
+	Replaced int  `json:"replaced"`
+	Skipped  int  `json:"skipped"`
+}
+
+// handleExport streams every key with the prefix given by the query, and its history, as NDJSON sorted by key
+func handleExport(repo repository.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorised(r, auth.PermissionAdmin, "") {
+			writeForbidden(w)
+			return
+		}
+		prefix := r.URL.Query().Get("prefix")
+		annotate(r, prefix, "export")
+
+		dataMap, err := readPrefix(r.Context(), repo, prefix)
+		if err != nil {
+			respBody, respCode := unexpectedError(r, err)
+			w.Header().Add(contentType, contentTypeText)
+			w.WriteHeader(respCode)
+			fmt.Fprint(w, respBody)
+			return
+		}
+		keys := make([]string, 0, len(dataMap))
+		for key := range dataMap {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		w.Header().Add(contentType, contentTypeNDJSON)
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		for _, key := range keys {
+			// The history is written as stored, so that nothing is lost in the round trip
+			record := struct {
+				Key    string      `json:"key"`
+				Events interface{} `json:"events"`
+			}{key, dataMap[key]}
+			if err := encoder.Encode(record); err != nil {
+				// The client has gone away
+				return
+			}
+		}
+	}
+}
+
+// handleImport loads an export into the store
+func handleImport(repo repository.Store, writeMu *sync.RWMutex, ws *watchers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorised(r, auth.PermissionAdmin, "") {
+			writeForbidden(w)
+			return
+		}
+		respBody, respCode := handleImportReq(repo, r, writeMu, ws)
+		if respCode == http.StatusOK {
+			w.Header().Add(contentType, contentTypeJson)
+		} else {
+			w.Header().Add(contentType, contentTypeText)
+		}
+		w.WriteHeader(respCode)
+		fmt.Fprint(w, respBody)
+	}
+}
+
+// handleImportReq handles an import request and returns the desired response body and code. Every record is
+// validated before any is applied, and they are applied in a single write, so an import is all or nothing.
+// The query sets the mode for keys which already exist: merge appends the imported events (or only the new ones,
+// if the existing history is a prefix of them), replace overwrites the history and skip leaves the key unchanged.
+// Each history written must be in an order the server could have produced, as verify checks.
+// With dryRun=true the summary is returned without writing anything
+func handleImportReq(repo repository.Store, r *http.Request, writeMu *sync.RWMutex, ws *watchers) (string, int) {
+	annotate(r, "", "import")
+
+	if r.Header.Get(contentType) != contentTypeNDJSON {
+		return errorInvalidImport, http.StatusUnsupportedMediaType
+	}
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "":
+		mode = importModeMerge
+	case importModeMerge, importModeReplace, importModeSkip:
+	default:
+		return errorInvalidMode, http.StatusBadRequest
+	}
+	summary := importSummary{DryRun: r.URL.Query().Get("dryRun") == "true"}
+
+	var records []exportRecord
+	var lines []int
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var record exportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || !record.valid() {
+			return fmt.Sprintf("%s (line %d)", errorInvalidImport, line), http.StatusBadRequest
+		}
+		records = append(records, record)
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return errorInvalidImport, http.StatusBadRequest
+	}
+
+	ctx, done, err := beginWrite(r.Context(), repo, writeMu)
+	if err != nil {
+		return unexpectedError(r, err)
+	}
+	defer done()
+	dataMap, err := repo.ReadData(ctx)
+	if err != nil {
+		return unexpectedError(r, err)
+	}
+
+	added := map[string][]eventObj{}
+	replaced := map[string]bool{}
+	for i, record := range records {
+		keyArray, exists := dataMap[record.Key]
+		// A record which is stored as the key's history must be in order alone, while one which is merged may continue
+		// the existing history, e.g. with an update
+		if !exists || mode == importModeReplace {
+			if found, err := historyProblem(arrayFromEvents(record.Events)); err != nil {
+				return unexpectedError(r, err)
+			} else if found != "" {
+				return fmt.Sprintf("%s (line %d, %s)", errorInvalidOrder, lines[i], found), http.StatusBadRequest
+			}
+		}
+		if !exists {
+			dataMap[record.Key] = arrayFromEvents(record.Events)
+			added[record.Key] = record.Events
+			summary.Created++
+			continue
+		}
+		switch mode {
+		case importModeSkip:
+			summary.Skipped++
+		case importModeReplace:
+			dataMap[record.Key] = arrayFromEvents(record.Events)
+			added[record.Key] = record.Events
+			replaced[record.Key] = true
+			summary.Replaced++
+		case importModeMerge:
+			array, err := sliceFromArray(keyArray)
+			if err != nil {
+				return unexpectedError(r, err)
+			}
+			events := record.Events
+			if existing, err := eventsFromSlice(array); err == nil && len(existing) <= len(events) && reflect.DeepEqual(existing, events[:len(existing)]) {
+				// Importing the same export again only adds what is new
+				events = events[len(existing):]
+			}
+			if len(events) == 0 {
+				summary.Skipped++
+				continue
+			}
+			merged := append(array, arrayFromEvents(events)...)
+			// Appending the events must leave the history in order, e.g. not create a key which has a value
+			if found, err := historyProblem(merged); err != nil {
+				return unexpectedError(r, err)
+			} else if found != "" {
+				return fmt.Sprintf("%s (key %q once merged, %s)", errorInvalidOrder, record.Key, found), http.StatusBadRequest
+			}
+			dataMap[record.Key] = merged
+			added[record.Key] = append(added[record.Key], events...)
+			summary.Merged++
+		}
+	}
+
+	respBody, err := json.Marshal(summary)
+	if err != nil {
+		return unexpectedError(r, err)
+	}
+	if summary.DryRun || len(added) == 0 {
+		return string(respBody), http.StatusOK
+	}
+	if err := repo.WriteData(ctx, dataMap); err != nil {
+		return unexpectedError(r, err)
+	}
+	for key, events := range added {
+		if replaced[key] {
+			ws.replace(key, events)
+			continue
+		}
+		for _, event := range events {
+			ws.publish(key, event)
+		}
+	}
+	return string(respBody), http.StatusOK
+}
+
+// valid reports whether the record has a key and a history of known events
+func (record exportRecord) valid() bool {
+	if record.Key == "" || len(record.Events) == 0 {
+		return false
+	}
+	for _, event := range record.Events {
+		switch event.Event {
+		case "create", "update", "delete", eventSnapshot:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// historyProblem describes the first problem which verifyData finds in a history, or returns "" if it has none
+func historyProblem(array []interface{}) (string, error) {
+	// verifyData checks histories as decoded from the stored JSON, rather than as events
+	data, err := json.Marshal(array)
+	if err != nil {
+		return "", err
+	}
+	var decoded []interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return "", err
+	}
+	report := verifyData(map[string]interface{}{"": decoded})
+	if len(report.Problems) == 0 {
+		return "", nil
+	}
+	found := report.Problems[0]
+	if found.Event == nil {
+		return found.Problem, nil
+	}
+	return fmt.Sprintf("event %d: %s", *found.Event, found.Problem), nil
+}
+
+// eventsFromSlice parses every event of a key's stored history
+func eventsFromSlice(array []interface{}) ([]eventObj, error) {
+	data, err := json.Marshal(array)
+	if err != nil {
+		return nil, err
+	}
+	var events []eventObj
+	err = json.Unmarshal(data, &events)
+	return events, err
+}
+
+// arrayFromEvents converts events to the form of a stored history, so that later records for the same key can extend it
+func arrayFromEvents(events []eventObj) []interface{} {
+	array := make([]interface{}, 0, len(events))
+	for _, event := range events {
+		array = append(array, event)
+	}
+	return array
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"its-dave/simple-crud-rest-server/auth"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImport(t *testing.T) {
+	repo := initialiseData(t, `{"key1":[{"event":"create","value":"value1"},{"event":"update","value":"value2"}],"key2":[{"event":"create","value":"value1"},{"event":"delete","value":""}],"other":[{"event":"create","value":"value1"}]}`)
+	mux := Create(repo)
+	export := `{"key":"key1","events":[{"event":"create","value":"value1"},{"event":"update","value":"value2"}]}` + "\n" +
+		`{"key":"key2","events":[{"event":"create","value":"value1"},{"event":"delete","value":""}]}` + "\n"
+
+	// Deleted keys are exported with their history, sorted by key
+	requestAndCheckResponse(t, mux, http.MethodGet, "/admin/export?prefix=key", "", "", http.StatusOK, export, contentTypeNDJSON)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/export", "", "", http.StatusMethodNotAllowed, "", "")
+
+	// Importing an export into the same store only adds what is new
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/import", export, contentTypeNDJSON, http.StatusOK, `{"dryRun":false,"created":0,"merged":0,"replaced":0,"skipped":2}`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/import", `{"key":"key1","events":[{"event":"create","value":"value1"},{"event":"update","value":"value2"},{"event":"update","value":"value3"}]}`, contentTypeNDJSON, http.StatusOK, `{"dryRun":false,"created":0,"merged":1,"replaced":0,"skipped":0}`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key1/history", "", "", http.StatusOK, `[{"event":"create","value":"value1"},{"event":"update","value":"value2"},{"event":"update","value":"value3"}]`, contentTypeJson)
+
+	// Merging a different history appends all of it
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/import?mode=merge", `{"key":"other","events":[{"event":"update","value":"value2"}]}`, contentTypeNDJSON, http.StatusOK, `{"dryRun":false,"created":0,"merged":1,"replaced":0,"skipped":0}`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/other/history", "", "", http.StatusOK, `[{"event":"create","value":"value1"},{"event":"update","value":"value2"}]`, contentTypeJson)
+
+	// A dry run changes nothing
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/import?mode=replace&dryRun=true", `{"key":"key1","events":[{"event":"create","value":"new"}]}`+"\n"+`{"key":"key3","events":[{"event":"create","value":"new"}]}`, contentTypeNDJSON, http.StatusOK, `{"dryRun":true,"created":1,"merged":0,"replaced":1,"skipped":0}`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key1", "", "", http.StatusOK, "value3", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key3", "", "", http.StatusNotFound, "", contentTypeText)
+
+	// Replace overwrites histories and skip leaves them unchanged, and keys which do not exist are created either way
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/import?mode=replace", `{"key":"key1","events":[{"event":"create","value":"new"}]}`+"\n"+`{"key":"key3","events":[{"event":"create","value":"new"}]}`, contentTypeNDJSON, http.StatusOK, `{"dryRun":false,"created":1,"merged":0,"replaced":1,"skipped":0}`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key1/history", "", "", http.StatusOK, `[{"event":"create","value":"new"}]`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/import?mode=skip", `{"key":"key1","events":[{"event":"create","value":"skipped"}]}`+"\n"+`{"key":"key4","events":[{"event":"create","value":"new"}]}`, contentTypeNDJSON, http.StatusOK, `{"dryRun":false,"created":1,"merged":0,"replaced":0,"skipped":1}`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key1", "", "", http.StatusOK, "new", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key4", "", "", http.StatusOK, "new", contentTypeText)
+
+	// Nothing is applied if any line is invalid
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/import", `{"key":"key5","events":[{"event":"create","value":"new"}]}`+"\n\n"+`{"key":"key6","events":[{"event":"rename","value":"new"}]}`, contentTypeNDJSON, http.StatusBadRequest, errorInvalidImport+" (line 3)", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/import", `{"key":"key5","events":[]}`, contentTypeNDJSON, http.StatusBadRequest, errorInvalidImport+" (line 1)", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/import", "not json", contentTypeNDJSON, http.StatusBadRequest, errorInvalidImport+" (line 1)", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/import", `{"key":"key5","events":[{"event":"create","value":"new"}]}`+"\n"+`{"key":"key6","events":[{"event":"update","value":"new"}]}`, contentTypeNDJSON, http.StatusBadRequest, errorInvalidOrder+" (line 2, event 0: update before the key was created)", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/import", `{"key":"key5","events":[{"event":"create","value":"new"},{"event":"delete","value":""},{"event":"delete","value":""}]}`, contentTypeNDJSON, http.StatusBadRequest, errorInvalidOrder+" (line 1, event 2: delete after delete)", contentTypeText)
+	// Merging a create into a key which has a value would leave it created twice
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/import", `{"key":"key5","events":[{"event":"create","value":"new"}]}`+"\n"+`{"key":"key4","events":[{"event":"create","value":"other"}]}`, contentTypeNDJSON, http.StatusBadRequest, errorInvalidOrder+` (key "key4" once merged, event 1: create while the key has a value)`, contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key5", "", "", http.StatusNotFound, "", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/import", export, contentTypeJson, http.StatusUnsupportedMediaType, errorInvalidImport, contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/import?mode=overwrite", export, contentTypeNDJSON, http.StatusBadRequest, errorInvalidMode, contentTypeText)
+}
+
+func TestExportImportRequireAdmin(t *testing.T) {
+	repo := initialiseData(t, `{"key1":[{"event":"create","value":"value1"}]}`)
+	keyStore, err := auth.NewKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	assert.NoError(t, err)
+	token, _, err := keyStore.Create("rw", []auth.Grant{{Permission: auth.PermissionRead}, {Permission: auth.PermissionWrite}, {Permission: auth.PermissionHistory}})
+	assert.NoError(t, err)
+	mux := Create(repo, WithAPIKeys(keyStore))
+
+	authRequestAndCheckResponse(t, mux, token, http.MethodGet, "/admin/export", "", "", http.StatusForbidden, errorForbidden)
+	authRequestAndCheckResponse(t, mux, token, http.MethodPost, "/admin/import", `{"key":"key2","events":[{"event":"create","value":"value1"}]}`, contentTypeNDJSON, http.StatusForbidden, errorForbidden)
+	authRequestAndCheckResponse(t, mux, token, http.MethodGet, "/api/key2", "", "", http.StatusNotFound, "")
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"its-dave/simple-crud-rest-server/auth"
+	"its-dave/simple-crud-rest-server/repository"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// problem is an inconsistency found in the stored data. Event is the index of the event in the key's history,
+// if the problem is with a single event
+type problem struct {
+	Key      string `json:"key,omitempty"`
+	Event    *int   `json:"event,omitempty"`
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired"`
+}
+
+// verifyReport is the result of checking every key in the store
+type verifyReport struct {
+	Keys     int       `json:"keys"`
+	Events   int       `json:"events"`
+	Problems []problem `json:"problems"`
+}
+
+// handleVerify checks the stored data, reporting any problems. A POST also repairs them if each can be repaired without
+// losing information: empty histories are removed and the checksum is rewritten. Nothing is repaired while any problem
+// needs fixing by hand, as rewriting the data would record a new checksum over it
+func handleVerify(repo repository.Store, writeMu *sync.RWMutex, ws *watchers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorised(r, auth.PermissionAdmin, "") {
+			writeForbidden(w)
+			return
+		}
+		respBody, respCode := handleVerifyReq(repo, r, writeMu, ws, r.Method == http.MethodPost)
+		if respCode == http.StatusOK {
+			w.Header().Add(contentType, contentTypeJson)
+		} else {
+			w.Header().Add(contentType, contentTypeText)
+		}
+		w.WriteHeader(respCode)
+		fmt.Fprint(w, respBody)
+	}
+}
+
+// handleVerifyReq handles a verify request and returns the desired response body and code
+func handleVerifyReq(repo repository.Store, r *http.Request, writeMu *sync.RWMutex, ws *watchers, repair bool) (string, int) {
+	annotate(r, "", "verify")
+
+	// Hold the lock while checking so that a repair applies to the data which was checked
+	ctx, done, err := beginWrite(r.Context(), repo, writeMu)
+	if err != nil {
+		return unexpectedError(r, err)
+	}
+	defer done()
+	dataMap, err := repo.ReadData(ctx)
+	if err != nil {
+		return unexpectedError(r, err)
+	}
+	report := verifyData(dataMap)
+
+	checksumErr := repo.VerifyChecksum()
+	if checksumErr != nil && !errors.Is(checksumErr, repository.ErrChecksumMismatch) {
+		return unexpectedError(r, checksumErr)
+	}
+	if checksumErr != nil {
+		report.Problems = append(report.Problems, problem{Problem: "the data file does not match its checksum, so has been changed other than by the server"})
+	}
+
+	if repair && len(report.Problems) > 0 && repairable(report.Problems) {
+		var removed []string
+		for _, p := range report.Problems {
+			if p.Problem == problemEmptyHistory {
+				delete(dataMap, p.Key)
+				removed = append(removed, p.Key)
+			}
+		}
+		// Rewriting the data also records a new checksum
+		if err := repo.WriteData(ctx, dataMap); err != nil {
+			return unexpectedError(r, err)
+		}
+		for _, key := range removed {
+			ws.remove(key)
+		}
+		for i := range report.Problems {
+			report.Problems[i].Repaired = true
+		}
+	}
+
+	respBody, err := json.Marshal(report)
+	if err != nil {
+		return unexpectedError(r, err)
+	}
+	return string(respBody), http.StatusOK
+}
+
+const problemEmptyHistory = "the history is empty"
+
+// repairable reports whether every problem can be repaired without losing information
+func repairable(problems []problem) bool {
+	for _, p := range problems {
+		if p.Key != "" && p.Problem != problemEmptyHistory {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyData checks that each key's history is an array of well formed events of known types, in an order which the
+// server could have produced: starting with a create or a compaction's snapshot, with updates and deletes only while
+// the key has a value, and creates only while it does not
+func verifyData(dataMap map[string]interface{}) verifyReport {
+	report := verifyReport{Keys: len(dataMap), Problems: []problem{}}
+	keys := make([]string, 0, len(dataMap))
+	for key := range dataMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		array, err := sliceFromArray(dataMap[key])
+		if err != nil {
+			report.Problems = append(report.Problems, problem{Key: key, Problem: fmt.Sprintf("the history is %s rather than an array of events", jsonType(dataMap[key]))})
+			continue
+		}
+		if len(array) == 0 {
+			report.Problems = append(report.Problems, problem{Key: key, Problem: problemEmptyHistory})
+			continue
+		}
+		report.Events += len(array)
+
+		live := false
+		previous := ""
+		for i, element := range array {
+			index := i
+			invalid := func(format string, args ...interface{}) {
+				report.Problems = append(report.Problems, problem{Key: key, Event: &index, Problem: fmt.Sprintf(format, args...)})
+			}
+			event, ok := element.(map[string]interface{})
+			if !ok {
+				invalid("the event is %s rather than an object", jsonType(element))
+				continue
+			}
+			eventType, ok := event["event"].(string)
+			if !ok {
+				invalid("the event has no type")
+				continue
+			}
+			if _, ok := event["value"].(string); !ok {
+				invalid("the %s event has no string value", eventType)
+			}
+			if identity, ok := event["identity"]; ok {
+				if _, ok := identity.(string); !ok {
+					invalid("the identity of the %s event is %s rather than a string", eventType, jsonType(identity))
+				}
+			}
+
+			switch eventType {
+			case "create":
+				if live {
+					invalid("create while the key has a value")
+				}
+				live = true
+			case eventSnapshot:
+				if i > 0 {
+					invalid("snapshot after %s", previous)
+				}
+				value, _ := event["value"].(string)
+				live = value != ""
+			case "update", "delete":
+				if !live && previous == "" {
+					invalid("%s before the key was created", eventType)
+				} else if !live {
+					invalid("%s after %s", eventType, previous)
+				}
+				live = eventType == "update"
+			default:
+				invalid("unknown event type %q", eventType)
+			}
+			previous = eventType
+		}
+	}
+	return report
+}
+
+// jsonType describes the JSON type of a decoded value, e.g. "a string"
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case float64:
+		return "a number"
+	case string:
+		return "a string"
+	case []interface{}:
+		return "an array"
+	}
+	return "an object"
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	repo := initialiseData(t, `{"key1":[{"event":"create","value":"value1"},{"event":"delete","value":""},{"event":"create","value":"value2","identity":"apikey:ci"}]}`)
+	mux := Create(repo)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/admin/verify", "", "", http.StatusOK, `{"keys":1,"events":3,"problems":[]}`, contentTypeJson)
+
+	repo = initialiseData(t, `{
+		"empty":[],
+		"number":[1],
+		"untyped":[{"value":"value1"}],
+		"unknown":[{"event":"create","value":"value1"},{"event":"rename","value":"value2"}],
+		"updated":[{"event":"create","value":"value1"},{"event":"delete","value":""},{"event":"update","value":"value2"}],
+		"created":[{"event":"create","value":"value1"},{"event":"create","value":"value2","identity":7}],
+		"deleted":[{"event":"delete"}]
+	}`)
+	mux = Create(repo)
+	expReport := `{"keys":7,"events":10,"problems":[` +
+		`{"key":"created","event":1,"problem":"the identity of the create event is a number rather than a string","repaired":false},` +
+		`{"key":"created","event":1,"problem":"create while the key has a value","repaired":false},` +
+		`{"key":"deleted","event":0,"problem":"the delete event has no string value","repaired":false},` +
+		`{"key":"deleted","event":0,"problem":"delete before the key was created","repaired":false},` +
+		`{"key":"empty","problem":"the history is empty","repaired":false},` +
+		`{"key":"number","event":0,"problem":"the event is a number rather than an object","repaired":false},` +
+		`{"key":"unknown","event":1,"problem":"unknown event type \"rename\"","repaired":false},` +
+		`{"key":"untyped","event":0,"problem":"the event has no type","repaired":false},` +
+		`{"key":"updated","event":2,"problem":"update after delete","repaired":false}]}`
+	requestAndCheckResponse(t, mux, http.MethodGet, "/admin/verify", "", "", http.StatusOK, expReport, contentTypeJson)
+
+	// Nothing is repaired while problems need fixing by hand
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/verify", "", "", http.StatusOK, expReport, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/admin/verify", "", "", http.StatusOK, expReport, contentTypeJson)
+
+	// Reading a malformed history is an error rather than a panic
+	resp := authRequest(t, mux, "", http.MethodGet, "/api/empty", "", "")
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Contains(t, resp.Body.String(), errorUnexpected)
+
+	// Only the data file can hold a history which is not an array
+	t.Run("history not an array", func(t *testing.T) {
+		requireFileBackend(t)
+		repo := initialiseData(t, `{"object":{"event":"create","value":"value1"}}`)
+		mux := Create(repo)
+		requestAndCheckResponse(t, mux, http.MethodGet, "/admin/verify", "", "", http.StatusOK, `{"keys":1,"events":0,"problems":[`+
+			`{"key":"object","problem":"the history is an object rather than an array of events","repaired":false}]}`, contentTypeJson)
+		resp := authRequest(t, mux, "", http.MethodGet, "/api/object", "", "")
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Contains(t, resp.Body.String(), errorUnexpected)
+	})
+}
+
+func TestVerifyRepair(t *testing.T) {
+	repo := initialiseData(t, `{"key1":[{"event":"create","value":"value1"}],"empty":[]}`)
+	mux := Create(repo)
+
+	expProblem := `{"key":"empty","problem":"the history is empty","repaired":%t}`
+	requestAndCheckResponse(t, mux, http.MethodGet, "/admin/verify", "", "", http.StatusOK, `{"keys":2,"events":1,"problems":[`+fmt.Sprintf(expProblem, false)+`]}`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodPost, "/admin/verify", "", "", http.StatusOK, `{"keys":2,"events":1,"problems":[`+fmt.Sprintf(expProblem, true)+`]}`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/admin/verify", "", "", http.StatusOK, `{"keys":1,"events":1,"problems":[]}`, contentTypeJson)
+	requestAndCheckResponse(t, mux, http.MethodGet, "/api/key1", "", "", http.StatusOK, "value1", contentTypeText)
+	requestAndCheckResponse(t, mux, http.MethodDelete, "/admin/verify", "", "", http.StatusMethodNotAllowed, "", "")
+
+	t.Run("checksum", func(t *testing.T) {
+		requireFileBackend(t)
+		repo := initialiseData(t, `{"key1":[{"event":"create","value":"value1"}]}`)
+		mux := Create(repo)
+
+		// Edit the file as a person would, without updating the checksum
+		data, err := os.ReadFile(testDataFilePath)
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(testDataFilePath, bytes.Replace(data, []byte("value1"), []byte("value2"), 1), 0666))
+
+		expProblem := `{"problem":"the data file does not match its checksum, so has been changed other than by the server","repaired":%t}`
+		requestAndCheckResponse(t, mux, http.MethodGet, "/admin/verify", "", "", http.StatusOK, `{"keys":1,"events":1,"problems":[`+fmt.Sprintf(expProblem, false)+`]}`, contentTypeJson)
+		requestAndCheckResponse(t, mux, http.MethodPost, "/admin/verify", "", "", http.StatusOK, `{"keys":1,"events":1,"problems":[`+fmt.Sprintf(expProblem, true)+`]}`, contentTypeJson)
+		requestAndCheckResponse(t, mux, http.MethodGet, "/admin/verify", "", "", http.StatusOK, `{"keys":1,"events":1,"problems":[]}`, contentTypeJson)
+		requestAndCheckResponse(t, mux, http.MethodGet, "/api/key1", "", "", http.StatusOK, "value2", contentTypeText)
+	})
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"its-dave/simple-crud-rest-server/auth"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	contentTypeEventStream = "text/event-stream"
+
+	// watchBufferSize is the number of events held for a slow watcher before its stream is closed
+	watchBufferSize = 256
+	// watchKeepAlive is the interval between comments sent to keep idle streams open through proxies
+	watchKeepAlive = 30 * time.Second
+)
+
+// watchEvent is an event of a key, as sent to watchers
+type watchEvent struct {
+	Key string `json:"key"`
+	eventObj
+}
+
+// watcher receives the events of keys with a prefix
+type watcher struct {
+	prefix string
+	events chan watchEvent
+}
+
+// watchers broadcasts the events of successful mutations to each watcher of the key, and records each change to the
+// data in the change log for followers, if there is one
+type watchers struct {
+	mu       sync.Mutex
+	watching map[*watcher]struct{}
+	log      *changeLog
+}
+
+func newWatchers() *watchers {
+	return &watchers{watching: map[*watcher]struct{}{}}
+}
+
+// watch registers a watcher of keys with the specified prefix
+func (ws *watchers) watch(prefix string) *watcher {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	w := &watcher{prefix: prefix, events: make(chan watchEvent, watchBufferSize)}
+	ws.watching[w] = struct{}{}
+	return w
+}
+
+// unwatch removes the watcher, closing its channel if it is still registered
+func (ws *watchers) unwatch(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if _, ok := ws.watching[w]; ok {
+		delete(ws.watching, w)
+		close(w.events)
+	}
+}
+
+// publish sends the event appended to the key's history to each watcher of the key. It, replace, rewrite and remove
+// must be called in the order that changes to the key are written, while its writes are serialised
+func (ws *watchers) publish(key string, event eventObj) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.send(key, event)
+	ws.log.record(change{Key: key, Events: []eventObj{event}})
+}
+
+// replace sends each event of the key's new history to each watcher of the key, as it replaced the history
+func (ws *watchers) replace(key string, events []eventObj) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for _, event := range events {
+		ws.send(key, event)
+	}
+	ws.log.record(change{Key: key, Events: events, Replace: true})
+}
+
+// rewrite records that the key's history was rewritten without adding events, which are not sent to watchers
+func (ws *watchers) rewrite(key string, events []eventObj) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.log.record(change{Key: key, Events: events, Replace: true})
+}
+
+// remove records that the key was removed
+func (ws *watchers) remove(key string) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.log.record(change{Key: key, Removed: true})
+}
+
+// send sends the event to each watcher of the key
+func (ws *watchers) send(key string, event eventObj) {
+	for w := range ws.watching {
+		if !strings.HasPrefix(key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- watchEvent{Key: key, eventObj: event}:
+		default:
+			// Rather than block writes, drop a watcher which cannot keep up; it will see its stream end and can reconnect
+			delete(ws.watching, w)
+			close(w.events)
+		}
+	}
+}
+
+// handleWatch streams the events of keys with the prefix given by the query as server-sent events,
+// until the client disconnects or shutdown is closed
+func handleWatch(ws *watchers, shutdown <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		prefix := r.URL.Query().Get("prefix")
+		annotate(r, prefix, "watch")
+
+		wt := ws.watch(prefix)
+		defer ws.unwatch(wt)
+
+		// The stream outlives the server's write timeout
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Time{})
+		w.Header().Add(contentType, contentTypeEventStream)
+		w.Header().Add("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		keepAlive := time.NewTicker(watchKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case event, ok := <-wt.events:
+				if !ok {
+					return
+				}
+				if !authorised(r, auth.PermissionRead, event.Key) {
+					continue
+				}
+				data, _ := json.Marshal(event)
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Event, data); err != nil {
+					return
+				}
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			case <-shutdown:
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	repo := initialiseData(t, `{"key1":[{"event":"create","value":"value1"}]}`)
+	shutdown := make(chan struct{})
+	srv := httptest.NewServer(Create(repo, WithShutdown(shutdown)))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/watch?prefix=key")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, contentTypeEventStream, resp.Header.Get(contentType))
+
+	requestAndCheckResponse(t, srv.Config.Handler.(*http.ServeMux), http.MethodPut, "/api/key1", "value2", contentTypeText, http.StatusNoContent, "", contentTypeText)
+	requestAndCheckResponse(t, srv.Config.Handler.(*http.ServeMux), http.MethodPost, "/api", `{"other":"value1"}`, contentTypeJson, http.StatusCreated, "", contentTypeText)
+	requestAndCheckResponse(t, srv.Config.Handler.(*http.ServeMux), http.MethodDelete, "/api/key1", "", "", http.StatusNoContent, "", contentTypeText)
+
+	// Only events of keys with the prefix are sent, in order
+	scanner := bufio.NewScanner(resp.Body)
+	var lines []string
+	for len(lines) < 6 && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	assert.Equal(t, []string{
+		"event: update",
+		`data: {"key":"key1","event":"update","value":"value2"}`,
+		"",
+		"event: delete",
+		`data: {"key":"key1","event":"delete","value":""}`,
+		"",
+	}, lines)
+
+	// Streams end on shutdown
+	close(shutdown)
+	for scanner.Scan() {
+		assert.Fail(t, "unexpected line after shutdown", scanner.Text())
+	}
+}
+
+func TestWatchersDropSlowWatcher(t *testing.T) {
+	ws := newWatchers()
+	slow := ws.watch("")
+	for i := 0; i <= watchBufferSize; i++ {
+		ws.publish("key1", eventObj{Event: "update", Value: strings.Repeat("v", i)})
+	}
+	received := 0
+	for range slow.events {
+		received++
+	}
+	assert.Equal(t, watchBufferSize, received)
+	ws.unwatch(slow)
+}
@@ -0,0 +1,275 @@
+// Package snapshot saves point-in-time copies of the data with a checksum, prunes them by age and verifies them
+// for restoring
+package snapshot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"its-dave/simple-crud-rest-server/repository"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// format is the version of the snapshot file format
+	format = 1
+
+	filePrefix = "snapshot-"
+	fileSuffix = ".json"
+	timeLayout = "20060102T150405.000Z"
+)
+
+// ErrCorrupt is returned when a snapshot fails verification
+var ErrCorrupt = errors.New("snapshot is corrupt")
+
+// Metadata describes the data in a snapshot. The checksum is the SHA-256 of the data as written in the file
+type Metadata struct {
+	Format      int       `json:"format"`
+	DataVersion int       `json:"dataVersion"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Keys        int       `json:"keys"`
+	Events      int       `json:"events"`
+	Checksum    string    `json:"checksum"`
+}
+
+// Snapshot is a saved snapshot file
+type Snapshot struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	Metadata
+}
+
+// file is the contents of a snapshot file
+type file struct {
+	Metadata
+	Data json.RawMessage `json:"data"`
+}
+
+// Retention is how many snapshots to keep: the newest snapshot of each of the most recent Hourly hours, and of each
+// of the most recent Daily days, which have one. Nothing is pruned if both are 0
+type Retention struct {
+	Hourly int
+	Daily  int
+}
+
+// Store saves snapshots to a directory
+type Store struct {
+	dir       string
+	retention Retention
+	mu        sync.Mutex
+	now       func() time.Time
+}
+
+// NewStore returns a Store which saves snapshots to the specified directory, creating it when first needed,
+// and prunes them after each snapshot according to the retention
+func NewStore(dir string, retention Retention) *Store {
+	return &Store{
+		dir:       dir,
+		retention: retention,
+		now:       time.Now,
+	}
+}
+
+// Create saves a snapshot of the specified data and prunes older snapshots
+func (store *Store) Create(ctx context.Context, dataMap map[string]interface{}) (Snapshot, error) {
+	data, err := json.Marshal(dataMap)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	checksum := sha256.Sum256(data)
+	f := file{
+		Metadata: Metadata{
+			Format:      format,
+			DataVersion: repository.CurrentVersion(),
+			CreatedAt:   store.now().UTC(),
+			Keys:        len(dataMap),
+			Events:      countEvents(dataMap),
+			Checksum:    "sha256:" + hex.EncodeToString(checksum[:]),
+		},
+		Data: data,
+	}
+	contents, err := json.Marshal(f)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := os.MkdirAll(store.dir, 0755); err != nil {
+		return Snapshot{}, err
+	}
+	path := filepath.Join(store.dir, filePrefix+f.CreatedAt.Format(timeLayout)+fileSuffix)
+	if _, err := os.Stat(path); err == nil {
+		return Snapshot{}, fmt.Errorf("snapshot %s already exists", path)
+	}
+	if err := writeFile(path, contents); err != nil {
+		return Snapshot{}, err
+	}
+	if err := store.prune(); err != nil {
+		return Snapshot{}, fmt.Errorf("pruning snapshots: %w", err)
+	}
+	return Snapshot{Path: path, Size: int64(len(contents)), Metadata: f.Metadata}, nil
+}
+
+// Run saves a snapshot of the data returned by read at the specified interval until ctx is cancelled, logging any
+// failures
+func (store *Store) Run(ctx context.Context, interval time.Duration, read func(context.Context) (map[string]interface{}, error), logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		dataMap, err := read(ctx)
+		if err == nil {
+			var snapshot Snapshot
+			if snapshot, err = store.Create(ctx, dataMap); err == nil {
+				logger.Info("saved snapshot", "path", snapshot.Path, "keys", snapshot.Keys)
+				continue
+			}
+		}
+		logger.Error("saving snapshot", "error", err)
+	}
+}
+
+// prune deletes the snapshots which the retention does not keep
+func (store *Store) prune() error {
+	if store.retention.Hourly == 0 && store.retention.Daily == 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		return err
+	}
+	type saved struct {
+		name      string
+		createdAt time.Time
+	}
+	var snapshots []saved
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		// Files which were not named by Create are left alone
+		createdAt, err := time.Parse(timeLayout, strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), fileSuffix))
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, saved{name, createdAt})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].createdAt.After(snapshots[j].createdAt)
+	})
+
+	keep := make([]bool, len(snapshots))
+	for _, period := range []struct {
+		count  int
+		bucket func(time.Time) time.Time
+	}{
+		{store.retention.Hourly, func(t time.Time) time.Time { return t.Truncate(time.Hour) }},
+		{store.retention.Daily, func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC) }},
+	} {
+		// Snapshots are newest first, so the first in each bucket is its newest
+		var buckets []time.Time
+		for i, snapshot := range snapshots {
+			bucket := period.bucket(snapshot.createdAt)
+			if len(buckets) > 0 && buckets[len(buckets)-1].Equal(bucket) {
+				continue
+			}
+			if len(buckets) == period.count {
+				break
+			}
+			buckets = append(buckets, bucket)
+			keep[i] = true
+		}
+	}
+
+	var errs []error
+	for i, snapshot := range snapshots {
+		if !keep[i] {
+			errs = append(errs, os.Remove(filepath.Join(store.dir, snapshot.name)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Read verifies the snapshot at the specified path and returns its data, migrated to the current format, and metadata.
+// A snapshot fails verification, with ErrCorrupt, if its data does not match its checksum, key count and event count
+func Read(path string) (map[string]interface{}, Metadata, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	var f file
+	if err := json.Unmarshal(contents, &f); err != nil {
+		return nil, Metadata{}, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if f.Format != format {
+		return nil, f.Metadata, fmt.Errorf("unsupported snapshot format %d", f.Format)
+	}
+	checksum := sha256.Sum256(f.Data)
+	if "sha256:"+hex.EncodeToString(checksum[:]) != f.Checksum {
+		return nil, f.Metadata, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+	var dataMap map[string]interface{}
+	if err := json.Unmarshal(f.Data, &dataMap); err != nil {
+		return nil, f.Metadata, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if len(dataMap) != f.Keys || countEvents(dataMap) != f.Events {
+		return nil, f.Metadata, fmt.Errorf("%w: expected %d keys and %d events, found %d and %d", ErrCorrupt, f.Keys, f.Events, len(dataMap), countEvents(dataMap))
+	}
+	if f.DataVersion == 0 {
+		// Saved before the data format was versioned
+		f.DataVersion = 1
+	}
+	if dataMap, err = repository.Migrate(dataMap, f.DataVersion); err != nil {
+		return nil, f.Metadata, err
+	}
+	return dataMap, f.Metadata, nil
+}
+
+// countEvents returns the number of events in the histories of every key
+func countEvents(dataMap map[string]interface{}) int {
+	events := 0
+	for _, history := range dataMap {
+		if array, ok := history.([]interface{}); ok {
+			events += len(array)
+		}
+	}
+	return events
+}
+
+// writeFile writes the bytes to a temporary file which is synced and then renamed to the specified path,
+// so that a snapshot is either complete or absent
+func writeFile(path string, bytes []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(bytes); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
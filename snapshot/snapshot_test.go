@@ -0,0 +1,80 @@
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateRead(t *testing.T) {
+	store := NewStore(filepath.Join(t.TempDir(), "snapshots"), Retention{})
+	dataMap := map[string]interface{}{
+		"key1": []interface{}{map[string]interface{}{"event": "create", "value": "value1"}, map[string]interface{}{"event": "delete", "value": ""}},
+		"key2": []interface{}{map[string]interface{}{"event": "create", "value": "value2"}},
+	}
+	snapshot, err := store.Create(context.Background(), dataMap)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1, snapshot.Format)
+	assert.Equal(t, 2, snapshot.Keys)
+	assert.Equal(t, 3, snapshot.Events)
+	assert.True(t, strings.HasPrefix(snapshot.Checksum, "sha256:"))
+
+	read, metadata, err := Read(snapshot.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, dataMap, read)
+	assert.Equal(t, snapshot.Metadata, metadata)
+
+	// Changing the data is detected
+	contents, err := os.ReadFile(snapshot.Path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(snapshot.Path, []byte(strings.Replace(string(contents), "value2", "value3", 1)), 0644))
+	_, _, err = Read(snapshot.Path)
+	assert.ErrorIs(t, err, ErrCorrupt)
+
+	// As is a torn file
+	assert.NoError(t, os.WriteFile(snapshot.Path, contents[:len(contents)/2], 0644))
+	_, _, err = Read(snapshot.Path)
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestRetention(t *testing.T) {
+	dir := t.TempDir()
+	store := NewStore(dir, Retention{Hourly: 2, Daily: 2})
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	// Every 30 minutes for two and a half days
+	for i := 0; i < 120; i++ {
+		_, err := store.Create(context.Background(), map[string]interface{}{})
+		assert.NoError(t, err)
+		now = now.Add(30 * time.Minute)
+	}
+	// Files which were not saved by the store are left alone
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot-manual.json"), []byte("{}"), 0644))
+	_, err := store.Create(context.Background(), map[string]interface{}{})
+	assert.NoError(t, err)
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{
+		// The newest of 2 May
+		"snapshot-20240502T233000.000Z.json",
+		// The newest of the previous hour
+		"snapshot-20240503T113000.000Z.json",
+		// The newest of this hour and day
+		"snapshot-20240503T120000.000Z.json",
+		"snapshot-manual.json",
+	}, names)
+}
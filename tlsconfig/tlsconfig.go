@@ -0,0 +1,127 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadCheckInterval is the minimum time between checks of the certificate files for changes
+const reloadCheckInterval = time.Second
+
+// Config describes the files used to serve TLS and optionally verify client certificates
+type Config struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is a PEM bundle of CAs trusted to issue client certificates; client certificates are not requested if unset
+	ClientCAFile string
+	// RequireClientCert rejects connections without a verified client certificate, rather than leaving it to other authentication
+	RequireClientCert bool
+}
+
+// New returns a server TLS configuration which reloads the certificate and key whenever their files change
+func New(config Config) (*tls.Config, error) {
+	reloader, err := NewCertReloader(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if config.ClientCAFile != "" {
+		pem, err := os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in client CA file")
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if config.RequireClientCert {
+		return nil, errors.New("a client CA file is required to verify client certificates")
+	}
+	return tlsConfig, nil
+}
+
+// CertReloader serves a certificate and key pair from disk, reloading it when either file is modified
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastChecked time.Time
+}
+
+// NewCertReloader loads the specified certificate and key files
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// GetCertificate returns the current certificate, for use as tls.Config.GetCertificate
+func (reloader *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+
+	if time.Since(reloader.lastChecked) >= reloadCheckInterval {
+		reloader.lastChecked = time.Now()
+		if reloader.modified() {
+			// Keep serving the previous certificate if the new files are not yet a valid pair,
+			// e.g. if only one of them has been replaced so far
+			reloader.reload()
+		}
+	}
+	return reloader.cert, nil
+}
+
+// modified reports whether either file has changed since it was loaded; the caller must hold the lock
+func (reloader *CertReloader) modified() bool {
+	certInfo, err := os.Stat(reloader.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(reloader.keyFile)
+	if err != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(reloader.certModTime) || !keyInfo.ModTime().Equal(reloader.keyModTime)
+}
+
+// reload reads the certificate and key files; the caller must hold the lock unless the reloader is not yet shared
+func (reloader *CertReloader) reload() error {
+	certInfo, err := os.Stat(reloader.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(reloader.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+	reloader.cert = &cert
+	reloader.certModTime = certInfo.ModTime()
+	reloader.keyModTime = keyInfo.ModTime()
+	return nil
+}
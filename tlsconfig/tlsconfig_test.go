@@ -0,0 +1,171 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"its-dave/simple-crud-rest-server/auth"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientCertIdentity(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCert(t, nil, nil, "test-ca", true)
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.Raw)
+	serverCert, serverKey := newCert(t, ca, caKey, "localhost", false)
+	writeCertAndKey(t, dir, "server", serverCert, serverKey)
+
+	tlsConfig, err := New(Config{
+		CertFile:          filepath.Join(dir, "server.pem"),
+		KeyFile:           filepath.Join(dir, "server-key.pem"),
+		ClientCAFile:      filepath.Join(dir, "ca.pem"),
+		RequireClientCert: true,
+	})
+	assert.NoError(t, err)
+
+	authenticator := auth.ClientCertAuthenticator{
+		Identities: map[string][]auth.Grant{
+			"svc-a": {{Permission: auth.PermissionRead}},
+		},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	srv := &http.Server{Handler: auth.Middleware(authenticator, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := auth.FromContext(r.Context())
+		if id.Allowed(auth.PermissionRead, "key1") {
+			io.WriteString(w, id.Name)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))}
+	go srv.Serve(tls.NewListener(listener, tlsConfig))
+	defer srv.Close()
+	url := "https://" + listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	clientWithCert := func(cert *x509.Certificate, key *ecdsa.PrivateKey) *http.Client {
+		clientTLS := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			clientTLS.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	}
+
+	// Mapped client certificate
+	cert, key := newCert(t, ca, caKey, "svc-a", false)
+	resp, err := clientWithCert(cert, key).Get(url)
+	if !assert.NoError(t, err) {
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "cert:svc-a", string(body))
+
+	// Unmapped client certificate is not an identity
+	cert, key = newCert(t, ca, caKey, "svc-b", false)
+	resp, err = clientWithCert(cert, key).Get(url)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Certificate from an untrusted CA
+	otherCA, otherCAKey := newCert(t, nil, nil, "other-ca", true)
+	cert, key = newCert(t, otherCA, otherCAKey, "svc-a", false)
+	_, err = clientWithCert(cert, key).Get(url)
+	assert.Error(t, err)
+
+	// No client certificate
+	_, err = clientWithCert(nil, nil).Get(url)
+	assert.Error(t, err)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCert(t, nil, nil, "test-ca", true)
+	first, firstKey := newCert(t, ca, caKey, "first", false)
+	writeCertAndKey(t, dir, "server", first, firstKey)
+
+	reloader, err := NewCertReloader(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	assert.NoError(t, err)
+	served, err := reloader.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, first.Raw, served.Certificate[0])
+
+	// Replace the files on disk
+	second, secondKey := newCert(t, ca, caKey, "second", false)
+	writeCertAndKey(t, dir, "server", second, secondKey)
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "server.pem"), future, future))
+	reloader.lastChecked = time.Time{}
+
+	served, err = reloader.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, second.Raw, served.Certificate[0])
+
+	// A broken replacement keeps the previous certificate
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "server-key.pem"), []byte("not a key"), 0600))
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "server-key.pem"), future.Add(time.Minute), future.Add(time.Minute)))
+	reloader.lastChecked = time.Time{}
+
+	served, err = reloader.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, second.Raw, served.Certificate[0])
+}
+
+// newCert creates a certificate for the specified name, self-signed if parent is nil
+func newCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, name string, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if isCA {
+		template.IsCA = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert, key
+}
+
+// writeCertAndKey writes the certificate and key as PEM files named after the specified base name
+func writeCertAndKey(t *testing.T, dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", cert.Raw)
+	writePEM(t, filepath.Join(dir, name+"-key.pem"), "EC PRIVATE KEY", keyDer)
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+}
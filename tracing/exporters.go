@@ -0,0 +1,189 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const instrumentationScope = "its-dave/simple-crud-rest-server"
+
+// OTLPExporter sends spans to an OpenTelemetry collector using OTLP over HTTP with JSON encoding
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+}
+
+// NewOTLPExporter returns an exporter posting to the /v1/traces path of the specified collector endpoint,
+// e.g. http://localhost:4318
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Export sends the specified spans to the collector
+func (exporter *OTLPExporter) Export(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(otlpRequest(exporter.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, exporter.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := exporter.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("exporting spans: unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Shutdown does nothing as the exporter holds no resources
+func (exporter *OTLPExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// WriterExporter writes each span as a line of OTLP JSON, for local use with stdout or a file
+type WriterExporter struct {
+	serviceName string
+	mu          sync.Mutex
+	w           io.Writer
+}
+
+// NewWriterExporter returns an exporter writing to w, which is closed on shutdown if it is an io.Closer
+func NewWriterExporter(w io.Writer, serviceName string) *WriterExporter {
+	return &WriterExporter{
+		serviceName: serviceName,
+		w:           w,
+	}
+}
+
+// Export writes the specified spans
+func (exporter *WriterExporter) Export(ctx context.Context, spans []*Span) error {
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	encoder := json.NewEncoder(exporter.w)
+	for _, span := range spans {
+		if err := encoder.Encode(otlpSpanFromSpan(span)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown closes the underlying writer if it can be closed
+func (exporter *WriterExporter) Shutdown(ctx context.Context) error {
+	if closer, ok := exporter.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// otlpRequest builds an OTLP ExportTraceServiceRequest for the specified spans
+func otlpRequest(serviceName string, spans []*Span) map[string]interface{} {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		otlpSpans = append(otlpSpans, otlpSpanFromSpan(span))
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{otlpAttributeFromValue("service.name", serviceName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": instrumentationScope},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpSpanFromSpan(span *Span) otlpSpan {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	s := otlpSpan{
+		TraceID:           span.Context.TraceID.String(),
+		SpanID:            span.Context.SpanID.String(),
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		Status:            otlpStatus{Code: span.Status, Message: span.StatusMsg},
+	}
+	if span.ParentSpanID.IsValid() {
+		s.ParentSpanID = span.ParentSpanID.String()
+	}
+	keys := make([]string, 0, len(span.Attributes))
+	for key := range span.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s.Attributes = append(s.Attributes, otlpAttributeFromValue(key, span.Attributes[key]))
+	}
+	return s
+}
+
+// otlpAttributeFromValue encodes an attribute as an OTLP AnyValue
+func otlpAttributeFromValue(key string, value interface{}) otlpAttribute {
+	var anyValue map[string]interface{}
+	switch v := value.(type) {
+	case string:
+		anyValue = map[string]interface{}{"stringValue": v}
+	case bool:
+		anyValue = map[string]interface{}{"boolValue": v}
+	case int:
+		anyValue = map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		anyValue = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		anyValue = map[string]interface{}{"doubleValue": v}
+	default:
+		anyValue = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+	return otlpAttribute{Key: key, Value: anyValue}
+}
@@ -0,0 +1,292 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBatchSize is the number of finished spans which triggers an immediate export
+	maxBatchSize = 512
+	// maxQueueSize is the number of finished spans held before new spans are dropped
+	maxQueueSize = 4096
+
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+
+	StatusUnset = 0
+	StatusOK    = 1
+	StatusError = 2
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the ID is not all zeros
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+func (id SpanID) IsValid() bool  { return id != SpanID{} }
+
+// SpanContext identifies a span within a trace, as propagated by the W3C traceparent header
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// Span is a timed operation within a trace
+type Span struct {
+	tracer *Tracer
+
+	Context      SpanContext
+	ParentSpanID SpanID
+	Name         string
+	Kind         int
+	Start        time.Time
+	End          time.Time
+	Status       int
+	StatusMsg    string
+
+	mu         sync.Mutex
+	Attributes map[string]interface{}
+	ended      bool
+}
+
+// SetAttribute sets an attribute on the span; a nil span ignores it, so callers need not check whether tracing is enabled
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	span.Attributes[key] = value
+}
+
+// RecordError marks the span as failed with the specified error, if not nil
+func (span *Span) RecordError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	span.Status = StatusError
+	span.StatusMsg = err.Error()
+}
+
+// SetStatus sets the status of the span
+func (span *Span) SetStatus(status int, msg string) {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	span.Status = status
+	span.StatusMsg = msg
+}
+
+// Finish ends the span and queues it for export
+func (span *Span) Finish() {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	if span.ended {
+		span.mu.Unlock()
+		return
+	}
+	span.ended = true
+	span.End = time.Now()
+	span.mu.Unlock()
+	if span.Context.Sampled {
+		span.tracer.enqueue(span)
+	}
+}
+
+// Exporter sends finished spans to a tracing backend
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+	Shutdown(ctx context.Context) error
+}
+
+// Tracer creates spans and exports them in batches
+type Tracer struct {
+	serviceName string
+	exporter    Exporter
+	interval    time.Duration
+
+	mu      sync.Mutex
+	queue   []*Span
+	flush   chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewTracer returns a tracer exporting spans via the specified exporter at least every interval
+func NewTracer(serviceName string, exporter Exporter, interval time.Duration) *Tracer {
+	tracer := &Tracer{
+		serviceName: serviceName,
+		exporter:    exporter,
+		interval:    interval,
+		flush:       make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go tracer.run()
+	return tracer
+}
+
+// ServiceName is the name of the service the tracer's spans belong to
+func (tracer *Tracer) ServiceName() string {
+	return tracer.serviceName
+}
+
+// StartRoot starts a span with the specified remote parent, or a new trace if the parent is not valid
+func (tracer *Tracer) StartRoot(ctx context.Context, name string, kind int, parent SpanContext) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		tracer:     tracer,
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: map[string]interface{}{},
+	}
+	if parent.TraceID.IsValid() && parent.SpanID.IsValid() {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+		span.ParentSpanID = parent.SpanID
+	} else {
+		rand.Read(span.Context.TraceID[:])
+		span.Context.Sampled = true
+	}
+	rand.Read(span.Context.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Start starts a child of the span carried by ctx; if ctx carries no span, tracing is disabled and a nil span is returned
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		tracer:       parent.tracer,
+		Name:         name,
+		Kind:         SpanKindInternal,
+		Start:        time.Now(),
+		ParentSpanID: parent.Context.SpanID,
+		Attributes:   map[string]interface{}{},
+	}
+	span.Context.TraceID = parent.Context.TraceID
+	span.Context.Sampled = parent.Context.Sampled
+	rand.Read(span.Context.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the span carried by ctx, if any
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Shutdown exports any queued spans and shuts the exporter down
+func (tracer *Tracer) Shutdown(ctx context.Context) error {
+	close(tracer.stop)
+	select {
+	case <-tracer.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	tracer.export(ctx)
+	return tracer.exporter.Shutdown(ctx)
+}
+
+func (tracer *Tracer) enqueue(span *Span) {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if len(tracer.queue) >= maxQueueSize {
+		// Drop spans rather than block requests when the exporter cannot keep up
+		return
+	}
+	tracer.queue = append(tracer.queue, span)
+	if len(tracer.queue) >= maxBatchSize {
+		select {
+		case tracer.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run exports queued spans periodically until the tracer is shut down
+func (tracer *Tracer) run() {
+	defer close(tracer.stopped)
+	ticker := time.NewTicker(tracer.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-tracer.flush:
+		case <-tracer.stop:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), tracer.interval)
+		tracer.export(ctx)
+		cancel()
+	}
+}
+
+func (tracer *Tracer) export(ctx context.Context) {
+	tracer.mu.Lock()
+	spans := tracer.queue
+	tracer.queue = nil
+	tracer.mu.Unlock()
+	if len(spans) > 0 {
+		tracer.exporter.Export(ctx, spans)
+	}
+}
+
+// Extract parses the W3C traceparent header of the specified request, returning an invalid context if absent or malformed
+func Extract(header http.Header) SpanContext {
+	parts := strings.Split(strings.TrimSpace(header.Get("traceparent")), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}
+	}
+	var sc SpanContext
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc
+}
+
+// Inject sets the W3C traceparent header to identify the specified span
+func Inject(header http.Header, span *Span) {
+	if span == nil {
+		return
+	}
+	flags := "00"
+	if span.Context.Sampled {
+		flags = "01"
+	}
+	header.Set("traceparent", "00-"+span.Context.TraceID.String()+"-"+span.Context.SpanID.String()+"-"+flags)
+}
@@ -0,0 +1,108 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPropagation(t *testing.T) {
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	sc := Extract(header)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		header.Set("traceparent", invalid)
+		assert.False(t, Extract(header).TraceID.IsValid(), invalid)
+	}
+
+	// Future versions may append fields
+	header.Set("traceparent", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	assert.True(t, Extract(header).TraceID.IsValid())
+	assert.False(t, Extract(header).Sampled)
+
+	tracer := NewTracer("test", NewWriterExporter(io.Discard, "test"), time.Hour)
+	defer tracer.Shutdown(context.Background())
+	_, span := tracer.StartRoot(context.Background(), "root", SpanKindServer, sc)
+	out := http.Header{}
+	Inject(out, span)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+span.Context.SpanID.String()+"-01", out.Get("traceparent"))
+}
+
+func TestSpans(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracer("test", NewWriterExporter(&buf, "test"), time.Hour)
+
+	// Spans are not recorded without a root span
+	ctx, span := Start(context.Background(), "orphan")
+	assert.Nil(t, span)
+	span.SetAttribute("ignored", true)
+	span.Finish()
+
+	ctx, root := tracer.StartRoot(ctx, "root", SpanKindServer, SpanContext{})
+	_, child := Start(ctx, "child")
+	child.SetAttribute("crud.key", "key1")
+	child.SetAttribute("crud.payload_size", 6)
+	child.Finish()
+	root.Finish()
+	assert.NoError(t, tracer.Shutdown(context.Background()))
+
+	decoder := json.NewDecoder(&buf)
+	var exported []otlpSpan
+	for decoder.More() {
+		var s otlpSpan
+		assert.NoError(t, decoder.Decode(&s))
+		exported = append(exported, s)
+	}
+	if assert.Len(t, exported, 2) {
+		assert.Equal(t, "child", exported[0].Name)
+		assert.Equal(t, root.Context.SpanID.String(), exported[0].ParentSpanID)
+		assert.Equal(t, root.Context.TraceID.String(), exported[0].TraceID)
+		assert.Equal(t, []otlpAttribute{
+			{Key: "crud.key", Value: map[string]interface{}{"stringValue": "key1"}},
+			{Key: "crud.payload_size", Value: map[string]interface{}{"intValue": "6"}},
+		}, exported[0].Attributes)
+		assert.Equal(t, "root", exported[1].Name)
+		assert.Empty(t, exported[1].ParentSpanID)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var body map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		received <- body
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer("crud", NewOTLPExporter(collector.URL, "crud"), time.Hour)
+	_, span := tracer.StartRoot(context.Background(), "root", SpanKindServer, SpanContext{})
+	span.Finish()
+	assert.NoError(t, tracer.Shutdown(context.Background()))
+
+	body := <-received
+	resourceSpans := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	resource := resourceSpans["resource"].(map[string]interface{})
+	assert.Equal(t, "service.name", resource["attributes"].([]interface{})[0].(map[string]interface{})["key"])
+	spans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	assert.Equal(t, "root", spans[0].(map[string]interface{})["name"])
+}